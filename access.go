@@ -0,0 +1,79 @@
+package sharaq
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+)
+
+// accessControl restricts who may access a group of endpoints, on top
+// of the token based authorization
+type accessControl struct {
+	nets        []*net.IPNet
+	requireCert bool
+}
+
+func newAccessControl(c *AccessConfig) (*accessControl, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	ac := &accessControl{
+		requireCert: c.RequireClientCert,
+	}
+	for _, v := range c.AllowFrom {
+		// Allow bare IP addresses as a shorthand for single host networks
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, `invalid network %s`, v)
+		}
+		ac.nets = append(ac.nets, n)
+	}
+	return ac, nil
+}
+
+// allowed returns true if the request satisfies the restrictions. A nil
+// accessControl allows everything. Note that the address checked is
+// that of the immediate peer: headers such as X-Forwarded-For are not
+// trusted
+func (ac *accessControl) allowed(r *http.Request) bool {
+	if ac == nil {
+		return true
+	}
+
+	if ac.requireCert {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return false
+		}
+	}
+
+	if len(ac.nets) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range ac.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package sharaq
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// handleAdmin dispatches requests to the administrative API. All of
+// these endpoints require a valid token
+func (s *Server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAccess.allowed(r) || !s.authorized(r) {
+		httpError(w, r, `not authorized`, http.StatusForbidden)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/admin/audit":
+		s.handleAdminAudit(w, r)
+	case "/admin/config":
+		s.handleAdminConfig(w, r)
+	case "/admin/migration":
+		s.handleAdminMigration(w, r)
+	case "/admin/readonly":
+		s.handleAdminReadOnly(w, r)
+	case "/admin/jobs":
+		s.handleAdminJobs(w, r)
+	case "/admin/view":
+		s.handleAdminView(w, r)
+	case "/admin/lookup":
+		s.handleAdminLookup(w, r)
+	case "/admin/duplicates":
+		s.handleAdminDuplicates(w, r)
+	default:
+		httpError(w, r, "Not Found", http.StatusNotFound)
+	}
+}
+
+type adminConfigResponse struct {
+	Config          map[string]interface{} `json:"config"`
+	DefaultsApplied []string               `json:"defaults_applied"`
+	Environment     string                 `json:"environment,omitempty"`
+	Filename        string                 `json:"filename,omitempty"`
+	LoadedAt        time.Time              `json:"loaded_at"`
+}
+
+// handleAdminConfig replies with the effective configuration, with
+// secrets redacted
+func (s *Server) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := s.config
+	m, err := c.redacted()
+	if err != nil {
+		httpError(w, r, "failed to encode config", http.StatusInternalServerError)
+		return
+	}
+
+	defaults := c.defaults
+	if defaults == nil {
+		defaults = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adminConfigResponse{
+		Config:          m,
+		DefaultsApplied: defaults,
+		Environment:     c.environment,
+		Filename:        c.filename,
+		LoadedAt:        c.loadedAt,
+	})
+}
@@ -0,0 +1,230 @@
+package sharaq
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/imageinfo"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/internal/util"
+)
+
+var viewTemplate = template.Must(template.New("view").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>sharaq: {{.URL}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; vertical-align: top; text-align: left; }
+img { max-width: 400px; max-height: 400px; }
+</style>
+</head>
+<body>
+<h1>{{.URL}}</h1>
+<table>
+<tr><th>Preset</th><th>Image</th><th>Details</th><th></th></tr>
+{{range .Variants}}
+<tr>
+<td>{{.Preset}}<br><code>{{.Rule}}</code></td>
+<td>{{if .Stored}}<img src="{{.ImageURL}}">{{else}}(not stored){{end}}</td>
+<td>
+{{if .Stored}}
+{{.Width}}x{{.Height}} {{.Format}}<br>
+{{.Size}} bytes<br>
+generated: {{if .CreatedAt}}{{.CreatedAt}}{{else}}unknown{{end}}<br>
+{{end}}
+url cache: {{if .Cached}}hit{{else}}miss{{end}}
+{{if .Error}}<br>error: {{.Error}}{{end}}
+</td>
+<td>
+<form method="POST" action="/admin/view">
+<input type="hidden" name="url" value="{{$.URL}}">
+<input type="hidden" name="preset" value="{{.Preset}}">
+<input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+<input type="submit" value="Regenerate">
+</form>
+</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+type viewVariant struct {
+	Preset    string     `json:"preset"`
+	Rule      string     `json:"rule"`
+	ImageURL  string     `json:"image_url"`
+	Stored    bool       `json:"stored"`
+	Width     int        `json:"width,omitempty"`
+	Height    int        `json:"height,omitempty"`
+	Format    string     `json:"format,omitempty"`
+	Size      int64      `json:"size,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"` // nil if unknown
+	Cached    bool       `json:"cached"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type adminViewResponse struct {
+	URL      string        `json:"url"`
+	Variants []viewVariant `json:"variants"`
+}
+
+// wantsHTML returns true if the view should be rendered as HTML rather
+// than JSON. The format parameter ("html" or "json") takes precedence
+// over the Accept header, which must explicitly list text/html
+func wantsHTML(r *http.Request) bool {
+	switch r.FormValue("format") {
+	case "html":
+		return true
+	case "json":
+		return false
+	}
+	return accepts(r, "text/html")
+}
+
+// csrfToken returns the token that must accompany POST requests from
+// the view page for the given url
+func (s *Server) csrfToken(u string) string {
+	h := hmac.New(sha256.New, s.csrfKey)
+	h.Write([]byte(u))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// handleAdminView describes each variant of the given url, either as
+// JSON for tools or as an HTML page for humans. The page allows
+// regenerating variants individually
+func (s *Server) handleAdminView(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleAdminViewPage(w, r)
+	case http.MethodPost:
+		s.handleAdminViewRegenerate(w, r)
+	default:
+		httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleAdminViewPage(w http.ResponseWriter, r *http.Request) {
+	ctx := util.RequestCtx(r)
+
+	u, err := s.getTargetURL(r)
+	if err != nil {
+		httpError(w, r, "Bad url", http.StatusBadRequest)
+		return
+	}
+
+	storage, _ := s.backend.(Storage)
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	presets := make([]string, 0, len(s.config.Presets))
+	for preset := range s.presetsFor(u) {
+		presets = append(presets, preset)
+	}
+	sort.Strings(presets)
+
+	variants := make([]viewVariant, 0, len(presets))
+	for _, preset := range presets {
+		v := viewVariant{
+			Preset:   preset,
+			Rule:     s.config.Presets[preset],
+			ImageURL: "/?" + url.Values{"url": {u.String()}, "preset": {preset}}.Encode(),
+			Cached:   s.cache.Lookup(ctx, urlcache.MakeCacheKey(s.config.Backend.Type, preset, u.String())) != "",
+		}
+
+		if storage != nil {
+			buf.Reset()
+			m, err := storage.Fetch(ctx, u, preset, buf)
+			switch {
+			case err == nil:
+				v.Stored = true
+				if !m.CreatedAt.IsZero() {
+					createdAt := m.CreatedAt
+					v.CreatedAt = &createdAt
+				}
+				if info, err := imageinfo.Inspect(buf.Bytes()); err == nil {
+					v.Width, v.Height, v.Format, v.Size = info.Width, info.Height, info.Format, info.Size
+				} else {
+					v.Size = int64(buf.Len())
+					v.Error = err.Error()
+				}
+			case !errors.IsTransformationRequired(err):
+				v.Error = err.Error()
+			}
+		}
+		variants = append(variants, v)
+	}
+
+	if !wantsHTML(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(adminViewResponse{
+			URL:      u.String(),
+			Variants: variants,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := viewTemplate.Execute(w, map[string]interface{}{
+		"URL":       u.String(),
+		"CSRFToken": s.csrfToken(u.String()),
+		"Variants":  variants,
+	}); err != nil {
+		log.Debugf(ctx, "failed to render view: %s", err)
+	}
+}
+
+func (s *Server) handleAdminViewRegenerate(w http.ResponseWriter, r *http.Request) {
+	ctx := util.RequestCtx(r)
+
+	if s.readOnly.on() {
+		httpError(w, r, "Server is in read-only mode", http.StatusServiceUnavailable)
+		return
+	}
+
+	u, err := url.Parse(r.FormValue("url"))
+	if err == nil {
+		u = s.NormalizeURL(u)
+	}
+	if err != nil || u.String() == "" {
+		httpError(w, r, "Bad url", http.StatusBadRequest)
+		return
+	}
+
+	if !hmac.Equal([]byte(r.FormValue("csrf_token")), []byte(s.csrfToken(u.String()))) {
+		httpError(w, r, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	preset := r.FormValue("preset")
+	rule, ok := s.config.Presets[preset]
+	if !ok || !s.allowedPreset(preset, u) {
+		httpError(w, r, "Bad preset", http.StatusBadRequest)
+		return
+	}
+
+	log.Debugf(ctx, "Regenerating %s (%s) from the view page", u, preset)
+	presets := map[string]string{preset: s.withMaxBytes(preset, rule)}
+	j := s.jobs.start(u, presets)
+	defer s.jobs.finish(j)
+	if err := s.backend.StoreTransformedContent(ctx, u, presets); err != nil {
+		log.Debugf(ctx, "failed to regenerate %s (%s): %s", u, preset, err)
+		httpError(w, r, "Failed to regenerate", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/view?"+url.Values{"url": {u.String()}}.Encode(), http.StatusSeeOther)
+}
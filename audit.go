@@ -0,0 +1,174 @@
+package sharaq
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/requestid"
+	"github.com/lestrrat-go/sharaq/internal/util"
+	"golang.org/x/net/context"
+)
+
+// auditEntry records a destructive operation, such as deleting the
+// variants of a source image for a takedown request
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	URL       string    `json:"url"`
+	Presets   []string  `json:"presets"`
+	Who       string    `json:"who"`
+	Remote    string    `json:"remote"`
+	RequestID string    `json:"request_id,omitempty"`
+	Result    string    `json:"result"` // "ok" or "failed"
+	Error     string    `json:"error,omitempty"`
+}
+
+// auditActor identifies who made the request. Tokens are secrets, so
+// only a fingerprint of the token is recorded
+func auditActor(r *http.Request) string {
+	if r.Header.Get("X-Appengine-Taskname") != "" {
+		return "taskqueue"
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return "cert:" + r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if tok := r.Header.Get("Sharaq-Token"); tok != "" {
+		sum := sha256.Sum256([]byte(tok))
+		return "token:" + hex.EncodeToString(sum[:4])
+	}
+	return "anonymous"
+}
+
+// audit writes an entry to the audit log, or to the debug log if no
+// audit log is configured
+func (s *Server) audit(ctx context.Context, r *http.Request, e *auditEntry) {
+	e.Time = time.Now().UTC()
+	e.Who = auditActor(r)
+	e.Remote = r.RemoteAddr
+	e.RequestID = requestid.Get(ctx)
+	if e.Error == "" {
+		e.Result = "ok"
+	} else {
+		e.Result = "failed"
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Debugf(ctx, "failed to encode audit entry: %s", err)
+		return
+	}
+
+	if s.auditLog == nil {
+		log.Debugf(ctx, "audit: %s", b)
+		return
+	}
+
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	if _, err := s.auditLog.Write(append(b, '\n')); err != nil {
+		log.Debugf(ctx, "failed to write audit entry: %s (%s)", err, b)
+	}
+}
+
+// maximum number of entries returned by /admin/audit
+const maxAuditEntries = 1000
+
+// handleAdminAudit replies with entries from the audit log. Entries can
+// be filtered by url and since (RFC3339), and the most recent limit
+// entries are returned
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ac := s.config.AuditLog
+	if ac == nil || ac.File == "" {
+		httpError(w, r, "audit log is not configured", http.StatusNotFound)
+		return
+	}
+
+	var since time.Time
+	if v := r.FormValue("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			httpError(w, r, "invalid since", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+
+	limit := 100
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxAuditEntries {
+			httpError(w, r, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	// entries record normalized URLs
+	target := r.FormValue("url")
+	if u, err := url.Parse(target); err == nil && target != "" {
+		target = s.NormalizeURL(u).String()
+	}
+
+	entries, err := readAuditLog(ac.File, target, since, limit)
+	if err != nil {
+		log.Debugf(util.RequestCtx(r), "Failed to read audit log: %s", err)
+		httpError(w, r, "failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// readAuditLog returns the last limit entries in the audit log file
+// that match the given url (if non-empty) and were recorded at or after
+// since
+func readAuditLog(fn string, u string, since time.Time, limit int) ([]auditEntry, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []auditEntry{}, nil
+		}
+		return nil, errors.Wrapf(err, `failed to open audit log %s`, fn)
+	}
+	defer f.Close()
+
+	entries := []auditEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// don't let a torn write hide the rest of the log
+			continue
+		}
+		if u != "" && e.URL != u {
+			continue
+		}
+		if e.Time.Before(since) {
+			continue
+		}
+		entries = append(entries, e)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, `failed to read audit log %s`, fn)
+	}
+	return entries, nil
+}
@@ -1,31 +1,49 @@
 package aws
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
-	"golang.org/x/sync/errgroup"
 
 	"github.com/goamz/goamz/aws"
 	"github.com/goamz/goamz/s3"
+	"github.com/lestrrat-go/sharaq/internal/accesslog"
 	"github.com/lestrrat-go/sharaq/internal/bbpool"
 	"github.com/lestrrat-go/sharaq/internal/errors"
 	"github.com/lestrrat-go/sharaq/internal/httputil"
 	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/throttle"
 	"github.com/lestrrat-go/sharaq/internal/transformer"
 	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/internal/util"
+	"github.com/lestrrat-go/sharaq/metadata"
 )
 
 type S3Backend struct {
-	bucketName  string
-	bucket      *s3.Bucket
+	buckets     []*bucket // the first one is the default bucket
 	cache       *urlcache.URLCache
+	headClient  *http.Client
+	paths       *util.PathScheme // nil for the default layout, see variantPath
 	presets     map[string]string
+	presetTTLs  map[string]time.Duration
+	redirect    httputil.Redirect // how clients are redirected to variants
+	routing     string
+	softTTL     time.Duration
 	transformer *transformer.Transformer
+	trustCache  bool
 }
 
 func NewBackend(c *Config, cache *urlcache.URLCache, trans *transformer.Transformer, presets map[string]string) (*S3Backend, error) {
@@ -34,104 +52,487 @@ func NewBackend(c *Config, cache *urlcache.URLCache, trans *transformer.Transfor
 		SecretKey: c.SecretKey,
 	}
 
-	s3o := s3.New(auth, aws.APNortheast)
+	switch c.Routing {
+	case "", RoutingHost, RoutingHash:
+	default:
+		return nil, errors.Errorf(`aws backend: unknown routing '%s'`, c.Routing)
+	}
+
+	if !httputil.ValidRedirectStatus(c.RedirectStatus) {
+		return nil, errors.Errorf(`aws backend: invalid redirect status %d`, c.RedirectStatus)
+	}
+
+	for preset, ttl := range c.PresetTTLs {
+		if ttl <= 0 {
+			return nil, errors.Errorf(`aws backend: TTL of preset '%s' must be positive`, preset)
+		}
+	}
+
+	var paths *util.PathScheme
+	if pc := c.Paths; pc != nil {
+		paths = &util.PathScheme{
+			Hash:        pc.Hash,
+			IncludeHost: pc.IncludeHost,
+			Filename:    pc.Filename,
+		}
+		if err := paths.Validate(); err != nil {
+			return nil, errors.Wrap(err, `aws backend: invalid 'Paths'`)
+		}
+	}
+
+	configs := append([]BucketConfig{{
+		BucketName: c.BucketName,
+		Region:     c.Region,
+		Replica:    c.Replica,
+	}}, c.Buckets...)
+
+	buckets := make([]*bucket, len(configs))
+	for i := range configs {
+		b, err := newBucket(auth, &configs[i])
+		if err != nil {
+			return nil, err
+		}
+		buckets[i] = b
+	}
+
 	return &S3Backend{
-		bucket:      s3o.Bucket(c.BucketName),
-		bucketName:  c.BucketName,
+		buckets:     buckets,
 		cache:       cache,
+		headClient:  newHeadClient(c),
+		paths:       paths,
 		presets:     presets,
+		presetTTLs:  c.PresetTTLs,
+		redirect:    httputil.Redirect{Status: c.RedirectStatus, CacheControl: c.RedirectCacheControl},
+		routing:     c.Routing,
+		softTTL:     c.SoftTTL,
 		transformer: trans,
+		trustCache:  c.TrustCache,
 	}, nil
 }
 
+var regionNamePattern = regexp.MustCompile(`^[a-z]{2}(-gov)?-[a-z]+-[0-9]+$`)
+
+// lookupRegion returns the region with the given name. Regions that
+// goamz does not know about yet are accepted as long as the name looks
+// like a region name
+func lookupRegion(name string) (aws.Region, error) {
+	if name == "" {
+		return aws.APNortheast, nil
+	}
+
+	if r, ok := aws.Regions[name]; ok {
+		return r, nil
+	}
+
+	if !regionNamePattern.MatchString(name) {
+		return aws.Region{}, errors.Errorf(`aws backend: unknown region '%s'`, name)
+	}
+
+	return aws.Region{
+		Name:                 name,
+		S3Endpoint:           "https://s3." + name + ".amazonaws.com",
+		S3LocationConstraint: true,
+		S3LowercaseBucket:    true,
+	}, nil
+}
+
+// newHeadClient creates the client used to check for the existence of
+// variants. It is separate from http.DefaultClient so that a slow S3
+// cannot tie up requests indefinitely, and so that connections to the
+// bucket are kept around for reuse
+func newHeadClient(c *Config) *http.Client {
+	timeout := c.HeadTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	maxIdle := c.HeadMaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = 32
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: maxIdle,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// head checks whether the variant at u exists. It returns nil if it
+// does, an errors.TransformationRequiredError if it does not, and an
+// errors.StorageUnavailableError if S3 could not tell us either way
+func (s *S3Backend) head(ctx context.Context, u string) error {
+	req, err := http.NewRequest(http.MethodHead, u, nil)
+	if err != nil {
+		return errors.Wrap(err, `failed to create request`)
+	}
+
+	start := time.Now()
+	res, err := s.headClient.Do(req.WithContext(ctx))
+	metrics.Timing("aws.head.duration", time.Since(start))
+	if err != nil {
+		if ctx.Err() == nil {
+			metrics.Count("aws.head.errors", 1)
+		}
+		log.Debugf(ctx, "HEAD request for %s failed: %s", u, err)
+		return errors.StorageUnavailableError{Err: err}
+	}
+	res.Body.Close()
+
+	log.Debugf(ctx, "HEAD request for %s returns %d", u, res.StatusCode)
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return nil
+	case res.StatusCode >= 500:
+		metrics.Count("aws.head.errors", 1)
+		return errors.StorageUnavailableError{Err: errors.Errorf(`HEAD request returned %d`, res.StatusCode)}
+	default:
+		return errors.TransformationRequiredError{}
+	}
+}
+
+// Get looks up the url cache and sends a HEAD request to S3 at the
+// same time, and uses whichever confirms the existence of the variant
+// first. This way a cache miss does not cost us a round trip to the
+// cache followed by a round trip to S3
 func (s *S3Backend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
+	if s.trustCache {
+		return s.getTrusted(ctx, u, preset)
+	}
+
 	cacheKey := urlcache.MakeCacheKey("aws", preset, u.String())
-	if cachedURL := s.cache.Lookup(ctx, cacheKey); cachedURL != "" {
-		log.Debugf(ctx, "Cached entry found for %s:%s -> %s", preset, u.String(), cachedURL)
-		if rand.Float32() < 0.25 {
-			log.Debugf(ctx, "Random check for cached URL %s", cachedURL)
-			res, err := http.Head(cachedURL)
-			if err != nil || res.StatusCode != http.StatusOK {
-				log.Debugf(ctx, "Cached entry %s is no longer valid. Deleting", cachedURL)
-				s.cache.Delete(ctx, cacheKey)
+	b := s.route(u)
+	specificURL := b.variantURL(s.VariantPath(u, preset))
+	entry := accesslog.FromContext(ctx)
+
+	headCtx, cancelHead := context.WithCancel(ctx)
+	cacheCh := make(chan string, 1)
+	headCh := make(chan error, 1)
+	go func() { cacheCh <- s.cache.Lookup(ctx, cacheKey) }()
+	go func() {
+		log.Debugf(ctx, "Making HEAD request to %s...", specificURL)
+		headCh <- s.head(headCtx, specificURL)
+	}()
+
+	var headErr error
+	for cacheCh != nil || headCh != nil {
+		select {
+		case cached := <-cacheCh:
+			cacheCh = nil
+			cachedURL, _ := parseCacheValue(cached)
+			if cachedURL == "" {
+				entry.SetCache(accesslog.CacheMiss)
+				continue
+			}
+
+			entry.SetCache(accesslog.CacheHit)
+			log.Debugf(ctx, "Cached entry found for %s:%s -> %s", preset, u.String(), cachedURL)
+			if headCh != nil && rand.Float32() < 0.25 {
+				// Let the HEAD request complete, and use it to check if the
+				// cached entry is still valid
+				log.Debugf(ctx, "Random check for cached URL %s", cachedURL)
+				go func(headCh chan error) {
+					defer cancelHead()
+					if errors.IsTransformationRequired(<-headCh) {
+						log.Debugf(ctx, "Cached entry %s is no longer valid. Deleting", cachedURL)
+						s.cache.Delete(ctx, cacheKey)
+					}
+				}(headCh)
+			} else {
+				cancelHead()
+			}
+			return s.redirect.To(cachedURL), nil
+		case headErr = <-headCh:
+			headCh = nil
+			cancelHead()
+			if headErr == nil {
+				s.cache.Set(ctx, cacheKey, s.cacheValue(specificURL))
+				return s.redirect.To(specificURL), nil
 			}
 		}
+	}
+
+	return s.fromReplica(ctx, b, preset, u, headErr)
+}
 
-		return httputil.RedirectContent(cachedURL), nil
+// getTrusted is Get for when the URL cache is trusted: if the cache
+// knows about the variant, S3 is not consulted at all
+func (s *S3Backend) getTrusted(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
+	cacheKey := urlcache.MakeCacheKey("aws", preset, u.String())
+	entry := accesslog.FromContext(ctx)
+
+	if cachedURL, setAt := parseCacheValue(s.cache.Lookup(ctx, cacheKey)); cachedURL != "" {
+		entry.SetCache(accesslog.CacheHit)
+		if s.softTTL > 0 && time.Since(setAt) > s.softTTL {
+			go s.revalidate(ctx, cacheKey, cachedURL)
+		}
+		return s.redirect.To(cachedURL), nil
 	}
+	entry.SetCache(accesslog.CacheMiss)
 
-	// create the proper url
-	specificURL := "http://" + s.bucketName + ".s3.amazonaws.com/" + preset + u.Path
+	b := s.route(u)
+	specificURL := b.variantURL(s.VariantPath(u, preset))
+	err := s.head(ctx, specificURL)
+	if err == nil {
+		s.cache.Set(ctx, cacheKey, s.cacheValue(specificURL))
+		return s.redirect.To(specificURL), nil
+	}
+	return s.fromReplica(ctx, b, preset, u, err)
+}
 
-	log.Debugf(ctx, "Making HEAD request to %s...", specificURL)
-	res, err := http.Head(specificURL)
-	if err != nil {
-		return nil, errors.TransformationRequiredError{}
+// revalidate checks that the cached variant still exists, and either
+// refreshes or deletes the cache entry. Only one instance revalidates
+// a given entry at a time
+func (s *S3Backend) revalidate(ctx context.Context, cacheKey, cachedURL string) {
+	// The request may be over by the time this runs, so don't use its
+	// context for anything but logging
+	bg := context.Background()
+	lockKey := urlcache.MakeCacheKey("aws-revalidate", cacheKey)
+	if err := s.cache.SetNX(bg, lockKey, "1", urlcache.WithExpires(30*time.Second)); err != nil {
+		return
 	}
+	defer s.cache.Delete(bg, lockKey)
 
-	log.Debugf(ctx, "HEAD request for %s returns %d", specificURL, res.StatusCode)
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.TransformationRequiredError{}
+	log.Debugf(ctx, "Revalidating cached URL %s", cachedURL)
+	switch err := s.head(bg, cachedURL); {
+	case err == nil:
+		s.cache.Set(bg, cacheKey, s.cacheValue(cachedURL))
+	case errors.IsTransformationRequired(err):
+		log.Debugf(ctx, "Cached entry %s is no longer valid. Deleting", cachedURL)
+		s.cache.Delete(bg, cacheKey)
 	}
+}
 
-	return httputil.RedirectContent(specificURL), nil
+// fromReplica is called when the variant could not be found in bucket
+// b. If the bucket is unavailable, its replica is tried. This is not
+// cached, as we want to go back to the primary as soon as possible
+func (s *S3Backend) fromReplica(ctx context.Context, b *bucket, preset string, u *url.URL, headErr error) (http.Handler, error) {
+	if errors.IsStorageUnavailable(headErr) && b.replica != nil {
+		replicaURL := b.replica.variantURL(s.VariantPath(u, preset))
+		log.Debugf(ctx, "Bucket unavailable, making HEAD request to replica %s...", replicaURL)
+		if err := s.head(ctx, replicaURL); err == nil {
+			metrics.Count("aws.replica.hit", 1)
+			return s.redirect.To(replicaURL), nil
+		}
+	}
+
+	return nil, headErr
 }
 
-func (s *S3Backend) StoreTransformedContent(ctx context.Context, u *url.URL) error {
+// cacheValue returns the value stored in the URL cache for the variant
+// at u. If SoftTTL is enabled, the current time is recorded as well,
+// as "<unix time> <url>"
+func (s *S3Backend) cacheValue(u string) string {
+	if s.softTTL <= 0 {
+		return u
+	}
+	return strconv.FormatInt(time.Now().Unix(), 10) + " " + u
+}
+
+// parseCacheValue parses values created by cacheValue. Values without
+// a time are reported as being infinitely old
+func parseCacheValue(v string) (string, time.Time) {
+	i := strings.IndexByte(v, ' ')
+	if i < 0 {
+		return v, time.Time{}
+	}
+
+	t, err := strconv.ParseInt(v[:i], 10, 64)
+	if err != nil {
+		return v, time.Time{}
+	}
+	return v[i+1:], time.Unix(t, 0)
+}
+
+func (s *S3Backend) StoreTransformedContent(ctx context.Context, u *url.URL, presets map[string]string) error {
 	log.Debugf(ctx, "S3Backend: transforming image at url %s", u)
 
 	// Transformation is completely done by the transformer, so just
 	// hand it over to it
-	var grp *errgroup.Group
-	grp, ctx = errgroup.WithContext(ctx)
+	var grp errors.PresetGroup
+	grp.SetLimit(throttle.Parallelism(ctx))
 
-	for preset, rule := range s.presets {
+	for preset, rule := range presets {
 		t := s.transformer
 		preset := preset
 		rule := rule
-		grp.Go(func() error {
+		grp.Go(preset, func() error {
 			buf := bbpool.Get()
 			defer bbpool.Release(buf)
 
 			var res transformer.Result
 			res.Content = buf
+			res.Preset = preset
 
 			if err := t.Transform(ctx, rule, u.String(), &res); err != nil {
 				return errors.Wrap(err, `failed to transform image`)
 			}
 
 			// good, done. save it to S3
-			path := "/" + preset + u.Path
-			log.Debugf(ctx, "Sending PUT to S3 %s...", path)
-			if err := s.bucket.PutReader(path, buf, res.Size, res.ContentType, s3.PublicRead, s3.Options{}); err != nil {
-				return errors.Wrapf(err, `failed to write data to %s`, path)
-			}
-			cacheKey := urlcache.MakeCacheKey("gcp", preset, u.String())
-			specificURL := "http://" + s.bucketName + ".s3.amazonaws.com/" + preset + u.Path
-			s.cache.Set(ctx, cacheKey, specificURL)
-			return nil
+			return s.Put(ctx, u, preset, buf.Bytes(), res.Metadata(u.String(), preset, rule))
 		})
 	}
 	return grp.Wait()
 }
 
-func (s *S3Backend) Delete(ctx context.Context, u *url.URL) error {
-	var wg sync.WaitGroup
-	errCh := make(chan error, len(s.presets))
+// Fetch writes the stored content for the given url and preset to dst
+func (s *S3Backend) Fetch(ctx context.Context, u *url.URL, preset string, dst io.Writer) (*metadata.Metadata, error) {
+	path := s.VariantPath(u, preset)
+	res, err := s.route(u).GetResponse(path)
+	if err != nil {
+		if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == http.StatusNotFound {
+			return nil, errors.TransformationRequiredError{}
+		}
+		return nil, errors.Wrapf(err, `failed to fetch %s`, path)
+	}
+	defer res.Body.Close()
+
+	if _, err := io.Copy(dst, res.Body); err != nil {
+		return nil, errors.Wrapf(err, `failed to read content from %s`, path)
+	}
+	return metadataFromHeader(res.Header), nil
+}
+
+// Put stores the given content as the variant for the given url and preset
+func (s *S3Backend) Put(ctx context.Context, u *url.URL, preset string, content []byte, m *metadata.Metadata) error {
+	path := s.VariantPath(u, preset)
+	log.Debugf(ctx, "Sending PUT to S3 %s...", path)
+
+	// S3 verifies the content against Content-MD5, and rejects the
+	// upload if they do not match. The rest of the metadata, including
+	// the SHA-256 checksum, is stored as object metadata
+	m.SHA256 = util.Checksum(content)
+	sum := md5.Sum(content)
+	options := s3.Options{
+		ContentMD5: base64.StdEncoding.EncodeToString(sum[:]),
+		Meta:       make(map[string][]string),
+	}
+	for k, v := range m.Map() {
+		options.Meta[k] = []string{v}
+	}
+	b := s.route(u)
+	if err := b.PutReader(path, bytes.NewReader(content), int64(len(content)), m.ContentType, s3.PublicRead, options); err != nil {
+		return errors.Wrapf(err, `failed to write data to %s`, path)
+	}
+	cacheKey := urlcache.MakeCacheKey("aws", preset, u.String())
+	specificURL := b.variantURL(s.VariantPath(u, preset))
+	s.cache.Set(ctx, cacheKey, s.cacheValue(specificURL))
+	return nil
+}
+
+// healthCheckPath is the key of the object that health checks write
+// and then delete
+const healthCheckPath = "/.sharaq-health"
+
+// CheckHealth writes a small object to each bucket and deletes it
+func (s *S3Backend) CheckHealth(ctx context.Context) error {
+	for _, b := range s.buckets {
+		if err := b.Put(healthCheckPath, []byte("ok"), "text/plain", s3.Private, s3.Options{}); err != nil {
+			return errors.Wrapf(err, `failed to write to bucket %s`, b.Name)
+		}
+		if err := b.Del(healthCheckPath); err != nil {
+			return errors.Wrapf(err, `failed to delete from bucket %s`, b.Name)
+		}
+	}
+	return nil
+}
+
+// Metadata returns the metadata that was recorded when the variant
+// was stored
+func (s *S3Backend) Metadata(ctx context.Context, u *url.URL, preset string) (*metadata.Metadata, error) {
+	path := s.VariantPath(u, preset)
+	res, err := s.route(u).Head(path, nil)
+	if err != nil {
+		if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == http.StatusNotFound {
+			return nil, errors.TransformationRequiredError{}
+		}
+		return nil, errors.Wrapf(err, `failed to fetch metadata for %s`, path)
+	}
+	res.Body.Close()
+	return metadataFromHeader(res.Header), nil
+}
+
+// List calls fn with the metadata of each variant stored in the buckets
+func (s *S3Backend) List(ctx context.Context, fn func(*metadata.Metadata) error) error {
+	for _, b := range s.buckets {
+		if err := s.listBucket(ctx, b, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3Backend) listBucket(ctx context.Context, b *bucket, fn func(*metadata.Metadata) error) error {
 	for preset := range s.presets {
+		var marker string
+		for {
+			res, err := b.List(preset+"/", "", marker, 1000)
+			if err != nil {
+				return errors.Wrapf(err, `failed to list objects under %s`, preset)
+			}
+
+			for _, key := range res.Contents {
+				// The listing does not include user metadata, so we
+				// need to fetch it for each object
+				hres, err := b.Head("/"+key.Key, nil)
+				if err != nil {
+					return errors.Wrapf(err, `failed to fetch metadata for %s`, key.Key)
+				}
+				hres.Body.Close()
+
+				m := metadataFromHeader(hres.Header)
+				if m.Preset == "" {
+					m.Preset = preset
+				}
+				if err := fn(m); err != nil {
+					return err
+				}
+				marker = key.Key
+			}
+
+			if !res.IsTruncated {
+				break
+			}
+			if res.NextMarker != "" {
+				marker = res.NextMarker
+			}
+		}
+	}
+	return nil
+}
+
+func metadataFromHeader(h http.Header) *metadata.Metadata {
+	return metadata.FromMap(h.Get("Content-Type"), func(k string) string {
+		return h.Get("X-Amz-Meta-" + k)
+	})
+}
+
+func (s *S3Backend) Delete(ctx context.Context, u *url.URL, presets []string) error {
+	if presets == nil {
+		for preset := range s.presets {
+			presets = append(presets, preset)
+		}
+	}
+
+	b := s.route(u)
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(presets))
+	for _, preset := range presets {
 		wg.Add(1)
 		go func(wg *sync.WaitGroup, preset string, errCh chan error) {
 			defer wg.Done()
-			path := "/" + preset + u.Path
+			path := s.VariantPath(u, preset)
 			log.Debugf(ctx, " + DELETE S3 entry %s\n", path)
-			err := s.bucket.Del(path)
+			err := b.Del(path)
 			if err != nil {
 				errCh <- err
 			}
 
 			// fallthrough here regardless, because it's better to lose the
 			// cache than to accidentally have one linger
-			s.cache.Delete(context.Background(), urlcache.MakeCacheKey(preset, u.String()))
+			s.cache.Delete(context.Background(), urlcache.MakeCacheKey("aws", preset, u.String()))
 		}(&wg, preset, errCh)
 	}
 
@@ -0,0 +1,193 @@
+package aws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupRegion(t *testing.T) {
+	r, err := lookupRegion("")
+	if !assert.NoError(t, err, "empty region should default") {
+		return
+	}
+	assert.Equal(t, "ap-northeast-1", r.Name, "default region should be ap-northeast-1")
+
+	r, err = lookupRegion("xx-future-9")
+	if !assert.NoError(t, err, "unknown but valid region names should be accepted") {
+		return
+	}
+	assert.Equal(t, "https://s3.xx-future-9.amazonaws.com", r.S3Endpoint, "endpoint should be derived from the name")
+
+	_, err = lookupRegion("tokyo")
+	assert.Error(t, err, "invalid region names should be rejected")
+}
+
+func TestRoute(t *testing.T) {
+	c := &Config{
+		BucketName: "default",
+		Buckets: []BucketConfig{
+			{BucketName: "tickets", Region: "us-west-2", Hosts: []string{"tickets.example.com"}},
+		},
+	}
+	s, err := NewBackend(c, nil, nil, nil)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	u, _ := url.Parse("http://tickets.example.com/foo.jpg")
+	if !assert.Equal(t, "http://tickets.s3.us-west-2.amazonaws.com/small/foo.jpg", s.route(u).variantURL(s.VariantPath(u, "small")), "should be routed by host") {
+		return
+	}
+
+	u, _ = url.Parse("http://www.example.com/foo.jpg")
+	if !assert.Equal(t, "http://default.s3.amazonaws.com/small/foo.jpg", s.route(u).variantURL(s.VariantPath(u, "small")), "unknown hosts should use the default bucket") {
+		return
+	}
+
+	c.Routing = RoutingHash
+	s, err = NewBackend(c, nil, nil, nil)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+	if !assert.Equal(t, s.route(u), s.route(u), "hash routing should be stable") {
+		return
+	}
+}
+
+func TestVariantPath(t *testing.T) {
+	u, _ := url.Parse("http://example.com/foo.jpg")
+	if !assert.Equal(t, "/small/foo.jpg", variantPath("small", u), "paths without a query should not change") {
+		return
+	}
+
+	v1, _ := url.Parse("http://example.com/foo.jpg?v=1")
+	v2, _ := url.Parse("http://example.com/foo.jpg?v=2")
+	if !assert.NotEqual(t, variantPath("small", v1), variantPath("small", v2), "versions should be stored separately") {
+		return
+	}
+	if !assert.NotEqual(t, variantPath("small", u), variantPath("small", v1), "versions should not overwrite the unversioned variant") {
+		return
+	}
+
+	s, err := NewBackend(&Config{BucketName: "default", Paths: &PathConfig{Hash: "sha1", IncludeHost: true, Filename: true}}, nil, nil, nil)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+	p := s.VariantPath(u, "small")
+	if !assert.Regexp(t, `^/small/example\.com/[0-9a-f]/[0-9a-f]{2}/[0-9a-f]{3}/[0-9a-f]{4}/foo\.jpg_[0-9a-f]{40}$`, p, "variants should be stored under the configured layout") {
+		return
+	}
+	if !assert.NotEqual(t, p, s.VariantPath(v1, "small"), "versions should be stored separately") {
+		return
+	}
+
+	_, err = NewBackend(&Config{Paths: &PathConfig{Hash: "crc32"}}, nil, nil, nil)
+	if !assert.Error(t, err, "unknown hash algorithms should be rejected") {
+		return
+	}
+}
+
+func TestCacheValue(t *testing.T) {
+	s := &S3Backend{}
+	u, setAt := parseCacheValue(s.cacheValue("http://bucket.s3.amazonaws.com/small/foo.jpg"))
+	if !assert.Equal(t, "http://bucket.s3.amazonaws.com/small/foo.jpg", u, "plain values should be used as is") {
+		return
+	}
+	if !assert.True(t, setAt.IsZero(), "plain values have no time") {
+		return
+	}
+
+	s.softTTL = time.Minute
+	u, setAt = parseCacheValue(s.cacheValue("http://bucket.s3.amazonaws.com/small/foo.jpg"))
+	if !assert.Equal(t, "http://bucket.s3.amazonaws.com/small/foo.jpg", u, "url should be extracted") {
+		return
+	}
+	if !assert.WithinDuration(t, time.Now(), setAt, 2*time.Second, "time should be recorded") {
+		return
+	}
+}
+
+func TestLifecycleRules(t *testing.T) {
+	s := &S3Backend{
+		presetTTLs: map[string]time.Duration{
+			"small":       36 * time.Hour,
+			"email-thumb": 90 * 24 * time.Hour,
+		},
+	}
+
+	rules, desc := s.lifecycleRules()
+	if !assert.Len(t, rules, 2, "there should be a rule per preset") {
+		return
+	}
+	if !assert.Equal(t, "sharaq-email-thumb", rules[0].ID, "rule ID should be derived from the preset") {
+		return
+	}
+	if !assert.Equal(t, "email-thumb/", rules[0].Prefix, "rule should apply to the preset prefix") {
+		return
+	}
+	if !assert.Equal(t, []string{"expire email-thumb/* after 90 days", "expire small/* after 2 days"}, desc, "TTLs should be rounded up to days") {
+		return
+	}
+}
+
+func TestTrustCacheDelete(t *testing.T) {
+	// a bucket with a single object, which DELETE removes
+	var deleted int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodDelete:
+			atomic.StoreInt32(&deleted, 1)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodHead:
+			if atomic.LoadInt32(&deleted) == 1 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "urlcache.New should succeed") {
+		return
+	}
+	s, err := NewBackend(&Config{BucketName: "test", TrustCache: true}, cache, nil, nil)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+	b := s.buckets[0]
+	b.Bucket = s3.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{Name: "test", S3Endpoint: srv.URL}).Bucket("test")
+	b.host = srv.Listener.Addr().String()
+
+	ctx := context.Background()
+	u, _ := url.Parse("http://example.com/foo.jpg")
+	if _, err := s.Get(ctx, u, "small"); !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+	if !assert.NotEmpty(t, cache.Lookup(ctx, urlcache.MakeCacheKey("aws", "small", u.String())), "variant should be cached") {
+		return
+	}
+
+	if !assert.NoError(t, s.Delete(ctx, u, []string{"small"}), "Delete should succeed") {
+		return
+	}
+	_, err = s.Get(ctx, u, "small")
+	if !assert.True(t, errors.IsTransformationRequired(err), "Get after Delete should not use the cache") {
+		return
+	}
+}
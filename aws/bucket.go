@@ -0,0 +1,100 @@
+package aws
+
+import (
+	"net/url"
+
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+	"github.com/lestrrat-go/sharaq/internal/crc64"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+)
+
+// bucket is a single S3 bucket that variants are stored in
+type bucket struct {
+	*s3.Bucket
+	host    string // host name used in generated URLs
+	hosts   map[string]struct{}
+	replica *bucket
+}
+
+func newBucket(auth aws.Auth, c *BucketConfig) (*bucket, error) {
+	if c.BucketName == "" {
+		return nil, errors.New(`aws backend: 'BucketName' is required`)
+	}
+
+	region, err := lookupRegion(c.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep using the global endpoint for generated URLs if no region
+	// was specified, so that URLs don't change for existing setups
+	host := c.BucketName + ".s3.amazonaws.com"
+	if c.Region != "" {
+		host = c.BucketName + ".s3." + region.Name + ".amazonaws.com"
+	}
+
+	b := &bucket{
+		Bucket: s3.New(auth, region).Bucket(c.BucketName),
+		host:   host,
+		hosts:  make(map[string]struct{}),
+	}
+	for _, h := range c.Hosts {
+		b.hosts[h] = struct{}{}
+	}
+
+	if c.Replica != nil {
+		b.replica, err = newBucket(auth, c.Replica)
+		if err != nil {
+			return nil, errors.Wrap(err, `invalid replica`)
+		}
+	}
+	return b, nil
+}
+
+// variantPath returns the path of the variant within the bucket.
+// Source URLs that differ only by their query (e.g. "?v=123" cache
+// busters) are stored separately, by appending a hash of the query
+func variantPath(preset string, u *url.URL) string {
+	p := "/" + preset + u.Path
+	if u.RawQuery != "" {
+		p += "_q" + crc64.EncodeString(u.RawQuery)
+	}
+	return p
+}
+
+// VariantPath returns the key of the variant within its bucket. With
+// Paths, the key is made of a hash of the source URL instead of its
+// path. Either way, variants are stored under "<preset>/", which the
+// lifecycle rules rely on
+func (s *S3Backend) VariantPath(u *url.URL, preset string) string {
+	if s.paths != nil {
+		return "/" + preset + "/" + s.paths.Key(preset, u.String())
+	}
+	return variantPath(preset, u)
+}
+
+// variantURL returns the public URL of the variant at path, as returned
+// by VariantPath
+func (b *bucket) variantURL(path string) string {
+	return "http://" + b.host + path
+}
+
+// route returns the bucket that variants of u are stored in
+func (s *S3Backend) route(u *url.URL) *bucket {
+	if len(s.buckets) == 1 {
+		return s.buckets[0]
+	}
+
+	switch s.routing {
+	case RoutingHash:
+		return s.buckets[crc64.Sum(u.String())%uint64(len(s.buckets))]
+	default:
+		for _, b := range s.buckets[1:] {
+			if _, ok := b.hosts[u.Host]; ok {
+				return b
+			}
+		}
+		return s.buckets[0]
+	}
+}
@@ -1,7 +1,85 @@
 package aws
 
+import "time"
+
 type Config struct {
 	AccessKey string
 	SecretKey string
 	BucketName string
+	// Region is the name of the region that the bucket is in (e.g.
+	// "us-west-2"). Defaults to ap-northeast-1
+	Region string
+
+	// HeadTimeout is the timeout for HEAD requests used to check
+	// whether a variant exists. Defaults to 5 seconds
+	HeadTimeout time.Duration
+	// HeadMaxIdleConnsPerHost is the number of idle connections to S3
+	// kept around for HEAD requests. Defaults to 32
+	HeadMaxIdleConnsPerHost int
+
+	// TrustCache makes the URL cache the only thing consulted for
+	// variants that have a cache entry: no HEAD request is sent to S3.
+	// This makes a cache hit cost a single round trip to the cache, at
+	// the risk of redirecting to variants that were removed from S3
+	// behind our back
+	TrustCache bool
+	// SoftTTL is used with TrustCache. Cache entries older than this
+	// are still used, but are revalidated with a HEAD request in the
+	// background. Disabled if 0. Note that cache entries written with
+	// SoftTTL enabled can not be read by older versions of sharaq
+	SoftTTL time.Duration
+
+	// RedirectStatus is the status used to redirect clients to stored
+	// variants: 301, 302 (default), 303, 307, or 308. Think twice before
+	// using a permanent redirect, as clients will keep using the bucket
+	// URL even if it changes
+	RedirectStatus int
+	// RedirectCacheControl, if specified, is sent as the Cache-Control
+	// header along with redirects
+	RedirectCacheControl string
+
+	// Replica is a copy of the bucket in another region (e.g. kept
+	// in sync via S3 cross-region replication). It is used for reads
+	// when the bucket is unavailable. sharaq never writes to it
+	Replica *BucketConfig
+
+	// Buckets lists additional buckets. Variants are routed to a bucket
+	// according to Routing. The bucket specified by BucketName is used
+	// as the default bucket
+	Buckets []BucketConfig
+	// Routing is either "host" (default), which routes by the host name
+	// of the source URL (see BucketConfig.Hosts), or "hash", which
+	// distributes source URLs evenly across all buckets
+	Routing string
+
+	// PresetTTLs specifies how long variants of each preset are kept.
+	// S3 expires them by itself once `sharaq lifecycle` has configured
+	// the buckets accordingly. TTLs are rounded up to whole days
+	PresetTTLs map[string]time.Duration
+
+	// Paths, if specified, stores variants under a hash of the source
+	// URL instead of its path, in the same way as the fs backend.
+	// Changing it orphans existing variants
+	Paths *PathConfig
+}
+
+// PathConfig specifies the layout of keys under "<preset>/", as for
+// fs.PathConfig
+type PathConfig struct {
+	Hash        string // "crc64" (default), "md5", "sha1", or "sha256"
+	IncludeHost bool   // if true, keys start with the source host
+	Filename    bool   // if true, the last element starts with the original file name
+}
+
+// Routing methods
+const (
+	RoutingHost = "host"
+	RoutingHash = "hash"
+)
+
+type BucketConfig struct {
+	BucketName string
+	Region     string
+	Hosts      []string      // source hosts stored in this bucket, for "host" routing
+	Replica    *BucketConfig // see Config.Replica
 }
@@ -0,0 +1,93 @@
+package aws
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"golang.org/x/net/context"
+)
+
+// lifecycleRulePrefix marks the lifecycle rules that are managed by
+// sharaq. Other rules in the bucket are left alone
+const lifecycleRulePrefix = "sharaq-"
+
+// lifecycleRules returns the rules that expire variants according to
+// PresetTTLs, sorted by preset name, along with their descriptions
+func (s *S3Backend) lifecycleRules() ([]*s3.LifecycleRule, []string) {
+	names := make([]string, 0, len(s.presetTTLs))
+	for preset := range s.presetTTLs {
+		names = append(names, preset)
+	}
+	sort.Strings(names)
+
+	rules := make([]*s3.LifecycleRule, len(names))
+	desc := make([]string, len(names))
+	for i, preset := range names {
+		days := uint((s.presetTTLs[preset] + 24*time.Hour - 1) / (24 * time.Hour))
+		// variants are stored under "<preset>/" (see variantPath)
+		rules[i] = s3.NewLifecycleRule(lifecycleRulePrefix+preset, preset+"/")
+		rules[i].SetExpirationDays(days)
+		desc[i] = fmt.Sprintf("expire %s/* after %d days", preset, days)
+	}
+	return rules, desc
+}
+
+// ApplyLifecycle configures each bucket to expire variants according to
+// PresetTTLs, replacing the rules that were previously configured by
+// sharaq. Replicas are not modified. The rules are returned in human
+// readable form. If dryRun is true, the buckets are left untouched
+func (s *S3Backend) ApplyLifecycle(ctx context.Context, dryRun bool) ([]string, error) {
+	rules, ruleDesc := s.lifecycleRules()
+
+	var desc []string
+	for _, b := range s.buckets {
+		current, err := b.GetLifecycleConfiguration()
+		if err != nil {
+			if s3err, ok := err.(*s3.Error); !ok || s3err.StatusCode != http.StatusNotFound {
+				return nil, errors.Wrapf(err, `failed to fetch lifecycle configuration of %s`, b.Name)
+			}
+			current = nil
+		}
+
+		var conf s3.LifecycleConfiguration
+		var kept int
+		if current != nil && current.Rules != nil {
+			for _, r := range *current.Rules {
+				if strings.HasPrefix(r.ID, lifecycleRulePrefix) {
+					continue
+				}
+				conf.AddRule(r)
+				kept++
+			}
+		}
+		for i, r := range rules {
+			conf.AddRule(r)
+			desc = append(desc, b.Name+": "+ruleDesc[i])
+		}
+
+		if dryRun {
+			continue
+		}
+
+		log.Debugf(ctx, "Applying %d lifecycle rules to %s (keeping %d other rules)", len(rules), b.Name, kept)
+		if conf.Rules == nil {
+			// S3 rejects empty configurations
+			if current == nil {
+				continue
+			}
+			err = b.DeleteLifecycleConfiguration()
+		} else {
+			err = b.PutLifecycleConfiguration(&conf)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, `failed to apply lifecycle configuration to %s`, b.Name)
+		}
+	}
+	return desc, nil
+}
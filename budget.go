@@ -0,0 +1,176 @@
+package sharaq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/errreport"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"golang.org/x/net/context"
+)
+
+// Kinds of bytes that are counted against budgets
+const (
+	budgetOrigin = "origin" // fetched from the origin
+	budgetUpload = "upload" // stored in the backend
+)
+
+// byteBudget counts the bytes transferred per kind over fixed periods
+// (clock hours and UTC days). Once a count exceeds its limit, the
+// budget stays exceeded until the period ends. The counts survive
+// configuration reloads. All methods are no-ops on a nil byteBudget
+type byteBudget struct {
+	mu       sync.Mutex
+	counters []*budgetCounter
+	alert    func(*budgetCounter) // called once per period when a counter is exceeded
+	now      func() time.Time
+}
+
+type budgetCounter struct {
+	name    string // such as "origin.hour"
+	kind    string
+	period  time.Duration
+	limit   int64
+	start   time.Time // start of the current period
+	used    int64
+	alerted bool
+}
+
+func newByteBudget() *byteBudget {
+	return &byteBudget{now: time.Now}
+}
+
+// setClock replaces the clock that periods are measured with
+func (b *byteBudget) setClock(now func() time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.now = now
+}
+
+// configure sets the limits from bc, keeping the counts of limits that
+// did not change. A nil bc removes all limits
+func (b *byteBudget) configure(bc *BudgetConfig) {
+	var limits []budgetCounter
+	if bc != nil {
+		limits = []budgetCounter{
+			{name: "origin.hour", kind: budgetOrigin, period: time.Hour, limit: bc.OriginBytesPerHour},
+			{name: "origin.day", kind: budgetOrigin, period: 24 * time.Hour, limit: bc.OriginBytesPerDay},
+			{name: "upload.hour", kind: budgetUpload, period: time.Hour, limit: bc.UploadBytesPerHour},
+			{name: "upload.day", kind: budgetUpload, period: 24 * time.Hour, limit: bc.UploadBytesPerDay},
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	old := make(map[string]*budgetCounter, len(b.counters))
+	for _, c := range b.counters {
+		old[c.name] = c
+	}
+
+	b.counters = nil
+	for i := range limits {
+		l := &limits[i]
+		if l.limit <= 0 {
+			continue
+		}
+		c, ok := old[l.name]
+		if !ok {
+			c = l
+		}
+		c.limit = l.limit
+		b.counters = append(b.counters, c)
+	}
+}
+
+// roll starts a new period if the current one is over. Must be called
+// with b.mu held
+func (c *budgetCounter) roll(now time.Time) {
+	start := now.UTC().Truncate(c.period)
+	if start.After(c.start) {
+		c.start = start
+		c.used = 0
+		c.alerted = false
+	}
+}
+
+func (c *budgetCounter) exceeded() bool {
+	return c.used >= c.limit
+}
+
+// add counts n bytes of the given kind
+func (b *byteBudget) add(kind string, n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	var alerts []budgetCounter
+	b.mu.Lock()
+	now := b.now()
+	for _, c := range b.counters {
+		if c.kind != kind {
+			continue
+		}
+		c.roll(now)
+		c.used += n
+		if c.exceeded() && !c.alerted {
+			c.alerted = true
+			alerts = append(alerts, *c)
+		}
+	}
+	alert := b.alert
+	b.mu.Unlock()
+
+	for i := range alerts {
+		metrics.Count("budget.exceeded", 1, "budget:"+alerts[i].name)
+		if alert != nil {
+			alert(&alerts[i])
+		}
+	}
+}
+
+// exceeded returns true if any budget is exceeded, along with the time
+// until the longest of the exceeded periods ends
+func (b *byteBudget) exceeded() (bool, time.Duration) {
+	if b == nil {
+		return false, 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	var over bool
+	var wait time.Duration
+	for _, c := range b.counters {
+		c.roll(now)
+		if !c.exceeded() {
+			continue
+		}
+		over = true
+		if d := c.start.Add(c.period).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return over, wait
+}
+
+// initBudget creates the budget on first use, and applies the limits of
+// the current configuration. Alerts are sent to the error reporters
+func (s *Server) initBudget() {
+	if s.budget == nil {
+		s.budget = newByteBudget()
+		s.budget.alert = func(c *budgetCounter) {
+			s.reportError(context.Background(), &errreport.Event{
+				Kind: errreport.KindBudget,
+				Err:  errors.Errorf(`%s budget exceeded: %d of %d bytes, redirecting misses to the origin`, c.name, c.used, c.limit),
+				Extra: map[string]string{
+					"budget": c.name,
+					"until":  c.start.Add(c.period).Format(time.RFC3339),
+				},
+			})
+		}
+	}
+	s.budget.configure(s.config.Budget)
+}
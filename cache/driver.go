@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Driver is the interface that URL cache drivers implement. Get stores
+// the value into v, which is either a *string or a *[]byte, and returns
+// an error on a cache miss. expires is in seconds, and 0 means that
+// the entry does not expire. SetNX returns an error if key already
+// exists
+type Driver interface {
+	Get(ctx context.Context, key string, v interface{}) error
+	Set(ctx context.Context, key string, value []byte, expires int32) error
+	SetNX(ctx context.Context, key string, value []byte, expires int32) error
+	Delete(ctx context.Context, key string) error
+}
+
+// DriverFactory creates a driver from the free form options given in
+// URLCache.Options
+type DriverFactory func(options map[string]string) (Driver, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]DriverFactory)
+)
+
+// builtinDrivers are handled by sharaq itself, and can not be registered
+var builtinDrivers = map[string]struct{}{
+	"Memcached": {},
+	"Memory":    {},
+	"Redis":     {},
+}
+
+// Register makes a URL cache driver available by the given name, which
+// is then used as URLCache.Type. It is meant to be called from init
+// functions, and panics if the name is already in use
+func Register(name string, f DriverFactory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if f == nil {
+		panic("cache: Register factory is nil")
+	}
+	if _, ok := builtinDrivers[name]; ok {
+		panic("cache: Register called for builtin driver " + name)
+	}
+	if _, ok := drivers[name]; ok {
+		panic("cache: Register called twice for driver " + name)
+	}
+	drivers[name] = f
+}
+
+// NewDriver creates a driver that was registered by Register
+func NewDriver(name string, options map[string]string) (Driver, error) {
+	driversMu.RLock()
+	f, ok := drivers[name]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf(`cache: unknown driver "%s"`, name)
+	}
+
+	d, err := f(options)
+	if err != nil {
+		return nil, errors.Wrapf(err, `cache: failed to create driver "%s"`, name)
+	}
+	return d, nil
+}
+
+// Drivers returns the sorted names of registered drivers
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	list := make([]string, 0, len(drivers))
+	for name := range drivers {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -3,6 +3,8 @@
 package cache
 
 import (
+	"time"
+
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -13,15 +15,75 @@ type Memcache struct {
 }
 
 type MemcacheConfig struct {
-	Addr []string
+	Addr         []string
+	Timeout      time.Duration // dial, read, and write timeout. default is the gomemcache default
+	MaxIdleConns int           // idle connections kept per server. default is the gomemcache default
+	Hashing      string        // "modulo" (default) or "consistent"
+	TLS          *TLSConfig    // if non-nil, connect using TLS
 }
 
+// Methods to distribute keys across servers
+const (
+	HashingModulo     = "modulo"
+	HashingConsistent = "consistent"
+)
+
 func NewMemcache(server ...string) *Memcache {
 	return &Memcache{
 		client: memcache.New(server...),
 	}
 }
 
+// NewMemcacheFromConfig creates a memcached client. Use consistent
+// hashing if servers are added or removed often: only the keys on the
+// affected server move, instead of almost all keys
+func NewMemcacheFromConfig(c *MemcacheConfig) (*Memcache, error) {
+	var cs *consistentSelector
+	switch c.Hashing {
+	case "", HashingModulo:
+	case HashingConsistent:
+		ss, err := newConsistentSelector(c.Addr)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to setup memcached servers`)
+		}
+		cs = ss
+	default:
+		return nil, errors.Errorf(`unknown memcached hashing '%s'`, c.Hashing)
+	}
+
+	// with TLS, the client connects to local tunnels instead, which are
+	// in the same order as the servers
+	servers := c.Addr
+	if c.TLS != nil {
+		tc, err := c.TLS.config()
+		if err != nil {
+			return nil, errors.Wrap(err, `invalid memcached TLS config`)
+		}
+		tunnels, err := newTLSTunnels(c.Addr, tc, c.Timeout)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to setup memcached TLS connections`)
+		}
+		servers = make([]string, len(tunnels))
+		for i, addr := range tunnels {
+			servers[i] = addr.String()
+		}
+		if cs != nil {
+			// the ring is still derived from the configured names
+			copy(cs.addrs, tunnels)
+		}
+	}
+
+	var client *memcache.Client
+	if cs != nil {
+		client = memcache.NewFromSelector(cs)
+	} else {
+		client = memcache.New(servers...)
+	}
+	client.Timeout = c.Timeout
+	client.MaxIdleConns = c.MaxIdleConns
+	return &Memcache{client: client}, nil
+}
+
 func (m *Memcache) Get(_ context.Context, key string, value interface{}) error {
 	it, err := m.client.Get(key)
 	if err != nil {
@@ -11,8 +11,13 @@ import (
 )
 
 type Memcache struct{} // dummy, as appengine just uses a default client
+// MemcacheConfig exists for compatibility, but is ignored
 type MemcacheConfig struct {
-	Addr []string // exists for compatibility, but is ignored
+	Addr         []string
+	Timeout      time.Duration
+	MaxIdleConns int
+	Hashing      string
+	TLS          *TLSConfig
 }
 
 var instance Memcache
@@ -21,6 +26,10 @@ func NewMemcache(_ ...string) *Memcache {
 	return &instance
 }
 
+func NewMemcacheFromConfig(_ *MemcacheConfig) (*Memcache, error) {
+	return &instance, nil
+}
+
 func (m *Memcache) Get(ctx context.Context, key string, value interface{}) error {
 	it, err := memcache.Get(ctx, key)
 	if err != nil {
@@ -0,0 +1,87 @@
+// +build !appengine
+
+package cache
+
+import (
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// number of points on the ring for each server. More points distribute
+// keys more evenly
+const pointsPerServer = 160
+
+type ringPoint struct {
+	hash   uint32
+	server int
+}
+
+type ringPoints []ringPoint
+
+func (r ringPoints) Len() int           { return len(r) }
+func (r ringPoints) Less(i, j int) bool { return r[i].hash < r[j].hash }
+func (r ringPoints) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// consistentSelector implements memcache.ServerSelector using a hash
+// ring, so that adding or removing a server only moves the keys that
+// were on that server
+type consistentSelector struct {
+	addrs []net.Addr
+	ring  ringPoints
+}
+
+func newConsistentSelector(servers []string) (*consistentSelector, error) {
+	s := &consistentSelector{
+		addrs: make([]net.Addr, len(servers)),
+		ring:  make(ringPoints, 0, len(servers)*pointsPerServer),
+	}
+	for i, server := range servers {
+		var addr net.Addr
+		var err error
+		if strings.Contains(server, "/") {
+			addr, err = net.ResolveUnixAddr("unix", server)
+		} else {
+			addr, err = net.ResolveTCPAddr("tcp", server)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, `failed to resolve %s`, server)
+		}
+		s.addrs[i] = addr
+
+		// points are derived from the name as configured, so that all
+		// instances agree on the ring regardless of DNS
+		for p := 0; p < pointsPerServer; p++ {
+			h := crc32.ChecksumIEEE([]byte(server + "-" + strconv.Itoa(p)))
+			s.ring = append(s.ring, ringPoint{hash: h, server: i})
+		}
+	}
+	sort.Sort(s.ring)
+	return s, nil
+}
+
+func (s *consistentSelector) PickServer(key string) (net.Addr, error) {
+	if len(s.ring) == 0 {
+		return nil, errors.New(`no memcached servers configured`)
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.addrs[s.ring[i].server], nil
+}
+
+func (s *consistentSelector) Each(f func(net.Addr) error) error {
+	for _, addr := range s.addrs {
+		if err := f(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
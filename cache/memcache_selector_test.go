@@ -0,0 +1,51 @@
+// +build !appengine
+
+package cache
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsistentSelector(t *testing.T) {
+	before, err := newConsistentSelector([]string{"127.0.0.1:11211", "127.0.0.1:11212", "127.0.0.1:11213"})
+	if !assert.NoError(t, err, "newConsistentSelector should succeed") {
+		return
+	}
+	after, err := newConsistentSelector([]string{"127.0.0.1:11211", "127.0.0.1:11212", "127.0.0.1:11213", "127.0.0.1:11214"})
+	if !assert.NoError(t, err, "newConsistentSelector should succeed") {
+		return
+	}
+
+	const keys = 10000
+	var moved int
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		key := "sharaq:urlcache:" + strconv.Itoa(i)
+		b, err := before.PickServer(key)
+		if !assert.NoError(t, err, "PickServer should succeed") {
+			return
+		}
+		a, err := after.PickServer(key)
+		if !assert.NoError(t, err, "PickServer should succeed") {
+			return
+		}
+		counts[b.String()]++
+		if a.String() != b.String() {
+			if !assert.Equal(t, "127.0.0.1:11214", a.String(), "keys should only move to the new server") {
+				return
+			}
+			moved++
+		}
+	}
+
+	if !assert.Len(t, counts, 3, "keys should be spread across all servers") {
+		return
+	}
+	// ideally a quarter of the keys move
+	if !assert.InDelta(t, keys/4, moved, keys/10, "about a quarter of the keys should move") {
+		return
+	}
+}
@@ -0,0 +1,121 @@
+// +build !appengine
+
+package cache
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tlsTunnel accepts plain connections on a loopback port, and forwards
+// each of them over a new TLS connection to a memcached server. The
+// gomemcache client dials servers by itself, so TLS is added by pointing
+// it at tunnels instead of the servers. Tunnels live as long as the
+// process, like the clients that use them
+type tlsTunnel struct {
+	listener net.Listener
+	network  string
+	server   string
+	config   *tls.Config
+	dialer   net.Dialer
+}
+
+// newTLSTunnels starts a tunnel for each server, and returns the
+// addresses to connect to instead, in the same order
+func newTLSTunnels(servers []string, tc *tls.Config, timeout time.Duration) ([]net.Addr, error) {
+	tunnels := make([]*tlsTunnel, 0, len(servers))
+	for _, server := range servers {
+		t, err := newTLSTunnel(server, tc, timeout)
+		if err != nil {
+			for _, t := range tunnels {
+				t.listener.Close()
+			}
+			return nil, err
+		}
+		tunnels = append(tunnels, t)
+	}
+
+	addrs := make([]net.Addr, len(tunnels))
+	for i, t := range tunnels {
+		addrs[i] = t.listener.Addr()
+		go t.serve()
+	}
+	return addrs, nil
+}
+
+func newTLSTunnel(server string, tc *tls.Config, timeout time.Duration) (*tlsTunnel, error) {
+	t := &tlsTunnel{
+		network: "tcp",
+		server:  server,
+		config:  tc.Clone(),
+		dialer:  net.Dialer{Timeout: timeout},
+	}
+	if strings.Contains(server, "/") {
+		t.network = "unix"
+	} else if t.config.ServerName == "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, errors.Wrapf(err, `invalid memcached server %s`, server)
+		}
+		t.config.ServerName = host
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to listen for TLS connections to %s`, server)
+	}
+	t.listener = l
+	return t, nil
+}
+
+func (t *tlsTunnel) serve() {
+	for {
+		c, err := t.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		go t.forward(c)
+	}
+}
+
+// forward copies data between c and a new TLS connection to the server,
+// until either side closes. Failures to connect just close c, which the
+// client reports as an error for the request at hand
+func (t *tlsTunnel) forward(c net.Conn) {
+	defer c.Close()
+
+	raw, err := t.dialer.Dial(t.network, t.server)
+	if err != nil {
+		return
+	}
+	sc := tls.Client(raw, t.config)
+	defer sc.Close()
+
+	if t.dialer.Timeout > 0 {
+		sc.SetDeadline(time.Now().Add(t.dialer.Timeout))
+	}
+	if err := sc.Handshake(); err != nil {
+		return
+	}
+	sc.SetDeadline(time.Time{})
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(sc, c)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, sc)
+		done <- struct{}{}
+	}()
+	<-done
+}
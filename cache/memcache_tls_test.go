@@ -0,0 +1,59 @@
+// +build !appengine
+
+package cache
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSTunnel(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			http.Error(w, "not TLS", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("tunneled"))
+	}))
+	defer srv.Close()
+
+	server := strings.TrimPrefix(srv.URL, "https://")
+	addrs, err := newTLSTunnels([]string{server}, &tls.Config{InsecureSkipVerify: true}, time.Second)
+	if !assert.NoError(t, err, "newTLSTunnels should succeed") {
+		return
+	}
+	if !assert.Len(t, addrs, 1, "there should be a tunnel for each server") {
+		return
+	}
+
+	// plain HTTP to the tunnel arrives over TLS
+	res, err := http.Get("http://" + addrs[0].String())
+	if !assert.NoError(t, err, "GET via the tunnel should succeed") {
+		return
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "status should be 200") {
+		return
+	}
+	if !assert.Equal(t, "tunneled", string(body), "body should match") {
+		return
+	}
+
+	// servers that fail verification are not reachable
+	addrs, err = newTLSTunnels([]string{server}, &tls.Config{}, time.Second)
+	if !assert.NoError(t, err, "newTLSTunnels should succeed") {
+		return
+	}
+	_, err = http.Get("http://" + addrs[0].String())
+	if !assert.Error(t, err, "GET via the tunnel should fail verification") {
+		return
+	}
+}
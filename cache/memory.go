@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Memory is a cache that lives in the process memory. It is meant to
+// be used in tests and for local debugging, as it is not shared between
+// sharaq instances
+type Memory struct {
+	mu    sync.Mutex
+	items map[string]memoryItem
+}
+
+type memoryItem struct {
+	value   []byte
+	expires time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		items: make(map[string]memoryItem),
+	}
+}
+
+// lookup must be called while holding the lock
+func (m *Memory) lookup(key string) ([]byte, bool) {
+	it, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	if !it.expires.IsZero() && time.Now().After(it.expires) {
+		delete(m.items, key)
+		return nil, false
+	}
+	return it.value, true
+}
+
+// store must be called while holding the lock
+func (m *Memory) store(key string, value []byte, expires int32) {
+	it := memoryItem{value: value}
+	if expires > 0 {
+		it.expires = time.Now().Add(time.Duration(expires) * time.Second)
+	}
+	m.items[key] = it
+}
+
+func (m *Memory) Get(_ context.Context, key string, value interface{}) error {
+	m.mu.Lock()
+	b, ok := m.lookup(key)
+	m.mu.Unlock()
+	if !ok {
+		return errors.New(`memory: cache miss`)
+	}
+
+	switch value.(type) {
+	case *string:
+		s := value.(*string)
+		*s = string(b)
+	case *[]byte:
+		s := value.(*[]byte)
+		*s = b
+	default:
+		return errors.New(`value must be &string or &[]byte`)
+	}
+
+	return nil
+}
+
+func (m *Memory) Set(_ context.Context, key string, value []byte, expires int32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store(key, value, expires)
+	return nil
+}
+
+func (m *Memory) SetNX(_ context.Context, key string, value []byte, expires int32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lookup(key); ok {
+		return errors.New(`memory: setNX failed`)
+	}
+	m.store(key, value, expires)
+	return nil
+}
+
+func (m *Memory) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.items, key)
+	return nil
+}
@@ -21,7 +21,9 @@ type Redis struct {
 }
 
 type RedisConfig struct {
-	Addr []string
+	Addr     []string
+	Password string // sent with AUTH, for servers that require it
+	DB       int
 }
 
 type RedisOption interface {
@@ -47,6 +49,12 @@ func WithMagic(s string) RedisOption {
 }
 
 func NewRedis(servers []string, options ...RedisOption) *Redis {
+	return NewRedisFromConfig(&RedisConfig{Addr: servers}, options...)
+}
+
+// NewRedisFromConfig creates a redis client for the servers in c
+func NewRedisFromConfig(rc *RedisConfig, options ...RedisOption) *Redis {
+	servers := append([]string(nil), rc.Addr...)
 	sort.Strings(servers)
 
 	addrs := make(map[string]string)
@@ -55,7 +63,9 @@ func NewRedis(servers []string, options ...RedisOption) *Redis {
 	}
 
 	r := redis.NewRing(&redis.RingOptions{
-		Addrs: addrs,
+		Addrs:    addrs,
+		Password: rc.Password,
+		DB:       rc.DB,
 	})
 	c := &Redis{
 		server: r,
@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConfig specifies how to connect to cache servers over TLS
+type TLSConfig struct {
+	CAFile             string // CA used to verify servers. default is the system roots
+	ServerName         string // name used to verify servers. default is the host of each server
+	InsecureSkipVerify bool   // do not verify servers. for testing only
+}
+
+func (c *TLSConfig) config() (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, `failed to read CA file %s`, c.CAFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf(`no certificates found in %s`, c.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	return tc, nil
+}
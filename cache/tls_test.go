@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSConfig(t *testing.T) {
+	c := TLSConfig{CAFile: "/nonexistent/ca.pem"}
+	if _, err := c.config(); !assert.Error(t, err, "missing CA file should be an error") {
+		return
+	}
+
+	f, err := ioutil.TempFile("", "sharaq-ca")
+	if !assert.NoError(t, err, "creating temporary file should succeed") {
+		return
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+
+	c = TLSConfig{CAFile: f.Name()}
+	if _, err := c.config(); !assert.Error(t, err, "CA file without certificates should be an error") {
+		return
+	}
+
+	c = TLSConfig{ServerName: "cache.example.com"}
+	tc, err := c.config()
+	if !assert.NoError(t, err, "config should succeed") {
+		return
+	}
+	if !assert.Equal(t, "cache.example.com", tc.ServerName, "server name should be set") {
+		return
+	}
+}
@@ -0,0 +1,291 @@
+// +build !appengine
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/sharaqtest"
+)
+
+// _bench drives sharaq with synthetic traffic, and reports latency
+// percentiles for the dispatcher and the throughput of transformations.
+//
+// Source images are generated by a fixture origin started by bench
+// itself. When -target is specified, the target instance must be able
+// to reach the origin at -origin-addr. Otherwise, an in-process server
+// with an in-memory backend is used, which measures the transformer
+// without any network or storage overhead
+func _bench(args []string) int {
+	fs := flag.NewFlagSet("sharaq bench", flag.ContinueOnError)
+	cfgfile := fs.String("config", "sharaq.json", "config file to read presets from")
+	target := fs.String("target", "", "base URL of a running sharaq instance. if empty, an in-process server is used")
+	token := fs.String("token", "", "token used to request transformations from -target")
+	originAddr := fs.String("origin-addr", "127.0.0.1:0", "address for the fixture origin to listen on (only used with -target)")
+	sizes := fs.String("sizes", "320x240,1024x768,3000x2000", "comma separated list of source image sizes")
+	format := fs.String("format", "jpeg", "format of source images (jpeg, png, or gif)")
+	duration := fs.Duration("duration", 10*time.Second, "how long to run")
+	concurrency := fs.Int("concurrency", 8, "number of concurrent clients")
+	missRatio := fs.Float64("miss-ratio", 0.1, "ratio of requests that transform a new source image")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	c, err := loadConfig(*cfgfile)
+	if err != nil {
+		log.Debugf(ctx, "Failed to parse '%s': %s", *cfgfile, err)
+		return 1
+	}
+
+	var presets []string
+	for preset := range c.Presets {
+		presets = append(presets, preset)
+	}
+	if len(presets) == 0 {
+		log.Debugf(ctx, "No presets are defined in '%s'", *cfgfile)
+		return 1
+	}
+	sort.Strings(presets)
+
+	b := &bencher{
+		format:    *format,
+		missRatio: *missRatio,
+		presets:   presets,
+		sizes:     strings.Split(*sizes, ","),
+		target:    strings.TrimSuffix(*target, "/"),
+		token:     *token,
+	}
+
+	if b.target == "" {
+		s, err := sharaqtest.NewServer(c)
+		if err != nil {
+			log.Debugf(ctx, "Failed to start in-process server: %s", err)
+			return 1
+		}
+		defer s.Close()
+		b.target = s.URL
+		b.origin = s.Origin.URL
+		b.token = sharaqtest.Token
+	} else {
+		ln, err := net.Listen("tcp", *originAddr)
+		if err != nil {
+			log.Debugf(ctx, "Failed to listen on '%s': %s", *originAddr, err)
+			return 1
+		}
+		defer ln.Close()
+		go http.Serve(ln, sharaqtest.FixtureHandler())
+		b.origin = "http://" + ln.Addr().String()
+	}
+
+	if b.token == "" && b.missRatio > 0 {
+		log.Debugf(ctx, "-token is not specified, transformations will not be measured")
+		b.missRatio = 0
+	}
+
+	if err := b.warmup(); err != nil {
+		log.Debugf(ctx, "Failed to warm up: %s", err)
+		return 1
+	}
+
+	runCtx, runCancel := context.WithTimeout(ctx, *duration)
+	defer runCancel()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.run(runCtx)
+		}()
+	}
+	wg.Wait()
+
+	b.report(os.Stdout, time.Since(start))
+	return 0
+}
+
+type bencher struct {
+	format    string
+	missRatio float64
+	origin    string
+	presets   []string
+	sizes     []string
+	target    string
+	token     string
+
+	mu         sync.Mutex
+	dispatcher benchStats
+	transform  benchStats
+}
+
+type benchStats struct {
+	errors    int
+	latencies []time.Duration
+}
+
+var benchClient = &http.Client{
+	// Backends such as aws reply with redirects, which we do not
+	// want to follow
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (b *bencher) sourceURL(size string, id int64) string {
+	u := fmt.Sprintf("%s/%s.%s", b.origin, size, b.format)
+	if id > 0 {
+		u += fmt.Sprintf("?id=%d", id)
+	}
+	return u
+}
+
+// warmup makes sure that the variants requested by the dispatcher
+// clients exist, so that they measure serving stored variants
+func (b *bencher) warmup() error {
+	for _, size := range b.sizes {
+		if b.token == "" {
+			// Let the dispatcher create the variants
+			for _, preset := range b.presets {
+				if _, err := b.fetch(b.sourceURL(size, 0), preset); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if _, err := b.store(b.sourceURL(size, 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bencher) run(ctx context.Context) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		size := b.sizes[rnd.Intn(len(b.sizes))]
+		if rnd.Float64() < b.missRatio {
+			elapsed, err := b.store(b.sourceURL(size, rnd.Int63()+1))
+			b.record(&b.transform, elapsed, err)
+			continue
+		}
+
+		elapsed, err := b.fetch(b.sourceURL(size, 0), b.presets[rnd.Intn(len(b.presets))])
+		b.record(&b.dispatcher, elapsed, err)
+	}
+}
+
+func (b *bencher) record(st *benchStats, elapsed time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		st.errors++
+		return
+	}
+	st.latencies = append(st.latencies, elapsed)
+}
+
+func (b *bencher) fetch(source, preset string) (time.Duration, error) {
+	u := b.target + "/?" + url.Values{"url": {source}, "preset": {preset}}.Encode()
+	start := time.Now()
+	res, err := benchClient.Get(u)
+	if err != nil {
+		return 0, errors.Wrap(err, `GET request failed`)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	elapsed := time.Since(start)
+
+	if res.StatusCode >= 400 {
+		return 0, errors.Errorf(`GET request returned %d`, res.StatusCode)
+	}
+	return elapsed, nil
+}
+
+func (b *bencher) store(source string) (time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, b.target+"/?"+url.Values{"url": {source}}.Encode(), nil)
+	if err != nil {
+		return 0, errors.Wrap(err, `failed to create request`)
+	}
+	req.Header.Set("Sharaq-Token", b.token)
+
+	start := time.Now()
+	res, err := benchClient.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, `POST request failed`)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	elapsed := time.Since(start)
+
+	if res.StatusCode != http.StatusNoContent {
+		return 0, errors.Errorf(`POST request returned %d`, res.StatusCode)
+	}
+	return elapsed, nil
+}
+
+func (b *bencher) report(dst io.Writer, elapsed time.Duration) {
+	fmt.Fprintf(dst, "duration: %.1fs, presets: %d, sizes: %s\n", elapsed.Seconds(), len(b.presets), strings.Join(b.sizes, ","))
+	b.dispatcher.report(dst, "dispatcher", elapsed, 1)
+	if b.missRatio > 0 {
+		b.transform.report(dst, "transform", elapsed, len(b.presets))
+	}
+}
+
+// report writes a summary of the stats. perRequest is the number of
+// images produced by each request
+func (st *benchStats) report(dst io.Writer, name string, elapsed time.Duration, perRequest int) {
+	n := len(st.latencies)
+	fmt.Fprintf(dst, "%s: %d requests (%.1f/s, %.1f images/s), %d errors\n",
+		name, n, float64(n)/elapsed.Seconds(), float64(n*perRequest)/elapsed.Seconds(), st.errors)
+	if n == 0 {
+		return
+	}
+
+	sort.Sort(durations(st.latencies))
+	fmt.Fprintf(dst, "  p50: %s, p90: %s, p99: %s, max: %s\n",
+		percentile(st.latencies, 50), percentile(st.latencies, 90), percentile(st.latencies, 99), st.latencies[n-1])
+}
+
+type durations []time.Duration
+
+func (l durations) Len() int           { return len(l) }
+func (l durations) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l durations) Less(i, j int) bool { return l[i] < l[j] }
+
+// percentile returns the p-th percentile of the sorted list
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := len(sorted) * p / 100
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
@@ -0,0 +1,152 @@
+// +build !appengine
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/lestrrat-go/sharaq"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/metadata"
+)
+
+// _gc deletes variants whose source URL is no longer live. A source URL
+// is considered gone if it is not listed in the manifest of live URLs,
+// or if the origin responds with 404 or 410 (when -check-origin is
+// given). Variants stored without metadata cannot be attributed to a
+// source URL, and are left alone.
+func _gc(args []string) int {
+	fs := flag.NewFlagSet("sharaq gc", flag.ContinueOnError)
+	cfgfile := fs.String("config", "sharaq.json", "config file")
+	manifest := fs.String("manifest", "", "file containing live source URLs, one per line")
+	checkOrigin := fs.Bool("check-origin", false, "treat source URLs for which the origin responds with 404 or 410 as gone")
+	dryRun := fs.Bool("dry-run", false, "only report orphaned variants, do not delete them")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *manifest == "" && !*checkOrigin {
+		log.Debugf(ctx, "-manifest or -check-origin is required")
+		return 1
+	}
+
+	s, err := loadServer(*cfgfile)
+	if err != nil {
+		log.Debugf(ctx, "Failed to load config '%s': %s", *cfgfile, err)
+		return 1
+	}
+
+	lister, ok := s.Backend().(sharaq.Lister)
+	if !ok {
+		log.Debugf(ctx, "Backend does not support listing variants")
+		return 1
+	}
+
+	var live map[string]struct{}
+	if *manifest != "" {
+		live = make(map[string]struct{})
+		if err := readLines(*manifest, func(l string) { live[l] = struct{}{} }); err != nil {
+			log.Debugf(ctx, "Failed to read manifest '%s': %s", *manifest, err)
+			return 1
+		}
+	}
+
+	var origin *originChecker
+	if *checkOrigin {
+		origin = &originChecker{
+			client: &http.Client{Timeout: 10 * time.Second},
+			gone:   make(map[string]bool),
+		}
+	}
+
+	var scanned, unknown int
+	orphans := make(map[string]struct{})
+	err = lister.List(ctx, func(m *metadata.Metadata) error {
+		scanned++
+		if m.SourceURL == "" {
+			unknown++
+			return nil
+		}
+
+		if _, ok := orphans[m.SourceURL]; ok {
+			return nil
+		}
+
+		if live != nil {
+			if _, ok := live[m.SourceURL]; !ok {
+				orphans[m.SourceURL] = struct{}{}
+				return nil
+			}
+		}
+
+		if origin != nil && origin.isGone(ctx, m.SourceURL) {
+			orphans[m.SourceURL] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Debugf(ctx, "Failed to list variants: %s", err)
+		return 1
+	}
+
+	var deleted, failed int
+	for l := range orphans {
+		fmt.Fprintf(os.Stdout, "ORPHAN %s\n", l)
+		if *dryRun {
+			continue
+		}
+
+		u, err := parseURL(s, l)
+		if err != nil {
+			log.Debugf(ctx, "Invalid url '%s': %s", l, err)
+			failed++
+			continue
+		}
+
+		if err := s.Delete(ctx, u); err != nil {
+			log.Debugf(ctx, "Failed to delete variants of %s: %s", u, err)
+			failed++
+			continue
+		}
+		deleted++
+	}
+
+	fmt.Fprintf(os.Stdout, "scanned: %d, orphaned sources: %d, deleted: %d, no metadata: %d, failed: %d\n", scanned, len(orphans), deleted, unknown, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// originChecker checks whether source URLs still exist at the origin.
+// Only a definitive 404 or 410 counts as gone, so that transient
+// failures never cause variants to be deleted
+type originChecker struct {
+	client *http.Client
+	gone   map[string]bool
+}
+
+func (c *originChecker) isGone(ctx context.Context, u string) bool {
+	if v, ok := c.gone[u]; ok {
+		return v
+	}
+
+	var gone bool
+	res, err := c.client.Head(u)
+	if err != nil {
+		log.Debugf(ctx, "Failed to check %s: %s", u, err)
+	} else {
+		res.Body.Close()
+		gone = res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone
+	}
+	c.gone[u] = gone
+	return gone
+}
@@ -0,0 +1,50 @@
+// +build !appengine
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lestrrat-go/sharaq"
+	"github.com/lestrrat-go/sharaq/internal/log"
+)
+
+// _lifecycle configures the storage to expire variants by itself,
+// according to the TTLs of each preset in the backend configuration
+func _lifecycle(args []string) int {
+	fs := flag.NewFlagSet("sharaq lifecycle", flag.ContinueOnError)
+	cfgfile := fs.String("config", "sharaq.json", "config file")
+	dryRun := fs.Bool("dry-run", false, "only report the rules, do not apply them")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := loadServer(*cfgfile)
+	if err != nil {
+		log.Debugf(ctx, "Failed to load config '%s': %s", *cfgfile, err)
+		return 1
+	}
+
+	lm, ok := s.Backend().(sharaq.LifecycleManager)
+	if !ok {
+		log.Debugf(ctx, "Backend does not support lifecycle rules")
+		return 1
+	}
+
+	rules, err := lm.ApplyLifecycle(ctx, *dryRun)
+	if err != nil {
+		log.Debugf(ctx, "Failed to apply lifecycle rules: %s", err)
+		return 1
+	}
+
+	for _, r := range rules {
+		fmt.Fprintf(os.Stdout, "RULE %s\n", r)
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+// +build !appengine
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq"
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+)
+
+// _migrate copies stored variants from the backend described in one
+// config file to the backend described in another. Since backends store
+// variants under paths derived from the source URL, the list of source
+// URLs to migrate must be provided via a manifest file.
+//
+// URLs whose variants have all been copied and verified are recorded in
+// the checkpoint file, so an interrupted migration can be resumed by
+// running the same command again.
+func _migrate(args []string) int {
+	fs := flag.NewFlagSet("sharaq migrate", flag.ContinueOnError)
+	from := fs.String("config", "sharaq.json", "config file describing the source backend")
+	to := fs.String("to", "", "config file describing the destination backend")
+	manifest := fs.String("manifest", "", "file containing source URLs to migrate, one per line")
+	checkpoint := fs.String("checkpoint", "", "file to record migrated URLs in, so that the migration can be resumed")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *to == "" || *manifest == "" {
+		log.Debugf(ctx, "-to and -manifest are required")
+		return 1
+	}
+
+	src, err := loadServer(*from)
+	if err != nil {
+		log.Debugf(ctx, "Failed to load source config '%s': %s", *from, err)
+		return 1
+	}
+
+	dst, err := loadServer(*to)
+	if err != nil {
+		log.Debugf(ctx, "Failed to load destination config '%s': %s", *to, err)
+		return 1
+	}
+
+	srcStorage, ok := src.Backend().(sharaq.Storage)
+	if !ok {
+		log.Debugf(ctx, "Source backend does not support direct access to variants")
+		return 1
+	}
+	dstStorage, ok := dst.Backend().(sharaq.Storage)
+	if !ok {
+		log.Debugf(ctx, "Destination backend does not support direct access to variants")
+		return 1
+	}
+
+	done := make(map[string]struct{})
+	var ckpt *os.File
+	if *checkpoint != "" {
+		if err := readLines(*checkpoint, func(l string) { done[l] = struct{}{} }); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			log.Debugf(ctx, "Failed to read checkpoint file '%s': %s", *checkpoint, err)
+			return 1
+		}
+
+		ckpt, err = os.OpenFile(*checkpoint, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Debugf(ctx, "Failed to open checkpoint file '%s': %s", *checkpoint, err)
+			return 1
+		}
+		defer ckpt.Close()
+	}
+
+	var migrated, skipped, failed int
+	err = readLines(*manifest, func(l string) {
+		if _, ok := done[l]; ok {
+			skipped++
+			return
+		}
+
+		u, err := parseURL(src, l)
+		if err != nil {
+			log.Debugf(ctx, "Invalid url '%s': %s", l, err)
+			failed++
+			return
+		}
+
+		if err := migrateURL(ctx, srcStorage, dstStorage, u, src.Presets()); err != nil {
+			log.Debugf(ctx, "Failed to migrate %s: %s", u, err)
+			failed++
+			return
+		}
+
+		migrated++
+		if ckpt != nil {
+			fmt.Fprintln(ckpt, l)
+		}
+	})
+	if err != nil {
+		log.Debugf(ctx, "Failed to read manifest '%s': %s", *manifest, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stdout, "migrated: %d, skipped: %d, failed: %d\n", migrated, skipped, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func migrateURL(ctx context.Context, src, dst sharaq.Storage, u *url.URL, presets map[string]string) error {
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	for preset := range presets {
+		buf.Reset()
+		m, err := src.Fetch(ctx, u, preset, buf)
+		if err != nil {
+			if errors.IsTransformationRequired(err) {
+				// Nothing stored for this preset, nothing to migrate
+				log.Debugf(ctx, "No content for %s (%s), skipping", u, preset)
+				continue
+			}
+			return errors.Wrapf(err, `failed to fetch %s (%s) from source`, u, preset)
+		}
+
+		expected := sha256.Sum256(buf.Bytes())
+		if err := dst.Put(ctx, u, preset, buf.Bytes(), m); err != nil {
+			return errors.Wrapf(err, `failed to store %s (%s) in destination`, u, preset)
+		}
+
+		// Read it back to make sure that what we wrote is what we have
+		buf.Reset()
+		if _, err := dst.Fetch(ctx, u, preset, buf); err != nil {
+			return errors.Wrapf(err, `failed to read back %s (%s) from destination`, u, preset)
+		}
+
+		if actual := sha256.Sum256(buf.Bytes()); !bytes.Equal(expected[:], actual[:]) {
+			return errors.Errorf(`checksum mismatch for %s (%s): expected %x, got %x`, u, preset, expected, actual)
+		}
+	}
+	return nil
+}
+
+// readLines calls cb for each non-empty line in the given file
+func readLines(fn string, cb func(string)) error {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return errors.Wrapf(err, `failed to open %s`, fn)
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" {
+			continue
+		}
+		cb(l)
+	}
+	return scanner.Err()
+}
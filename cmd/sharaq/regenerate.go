@@ -0,0 +1,211 @@
+// +build !appengine
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/lestrrat-go/sharaq"
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/metadata"
+)
+
+// _regenerate regenerates the variants of the URLs listed in a manifest
+// file whose stored metadata shows that they were generated with a
+// different preset rule or engine version than the current one.
+//
+// As with migrate, URLs that have been processed are recorded in the
+// checkpoint file, so an interrupted run can be resumed.
+func _regenerate(args []string) int {
+	fs := flag.NewFlagSet("sharaq regenerate", flag.ContinueOnError)
+	cfgfile := fs.String("config", "sharaq.json", "config file")
+	manifest := fs.String("manifest", "", "file containing source URLs to check, one per line")
+	checkpoint := fs.String("checkpoint", "", "file to record processed URLs in, so that the run can be resumed")
+	concurrency := fs.Int("concurrency", 4, "number of URLs to process concurrently")
+	dryRun := fs.Bool("dry-run", false, "only report outdated variants, do not regenerate them")
+	profile := fs.String("profile", "", "only check the presets of this profile")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *manifest == "" {
+		log.Debugf(ctx, "-manifest is required")
+		return 1
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	s, err := loadServer(*cfgfile)
+	if err != nil {
+		log.Debugf(ctx, "Failed to load config '%s': %s", *cfgfile, err)
+		return 1
+	}
+
+	storage, ok := s.Backend().(sharaq.Storage)
+	if !ok {
+		log.Debugf(ctx, "Backend does not support direct access to variants")
+		return 1
+	}
+
+	done := make(map[string]struct{})
+	var ckpt *os.File
+	if *checkpoint != "" {
+		if err := readLines(*checkpoint, func(l string) { done[l] = struct{}{} }); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			log.Debugf(ctx, "Failed to read checkpoint file '%s': %s", *checkpoint, err)
+			return 1
+		}
+
+		ckpt, err = os.OpenFile(*checkpoint, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Debugf(ctx, "Failed to open checkpoint file '%s': %s", *checkpoint, err)
+			return 1
+		}
+		defer ckpt.Close()
+	}
+
+	presets := s.Presets()
+	if *profile != "" {
+		presets, ok = s.ProfilePresets(*profile)
+		if !ok {
+			log.Debugf(ctx, "Profile '%s' is not defined", *profile)
+			return 1
+		}
+	}
+
+	r := &regenerator{
+		dryRun:      *dryRun,
+		presets:     presets,
+		storage:     storage,
+		transformer: s.Transformer(),
+	}
+
+	var mu sync.Mutex
+	var upToDate, regenerated, skipped, failed int
+
+	var wg sync.WaitGroup
+	urls := make(chan string)
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range urls {
+				u, err := parseURL(s, l)
+				if err != nil {
+					log.Debugf(ctx, "Invalid url '%s': %s", l, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+					continue
+				}
+
+				n, err := r.run(ctx, u)
+				mu.Lock()
+				if err != nil {
+					log.Debugf(ctx, "Failed to regenerate %s: %s", u, err)
+					failed++
+				} else {
+					if n == 0 {
+						upToDate++
+					}
+					regenerated += n
+					if ckpt != nil && !r.dryRun {
+						fmt.Fprintln(ckpt, l)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err = readLines(*manifest, func(l string) {
+		if _, ok := done[l]; ok {
+			skipped++
+			return
+		}
+		urls <- l
+	})
+	close(urls)
+	wg.Wait()
+
+	if err != nil {
+		log.Debugf(ctx, "Failed to read manifest '%s': %s", *manifest, err)
+		return 1
+	}
+
+	verb := "regenerated"
+	if *dryRun {
+		verb = "outdated"
+	}
+	fmt.Fprintf(os.Stdout, "%s: %d, up to date: %d, skipped: %d, failed: %d\n", verb, regenerated, upToDate, skipped, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+type regenerator struct {
+	dryRun      bool
+	presets     map[string]string
+	storage     sharaq.Storage
+	transformer *transformer.Transformer
+}
+
+// outdated returns true if the variant described by m was generated
+// with something other than the given rule and the current engine
+func outdated(m *metadata.Metadata, rule string) bool {
+	return m.Rule != rule || m.Engine != transformer.Engine || m.EngineVersion != transformer.EngineVersion
+}
+
+// run regenerates the outdated variants of u, and returns the number
+// of variants that were (or in dry-run mode, would have been) regenerated
+func (r *regenerator) run(ctx context.Context, u *url.URL) (int, error) {
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	var n int
+	for preset, rule := range r.presets {
+		m, err := r.storage.Metadata(ctx, u, preset)
+		if err != nil {
+			if errors.IsTransformationRequired(err) {
+				// Nothing stored, it will be generated on the next request
+				continue
+			}
+			return n, errors.Wrapf(err, `failed to fetch metadata for %s (%s)`, u, preset)
+		}
+
+		if !outdated(m, rule) {
+			continue
+		}
+
+		n++
+		if r.dryRun {
+			fmt.Fprintf(os.Stdout, "OUTDATED %s %s: rule %q, engine %s/%s\n", preset, u, m.Rule, m.Engine, m.EngineVersion)
+			continue
+		}
+
+		buf.Reset()
+		var res transformer.Result
+		res.Content = buf
+		res.Preset = preset
+		if err := r.transformer.Transform(ctx, rule, u.String(), &res); err != nil {
+			return n, errors.Wrapf(err, `failed to transform %s (%s)`, u, preset)
+		}
+
+		if err := r.storage.Put(ctx, u, preset, buf.Bytes(), res.Metadata(u.String(), preset, rule)); err != nil {
+			return n, errors.Wrapf(err, `failed to store %s (%s)`, u, preset)
+		}
+	}
+	return n, nil
+}
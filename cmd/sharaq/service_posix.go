@@ -0,0 +1,16 @@
+// +build !appengine,!windows
+
+package main
+
+import (
+	"context"
+
+	"github.com/lestrrat-go/sharaq/internal/log"
+)
+
+// _service is only available on Windows. Elsewhere, use a process
+// supervisor with `sharaq` itself
+func _service(args []string) int {
+	log.Debugf(context.Background(), "sharaq service is only available on Windows")
+	return 1
+}
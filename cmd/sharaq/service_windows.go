@@ -0,0 +1,97 @@
+// +build !appengine
+
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/lestrrat-go/sharaq"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"golang.org/x/sys/windows/svc"
+)
+
+// _service runs sharaq as a Windows service. Register it with the
+// service control manager, e.g.
+//
+//	sc.exe create sharaq binPath= "C:\sharaq\sharaq.exe service -config C:\sharaq\sharaq.json"
+//
+// Stopping the service shuts the server down, and the "paramchange"
+// control (sc.exe control sharaq paramchange) reloads the config file
+func _service(args []string) int {
+	fs := flag.NewFlagSet("sharaq service", flag.ContinueOnError)
+	cfgfile := fs.String("config", "sharaq.json", "config file")
+	name := fs.String("name", "sharaq", "service name")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx := context.Background()
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		log.Debugf(ctx, "Failed to determine session type: %s", err)
+		return 1
+	}
+	if interactive {
+		log.Debugf(ctx, "sharaq service must be started by the service control manager")
+		return 1
+	}
+
+	if err := svc.Run(*name, &service{cfgfile: *cfgfile}); err != nil {
+		log.Debugf(ctx, "Failed to run service: %s", err)
+		return 1
+	}
+	return 0
+}
+
+type service struct {
+	cfgfile string
+}
+
+func (h *service) Execute(_ []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes <- svc.Status{State: svc.StartPending}
+
+	var config sharaq.Config
+	if err := config.ParseFile(h.cfgfile); err != nil {
+		log.Debugf(ctx, "Failed to parse '%s': %s", h.cfgfile, err)
+		return true, 1
+	}
+
+	s, err := sharaq.NewServer(&config)
+	if err != nil {
+		log.Debugf(ctx, "Failed to instantiate server: %s", err)
+		return true, 1
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	changes <- svc.Status{State: svc.Running, Accepts: accepts}
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Debugf(ctx, "Failed to run server: %s", err)
+				return true, 1
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.ParamChange:
+				s.Reload()
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				cancel()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
@@ -5,25 +5,54 @@ package main
 import (
 	"context"
 	"flag"
+	"net/url"
 	"os"
 
 	"github.com/lestrrat-go/sharaq"
 	"github.com/lestrrat-go/sharaq/internal/log"
 )
 
-const version = "0.0.8"
-
 func main() {
 	os.Exit(_main())
 }
 
 func _main() int {
-	cfgfile := flag.String("config", "sharaq.json", "config file")
-	showVersion := flag.Bool("version", false, "show sharaq version")
-	flag.Parse()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			return _bench(os.Args[2:])
+		case "gc":
+			return _gc(os.Args[2:])
+		case "lifecycle":
+			return _lifecycle(os.Args[2:])
+		case "migrate":
+			return _migrate(os.Args[2:])
+		case "regenerate":
+			return _regenerate(os.Args[2:])
+		case "service":
+			return _service(os.Args[2:])
+		case "transform":
+			return _transform(os.Args[2:])
+		case "validate":
+			return _validate(os.Args[2:])
+		case "verify":
+			return _verify(os.Args[2:])
+		}
+	}
+	return _serve(os.Args[1:])
+}
+
+func _serve(args []string) int {
+	fs := flag.NewFlagSet("sharaq", flag.ContinueOnError)
+	cfgfile := fs.String("config", "sharaq.json", "config file")
+	env := fs.String("env", os.Getenv(sharaq.EnvironmentVariable), "environment whose config overlay is applied")
+	showVersion := fs.Bool("version", false, "show sharaq version")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
 
 	if *showVersion {
-		os.Stdout.WriteString("sharaq version " + version + "\n")
+		os.Stdout.WriteString("sharaq version " + sharaq.Version + "\n")
 		return 0
 	}
 
@@ -31,8 +60,8 @@ func _main() int {
 	defer cancel()
 
 	var config sharaq.Config
-	log.Debugf(ctx, "Using config file %s", *cfgfile)
-	if err := config.ParseFile(*cfgfile); err != nil {
+	log.Debugf(ctx, "Using config file %s (environment '%s')", *cfgfile, *env)
+	if err := config.ParseFileEnv(*cfgfile, *env); err != nil {
 		log.Debugf(ctx, "Failed to parse '%s': %s", *cfgfile, err)
 		return 1
 	}
@@ -50,3 +79,41 @@ func _main() int {
 
 	return 0
 }
+
+func loadConfig(cfgfile string) (*sharaq.Config, error) {
+	var config sharaq.Config
+	if err := config.ParseFile(cfgfile); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// loadServer creates an initialized server from the given config file.
+// This is used by subcommands which need access to the configured
+// backend, but do not actually serve requests
+func loadServer(cfgfile string) (*sharaq.Server, error) {
+	config, err := loadConfig(cfgfile)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := sharaq.NewServer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Initialize(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseURL parses a source URL read from a manifest, and normalizes it
+// the same way the server does, so that it maps to the same variants
+func parseURL(s *sharaq.Server, l string) (*url.URL, error) {
+	u, err := url.Parse(l)
+	if err != nil {
+		return nil, err
+	}
+	return s.NormalizeURL(u), nil
+}
@@ -0,0 +1,87 @@
+// +build !appengine
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+)
+
+// _transform runs the transformer against a local file, without
+// requiring a server or a backend. This allows users to check what
+// a particular rule (or a preset from a config file) will produce.
+//
+// "-" may be used as either file name to denote stdin/stdout
+func _transform(args []string) int {
+	fs := flag.NewFlagSet("sharaq transform", flag.ContinueOnError)
+	rule := fs.String("rule", "", "transformation rule to apply (e.g. 360x216)")
+	preset := fs.String("preset", "", "name of the preset to apply, looked up from -config")
+	cfgfile := fs.String("config", "sharaq.json", "config file (only used with -preset)")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if fs.NArg() != 2 {
+		log.Debugf(ctx, "usage: sharaq transform [-rule RULE | -preset NAME] input output")
+		return 1
+	}
+
+	if *preset != "" {
+		c, err := loadConfig(*cfgfile)
+		if err != nil {
+			log.Debugf(ctx, "Failed to parse '%s': %s", *cfgfile, err)
+			return 1
+		}
+
+		r, ok := c.Presets[*preset]
+		if !ok {
+			log.Debugf(ctx, "Preset '%s' is not defined in '%s'", *preset, *cfgfile)
+			return 1
+		}
+		*rule = r
+	}
+
+	if *rule == "" {
+		log.Debugf(ctx, "one of -rule or -preset must be specified")
+		return 1
+	}
+
+	if err := transformFile(ctx, *rule, fs.Arg(0), fs.Arg(1)); err != nil {
+		log.Debugf(ctx, "Failed to transform '%s': %s", fs.Arg(0), err)
+		return 1
+	}
+	return 0
+}
+
+func transformFile(ctx context.Context, rule, input, output string) error {
+	var src io.Reader = os.Stdin
+	if input != "-" {
+		fh, err := os.Open(input)
+		if err != nil {
+			return errors.Wrapf(err, `failed to open %s`, input)
+		}
+		defer fh.Close()
+		src = fh
+	}
+
+	var dst io.Writer = os.Stdout
+	if output != "-" {
+		fh, err := os.Create(output)
+		if err != nil {
+			return errors.Wrapf(err, `failed to create %s`, output)
+		}
+		defer fh.Close()
+		dst = fh
+	}
+
+	return transformer.New().TransformContent(ctx, rule, dst, src)
+}
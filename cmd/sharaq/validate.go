@@ -0,0 +1,51 @@
+// +build !appengine
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lestrrat-go/sharaq"
+	"github.com/lestrrat-go/sharaq/internal/log"
+)
+
+// _validate checks the config file without starting the server, and
+// reports likely mistakes in the presets as warnings
+func _validate(args []string) int {
+	fs := flag.NewFlagSet("sharaq validate", flag.ContinueOnError)
+	cfgfile := fs.String("config", "sharaq.json", "config file")
+	env := fs.String("env", os.Getenv(sharaq.EnvironmentVariable), "environment whose config overlay is applied")
+	strict := fs.Bool("strict", false, "fail if there are warnings")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var config sharaq.Config
+	if err := config.ParseFileEnv(*cfgfile, *env); err != nil {
+		log.Debugf(ctx, "Failed to parse '%s': %s", *cfgfile, err)
+		return 1
+	}
+
+	// NewServer checks the references between sections of the config
+	if _, err := sharaq.NewServer(&config); err != nil {
+		log.Debugf(ctx, "Invalid config '%s': %s", *cfgfile, err)
+		return 1
+	}
+
+	warnings := config.Lint()
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stdout, "WARNING %s\n", w)
+	}
+	fmt.Fprintf(os.Stdout, "warnings: %d\n", len(warnings))
+
+	if *strict && len(warnings) > 0 {
+		return 1
+	}
+	return 0
+}
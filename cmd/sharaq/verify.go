@@ -0,0 +1,103 @@
+// +build !appengine
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lestrrat-go/sharaq"
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/util"
+)
+
+// _verify checks the stored variants of the URLs listed in the manifest
+// against the checksums that were recorded when they were stored, to
+// detect bit-rot and truncated writes
+func _verify(args []string) int {
+	fs := flag.NewFlagSet("sharaq verify", flag.ContinueOnError)
+	cfgfile := fs.String("config", "sharaq.json", "config file")
+	manifest := fs.String("manifest", "", "file containing source URLs to verify, one per line")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *manifest == "" {
+		log.Debugf(ctx, "-manifest is required")
+		return 1
+	}
+
+	s, err := loadServer(*cfgfile)
+	if err != nil {
+		log.Debugf(ctx, "Failed to load config '%s': %s", *cfgfile, err)
+		return 1
+	}
+
+	storage, ok := s.Backend().(sharaq.Storage)
+	if !ok {
+		log.Debugf(ctx, "Backend does not support direct access to variants")
+		return 1
+	}
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	var verified, missing, unknown, bad int
+	err = readLines(*manifest, func(l string) {
+		u, err := parseURL(s, l)
+		if err != nil {
+			log.Debugf(ctx, "Invalid url '%s': %s", l, err)
+			bad++
+			return
+		}
+
+		for preset := range s.Presets() {
+			m, err := storage.Metadata(ctx, u, preset)
+			if err != nil {
+				missing++
+				continue
+			}
+			expected := m.SHA256
+			if expected == "" {
+				// Stored before checksums were recorded
+				unknown++
+				continue
+			}
+
+			buf.Reset()
+			if _, err := storage.Fetch(ctx, u, preset, buf); err != nil {
+				if errors.IsTransformationRequired(err) {
+					missing++
+					continue
+				}
+				fmt.Fprintf(os.Stdout, "ERROR %s %s: %s\n", preset, u, err)
+				bad++
+				continue
+			}
+
+			if actual := util.Checksum(buf.Bytes()); actual != expected {
+				fmt.Fprintf(os.Stdout, "MISMATCH %s %s: expected %s, got %s\n", preset, u, expected, actual)
+				bad++
+				continue
+			}
+			verified++
+		}
+	})
+	if err != nil {
+		log.Debugf(ctx, "Failed to read manifest '%s': %s", *manifest, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stdout, "ok: %d, missing: %d, no checksum: %d, bad: %d\n", verified, missing, unknown, bad)
+	if bad > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package sharaq
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// Responses that are already compressed, such as images, are never
+// compressed again
+func compressibleType(ct string) bool {
+	if ct == "" {
+		return false
+	}
+	return !strings.HasPrefix(ct, "image/")
+}
+
+// compressRoute returns true if responses for the given path may be
+// compressed
+func (s *Server) compressRoute(path string) bool {
+	cc := s.config.Compression
+	if cc == nil {
+		return false
+	}
+
+	for _, prefix := range cc.Routes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if i := strings.IndexByte(enc, ';'); i >= 0 {
+			if strings.TrimSpace(enc[i+1:]) == "q=0" {
+				continue
+			}
+			enc = enc[:i]
+		}
+		if strings.TrimSpace(enc) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the response if its content type
+// allows it. The decision is made when the header is written. Responses
+// that already have a Content-Length, such as stored variants and
+// ranges of them, are sent as is, so that the length is not lost
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if code != http.StatusNoContent && code != http.StatusNotModified && h.Get("Content-Encoding") == "" && h.Get("Content-Length") == "" && compressibleType(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Close flushes the compressed stream, if any
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
@@ -1,24 +1,65 @@
 package sharaq
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"time"
 
+	"github.com/lestrrat-go/sharaq/internal/accesslog"
+	"github.com/lestrrat-go/sharaq/internal/httputil"
+	"github.com/lestrrat-go/sharaq/internal/kvconfig"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
 	"github.com/lestrrat-go/sharaq/internal/urlcache"
 )
 
+// ParseFile parses the config file f, along with the files that it
+// includes. The environment is taken from $SHARAQ_ENV
 func (c *Config) ParseFile(f string) error {
-	fh, err := os.Open(f)
+	return c.ParseFileEnv(f, os.Getenv(EnvironmentVariable))
+}
+
+// ParseFileEnv is like ParseFile, but if env is non-empty, the overlay
+// for that environment (e.g. sharaq.production.json for sharaq.json)
+// is merged on top of f, if it exists
+func (c *Config) ParseFileEnv(f, env string) error {
+	var files []string
+	m, err := loadConfigFile(f, map[string]bool{}, &files)
+	if err != nil {
+		return err
+	}
+
+	if env != "" {
+		o := overlayFile(f, env)
+		if _, err := os.Stat(o); err == nil {
+			overlay, err := loadConfigFile(o, map[string]bool{}, &files)
+			if err != nil {
+				return err
+			}
+			mergeConfig(m, overlay)
+		} else if os.IsNotExist(err) {
+			// watched, in case it is created later
+			files = append(files, o)
+		} else {
+			return err
+		}
+	}
+
+	buf, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
-	defer fh.Close()
 
 	c.filename = f
-	return c.Parse(fh)
+	c.environment = env
+	c.files = files
+	c.fingerprint, err = configFingerprint(files)
+	if err != nil {
+		return err
+	}
+	return c.Parse(bytes.NewReader(buf))
 }
 
 func (c *Config) Parse(rdr io.Reader) error {
@@ -27,12 +68,320 @@ func (c *Config) Parse(rdr io.Reader) error {
 		return err
 	}
 
-	if len(c.Presets) == 0 {
+	if len(c.Presets) == 0 && len(c.PresetTemplates) == 0 {
 		return fmt.Errorf("error: Presets is empty")
 	}
 
+	if c.AccessLog != nil && !accesslog.ValidFormat(c.AccessLog.Format) {
+		return fmt.Errorf("error: unknown access log format '%s'", c.AccessLog.Format)
+	}
+
+	if !validFallbackPolicy(c.Fallback.Policy) {
+		return fmt.Errorf("error: unknown fallback policy '%s'", c.Fallback.Policy)
+	}
+
+	if !httputil.ValidRedirectStatus(c.Origin.RedirectStatus) {
+		return fmt.Errorf("error: invalid redirect status %d", c.Origin.RedirectStatus)
+	}
+
+	for name, fc := range c.Flags {
+		if fc.Percent < 0 || fc.Percent > 100 {
+			return fmt.Errorf("error: percentage of flag '%s' must be between 0 and 100", name)
+		}
+	}
+
+	if mc := c.Metrics; mc != nil {
+		if mc.QualitySamplePercent < 0 || mc.QualitySamplePercent > 100 {
+			return fmt.Errorf("error: Metrics.QualitySamplePercent must be between 0 and 100")
+		}
+		if mc.QualityBaseline != "" && !transformer.ValidFormat(mc.QualityBaseline) {
+			return fmt.Errorf("error: unknown quality baseline format '%s'", mc.QualityBaseline)
+		}
+	}
+
+	if pc := c.Placeholders; pc != nil && pc.Background != "" && !transformer.ValidColor(pc.Background) {
+		return fmt.Errorf("error: Placeholders.Background must be a color in RRGGBB form")
+	}
+
+	for preset, n := range c.PresetMaxBytes {
+		if n <= 0 {
+			return fmt.Errorf("error: PresetMaxBytes of preset '%s' must be positive", preset)
+		}
+	}
+
+	for preset, oc := range c.TextOverlays {
+		if oc.Font != "" && !transformer.ValidFont(oc.Font) {
+			return fmt.Errorf("error: unknown font '%s' in text overlay of preset '%s'", oc.Font, preset)
+		}
+		if oc.Position != "" && !transformer.ValidTextPosition(oc.Position) {
+			return fmt.Errorf("error: unknown position '%s' in text overlay of preset '%s'", oc.Position, preset)
+		}
+		if oc.Size < 0 {
+			return fmt.Errorf("error: text size of preset '%s' must not be negative", preset)
+		}
+		if (oc.Color != "" && !transformer.ValidColor(oc.Color)) || (oc.Background != "" && !transformer.ValidColor(oc.Background)) {
+			return fmt.Errorf("error: text colors of preset '%s' must be colors in RRGGBB form", preset)
+		}
+	}
+
+	if hc := c.Health; hc != nil && (hc.Interval < 0 || hc.Timeout < 0 || hc.Threshold < 0) {
+		return fmt.Errorf("error: Health.Interval, Health.Timeout and Health.Threshold must not be negative")
+	}
+
+	if bc := c.Budget; bc != nil && (bc.OriginBytesPerHour < 0 || bc.OriginBytesPerDay < 0 || bc.UploadBytesPerHour < 0 || bc.UploadBytesPerDay < 0) {
+		return fmt.Errorf("error: Budget limits must not be negative")
+	}
+
+	if c.Jobs.Parallelism < 0 {
+		return fmt.Errorf("error: Jobs.Parallelism must not be negative")
+	}
+	if c.Jobs.HostRate < 0 {
+		return fmt.Errorf("error: Jobs.HostRate must not be negative")
+	}
+	for host, rate := range c.Jobs.HostRates {
+		if rate < 0 {
+			return fmt.Errorf("error: Jobs.HostRates for %s must not be negative", host)
+		}
+	}
+
+	if tc := c.Throttle; tc != nil && (tc.BatchCPUBudget <= 0 || tc.BatchCPUBudget > 1) {
+		return fmt.Errorf("error: Throttle.BatchCPUBudget must be greater than 0 and at most 1")
+	}
+
+	addrs := make(map[string]struct{})
+	for i := range c.Listeners {
+		lc := &c.Listeners[i]
+		if err := validateListenerConfig(lc); err != nil {
+			return fmt.Errorf("error: %s", err)
+		}
+		if _, ok := addrs[lc.Addr]; ok {
+			return fmt.Errorf("error: duplicate listener address %s", lc.Addr)
+		}
+		addrs[lc.Addr] = struct{}{}
+	}
+
+	for _, lc := range c.listeners() {
+		if lc.TLS != nil && lc.TLS.HTTP3 && !http3Available {
+			return fmt.Errorf("error: listener %s enables HTTP3, but HTTP/3 support is not compiled in (build with -tags quic)", lc.Addr)
+		}
+	}
+
+	if dc := c.Dynamic; dc != nil {
+		if err := kvconfig.Validate(dc); err != nil {
+			return fmt.Errorf("error: invalid Dynamic config: %s", err)
+		}
+	}
+
+	if dc := c.DuplicateIndex; dc != nil {
+		if dc.BucketSize < 0 {
+			return fmt.Errorf("error: DuplicateIndex.BucketSize must not be negative")
+		}
+		if dc.MaxDistance < 0 || dc.MaxDistance > maxDuplicateDistance {
+			return fmt.Errorf("error: DuplicateIndex.MaxDistance must be between 0 and %d", maxDuplicateDistance)
+		}
+	}
+
+	if wc := c.Watch; wc != nil && wc.Interval < 0 {
+		return fmt.Errorf("error: Watch.Interval must not be negative")
+	}
+
+	if c.Upstream != nil {
+		if err := validateUpstreamConfig(c.Upstream); err != nil {
+			return fmt.Errorf("error: %s", err)
+		}
+	}
+
+	if c.Mirror != nil {
+		if err := validateMirrorConfig(c.Mirror); err != nil {
+			return fmt.Errorf("error: %s", err)
+		}
+	}
+
+	if ec := c.Events; ec != nil {
+		switch ec.Type {
+		case "", "webhook", "nats":
+		default:
+			return fmt.Errorf("error: unknown event publisher type '%s'", ec.Type)
+		}
+	}
+
+	c.applyDefaults()
+	return nil
+}
+
+// applyDefaults fills in the default values for parameters that were
+// not specified. Some defaults depend on the platform that we are
+// running on (see config_standalone.go and config_appengine.go).
+//
+// The names of the parameters that were filled in are recorded, so
+// that they can be reported via the admin API
+func (c *Config) applyDefaults() {
+	if c.loadedAt.IsZero() {
+		c.loadedAt = time.Now()
+	}
+
 	if c.Listen == "" {
 		c.Listen = "0.0.0.0:9090"
+		c.markDefault("Listen")
+	}
+
+	if c.Origin.UserAgent == "" {
+		c.Origin.UserAgent = "sharaq/" + Version
+		c.markDefault("Origin.UserAgent")
+	}
+
+	if c.Fallback.Policy == "" {
+		c.Fallback.Policy = FallbackOrigin
+		c.markDefault("Fallback.Policy")
+	}
+	if c.Fallback.RetryAfter <= 0 {
+		c.Fallback.RetryAfter = 30 * time.Second
+		c.markDefault("Fallback.RetryAfter")
+	}
+
+	if mc := c.Mirror; mc != nil {
+		if mc.Timeout <= 0 {
+			mc.Timeout = 5 * time.Second
+			c.markDefault("Mirror.Timeout")
+		}
+		if mc.MaxInFlight <= 0 {
+			mc.MaxInFlight = 100
+			c.markDefault("Mirror.MaxInFlight")
+		}
+	}
+	if uc := c.Upstream; uc != nil && uc.Wait <= 0 {
+		uc.Wait = 10 * time.Second
+		c.markDefault("Upstream.Wait")
+	}
+	if ec := c.Events; ec != nil && ec.MaxInFlight <= 0 {
+		ec.MaxInFlight = 100
+		c.markDefault("Events.MaxInFlight")
+	}
+	if c.Fallback.StaleSize <= 0 {
+		c.Fallback.StaleSize = 10000
+		c.markDefault("Fallback.StaleSize")
+	}
+	if c.Fallback.StaleBytes <= 0 {
+		c.Fallback.StaleBytes = 64 << 20
+		c.markDefault("Fallback.StaleBytes")
+	}
+	if c.Idempotency.Window <= 0 {
+		c.Idempotency.Window = 24 * time.Hour
+		c.markDefault("Idempotency.Window")
+	}
+	if pc := c.Placeholders; pc != nil {
+		if pc.Background == "" {
+			pc.Background = "cccccc"
+			c.markDefault("Placeholders.Background")
+		}
+		if pc.CacheControl == "" {
+			pc.CacheControl = "public, max-age=86400"
+			c.markDefault("Placeholders.CacheControl")
+		}
+	}
+	if hc := c.Health; hc != nil {
+		if hc.Interval == 0 {
+			hc.Interval = 30 * time.Second
+			c.markDefault("Health.Interval")
+		}
+		if hc.Timeout == 0 {
+			hc.Timeout = 10 * time.Second
+			c.markDefault("Health.Timeout")
+		}
+		if hc.Threshold == 0 {
+			hc.Threshold = 2
+			c.markDefault("Health.Threshold")
+		}
+	}
+	if dc := c.Dynamic; dc != nil && dc.Interval == 0 {
+		dc.Interval = kvconfig.DefaultInterval
+		c.markDefault("Dynamic.Interval")
+	}
+	if wc := c.Watch; wc != nil && wc.Interval == 0 {
+		wc.Interval = 10 * time.Second
+		c.markDefault("Watch.Interval")
+	}
+	if dc := c.DuplicateIndex; dc != nil {
+		if dc.TTL == 0 {
+			dc.TTL = 30 * 24 * time.Hour
+			c.markDefault("DuplicateIndex.TTL")
+		}
+		if dc.BucketSize == 0 {
+			dc.BucketSize = 100
+			c.markDefault("DuplicateIndex.BucketSize")
+		}
+		if dc.MaxDistance == 0 {
+			dc.MaxDistance = 5
+			c.markDefault("DuplicateIndex.MaxDistance")
+		}
+	}
+	if rc := c.ReverseIndex; rc != nil && rc.TTL == 0 {
+		rc.TTL = 30 * 24 * time.Hour
+		c.markDefault("ReverseIndex.TTL")
+	}
+	if vc := c.Versioning; vc != nil && vc.CacheControl == "" {
+		vc.CacheControl = "public, max-age=31536000, immutable"
+		c.markDefault("Versioning.CacheControl")
+	}
+	if c.Jobs.HostBurst <= 0 {
+		c.Jobs.HostBurst = 1
+		c.markDefault("Jobs.HostBurst")
+	}
+	if c.Jobs.MaxDelay <= 0 {
+		c.Jobs.MaxDelay = 24 * time.Hour
+		c.markDefault("Jobs.MaxDelay")
+	}
+
+	if cc := c.Compression; cc != nil && len(cc.Routes) == 0 {
+		cc.Routes = []string{"/admin/", "/info", "/sign"}
+		c.markDefault("Compression.Routes")
+	}
+
+	if c.Limits.MaxQuerySize <= 0 {
+		c.Limits.MaxQuerySize = 8 * 1024
+		c.markDefault("Limits.MaxQuerySize")
+	}
+	if c.Limits.MaxBodySize <= 0 {
+		c.Limits.MaxBodySize = 1024 * 1024
+		c.markDefault("Limits.MaxBodySize")
+	}
+	if c.Limits.MaxFormValues <= 0 {
+		c.Limits.MaxFormValues = 100
+		c.markDefault("Limits.MaxFormValues")
+	}
+	if c.Limits.MaxWait <= 0 {
+		c.Limits.MaxWait = 10 * time.Second
+		c.markDefault("Limits.MaxWait")
+	}
+
+	if c.NotFound.TTL <= 0 {
+		c.NotFound.TTL = 10 * time.Minute
+		c.markDefault("NotFound.TTL")
+	}
+
+	if sc := c.Signing; sc != nil {
+		if sc.DefaultTTL <= 0 {
+			sc.DefaultTTL = 24 * time.Hour
+			c.markDefault("Signing.DefaultTTL")
+		}
+		if sc.MaxTTL <= 0 {
+			sc.MaxTTL = 30 * 24 * time.Hour
+			c.markDefault("Signing.MaxTTL")
+		}
+	}
+
+	if c.Original != nil {
+		if _, ok := c.Presets[OriginalPreset]; !ok {
+			var rule string
+			if c.Original.Strip {
+				rule = "strip"
+			}
+			if c.Presets == nil {
+				c.Presets = make(map[string]string)
+			}
+			c.Presets[OriginalPreset] = rule
+			c.markDefault("Presets." + OriginalPreset)
+		}
 	}
 
 	if c.URLCache == nil {
@@ -40,17 +389,25 @@ func (c *Config) Parse(rdr io.Reader) error {
 	}
 
 	if c.URLCache.Type == "" {
-		c.URLCache.Type = "Redis"
+		c.URLCache.Type = defaultURLCacheType
+		c.markDefault("URLCache.Type")
+	}
+
+	if c.Backend.Type == "" && defaultBackendType != "" {
+		c.Backend.Type = defaultBackendType
+		c.markDefault("Backend.Type")
 	}
 
 	switch c.URLCache.Type {
 	case "Redis":
 		if len(c.URLCache.Redis.Addr) < 1 {
 			c.URLCache.Redis.Addr = []string{"127.0.0.1:6379"}
+			c.markDefault("URLCache.Redis.Addr")
 		}
 	case "Memcached":
 		if len(c.URLCache.Memcached.Addr) < 1 {
 			c.URLCache.Memcached.Addr = []string{"127.0.0.1:11211"}
+			c.markDefault("URLCache.Memcached.Addr")
 		}
 	}
 
@@ -58,25 +415,169 @@ func (c *Config) Parse(rdr io.Reader) error {
 	if l := c.Listen; l[0] == ':' {
 		c.Listen = "0.0.0.0" + l
 	}
+	for i := range c.Listeners {
+		if l := c.Listeners[i].Addr; l != "" && l[0] == ':' {
+			c.Listeners[i].Addr = "0.0.0.0" + l
+		}
+	}
 
-	applyLogDefaults := func(c *LogConfig) {
-		if c.RotationTime <= 0 {
+	applyLogDefaults := func(c *Config, lc *LogConfig, name string) {
+		if lc.RotationTime <= 0 {
 			// 1 day
-			c.RotationTime = 24 * time.Hour
+			lc.RotationTime = 24 * time.Hour
+			c.markDefault(name + ".RotationTime")
 		}
-		if c.MaxAge <= 0 {
+		if lc.MaxAge <= 0 {
 			// 30 days
-			c.MaxAge = 30 * 24 * time.Hour
+			lc.MaxAge = 30 * 24 * time.Hour
+			c.markDefault(name + ".MaxAge")
 		}
 	}
 	/*
 		if c.ErrorLog != nil {
-			applyLogDefaults(c.ErrorLog)
+			applyLogDefaults(c, c.ErrorLog, "ErrorLog")
 		}
 	*/
 	if c.AccessLog != nil {
-		applyLogDefaults(c.AccessLog)
+		applyLogDefaults(c, c.AccessLog, "AccessLog")
 	}
+}
 
-	return nil
+// withDefaults returns a copy of c with defaults applied, for functions
+// that must not modify the configuration that they are given. Whatever
+// applyDefaults may change is copied, including the settings that are
+// referred to by pointers
+func (c *Config) withDefaults() *Config {
+	if c == nil {
+		c = &Config{}
+	}
+	cc := *c
+	cc.defaults = append([]string(nil), c.defaults...)
+	cc.Listeners = append([]ListenerConfig(nil), c.Listeners...)
+	if c.Presets != nil {
+		cc.Presets = make(map[string]string, len(c.Presets))
+		for name, rule := range c.Presets {
+			cc.Presets[name] = rule
+		}
+	}
+	if v := c.AccessLog; v != nil {
+		lc := *v
+		cc.AccessLog = &lc
+	}
+	if v := c.Compression; v != nil {
+		vc := *v
+		cc.Compression = &vc
+	}
+	if v := c.DuplicateIndex; v != nil {
+		vc := *v
+		cc.DuplicateIndex = &vc
+	}
+	if v := c.Dynamic; v != nil {
+		vc := *v
+		cc.Dynamic = &vc
+	}
+	if v := c.Events; v != nil {
+		vc := *v
+		cc.Events = &vc
+	}
+	if v := c.Health; v != nil {
+		vc := *v
+		cc.Health = &vc
+	}
+	if v := c.Mirror; v != nil {
+		vc := *v
+		cc.Mirror = &vc
+	}
+	if v := c.Placeholders; v != nil {
+		vc := *v
+		cc.Placeholders = &vc
+	}
+	if v := c.ReverseIndex; v != nil {
+		vc := *v
+		cc.ReverseIndex = &vc
+	}
+	if v := c.Signing; v != nil {
+		vc := *v
+		cc.Signing = &vc
+	}
+	if v := c.Upstream; v != nil {
+		vc := *v
+		cc.Upstream = &vc
+	}
+	if v := c.URLCache; v != nil {
+		vc := *v
+		cc.URLCache = &vc
+	}
+	if v := c.Versioning; v != nil {
+		vc := *v
+		cc.Versioning = &vc
+	}
+	if v := c.Watch; v != nil {
+		vc := *v
+		cc.Watch = &vc
+	}
+	cc.applyDefaults()
+	return &cc
+}
+
+func (c *Config) markDefault(name string) {
+	for _, v := range c.defaults {
+		if v == name {
+			return
+		}
+	}
+	c.defaults = append(c.defaults, name)
+}
+
+// secretKeys lists the names of configuration parameters whose values
+// must never be displayed
+var secretKeys = map[string]struct{}{
+	"AccessKey": {},
+	"DSN":       {},
+	"Key":       {},
+	"Options":   {}, // options of custom URL cache drivers may contain credentials
+	"Password":  {},
+	"Secret":    {}, // used to sign event webhooks
+	"SecretKey": {},
+	"Token":     {}, // NATS authentication token
+	"Tokens":    {},
+	"Users":     {}, // passwords of the basicauth middleware
+}
+
+// redacted returns a generic representation of the configuration, with
+// the values of secret parameters replaced
+func (c *Config) redacted() (map[string]interface{}, error) {
+	j, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(j, &m); err != nil {
+		return nil, err
+	}
+	redactMap(m)
+	return m, nil
+}
+
+func redactMap(m map[string]interface{}) {
+	for k, v := range m {
+		if _, ok := secretKeys[k]; ok {
+			if v != nil && v != "" {
+				m[k] = "(redacted)"
+			}
+			continue
+		}
+
+		switch v := v.(type) {
+		case map[string]interface{}:
+			redactMap(v)
+		case []interface{}:
+			for _, e := range v {
+				if em, ok := e.(map[string]interface{}); ok {
+					redactMap(em)
+				}
+			}
+		}
+	}
 }
@@ -0,0 +1,14 @@
+// +build appengine
+
+package sharaq
+
+// Under appengine, the only sensible choices are Google Storage and
+// the memcache service provided by the platform
+const (
+	defaultBackendType  = "gcp"
+	defaultURLCacheType = "Memcached"
+)
+
+// Dynamic settings are watched by the loop of standalone servers, which
+// does not run under appengine
+const dynamicSupported = false
@@ -0,0 +1,107 @@
+package sharaq
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+)
+
+// includeKey is the top-level key in config files that lists other
+// config files to be loaded first. Paths are relative to the file
+// that includes them
+const includeKey = "Include"
+
+// EnvironmentVariable names the environment variable that selects the
+// overlay loaded by ParseFile
+const EnvironmentVariable = "SHARAQ_ENV"
+
+// overlayFile returns the name of the overlay for environment env:
+// "sharaq.json" becomes "sharaq.production.json"
+func overlayFile(f, env string) string {
+	ext := filepath.Ext(f)
+	return strings.TrimSuffix(f, ext) + "." + env + ext
+}
+
+// loadConfigFile reads the JSON object in f, after merging the files it
+// includes underneath it. seen holds the files currently being loaded,
+// to detect include loops. The names of all files that were read are
+// appended to files
+func loadConfigFile(f string, seen map[string]bool, files *[]string) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to resolve path %s`, f)
+	}
+	if seen[abs] {
+		return nil, errors.Errorf(`include loop detected at %s`, f)
+	}
+	seen[abs] = true
+	defer delete(seen, abs)
+
+	fh, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	*files = append(*files, f)
+
+	// numbers are kept as is, so that large integers such as
+	// durations survive being encoded again
+	dec := json.NewDecoder(fh)
+	dec.UseNumber()
+
+	var m map[string]interface{}
+	if err := dec.Decode(&m); err != nil {
+		return nil, errors.Wrapf(err, `failed to parse %s`, f)
+	}
+
+	v, ok := m[includeKey]
+	if !ok {
+		return m, nil
+	}
+	delete(m, includeKey)
+
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.Errorf(`%s in %s must be a list of file names`, includeKey, f)
+	}
+
+	merged := map[string]interface{}{}
+	for _, item := range list {
+		name, ok := item.(string)
+		if !ok {
+			return nil, errors.Errorf(`%s in %s must be a list of file names`, includeKey, f)
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(f), name)
+		}
+		included, err := loadConfigFile(name, seen, files)
+		if err != nil {
+			return nil, errors.Wrapf(err, `failed to include %s`, name)
+		}
+		mergeConfig(merged, included)
+	}
+	mergeConfig(merged, m)
+	return merged, nil
+}
+
+// mergeConfig merges src into dst. Objects are merged recursively,
+// while any other value in src, including lists, replaces the value
+// in dst
+func mergeConfig(dst, src map[string]interface{}) {
+	for k, v := range src {
+		sv, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		dv, ok := dst[k].(map[string]interface{})
+		if !ok {
+			dv = map[string]interface{}{}
+			dst[k] = dv
+		}
+		mergeConfig(dv, sv)
+	}
+}
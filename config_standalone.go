@@ -0,0 +1,10 @@
+// +build !appengine
+
+package sharaq
+
+const (
+	defaultBackendType  = "" // must be explicitly specified
+	defaultURLCacheType = "Redis"
+)
+
+const dynamicSupported = true
@@ -0,0 +1,59 @@
+package sharaq
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"golang.org/x/net/context"
+)
+
+// configFingerprint returns a checksum of the contents of the given
+// config files. Files that do not exist are part of the checksum as
+// such, so that creating them counts as a change
+func configFingerprint(files []string) (string, error) {
+	h := sha256.New()
+	for _, f := range files {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+		b, err := ioutil.ReadFile(f)
+		switch {
+		case err == nil:
+			h.Write([]byte{1})
+			h.Write(b)
+		case os.IsNotExist(err):
+			h.Write([]byte{0})
+		default:
+			return "", errors.Wrapf(err, `failed to read %s`, f)
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// configChanged returns true if the config files of c have changed
+// since they were loaded, and the new contents are valid. Invalid
+// contents are logged once, and ignored until they change again, so
+// that a broken update does not take down a running server
+func (s *Server) configChanged(ctx context.Context, c *Config) bool {
+	fp, err := configFingerprint(c.files)
+	if err != nil {
+		// files may be briefly unreadable while they are being replaced
+		log.Debugf(ctx, "Failed to check config files: %s", err)
+		return false
+	}
+	if fp == c.fingerprint || fp == s.rejectedConfig {
+		return false
+	}
+
+	var newConfig Config
+	if err := newConfig.ParseFileEnv(c.filename, c.environment); err != nil {
+		log.Debugf(ctx, "Ignoring changes to config file %s: %s", c.filename, err)
+		s.rejectedConfig = fp
+		return false
+	}
+	return true
+}
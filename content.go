@@ -0,0 +1,289 @@
+package sharaq
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/throttle"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/metadata"
+	"golang.org/x/net/context"
+)
+
+// contentSourcePreset is the preset under which contentBackend records
+// the checksum of the source image of each URL. It may not be used as
+// the name of a preset
+const contentSourcePreset = "_source"
+
+// contentBackend stores variants under the checksum of their source
+// image rather than its URL (see BackendConfig.ContentKeys). The
+// checksum of the image last stored for each URL is recorded in the
+// wrapped backend as well, and cached in the URL cache.
+//
+// The same image published under several URLs is transformed and
+// stored once, and an image that changes at the same URL is stored as
+// new variants. Variants that no URL refers to any more are left for
+// the storage to expire
+type contentBackend struct {
+	backend     Backend
+	storage     Storage
+	cache       *urlcache.URLCache
+	transformer *transformer.Transformer
+}
+
+func newContentBackend(b Backend, cache *urlcache.URLCache, t *transformer.Transformer) (*contentBackend, error) {
+	st, ok := b.(Storage)
+	if !ok {
+		return nil, errors.New(`backend does not support direct access to variants`)
+	}
+	return &contentBackend{
+		backend:     b,
+		storage:     st,
+		cache:       cache,
+		transformer: t,
+	}, nil
+}
+
+// validateContentKeys returns an error if c has settings that do not
+// work with BackendConfig.ContentKeys
+func validateContentKeys(c *Config) error {
+	switch {
+	case c.Backend.Previous != nil:
+		return errors.New(`Backend.ContentKeys can not be used with Backend.Previous`)
+	case c.Upstream != nil:
+		return errors.New(`Backend.ContentKeys can not be used with Upstream`)
+	case c.Backend.Type == "fs" && c.Backend.FileSystem.MaxStale > 0:
+		// stale variants are regenerated from their URL
+		return errors.New(`Backend.ContentKeys can not be used with Backend.FileSystem.MaxStale`)
+	}
+	if _, ok := c.Presets[contentSourcePreset]; ok {
+		return errors.Errorf(`preset '%s' is reserved for Backend.ContentKeys`, contentSourcePreset)
+	}
+	if _, ok := c.PresetTemplates[contentSourcePreset]; ok {
+		return errors.Errorf(`preset '%s' is reserved for Backend.ContentKeys`, contentSourcePreset)
+	}
+	return nil
+}
+
+// contentURL returns the URL that the variants of the source image with
+// the given checksum are stored under
+func contentURL(sum string) *url.URL {
+	return &url.URL{Scheme: "sha256", Opaque: sum}
+}
+
+func contentCacheKey(u *url.URL) string {
+	return urlcache.MakeCacheKey("content", u.String())
+}
+
+// source returns the checksum of the source image last stored for u.
+// If there is none, an error for which errors.IsTransformationRequired()
+// returns true is returned
+func (c *contentBackend) source(ctx context.Context, u *url.URL) (string, error) {
+	key := contentCacheKey(u)
+	if sum := c.cache.Lookup(ctx, key); sum != "" {
+		return sum, nil
+	}
+
+	m, err := c.storage.Metadata(ctx, u, contentSourcePreset)
+	if err != nil {
+		return "", err
+	}
+	if m.SourceSHA256 == "" {
+		return "", errors.TransformationRequiredError{}
+	}
+	c.cache.Set(ctx, key, m.SourceSHA256)
+	return m.SourceSHA256, nil
+}
+
+// setSource records sum as the checksum of the source image of u
+func (c *contentBackend) setSource(ctx context.Context, u *url.URL, sum string) error {
+	m := &metadata.Metadata{
+		SourceURL:    u.String(),
+		Preset:       contentSourcePreset,
+		ContentType:  "text/plain",
+		SourceSHA256: sum,
+	}
+	if err := c.storage.Put(ctx, u, contentSourcePreset, []byte(sum), m); err != nil {
+		return errors.Wrapf(err, `failed to record source of %s`, u)
+	}
+	c.cache.Set(ctx, contentCacheKey(u), sum)
+	return nil
+}
+
+func (c *contentBackend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
+	sum, err := c.source(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return c.backend.Get(ctx, contentURL(sum), preset)
+}
+
+// StoreTransformedContent fetches the source image once, and only
+// transforms it for the presets that have not been stored for the same
+// image yet, e.g. under another URL
+func (c *contentBackend) StoreTransformedContent(ctx context.Context, u *url.URL, presets map[string]string) error {
+	src, err := c.transformer.FetchSource(ctx, u.String())
+	if err != nil {
+		return errors.Wrap(err, `failed to fetch source image`)
+	}
+	defer src.Release()
+
+	sum := src.SHA256()
+	cu := contentURL(sum)
+
+	var grp errors.PresetGroup
+	grp.SetLimit(throttle.Parallelism(ctx))
+	for preset, rule := range presets {
+		preset := preset
+		rule := rule
+		grp.Go(preset, func() error {
+			_, err := c.storage.Metadata(ctx, cu, preset)
+			if err == nil {
+				log.Debugf(ctx, "Variant %s of %s is already stored", preset, u)
+				metrics.Count("backend.content.shared", 1, metrics.PresetTag(preset))
+				return nil
+			}
+			if !errors.IsTransformationRequired(err) {
+				return err
+			}
+
+			buf := bbpool.Get()
+			defer bbpool.Release(buf)
+
+			var res transformer.Result
+			res.Content = buf
+			res.Preset = preset
+			if err := src.Transform(ctx, rule, &res); err != nil {
+				return errors.Wrap(err, `failed to transform image`)
+			}
+			return c.storage.Put(ctx, cu, preset, buf.Bytes(), res.Metadata(u.String(), preset, rule))
+		})
+	}
+	err = grp.Wait()
+
+	// Presets that failed are missing for the new image, and are
+	// generated again when they are requested
+	if serr := c.setSource(ctx, u, sum); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// Delete removes the given variants of the image last stored for u,
+// and forgets about u. Other URLs with the same image get the variants
+// generated again when they are requested
+func (c *contentBackend) Delete(ctx context.Context, u *url.URL, presets []string) error {
+	if presets != nil {
+		variants := make([]string, 0, len(presets))
+		for _, preset := range presets {
+			if preset == templateInstancesPreset {
+				if err := c.backend.Delete(ctx, u, []string{preset}); err != nil {
+					return err
+				}
+				continue
+			}
+			variants = append(variants, preset)
+		}
+		if len(variants) == 0 {
+			return nil
+		}
+		presets = variants
+	}
+
+	sum, err := c.source(ctx, u)
+	if err != nil {
+		if errors.IsTransformationRequired(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := c.backend.Delete(ctx, contentURL(sum), presets); err != nil {
+		return err
+	}
+	c.cache.Delete(ctx, contentCacheKey(u))
+	return c.backend.Delete(ctx, u, []string{contentSourcePreset})
+}
+
+// Fetch writes the variant of the image last stored for u to dst
+func (c *contentBackend) Fetch(ctx context.Context, u *url.URL, preset string, dst io.Writer) (*metadata.Metadata, error) {
+	if preset == templateInstancesPreset {
+		return c.storage.Fetch(ctx, u, preset, dst)
+	}
+	sum, err := c.source(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.storage.Fetch(ctx, contentURL(sum), preset, dst)
+	if err != nil {
+		return nil, err
+	}
+	// the variant may have been stored for another URL
+	m.SourceURL = u.String()
+	return m, nil
+}
+
+// Put stores the variant under the checksum of its source image, which
+// must be given in m, and records that checksum for u. The record of
+// the preset template instances of u is stored for u itself, like in
+// Fetch, Metadata and Delete
+func (c *contentBackend) Put(ctx context.Context, u *url.URL, preset string, content []byte, m *metadata.Metadata) error {
+	if preset == templateInstancesPreset {
+		return c.storage.Put(ctx, u, preset, content, m)
+	}
+	if m.SourceSHA256 == "" {
+		return errors.Errorf(`checksum of the source of %s (%s) is unknown`, u, preset)
+	}
+	if err := c.storage.Put(ctx, contentURL(m.SourceSHA256), preset, content, m); err != nil {
+		return err
+	}
+	return c.setSource(ctx, u, m.SourceSHA256)
+}
+
+func (c *contentBackend) Metadata(ctx context.Context, u *url.URL, preset string) (*metadata.Metadata, error) {
+	if preset == templateInstancesPreset {
+		return c.storage.Metadata(ctx, u, preset)
+	}
+	sum, err := c.source(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.storage.Metadata(ctx, contentURL(sum), preset)
+	if err != nil {
+		return nil, err
+	}
+	m.SourceURL = u.String()
+	return m, nil
+}
+
+// List calls fn once for each URL, with the record of the checksum of
+// its source image. This is what `sharaq gc` needs to find the URLs
+// whose source no longer exists
+func (c *contentBackend) List(ctx context.Context, fn func(*metadata.Metadata) error) error {
+	l, ok := c.backend.(Lister)
+	if !ok {
+		return errors.New(`backend does not support listing variants`)
+	}
+	return l.List(ctx, func(m *metadata.Metadata) error {
+		if m.Preset != contentSourcePreset {
+			return nil
+		}
+		return fn(m)
+	})
+}
+
+// ApplyLifecycle configures the wrapped backend. Variants are still
+// stored under their preset, so rules for presets keep working
+func (c *contentBackend) ApplyLifecycle(ctx context.Context, dryRun bool) ([]string, error) {
+	lm, ok := c.backend.(LifecycleManager)
+	if !ok {
+		return nil, errors.New(`backend does not manage the lifecycle of variants`)
+	}
+	return lm.ApplyLifecycle(ctx, dryRun)
+}
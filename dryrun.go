@@ -0,0 +1,91 @@
+package sharaq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/imageinfo"
+	"github.com/lestrrat-go/sharaq/internal/throttle"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"golang.org/x/net/context"
+)
+
+type dryRunResponse struct {
+	URL     string                   `json:"url"`
+	Presets map[string]*dryRunResult `json:"presets"`
+}
+
+type dryRunResult struct {
+	Rule        string  `json:"rule"`
+	ContentType string  `json:"content_type,omitempty"`
+	Size        int64   `json:"size,omitempty"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	Duration    float64 `json:"duration"` // seconds
+	Error       string  `json:"error,omitempty"`
+}
+
+// handleDryRun transforms the source for each preset as a guardian
+// request would, and replies with a report of the results instead of
+// storing them. Presets that fail are reported along with the others
+func (s *Server) handleDryRun(ctx context.Context, w http.ResponseWriter, u *url.URL, presets map[string]string) {
+	presets = s.applyFlags(ctx, presets)
+	if throttle.Parallelism(ctx) == 0 {
+		ctx = throttle.WithParallelism(ctx, s.config.Jobs.Parallelism)
+	}
+
+	resp := dryRunResponse{
+		URL:     u.String(),
+		Presets: make(map[string]*dryRunResult, len(presets)),
+	}
+
+	var mu sync.Mutex
+	var grp errors.PresetGroup
+	grp.SetLimit(throttle.Parallelism(ctx))
+	for preset, rule := range presets {
+		preset := preset
+		rule := rule
+		grp.Go(preset, func() error {
+			result := s.dryRun(ctx, u, rule)
+			mu.Lock()
+			resp.Presets[preset] = result
+			mu.Unlock()
+			return nil
+		})
+	}
+	grp.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// dryRun transforms the source with rule, and describes the result
+func (s *Server) dryRun(ctx context.Context, u *url.URL, rule string) *dryRunResult {
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	result := &dryRunResult{Rule: rule}
+	var res transformer.Result
+	res.Content = buf
+
+	start := time.Now()
+	err := s.transformer.Transform(ctx, rule, u.String(), &res)
+	result.Duration = time.Since(start).Seconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.ContentType = res.ContentType
+	result.Size = int64(buf.Len())
+	if info, err := imageinfo.Inspect(buf.Bytes()); err == nil {
+		result.Width = info.Width
+		result.Height = info.Height
+	}
+	return result
+}
@@ -0,0 +1,253 @@
+package sharaq
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/throttle"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/util"
+	"github.com/lestrrat-go/sharaq/metadata"
+	"golang.org/x/net/context"
+)
+
+// dualBackend is used while migrating from one backend to another.
+// While migration mode is enabled, variants are written to both
+// backends, and reads fall back to the previous backend. Once disabled,
+// only the new backend is used. Migration mode can be toggled at
+// runtime via the admin API.
+//
+// When health checks are enabled and the new backend is unhealthy, the
+// previous backend is used for everything instead (see failOver)
+type dualBackend struct {
+	current     Backend
+	previous    Backend
+	enabled     int32
+	failedOver  int32
+	transformer *transformer.Transformer
+}
+
+func newDualBackend(current, previous Backend, t *transformer.Transformer) *dualBackend {
+	return &dualBackend{
+		current:     current,
+		previous:    previous,
+		enabled:     1,
+		transformer: t,
+	}
+}
+
+func (d *dualBackend) migrating() bool {
+	return atomic.LoadInt32(&d.enabled) == 1
+}
+
+func (d *dualBackend) setMigrating(v bool) {
+	var i int32
+	if v {
+		i = 1
+	}
+	atomic.StoreInt32(&d.enabled, i)
+}
+
+func (d *dualBackend) failingOver() bool {
+	return atomic.LoadInt32(&d.failedOver) == 1
+}
+
+// failOver switches between the new and the previous backend. It
+// returns true if that changed anything
+func (d *dualBackend) failOver(v bool) bool {
+	var i int32
+	if v {
+		i = 1
+	}
+	return atomic.SwapInt32(&d.failedOver, i) != i
+}
+
+// VariantPath returns the path of the variant in the backend that is
+// in use
+func (d *dualBackend) VariantPath(u *url.URL, preset string) string {
+	b := d.current
+	if d.failingOver() {
+		b = d.previous
+	}
+	if loc, ok := b.(Locator); ok {
+		return loc.VariantPath(u, preset)
+	}
+	return ""
+}
+
+func (d *dualBackend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
+	if d.failingOver() {
+		return d.previous.Get(ctx, u, preset)
+	}
+
+	h, err := d.current.Get(ctx, u, preset)
+	if err == nil || !d.migrating() || !errors.IsTransformationRequired(err) {
+		return h, err
+	}
+
+	h, perr := d.previous.Get(ctx, u, preset)
+	if perr != nil {
+		// Report the error from the new backend, so that the variant
+		// gets generated there
+		return nil, err
+	}
+	metrics.Count("backend.previous.hit", 1)
+	log.Debugf(ctx, "Serving %s (%s) from previous backend", u, preset)
+	return h, nil
+}
+
+// StoreTransformedContent writes the variants to both backends while
+// migrating. If both backends allow direct access to variants, each
+// variant is transformed only once
+func (d *dualBackend) StoreTransformedContent(ctx context.Context, u *url.URL, presets map[string]string) error {
+	if d.failingOver() {
+		return d.previous.StoreTransformedContent(ctx, u, presets)
+	}
+	if !d.migrating() {
+		return d.current.StoreTransformedContent(ctx, u, presets)
+	}
+
+	cs, ok1 := d.current.(Storage)
+	ps, ok2 := d.previous.(Storage)
+	if !ok1 || !ok2 {
+		if err := d.current.StoreTransformedContent(ctx, u, presets); err != nil {
+			return err
+		}
+		return errors.Wrap(d.previous.StoreTransformedContent(ctx, u, presets), `failed to store in previous backend`)
+	}
+
+	var grp errors.PresetGroup
+	grp.SetLimit(throttle.Parallelism(ctx))
+	for preset, rule := range presets {
+		preset := preset
+		rule := rule
+		grp.Go(preset, func() error {
+			buf := bbpool.Get()
+			defer bbpool.Release(buf)
+
+			var res transformer.Result
+			res.Content = buf
+			res.Preset = preset
+			if err := d.transformer.Transform(ctx, rule, u.String(), &res); err != nil {
+				return errors.Wrap(err, `failed to transform image`)
+			}
+
+			m := res.Metadata(u.String(), preset, rule)
+			if err := cs.Put(ctx, u, preset, buf.Bytes(), m); err != nil {
+				return err
+			}
+			return errors.Wrap(ps.Put(ctx, u, preset, buf.Bytes(), m), `failed to store in previous backend`)
+		})
+	}
+	return grp.Wait()
+}
+
+func (d *dualBackend) Delete(ctx context.Context, u *url.URL, presets []string) error {
+	if d.failingOver() {
+		return d.previous.Delete(ctx, u, presets)
+	}
+	if err := d.current.Delete(ctx, u, presets); err != nil {
+		return err
+	}
+	if !d.migrating() {
+		return nil
+	}
+	return errors.Wrap(d.previous.Delete(ctx, u, presets), `failed to delete from previous backend`)
+}
+
+// The Storage methods operate on the new backend (or the previous one
+// while failed over), and fall back to the previous backend for reads
+// while migrating
+
+func (d *dualBackend) storage() Backend {
+	if d.failingOver() {
+		return d.previous
+	}
+	return d.current
+}
+
+func (d *dualBackend) Fetch(ctx context.Context, u *url.URL, preset string, dst io.Writer) (*metadata.Metadata, error) {
+	cs, ok := d.storage().(Storage)
+	if !ok {
+		return nil, errors.New(`backend does not support direct access to variants`)
+	}
+
+	m, err := cs.Fetch(ctx, u, preset, dst)
+	if err == nil || !d.migrating() || !errors.IsTransformationRequired(err) {
+		return m, err
+	}
+	if ps, ok := d.previous.(Storage); ok {
+		return ps.Fetch(ctx, u, preset, dst)
+	}
+	return nil, err
+}
+
+func (d *dualBackend) Put(ctx context.Context, u *url.URL, preset string, content []byte, m *metadata.Metadata) error {
+	cs, ok := d.storage().(Storage)
+	if !ok {
+		return errors.New(`backend does not support direct access to variants`)
+	}
+	return cs.Put(ctx, u, preset, content, m)
+}
+
+func (d *dualBackend) Metadata(ctx context.Context, u *url.URL, preset string) (*metadata.Metadata, error) {
+	cs, ok := d.storage().(Storage)
+	if !ok {
+		return nil, errors.New(`backend does not support direct access to variants`)
+	}
+
+	m, err := cs.Metadata(ctx, u, preset)
+	if err == nil || !d.migrating() || !errors.IsTransformationRequired(err) {
+		return m, err
+	}
+	if ps, ok := d.previous.(Storage); ok {
+		return ps.Metadata(ctx, u, preset)
+	}
+	return nil, err
+}
+
+type adminMigrationResponse struct {
+	Configured bool `json:"configured"`
+	Enabled    bool `json:"enabled"`
+	FailedOver bool `json:"failed_over"`
+}
+
+// handleAdminMigration reports and toggles migration mode. POST with
+// enabled=true or enabled=false to toggle it
+func (s *Server) handleAdminMigration(w http.ResponseWriter, r *http.Request) {
+	d, ok := s.backend.(*dualBackend)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !ok {
+			httpError(w, r, "No previous backend configured", http.StatusConflict)
+			return
+		}
+		v, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			httpError(w, r, "Bad value for enabled", http.StatusBadRequest)
+			return
+		}
+		d.setMigrating(v)
+		log.Debugf(util.RequestCtx(r), "Migration mode set to %t", v)
+	default:
+		httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adminMigrationResponse{
+		Configured: ok,
+		Enabled:    ok && d.migrating(),
+		FailedOver: ok && d.failingOver(),
+	})
+}
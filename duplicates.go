@@ -0,0 +1,231 @@
+package sharaq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/phash"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/internal/util"
+	"golang.org/x/net/context"
+)
+
+// The duplicate index finds source images that look alike, by the
+// perceptual hashes that are computed while transforming them. Each
+// hash is split into duplicateBands bands, and the source is listed in
+// the URL cache under each of its bands. Hashes that differ in fewer
+// bits than there are bands have at least one band in common, and
+// those that differ in up to twice as many have a band that differs in
+// at most one bit, so searching a bounded number of buckets is enough
+
+// duplicateBands is the number of bands that hashes are split into
+const duplicateBands = 4
+
+// duplicateBandBits is the number of bits in each band
+const duplicateBandBits = phash.Size / duplicateBands
+
+// maxDuplicateDistance is the largest distance that can be searched
+// for, probing neighbors of each band that differ by up to one bit
+const maxDuplicateDistance = 2*duplicateBands - 1
+
+type duplicateEntry struct {
+	URL            string `json:"url"`
+	PerceptualHash string `json:"phash"`
+	Distance       int    `json:"distance"`
+}
+
+type duplicatesResponse struct {
+	PerceptualHash string           `json:"phash"`
+	Distance       int              `json:"distance"`
+	Matches        []duplicateEntry `json:"matches"`
+}
+
+func duplicateCacheKey(band int, v uint64) string {
+	return urlcache.MakeCacheKey("phash", strconv.Itoa(band), fmt.Sprintf("%04x", v))
+}
+
+// duplicateBand returns the nth band of h
+func duplicateBand(h uint64, n int) uint64 {
+	return (h >> uint(n*duplicateBandBits)) & (1<<duplicateBandBits - 1)
+}
+
+// lookupDuplicateBucket returns the sources listed under the given band
+func (s *Server) lookupDuplicateBucket(ctx context.Context, band int, v uint64) []duplicateEntry {
+	raw := s.cache.Lookup(ctx, duplicateCacheKey(band, v))
+	if raw == "" {
+		return nil
+	}
+	var entries []duplicateEntry
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		log.Debugf(ctx, "Broken duplicate index entry for band %d: %s", band, err)
+		return nil
+	}
+	return entries
+}
+
+// indexDuplicate lists the source u under each band of its perceptual
+// hash, most recent first. Failures are only logged. Concurrent updates
+// from other instances may be lost, which is fine, as the source is
+// indexed again every time it is transformed
+func (s *Server) indexDuplicate(ctx context.Context, u *url.URL, results *variantResults) {
+	dc := s.config.DuplicateIndex
+	if dc == nil || results == nil {
+		return
+	}
+	ph := results.perceptualHash()
+	h, err := phash.Parse(ph)
+	if err != nil {
+		return
+	}
+
+	s.duplicateMu.Lock()
+	defer s.duplicateMu.Unlock()
+
+	for band := 0; band < duplicateBands; band++ {
+		v := duplicateBand(h, band)
+		entries := []duplicateEntry{{URL: u.String(), PerceptualHash: ph}}
+		for _, e := range s.lookupDuplicateBucket(ctx, band, v) {
+			if e.URL != u.String() && len(entries) < dc.BucketSize {
+				entries = append(entries, e)
+			}
+		}
+		b, err := json.Marshal(entries)
+		if err != nil {
+			continue
+		}
+		if err := s.cache.Set(ctx, duplicateCacheKey(band, v), string(b), urlcache.WithExpires(dc.TTL)); err != nil {
+			log.Debugf(ctx, "Failed to index perceptual hash of %s: %s", u, err)
+		}
+	}
+}
+
+// findDuplicates returns the indexed sources whose hashes differ from h
+// in at most distance bits, closest first
+func (s *Server) findDuplicates(ctx context.Context, h uint64, distance int) []duplicateEntry {
+	// hashes within the distance have a band that differs in at most
+	// this many bits
+	radius := distance / duplicateBands
+
+	seen := make(map[string]struct{})
+	matches := []duplicateEntry{}
+	probe := func(band int, v uint64) {
+		for _, e := range s.lookupDuplicateBucket(ctx, band, v) {
+			if _, ok := seen[e.URL]; ok {
+				continue
+			}
+			other, err := phash.Parse(e.PerceptualHash)
+			if err != nil {
+				continue
+			}
+			if d := phash.Distance(h, other); d <= distance {
+				seen[e.URL] = struct{}{}
+				e.Distance = d
+				matches = append(matches, e)
+			}
+		}
+	}
+
+	for band := 0; band < duplicateBands; band++ {
+		v := duplicateBand(h, band)
+		probe(band, v)
+		if radius > 0 {
+			for bit := uint(0); bit < duplicateBandBits; bit++ {
+				probe(band, v^(1<<bit))
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].URL < matches[j].URL
+	})
+	return matches
+}
+
+// sourcePerceptualHash fetches the image at u, and computes its
+// perceptual hash
+func (s *Server) sourcePerceptualHash(ctx context.Context, u *url.URL) (uint64, error) {
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	// An empty rule fetches the image as is
+	res := transformer.Result{Content: buf}
+	if err := s.transformer.Transform(ctx, "", u.String(), &res); err != nil {
+		return 0, errors.Wrap(err, `failed to fetch image`)
+	}
+	m, _, err := image.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return 0, errors.Wrap(err, `failed to decode image`)
+	}
+	return phash.DHash(m), nil
+}
+
+// handleAdminDuplicates replies with the sources that look like the
+// image at the given URL, or the image with the given perceptual hash
+func (s *Server) handleAdminDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dc := s.config.DuplicateIndex
+	if dc == nil {
+		httpError(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	distance := dc.MaxDistance
+	if v := r.FormValue("distance"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 0 || d > maxDuplicateDistance {
+			httpError(w, r, fmt.Sprintf("distance must be between 0 and %d", maxDuplicateDistance), http.StatusBadRequest)
+			return
+		}
+		distance = d
+	}
+
+	ctx := util.RequestCtx(r)
+	var h uint64
+	if v := r.FormValue("phash"); v != "" {
+		var err error
+		h, err = phash.Parse(v)
+		if err != nil {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		u, err := s.getTargetURL(r)
+		if err != nil {
+			httpError(w, r, "phash or url parameter missing", http.StatusBadRequest)
+			return
+		}
+		if !s.allowedTarget(u) {
+			httpError(w, r, "Specified url not allowed", http.StatusForbidden)
+			return
+		}
+		h, err = s.sourcePerceptualHash(ctx, u)
+		if err != nil {
+			log.Debugf(ctx, "failed to compute perceptual hash of %s: %s", u, err)
+			httpError(w, r, "Failed to read image", http.StatusBadGateway)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(duplicatesResponse{
+		PerceptualHash: phash.Format(h),
+		Distance:       distance,
+		Matches:        s.findDuplicates(ctx, h, distance),
+	})
+}
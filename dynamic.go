@@ -0,0 +1,166 @@
+package sharaq
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/kvconfig"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"golang.org/x/net/context"
+)
+
+// dynamicLoadTimeout limits the first read of the dynamic settings, so
+// that an unreachable store does not keep the server from starting
+const dynamicLoadTimeout = 10 * time.Second
+
+// dynamicSettings is the document stored in the key/value store given
+// by Config.Dynamic. Settings that are present replace those in the
+// config file
+type dynamicSettings struct {
+	Presets   map[string]string
+	Whitelist []string
+	Flags     map[string]FlagConfig
+}
+
+func parseDynamicSettings(b []byte) (*dynamicSettings, error) {
+	var d dynamicSettings
+	if len(bytes.TrimSpace(b)) == 0 {
+		return &d, nil
+	}
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, errors.Wrap(err, `failed to parse dynamic settings`)
+	}
+	if d.Presets != nil && len(d.Presets) == 0 {
+		return nil, errors.New(`Presets must not be empty`)
+	}
+	for _, pat := range d.Whitelist {
+		if _, err := regexp.Compile(pat); err != nil {
+			return nil, errors.Wrapf(err, `invalid Whitelist pattern '%s'`, pat)
+		}
+	}
+	for name, fc := range d.Flags {
+		if fc.Percent < 0 || fc.Percent > 100 {
+			return nil, errors.Errorf(`percentage of flag '%s' must be between 0 and 100`, name)
+		}
+	}
+	return &d, nil
+}
+
+// applyTo replaces the settings in c with these
+func (d *dynamicSettings) applyTo(c *Config) {
+	if d.Presets != nil {
+		c.Presets = make(map[string]string, len(d.Presets))
+		for name, rule := range d.Presets {
+			c.Presets[name] = rule
+		}
+	}
+	if d.Whitelist != nil {
+		c.Whitelist = d.Whitelist
+	}
+	if d.Flags != nil {
+		c.Flags = d.Flags
+	}
+	// e.g. the "original" preset
+	c.applyDefaults()
+}
+
+// check returns an error if the settings cannot be applied to c, as
+// NewServer would reject the result. For example, presets that
+// profiles or TextOverlays refer to must not be removed. c is not
+// modified
+func (d *dynamicSettings) check(c *Config) error {
+	cc := c.withDefaults()
+	d.applyTo(cc)
+	return (&Server{config: cc}).configurePresets(cc)
+}
+
+// dynamicConfig holds the settings last read from the key/value store.
+// It survives configuration reloads, so that the settings can be
+// applied on top of the reloaded config file
+type dynamicConfig struct {
+	source kvconfig.Source
+
+	mu       sync.Mutex
+	raw      []byte // as read from the store
+	index    uint64 // modification index of raw
+	settings *dynamicSettings
+}
+
+func newDynamicConfig(kc *kvconfig.Config) (*dynamicConfig, error) {
+	src, err := kvconfig.New(kc)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamicConfig{source: src}, nil
+}
+
+// update records settings read from the store. It returns true if they
+// differ from the current ones. Settings that cannot be parsed, or that
+// cannot be applied to c, are rejected, but their index is recorded, so
+// that they are not read again
+func (d *dynamicConfig) update(raw []byte, index uint64, c *Config) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	changed := index != d.index
+	d.index = index
+	if !changed || bytes.Equal(raw, d.raw) {
+		return false, nil
+	}
+
+	settings, err := parseDynamicSettings(raw)
+	if err != nil {
+		return false, err
+	}
+	if err := settings.check(c); err != nil {
+		return false, err
+	}
+	d.raw = raw
+	d.settings = settings
+	return true, nil
+}
+
+func (d *dynamicConfig) currentIndex() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.index
+}
+
+// apply replaces the settings in c with those read from the store. The
+// config file may have changed since they were read, so they are checked
+// again. If they cannot be applied, c is left as is
+func (d *dynamicConfig) apply(c *Config) error {
+	d.mu.Lock()
+	settings := d.settings
+	d.mu.Unlock()
+	if settings == nil {
+		return nil
+	}
+
+	if err := settings.check(c); err != nil {
+		return err
+	}
+	settings.applyTo(c)
+	return nil
+}
+
+// loadDynamic reads the settings from the key/value store for the first
+// time. If the store cannot be reached, the config file is used as is
+// until the settings can be read
+func (s *Server) loadDynamic(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, dynamicLoadTimeout)
+	defer cancel()
+
+	raw, index, err := s.dynamic.source.Get(ctx, 0)
+	if err != nil {
+		log.Debugf(ctx, "Failed to read dynamic settings: %s", err)
+		return
+	}
+	if _, err := s.dynamic.update(raw, index, s.config); err != nil {
+		log.Debugf(ctx, "Ignoring dynamic settings: %s", err)
+	}
+}
@@ -0,0 +1,192 @@
+package sharaq
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/util"
+	"github.com/lestrrat-go/sharaq/metadata"
+	"golang.org/x/net/context"
+)
+
+// Edge instances do not transform images themselves. Their transformer
+// requests each missing variant from the /variant endpoint of the
+// upstream, which generates and stores it like any other miss, and
+// replies with its content and metadata. The edge then stores the
+// variant in its own backend, so that it is served locally from then on
+
+func validateUpstreamConfig(uc *UpstreamConfig) error {
+	u, err := url.Parse(uc.URL)
+	if err != nil {
+		return errors.Wrap(err, `invalid upstream URL`)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf(`invalid upstream URL %s`, uc.URL)
+	}
+	if uc.Token == "" {
+		return errors.New(`upstream token is required`)
+	}
+	return nil
+}
+
+// newUpstreamFunc returns the function that creates requests to the
+// /variant endpoint of the upstream
+func newUpstreamFunc(uc *UpstreamConfig) (transformer.UpstreamFunc, error) {
+	if err := validateUpstreamConfig(uc); err != nil {
+		return nil, err
+	}
+	base, _ := url.Parse(uc.URL)
+	endpoint := base.ResolveReference(&url.URL{Path: "variant"})
+	wait := uc.Wait.String()
+	token := uc.Token
+
+	return func(preset, u string) (*http.Request, error) {
+		ep := *endpoint
+		ep.RawQuery = url.Values{
+			"url":    {u},
+			"preset": {preset},
+			"wait":   {wait},
+		}.Encode()
+		req, err := http.NewRequest(http.MethodGet, ep.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Sharaq-Token", token)
+		return req, nil
+	}, nil
+}
+
+// handleVariant replies with the content of the variant for the given
+// url and preset, and its metadata as headers. Missing variants are
+// generated, waiting up to the given duration for them
+func (s *Server) handleVariant(w http.ResponseWriter, r *http.Request) {
+	if !s.guardianAccess.allowed(r) || !s.authorized(r) {
+		httpError(w, r, `not authorized`, http.StatusForbidden)
+		return
+	}
+
+	storage, ok := s.backend.(Storage)
+	if !ok {
+		httpError(w, r, "Backend does not support reading variants", http.StatusNotImplemented)
+		return
+	}
+
+	ctx := util.RequestCtx(r)
+	u, err := s.getTargetURL(r)
+	if err != nil {
+		log.Debugf(ctx, "Bad url: %s", err)
+		httpError(w, r, "Bad url", http.StatusBadRequest)
+		return
+	}
+
+	preset, err := util.GetPresetFromRequest(r)
+	if err != nil {
+		httpError(w, r, "Bad preset", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.checkRequest(u, preset); err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+
+	wait, err := s.waitDuration(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	tag := metrics.PresetTag(preset)
+	metrics.Count("upstream.requests", 1, tag)
+	m, err := storage.Fetch(ctx, u, preset, buf)
+	if errors.IsTransformationRequired(err) {
+		if s.serveNotFound(ctx, w, r, u) {
+			return
+		}
+		metrics.Count("upstream.miss", 1, tag)
+		buf.Reset()
+		m, err = s.generateVariant(ctx, r, storage, u, preset, buf, wait)
+	}
+
+	if err != nil {
+		if !errors.IsTransformationRequired(err) {
+			log.Debugf(ctx, "failed to read variant %s (%s): %s", u, preset, err)
+			httpError(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		// The source may have turned out not to exist in the meantime
+		if s.serveNotFound(ctx, w, r, u) {
+			return
+		}
+		metrics.Count("upstream.unavailable", 1, tag)
+		httpError(w, r, "Variant is not available yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	m.SetHeader(w.Header())
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// generateVariant triggers the generation of the variant, and waits up
+// to d for it to be stored, writing its content to buf. It returns
+// errors.TransformationRequiredError if the variant is not ready in time
+func (s *Server) generateVariant(ctx context.Context, r *http.Request, storage Storage, u *url.URL, preset string, buf *bytes.Buffer, d time.Duration) (*metadata.Metadata, error) {
+	if s.readOnly.on() {
+		log.Debugf(ctx, "Read-only mode, not generating %s (%s)", u, preset)
+		return nil, errors.TransformationRequiredError{}
+	}
+	if over, _ := s.budget.exceeded(); over {
+		log.Debugf(ctx, "Byte budget exceeded, not generating %s (%s)", u, preset)
+		return nil, errors.TransformationRequiredError{}
+	}
+
+	done, err := s.deferedTransformAndStore(s.withFlags(ctx, r, u), u, s.presetsToGenerate(u, preset))
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to transform content`)
+	}
+	if d <= 0 {
+		return nil, errors.TransformationRequiredError{}
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	var poll <-chan time.Time
+	if done == nil {
+		ticker := time.NewTicker(waitPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			done = nil
+		case <-poll:
+		case <-timer.C:
+			return nil, errors.TransformationRequiredError{}
+		case <-ctx.Done():
+			return nil, errors.TransformationRequiredError{}
+		}
+
+		buf.Reset()
+		m, err := storage.Fetch(ctx, u, preset, buf)
+		if err == nil || !errors.IsTransformationRequired(err) || poll == nil {
+			// either we got it, or we are not getting it
+			return m, err
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package sharaq
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/requestid"
+)
+
+// Kinds of errors returned by sharaq. Errors are wrapped with these, so
+// use IsError to find out the kind of an error instead of comparing
+// error messages
+var (
+	// ErrSourceNotAllowed is returned when the source URL is not
+	// allowed by the whitelist, or when the preset may not be applied
+	// to the source URL
+	ErrSourceNotAllowed = errors.ErrSourceNotAllowed
+
+	// ErrPresetUnknown is returned when the requested preset is not
+	// defined in the configuration
+	ErrPresetUnknown = errors.ErrPresetUnknown
+
+	// ErrSourceNotFound is returned when the origin replied with 404
+	// or 410 for the source image
+	ErrSourceNotFound = errors.ErrSourceNotFound
+
+	// ErrSourceTooLarge is returned when the source image exceeds
+	// Origin.MaxSize
+	ErrSourceTooLarge = errors.ErrSourceTooLarge
+
+	// ErrTransformFailed is returned when the source image could not be
+	// fetched or transformed
+	ErrTransformFailed = errors.ErrTransformFailed
+
+	// ErrStorage is returned when the backend storage failed
+	ErrStorage = errors.ErrStorage
+)
+
+// IsError returns true if err, or any error that it wraps, is of the
+// given kind. Errors also implement Unwrap, so errors.Is from the
+// standard library works as well
+func IsError(err, kind error) bool {
+	return errors.IsKind(err, kind)
+}
+
+// FailedPresets returns the presets that failed to be stored, along
+// with their errors, if err reports a partial failure. The variants for
+// the other presets were stored
+func FailedPresets(err error) (map[string]error, bool) {
+	pe, ok := errors.GetPresetErrors(err)
+	return pe, ok
+}
+
+// errorStatus returns the HTTP status code used to report err
+func errorStatus(err error) int {
+	switch {
+	case IsError(err, ErrSourceNotAllowed):
+		return http.StatusForbidden
+	case IsError(err, ErrPresetUnknown):
+		return http.StatusBadRequest
+	case IsError(err, ErrSourceNotFound):
+		return http.StatusNotFound
+	case IsError(err, ErrSourceTooLarge):
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errorResponse is the body of error responses sent to clients that
+// accept JSON
+type errorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// httpError replies with the given message and status. Clients that
+// send "Accept: application/json" get an errorResponse, and others get
+// plain text as with http.Error
+func httpError(w http.ResponseWriter, r *http.Request, msg string, status int) {
+	if !acceptsJSON(r) {
+		http.Error(w, msg, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{
+		Code:      errorCode(status),
+		Message:   msg,
+		RequestID: requestid.Get(r.Context()),
+	})
+}
+
+// errorCode returns a machine readable name for the status, such as
+// "not_found"
+func errorCode(status int) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		case r == ' ' || r == '-':
+			return '_'
+		}
+		return -1
+	}, http.StatusText(status))
+}
+
+// acceptsJSON returns true if the Accept header of r lists JSON
+func acceptsJSON(r *http.Request) bool {
+	return accepts(r, "application/json")
+}
+
+// accepts returns true if the Accept header of r explicitly lists the
+// media type mediaType. Wildcards are not considered
+func accepts(r *http.Request, mediaType string) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil || mt != mediaType {
+			continue
+		}
+		if params["q"] == "0" {
+			continue
+		}
+		return true
+	}
+	return false
+}
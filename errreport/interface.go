@@ -0,0 +1,47 @@
+package errreport
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+// Kinds of errors that are reported
+const (
+	KindTransform = "transform"
+	KindStorage   = "storage"
+	KindPanic     = "panic"
+	KindBudget    = "budget" // a byte budget was exceeded. see sharaq.BudgetConfig
+)
+
+// Event describes an error that sharaq could not handle on its own
+type Event struct {
+	Kind    string
+	Err     error
+	Request *http.Request     // the request that triggered the error. may be nil
+	Extra   map[string]string // additional context, such as the source url and preset
+}
+
+// Reporter is the interface for error reporting hooks. Report must not
+// block for extended periods of time, as it may be called from within
+// request handlers
+type Reporter interface {
+	Report(context.Context, *Event)
+}
+
+// ReporterFunc allows regular functions to be used as a Reporter
+type ReporterFunc func(context.Context, *Event)
+
+func (f ReporterFunc) Report(ctx context.Context, ev *Event) {
+	f(ctx, ev)
+}
+
+type Config struct {
+	Type   string // "sentry"
+	Sentry SentryConfig
+}
+
+type SentryConfig struct {
+	DSN         string
+	Environment string
+}
@@ -0,0 +1,61 @@
+package errreport_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/errreport"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestSentry(t *testing.T) {
+	type received struct {
+		path string
+		auth string
+		body map[string]interface{}
+	}
+	ch := make(chan received, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v received
+		v.path = r.URL.Path
+		v.auth = r.Header.Get("X-Sentry-Auth")
+		json.NewDecoder(r.Body).Decode(&v.body)
+		ch <- v
+	}))
+	defer srv.Close()
+
+	dsn := strings.Replace(srv.URL, "http://", "http://public:secret@", 1) + "/42"
+	r, err := errreport.NewSentry(&errreport.SentryConfig{DSN: dsn})
+	if !assert.NoError(t, err, "NewSentry should succeed") {
+		return
+	}
+
+	req := httptest.NewRequest("GET", "/?url=http://example.com/a.jpg&preset=small", nil)
+	req.Header.Set("User-Agent", "sharaq-test")
+	req.Header.Set("Sharaq-Token", "do-not-leak")
+	r.Report(context.Background(), &errreport.Event{
+		Kind:    errreport.KindTransform,
+		Err:     errors.New("boom"),
+		Request: req,
+		Extra:   map[string]string{"url": "http://example.com/a.jpg"},
+	})
+
+	select {
+	case v := <-ch:
+		assert.Equal(t, "/api/42/store/", v.path, "store path should match")
+		assert.True(t, strings.Contains(v.auth, "sentry_key=public"), "auth header should contain public key")
+		assert.Equal(t, "boom", v.body["message"], "message should match")
+		assert.Equal(t, "transform", v.body["tags"].(map[string]interface{})["kind"], "kind should be tagged")
+		headers := v.body["request"].(map[string]interface{})["headers"].(map[string]interface{})
+		_, leaked := headers["Sharaq-Token"]
+		assert.False(t, leaked, "tokens should not be sent")
+	case <-time.After(5 * time.Second):
+		t.Errorf("timed out waiting for sentry request")
+	}
+}
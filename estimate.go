@@ -0,0 +1,104 @@
+package sharaq
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/util"
+)
+
+type estimateSource struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+}
+
+type estimateResponse struct {
+	URL     string         `json:"url"`
+	Preset  string         `json:"preset"`
+	Width   int            `json:"width"`
+	Height  int            `json:"height"`
+	Format  string         `json:"format"`
+	Size    int64          `json:"size"`
+	Basis   string         `json:"basis"`
+	Samples int64          `json:"samples"`
+	Source  estimateSource `json:"source"`
+}
+
+// handleEstimate replies with the estimated dimensions and size of a
+// variant, without generating it. Only the headers of the source image
+// are read
+func (s *Server) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	ctx := util.RequestCtx(r)
+
+	u, err := s.getTargetURL(r)
+	if err != nil {
+		log.Debugf(ctx, "Bad url: %s", err)
+		httpError(w, r, "Bad url", http.StatusBadRequest)
+		return
+	}
+
+	preset, err := util.GetPresetFromRequest(r)
+	if err != nil {
+		log.Debugf(ctx, "Bad preset: %s", err)
+		httpError(w, r, "Bad preset", http.StatusBadRequest)
+		return
+	}
+	if s.isTextVariant(preset) {
+		log.Debugf(ctx, "Rejecting request: text variant '%s' requested by name", preset)
+		httpError(w, r, "Bad preset", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.checkRequest(u, preset); err != nil {
+		log.Debugf(ctx, "Rejecting request: %s", err)
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+
+	if err := s.verifySignature(r, preset); err != nil {
+		log.Debugf(ctx, "Rejecting request: %s", err)
+		httpError(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !s.allowedInternal(r, preset) {
+		log.Debugf(ctx, "Rejecting request: preset '%s' is internal", preset)
+		httpError(w, r, "preset '"+preset+"' is not available", http.StatusForbidden)
+		return
+	}
+
+	rule, _ := s.lookupPreset(preset)
+	est, err := s.transformer.Estimate(ctx, rule, u.String())
+	if err != nil {
+		log.Debugf(ctx, "failed to estimate %s (%s): %s", u, preset, err)
+		if IsError(err, ErrSourceNotFound) || IsError(err, ErrSourceTooLarge) {
+			httpError(w, r, err.Error(), errorStatus(err))
+			return
+		}
+		httpError(w, r, "Failed to read image", http.StatusBadGateway)
+		return
+	}
+	metrics.Count("estimate", 1, metrics.PresetTag(preset), "basis:"+est.Basis)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(estimateResponse{
+		URL:     u.String(),
+		Preset:  preset,
+		Width:   est.Width,
+		Height:  est.Height,
+		Format:  est.Format,
+		Size:    est.Size,
+		Basis:   est.Basis,
+		Samples: est.Samples,
+		Source: estimateSource{
+			Width:  est.SourceWidth,
+			Height: est.SourceHeight,
+			Format: est.SourceFormat,
+			Size:   est.SourceSize,
+		},
+	})
+}
@@ -0,0 +1,186 @@
+package sharaq
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/events"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/requestid"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"golang.org/x/net/context"
+)
+
+// eventTimeout limits the delivery of each event
+const eventTimeout = 10 * time.Second
+
+func newEventPublisher(ec *events.Config) (events.Publisher, error) {
+	switch ec.Type {
+	case "webhook":
+		p, err := events.NewWebhook(&ec.Webhook)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to create webhook publisher`)
+		}
+		return p, nil
+	case "nats":
+		p, err := events.NewNATS(&ec.NATS)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to create NATS publisher`)
+		}
+		return p, nil
+	default:
+		return nil, errors.Errorf(`invalid event publisher type %s`, ec.Type)
+	}
+}
+
+func (s *Server) initEventPublisher() error {
+	s.configPublisher = nil
+	s.eventSem = nil
+
+	maxInFlight := 100
+	if ec := s.config.Events; ec != nil {
+		maxInFlight = ec.MaxInFlight
+		if ec.Type != "" {
+			p, err := newEventPublisher(ec)
+			if err != nil {
+				return err
+			}
+			s.configPublisher = p
+		}
+	}
+	if s.configPublisher != nil || s.eventPublisher != nil {
+		s.eventSem = make(chan struct{}, maxInFlight)
+	}
+	return nil
+}
+
+// SetEventPublisher sets a custom publisher that is notified of every
+// variant that is stored or deleted, such as one that sends them to
+// Kafka. It is called in addition to the publisher specified in the
+// configuration, if any. It must be called before Initialize
+func (s *Server) SetEventPublisher(p events.Publisher) {
+	s.eventPublisher = p
+}
+
+// publishing reports whether events are published at all
+func (s *Server) publishing() bool {
+	return s.eventSem != nil
+}
+
+// variantResults collects the sizes of the variants that a backend
+// generates, and the perceptual hash of their source, via
+// transformer.WithObserver
+type variantResults struct {
+	mu    sync.Mutex
+	sizes map[string]int64
+	phash string
+}
+
+func (v *variantResults) observe(res *transformer.Result, _ time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.sizes[res.Preset] = res.Size
+	if res.PerceptualHash != "" {
+		v.phash = res.PerceptualHash
+	}
+}
+
+func (v *variantResults) size(preset string) int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.sizes[preset]
+}
+
+func (v *variantResults) perceptualHash() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.phash
+}
+
+// observeVariants returns a context that records the results of the
+// transformations done with it, for events, the upload budget, and the
+// duplicate index. It returns nil results if none of them need them
+func (s *Server) observeVariants(ctx context.Context) (context.Context, *variantResults) {
+	if !s.publishing() && s.config.Budget == nil && s.config.DuplicateIndex == nil {
+		return ctx, nil
+	}
+	v := &variantResults{sizes: make(map[string]int64)}
+	return transformer.WithObserver(ctx, func(res *transformer.Result, elapsed time.Duration) {
+		v.observe(res, elapsed)
+		s.budget.add(budgetUpload, res.Size)
+	}), v
+}
+
+// publishTransformed publishes a "transform" event for each preset
+func (s *Server) publishTransformed(ctx context.Context, u *url.URL, presets map[string]string, results *variantResults, elapsed time.Duration) {
+	if !s.publishing() {
+		return
+	}
+	now := time.Now().UTC()
+	for preset := range presets {
+		ev := &events.Event{
+			Type:      events.TypeTransform,
+			Time:      now,
+			URL:       u.String(),
+			Preset:    preset,
+			Duration:  elapsed,
+			RequestID: requestid.Get(ctx),
+		}
+		if results != nil {
+			ev.Bytes = results.size(preset)
+		}
+		s.publish(ctx, ev)
+	}
+}
+
+// publishDeleted publishes a "delete" event for each of the variants
+// that were deleted, as listed by variantsToDelete
+func (s *Server) publishDeleted(ctx context.Context, u *url.URL, variants []string, elapsed time.Duration) {
+	if !s.publishing() {
+		return
+	}
+	now := time.Now().UTC()
+	for _, preset := range variants {
+		s.publish(ctx, &events.Event{
+			Type:      events.TypeDelete,
+			Time:      now,
+			URL:       u.String(),
+			Preset:    preset,
+			Duration:  elapsed,
+			RequestID: requestid.Get(ctx),
+		})
+	}
+}
+
+// publish sends ev to the publishers in the background. It never
+// blocks: events are dropped if too many are already in flight
+func (s *Server) publish(ctx context.Context, ev *events.Event) {
+	select {
+	case s.eventSem <- struct{}{}:
+	default:
+		metrics.Count("events.dropped", 1)
+		return
+	}
+
+	publishers := []events.Publisher{s.configPublisher, s.eventPublisher}
+	go func() {
+		defer func() { <-s.eventSem }()
+
+		bg, cancel := context.WithTimeout(requestid.With(context.Background(), ev.RequestID), eventTimeout)
+		defer cancel()
+		for _, p := range publishers {
+			if p == nil {
+				continue
+			}
+			if err := p.Publish(bg, ev); err != nil {
+				log.Debugf(bg, "Failed to publish %s event for %s (%s): %s", ev.Type, ev.URL, ev.Preset, err)
+				metrics.Count("events.errors", 1)
+				continue
+			}
+			metrics.Count("events.sent", 1)
+		}
+	}()
+}
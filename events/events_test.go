@@ -0,0 +1,115 @@
+package events_test
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/events"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestWebhook(t *testing.T) {
+	type received struct {
+		sig  string
+		body []byte
+	}
+	ch := make(chan received, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ch <- received{sig: r.Header.Get(events.SignatureHeader), body: body}
+	}))
+	defer srv.Close()
+
+	p, err := events.NewWebhook(&events.WebhookConfig{URL: srv.URL, Secret: "s3cr3t"})
+	if !assert.NoError(t, err, "NewWebhook should succeed") {
+		return
+	}
+
+	ev := events.Event{Type: events.TypeTransform, URL: "http://example.com/a.jpg", Preset: "small", Bytes: 1234}
+	if !assert.NoError(t, p.Publish(context.Background(), &ev), "Publish should succeed") {
+		return
+	}
+
+	v := <-ch
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write(v.body)
+	if !assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), v.sig, "body should be signed") {
+		return
+	}
+	var got events.Event
+	if !assert.NoError(t, json.Unmarshal(v.body, &got), "body should be JSON") {
+		return
+	}
+	if !assert.Equal(t, ev, got, "event should be sent as is") {
+		return
+	}
+}
+
+func TestNATS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, "net.Listen should succeed") {
+		return
+	}
+	defer ln.Close()
+
+	lines := make(chan string, 3)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+		rdr := bufio.NewReader(conn)
+		for i := 0; i < 3; i++ {
+			line, err := rdr.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- strings.TrimSpace(line)
+		}
+	}()
+
+	p, err := events.NewNATS(&events.NATSConfig{Addr: ln.Addr().String()})
+	if !assert.NoError(t, err, "NewNATS should succeed") {
+		return
+	}
+	ev := events.Event{Type: events.TypeDelete, URL: "http://example.com/a.jpg", Preset: "small"}
+	if !assert.NoError(t, p.Publish(context.Background(), &ev), "Publish should succeed") {
+		return
+	}
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Errorf("server did not receive the event")
+			return
+		}
+	}
+
+	body, _ := json.Marshal(ev)
+	if !assert.True(t, strings.HasPrefix(got[0], "CONNECT "), "client should send CONNECT") {
+		return
+	}
+	if !assert.Equal(t, "PUB sharaq.events "+strconv.Itoa(len(body)), got[1], "client should publish to the default subject") {
+		return
+	}
+	if !assert.Equal(t, string(body), got[2], "event should be published as JSON") {
+		return
+	}
+}
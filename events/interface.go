@@ -0,0 +1,58 @@
+package events
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Types of events that are published
+const (
+	TypeTransform = "transform"
+	TypeDelete    = "delete"
+)
+
+// Event describes a variant that was stored or deleted
+type Event struct {
+	Type      string        `json:"type"`
+	Time      time.Time     `json:"time"`
+	URL       string        `json:"url"`
+	Preset    string        `json:"preset"`
+	Bytes     int64         `json:"bytes,omitempty"`       // size of the variant. only for "transform"
+	Duration  time.Duration `json:"duration_ns,omitempty"` // time it took to transform or delete
+	RequestID string        `json:"request_id,omitempty"`
+}
+
+// Publisher is the interface for event sinks. Publish is called from
+// background goroutines, and may block while the event is delivered
+type Publisher interface {
+	Publish(context.Context, *Event) error
+}
+
+// PublisherFunc allows regular functions to be used as a Publisher
+type PublisherFunc func(context.Context, *Event) error
+
+func (f PublisherFunc) Publish(ctx context.Context, ev *Event) error {
+	return f(ctx, ev)
+}
+
+type Config struct {
+	Type        string // "webhook" or "nats"
+	Webhook     WebhookConfig
+	NATS        NATSConfig
+	MaxInFlight int // events beyond this many in flight are dropped. default is 100
+}
+
+type WebhookConfig struct {
+	URL     string
+	Timeout time.Duration // default is 5 seconds
+	// Secret, if specified, is used to sign the body of each request
+	// with HMAC-SHA256, which is sent as X-Sharaq-Signature
+	Secret string
+}
+
+type NATSConfig struct {
+	Addr    string // host:port of the NATS server
+	Subject string // default is "sharaq.events"
+	Token   string // authentication token, if the server requires one
+}
@@ -0,0 +1,138 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// NATS is a Publisher that publishes each event as JSON to a subject
+// of a NATS server. Only the parts of the protocol that are needed to
+// publish are implemented. The connection is established on first use,
+// and re-established after errors
+type NATS struct {
+	addr    string
+	subject string
+	token   string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewNATS creates a new NATS publisher
+func NewNATS(c *NATSConfig) (*NATS, error) {
+	if c.Addr == "" {
+		return nil, errors.New(`NATS address is required`)
+	}
+	subject := c.Subject
+	if subject == "" {
+		subject = "sharaq.events"
+	}
+	if strings.ContainsAny(subject, " \t\r\n") {
+		return nil, errors.Errorf(`invalid NATS subject '%s'`, subject)
+	}
+	return &NATS{
+		addr:    c.Addr,
+		subject: subject,
+		token:   c.Token,
+	}, nil
+}
+
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+func (n *NATS) Publish(ctx context.Context, ev *Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Wrap(err, `failed to encode event`)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	msg := make([]byte, 0, len(body)+len(n.subject)+32)
+	msg = append(msg, "PUB "+n.subject+" "+strconv.Itoa(len(body))+"\r\n"...)
+	msg = append(msg, body...)
+	msg = append(msg, "\r\n"...)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		n.conn.SetWriteDeadline(deadline)
+	} else {
+		n.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	}
+	if _, err := n.conn.Write(msg); err != nil {
+		n.conn.Close()
+		n.conn = nil
+		return errors.Wrap(err, `failed to publish to NATS`)
+	}
+	return nil
+}
+
+// connect reads the INFO sent by the server, and replies with CONNECT.
+// Must be called with n.mu held
+func (n *NATS) connect(ctx context.Context) error {
+	d := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", n.addr)
+	if err != nil {
+		return errors.Wrap(err, `failed to connect to NATS`)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rdr := bufio.NewReader(conn)
+	line, err := rdr.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return errors.Errorf(`unexpected greeting from NATS server: %q`, line)
+	}
+
+	connect, _ := json.Marshal(natsConnect{Name: "sharaq", AuthToken: n.token})
+	if _, err := conn.Write([]byte("CONNECT " + string(connect) + "\r\n")); err != nil {
+		conn.Close()
+		return errors.Wrap(err, `failed to send CONNECT to NATS`)
+	}
+	conn.SetDeadline(time.Time{})
+
+	n.conn = conn
+	go n.pong(conn, rdr)
+	return nil
+}
+
+// pong answers the PINGs that the server sends to check that we are
+// alive. Everything else (such as -ERR) is ignored. It returns when
+// the connection is closed
+func (n *NATS) pong(conn net.Conn, rdr *bufio.Reader) {
+	for {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			n.mu.Lock()
+			if n.conn == conn {
+				n.conn.Close()
+				n.conn = nil
+			}
+			n.mu.Unlock()
+			return
+		}
+		if strings.TrimSpace(line) == "PING" {
+			n.mu.Lock()
+			conn.Write([]byte("PONG\r\n"))
+			n.mu.Unlock()
+		}
+	}
+}
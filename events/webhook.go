@@ -0,0 +1,79 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// SignatureHeader carries the hex encoded HMAC-SHA256 of the body of
+// webhook requests, if WebhookConfig.Secret is specified
+const SignatureHeader = "X-Sharaq-Signature"
+
+// Webhook is a Publisher that POSTs each event as JSON to a URL
+type Webhook struct {
+	client *http.Client
+	secret []byte
+	url    string
+}
+
+// NewWebhook creates a new Webhook publisher
+func NewWebhook(c *WebhookConfig) (*Webhook, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to parse webhook URL`)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf(`invalid webhook URL %s`, c.URL)
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &Webhook{
+		client: &http.Client{Timeout: timeout},
+		secret: []byte(c.Secret),
+		url:    c.URL,
+	}, nil
+}
+
+func (w *Webhook) Publish(ctx context.Context, ev *Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Wrap(err, `failed to encode event`)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, `failed to create webhook request`)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, `failed to send webhook request`)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf(`webhook responded with status %d`, res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package sharaq
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/httputil"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/internal/util"
+	"golang.org/x/net/context"
+)
+
+// Fallback policies, applied when the backend storage cannot be reached
+const (
+	FallbackOrigin      = "origin"      // redirect to the original image
+	FallbackStale       = "stale"       // serve the last known variant, or the original image
+	FallbackUnavailable = "unavailable" // reply with 503 and Retry-After
+)
+
+func validFallbackPolicy(s string) bool {
+	switch s {
+	case "", FallbackOrigin, FallbackStale, FallbackUnavailable:
+		return true
+	}
+	return false
+}
+
+// serveFallback replies to a request that could not be served because
+// the backend storage was unavailable, according to the configured
+// policy. Unlike a cache miss, no transformation is triggered, as we
+// would not be able to store the result anyway
+func (s *Server) serveFallback(w http.ResponseWriter, r *http.Request, u *url.URL, preset string) {
+	ctx := util.RequestCtx(r)
+	policy := s.config.Fallback.Policy
+
+	switch policy {
+	case FallbackUnavailable:
+		metrics.Count("dispatcher.degraded", 1, "policy:"+policy)
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.config.Fallback.RetryAfter.Seconds())))
+		httpError(w, r, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	case FallbackStale:
+		if h := s.stale.get(preset, u.String()); h != nil {
+			log.Debugf(ctx, "Serving stale content for %s (%s)", u, preset)
+			metrics.Count("dispatcher.degraded", 1, "policy:"+policy)
+			h.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	// Serve the original file, just so that we don't return an error
+	metrics.Count("dispatcher.degraded", 1, "policy:"+FallbackOrigin)
+	log.Debugf(ctx, "Fallback to serving original content at %s", u)
+	s.originRedirect().To(u.String()).ServeHTTP(w, r)
+}
+
+// originRedirect specifies how clients are redirected to source images
+func (s *Server) originRedirect() httputil.Redirect {
+	oc := s.config.Origin
+	return httputil.Redirect{Status: oc.RedirectStatus, CacheControl: oc.RedirectCacheControl}
+}
+
+// staleFetchTimeout limits the background fetches of variants that the
+// backend serves by redirecting to the storage
+const staleFetchTimeout = 30 * time.Second
+
+// staleMaxFetches is the number of such fetches that may run at once.
+// Variants that are hit while as many are running are not remembered
+// until they are hit again
+const staleMaxFetches = 4
+
+// serveAndRemember serves a variant that the backend returned, and keeps
+// a copy of it for the "stale" policy. Variants that the backend serves
+// by itself are copied as they are written. Redirects to the storage
+// carry no content, so those variants are fetched from the backend in
+// the background instead
+func (s *Server) serveAndRemember(w http.ResponseWriter, r *http.Request, u *url.URL, preset string, content http.Handler) {
+	key := urlcache.MakeCacheKey(preset, u.String())
+	if s.stale == nil || s.stale.touch(key) {
+		content.ServeHTTP(w, r)
+		return
+	}
+
+	if httputil.IsRedirect(content) {
+		content.ServeHTTP(w, r)
+		s.fetchStale(u, preset, key)
+		return
+	}
+
+	// Only complete responses can be served again
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" {
+		content.ServeHTTP(w, r)
+		return
+	}
+
+	rec := &staleRecorder{ResponseWriter: w, status: http.StatusOK}
+	rec.buf.max = s.stale.maxBytes
+	content.ServeHTTP(rec, r)
+	if rec.status != http.StatusOK || rec.buf.overflow {
+		return
+	}
+	modTime, _ := http.ParseTime(w.Header().Get("Last-Modified"))
+	s.stale.add(&staleEntry{
+		key:         key,
+		content:     rec.buf.Bytes(),
+		contentType: w.Header().Get("Content-Type"),
+		modTime:     modTime,
+	})
+}
+
+// fetchStale fetches the variant from the backend in the background,
+// and keeps a copy of it. Nothing happens if the backend does not allow
+// direct access to its variants (see Storage)
+func (s *Server) fetchStale(u *url.URL, preset, key string) {
+	st, ok := s.backend.(Storage)
+	c := s.stale
+	if !ok || !c.startFetch(key) {
+		return
+	}
+
+	go func() {
+		defer c.finishFetch(key)
+		// The request may be over by the time this runs
+		ctx, cancel := context.WithTimeout(context.Background(), staleFetchTimeout)
+		defer cancel()
+		defer s.recoverBackground(ctx, u)
+
+		buf := limitedBuffer{max: c.maxBytes}
+		m, err := st.Fetch(ctx, u, preset, &buf)
+		if err != nil {
+			if !buf.overflow {
+				log.Debugf(ctx, "Failed to fetch %s (%s) for the stale cache: %s", u, preset, err)
+			}
+			return
+		}
+		c.add(&staleEntry{
+			key:         key,
+			content:     buf.Bytes(),
+			contentType: m.ContentType,
+			modTime:     m.CreatedAt,
+		})
+	}()
+}
+
+// staleRecorder copies the response written through it, as long as it
+// fits in buf
+type staleRecorder struct {
+	http.ResponseWriter
+	status int
+	buf    limitedBuffer
+}
+
+func (w *staleRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *staleRecorder) Write(b []byte) (int, error) {
+	w.buf.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// errStaleTooLarge is returned by limitedBuffer once it is full
+var errStaleTooLarge = errors.New(`variant is too large for the stale cache`)
+
+// limitedBuffer holds at most max bytes. Writes beyond that fail, and
+// the content is discarded. It does not embed bytes.Buffer, so that
+// io.Copy cannot bypass the limit via ReadFrom
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.overflow || int64(b.buf.Len()+len(p)) > b.max {
+		b.overflow = true
+		b.buf.Reset()
+		return 0, errStaleTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// staleEntry is a copy of a variant, which is served without going
+// through the backend
+type staleEntry struct {
+	key         string
+	content     []byte
+	contentType string
+	modTime     time.Time
+}
+
+func (e *staleEntry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if e.contentType != "" {
+		w.Header().Set("Content-Type", e.contentType)
+	}
+	w.Header().Set("X-Sharaq-Stale", "true")
+	w.Header().Set("Warning", `110 sharaq "Response is Stale"`)
+	http.ServeContent(w, r, "", e.modTime, bytes.NewReader(e.content))
+}
+
+// staleCache keeps copies of recently served variants. Entries are
+// evicted in LRU order when there are more than maxEntries of them, or
+// when their total size exceeds maxBytes. All methods are no-ops on a
+// nil staleCache
+type staleCache struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	size       int64
+	maxEntries int
+	maxBytes   int64
+	fetching   map[string]struct{} // keys of the variants being fetched
+}
+
+func newStaleCache(maxEntries int, maxBytes int64) *staleCache {
+	return &staleCache{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		fetching:   make(map[string]struct{}),
+	}
+}
+
+func (c *staleCache) get(preset, u string) http.Handler {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[urlcache.MakeCacheKey(preset, u)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*staleEntry)
+}
+
+// touch returns true if there is a copy of the variant, and marks it
+// as recently used
+func (c *staleCache) touch(key string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	return ok
+}
+
+func (c *staleCache) delete(preset, u string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[urlcache.MakeCacheKey(preset, u)]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *staleCache) add(entry *staleEntry) {
+	if c == nil || int64(len(entry.content)) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[entry.key]; ok {
+		c.remove(e)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += int64(len(entry.content))
+	for c.size > c.maxBytes || len(c.entries) > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *staleCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*staleEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.content))
+}
+
+// startFetch returns true if the variant may be fetched. finishFetch
+// must be called once it is done
+func (c *staleCache) startFetch(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.fetching[key]; ok || len(c.fetching) >= staleMaxFetches {
+		return false
+	}
+	c.fetching[key] = struct{}{}
+	return true
+}
+
+func (c *staleCache) finishFetch(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.fetching, key)
+}
@@ -0,0 +1,100 @@
+package sharaq
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq/internal/crc64"
+	"github.com/lestrrat-go/sharaq/internal/flags"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"golang.org/x/net/context"
+)
+
+// flagsHeader lists flags to enable ("name") or disable ("-name") for
+// a request, regardless of their percentage. It is only honored for
+// authorized requests
+const flagsHeader = "X-Sharaq-Flags"
+
+// enabledFlags returns the sorted names of the flags enabled for
+// transformations of u triggered by r.
+//
+// Flags are enabled for a stable portion of source URLs, so that all
+// variants of a source are generated with the same settings, and
+// regenerating them does not flip between settings
+func (s *Server) enabledFlags(r *http.Request, u *url.URL) []string {
+	if len(s.config.Flags) == 0 {
+		return nil
+	}
+
+	forced := make(map[string]bool)
+	if s.authorized(r) {
+		for _, v := range strings.Split(r.Header.Get(flagsHeader), ",") {
+			v = strings.TrimSpace(v)
+			if strings.HasPrefix(v, "-") {
+				forced[v[1:]] = false
+			} else if v != "" {
+				forced[v] = true
+			}
+		}
+	}
+
+	var names []string
+	for name, fc := range s.config.Flags {
+		enabled, ok := forced[name]
+		if !ok {
+			enabled = float64(crc64.Sum(name, u.String())%10000) < fc.Percent*100
+		}
+		if enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// withFlags returns a context that carries the flags enabled for r
+func (s *Server) withFlags(ctx context.Context, r *http.Request, u *url.URL) context.Context {
+	names := s.enabledFlags(r, u)
+	if len(names) == 0 {
+		return ctx
+	}
+	log.Debugf(ctx, "Flags enabled for %s: %s", u, strings.Join(names, ","))
+	return flags.With(ctx, names)
+}
+
+// applyFlags returns the presets with the rules of the flags enabled in
+// ctx appended. Later options in a rule override earlier ones, so flags
+// can change options that presets already specify
+func (s *Server) applyFlags(ctx context.Context, presets map[string]string) map[string]string {
+	names := flags.Get(ctx)
+	if len(names) == 0 {
+		return presets
+	}
+
+	applied := make(map[string]string, len(presets))
+	for preset, rule := range presets {
+		for _, name := range names {
+			fc := s.config.Flags[name]
+			if fc.Rule == "" || !fc.appliesTo(preset) {
+				continue
+			}
+			rule += "," + fc.Rule
+		}
+		applied[preset] = rule
+	}
+	return applied
+}
+
+func (fc FlagConfig) appliesTo(preset string) bool {
+	if len(fc.Presets) == 0 {
+		return preset != OriginalPreset
+	}
+	for _, p := range fc.Presets {
+		if p == preset {
+			return true
+		}
+	}
+	return false
+}
@@ -1,28 +1,37 @@
 package fs
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/sync/errgroup"
 
-	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/accesslog"
 	"github.com/lestrrat-go/sharaq/internal/errors"
 	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/throttle"
 	"github.com/lestrrat-go/sharaq/internal/transformer"
 	"github.com/lestrrat-go/sharaq/internal/urlcache"
 	"github.com/lestrrat-go/sharaq/internal/util"
+	"github.com/lestrrat-go/sharaq/metadata"
 )
 
 type Backend struct {
 	root        string
 	cache       *urlcache.URLCache
+	paths       util.PathScheme
 	imageTTL    time.Duration
+	maxStale    time.Duration
+	presetTTLs  map[string]time.Duration
 	presets     map[string]string
 	transformer *transformer.Transformer
 }
@@ -32,89 +41,228 @@ func NewBackend(c *Config, cache *urlcache.URLCache, trans *transformer.Transfor
 	if root == "" {
 		return nil, errors.New("fs backend: 'Root' is required")
 	}
+	paths := util.PathScheme{
+		Hash:        c.Paths.Hash,
+		IncludeHost: c.Paths.IncludeHost,
+		Filename:    c.Paths.Filename,
+	}
+	if err := paths.Validate(); err != nil {
+		return nil, errors.Wrap(err, `fs backend: invalid 'Paths'`)
+	}
 	log.Debugf(context.Background(), "Backend: storing files under %s", root)
 	return &Backend{
 		root:        root,
+		paths:       paths,
 		cache:       cache,
 		imageTTL:    c.ImageTTL,
+		maxStale:    c.MaxStale,
+		presetTTLs:  c.PresetTTLs,
 		presets:     presets,
 		transformer: trans,
 	}, nil
 }
 
-func (f *Backend) EncodeFilename(preset string, urlstr string) string {
+// EncodeFilename returns the path of the file that the variant of
+// urlstr for preset is stored in. Source URLs are under the control of
+// clients, so paths that would end up outside of the storage root are
+// rejected
+func (f *Backend) EncodeFilename(preset string, urlstr string) (string, error) {
 	// we are not going to be storing the requested path directly...
 	// need to encode it
-	return filepath.Join(f.root, util.HashedPath(preset, urlstr))
+	p := filepath.Join(f.root, f.paths.Path(preset, urlstr))
+	rel, err := filepath.Rel(f.root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf(`path of %s (%s) is outside of the storage root`, urlstr, preset)
+	}
+	return p, nil
+}
+
+// VariantPath returns the path of the variant relative to the storage
+// root
+func (f *Backend) VariantPath(u *url.URL, preset string) string {
+	return filepath.ToSlash(f.paths.Path(preset, u.String()))
 }
 
 type fileServer string
 
 func (s fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Debugf(util.RequestCtx(r), "Serving file %s", s)
+	ctx := util.RequestCtx(r)
+	log.Debugf(ctx, "Serving file %s", s)
+
+	// Stored files have no extension, so use the content type that was
+	// recorded when the file was stored, instead of letting ServeFile
+	// guess. Files stored by older versions fall back to sniffing
+	if m, err := readMetadata(string(s)); err != nil {
+		log.Debugf(ctx, "Failed to read metadata for %s: %s", s, err)
+	} else if m.ContentType != "" {
+		w.Header().Set("Content-Type", m.ContentType)
+	}
 	http.ServeFile(w, r, string(s))
 }
 
+// staleFileServer serves a file that is older than ImageTTL, and tells
+// the client about it
+type staleFileServer string
+
+func (s staleFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Sharaq-Stale", "true")
+	w.Header().Set("Warning", `110 sharaq "Response is Stale"`)
+	fileServer(s).ServeHTTP(w, r)
+}
+
+// lookupState is what lookup found out about a stored variant
+type lookupState int
+
+const (
+	stateMiss     lookupState = iota // no file, so the variant must be generated
+	stateCacheHit                    // the URL cache knew the file, and it exists
+	stateDiskHit                     // the file exists, but the URL cache did not know it
+	stateStale                       // the file exists, but is older than its TTL
+)
+
 func (f *Backend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
-	cacheKey := urlcache.MakeCacheKey("fs", preset, u.String())
-	if cachedFile := f.cache.Lookup(ctx, cacheKey); cachedFile != "" {
-		log.Debugf(ctx, "Cached entry found for %s:%s -> %s", preset, u.String(), cachedFile)
-		return fileServer(cachedFile), nil
+	path, state, err := f.lookup(ctx, u, preset)
+	if err != nil {
+		return nil, err
 	}
 
-	path := f.EncodeFilename(preset, u.String())
-	if _, err := os.Stat(path); err == nil {
-		// HIT. Serve this guy after filling the cache
+	switch state {
+	case stateStale:
+		if util.IsReadOnly(ctx) {
+			log.Debugf(ctx, "File %s is stale, but not regenerated in read-only mode", path)
+			return staleFileServer(path), nil
+		}
+		log.Debugf(ctx, "File %s is stale, regenerating in the background", path)
+		go f.revalidate(ctx, u, preset)
+		return staleFileServer(path), nil
+	case stateDiskHit:
+		// Let the next request skip the lookup on disk
+		f.setCache(ctx, u, preset, path)
 		return fileServer(path), nil
+	case stateCacheHit:
+		return fileServer(path), nil
+	default:
+		return nil, errors.TransformationRequiredError{}
 	}
+}
+
+// lookup finds the file that the variant is stored in. Files that the
+// URL cache knows about are checked as well, so that a file that was
+// removed behind our back is regenerated instead of served as a 404
+func (f *Backend) lookup(ctx context.Context, u *url.URL, preset string) (string, lookupState, error) {
+	cacheKey := urlcache.MakeCacheKey("fs", preset, u.String())
+	entry := accesslog.FromContext(ctx)
 
-	return nil, errors.TransformationRequiredError{}
+	path := f.cache.Lookup(ctx, cacheKey)
+	cached := path != ""
+	if cached {
+		entry.SetCache(accesslog.CacheHit)
+		log.Debugf(ctx, "Cached entry found for %s:%s -> %s", preset, u.String(), path)
+	} else {
+		entry.SetCache(accesslog.CacheMiss)
+		var err error
+		path, err = f.EncodeFilename(preset, u.String())
+		if err != nil {
+			return "", stateMiss, err
+		}
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", stateMiss, errors.StorageUnavailableError{Err: err}
+		}
+		if cached {
+			log.Debugf(ctx, "Cached file %s does not exist", path)
+			f.cache.Delete(ctx, cacheKey)
+		}
+		return path, stateMiss, nil
+	}
+
+	switch {
+	case f.staleWhileRevalidate(preset) && time.Since(fi.ModTime()) > f.ttl(preset):
+		return path, stateStale, nil
+	case cached:
+		return path, stateCacheHit, nil
+	default:
+		return path, stateDiskHit, nil
+	}
 }
 
-func (f *Backend) StoreTransformedContent(ctx context.Context, u *url.URL) error {
+// ttl returns how long variants of the preset are fresh. 0 means forever
+func (f *Backend) ttl(preset string) time.Duration {
+	if ttl, ok := f.presetTTLs[preset]; ok {
+		return ttl
+	}
+	return f.imageTTL
+}
+
+func (f *Backend) staleWhileRevalidate(preset string) bool {
+	return f.ttl(preset) > 0 && f.maxStale > 0
+}
+
+// revalidate regenerates a stale variant. Only one instance regenerates
+// a given variant at a time
+func (f *Backend) revalidate(ctx context.Context, u *url.URL, preset string) {
+	rule, ok := f.presets[preset]
+	if !ok {
+		return
+	}
+
+	// The request may be over by the time this runs, so don't use its
+	// context for anything but logging
+	bg := context.Background()
+	lockKey := urlcache.MakeCacheKey("fs-revalidate", preset, u.String())
+	if err := f.cache.SetNX(bg, lockKey, "1", urlcache.WithExpires(time.Minute)); err != nil {
+		return
+	}
+	defer f.cache.Delete(bg, lockKey)
+
+	if err := f.StoreTransformedContent(bg, u, map[string]string{preset: rule}); err != nil {
+		log.Debugf(ctx, "Failed to regenerate %s (%s): %s", u, preset, err)
+	}
+}
+
+func (f *Backend) StoreTransformedContent(ctx context.Context, u *url.URL, presets map[string]string) error {
 	log.Debugf(ctx, "Backend: transforming image at url %s", u)
 
-	var grp *errgroup.Group
-	grp, ctx = errgroup.WithContext(ctx)
+	var grp errors.PresetGroup
+	grp.SetLimit(throttle.Parallelism(ctx))
 
-	for preset, rule := range f.presets {
+	for preset, rule := range presets {
 		t := f.transformer
 		preset := preset
 		rule := rule
-		grp.Go(func() error {
-			buf := bbpool.Get()
-			defer bbpool.Release(buf)
+		grp.Go(preset, func() error {
+			// The encoder writes straight into the temporary file, so
+			// the variant is never held in memory as a whole
+			path, err := f.EncodeFilename(preset, u.String())
+			if err != nil {
+				return err
+			}
+			fh, err := createTemp(path)
+			if err != nil {
+				return err
+			}
 
+			h := sha256.New()
 			var res transformer.Result
-			res.Content = buf
+			res.Content = io.MultiWriter(fh, h)
+			res.Preset = preset
 
 			log.Debugf(ctx, "Backend: applying transformation %s (%s)...", preset, rule)
-			if err := t.Transform(ctx, rule, u.String(), &res); err != nil {
-				return errors.Wrap(err, `failed to transform`)
-			}
-
-			path := f.EncodeFilename(preset, u.String())
-			log.Debugf(ctx, "Saving to %s...", path)
-
-			dir := filepath.Dir(path)
-			if _, err := os.Stat(dir); err != nil {
-				if err := os.MkdirAll(filepath.Dir(path), 0744); err != nil {
-					return errors.Wrapf(err, `failed to create directory %s`, filepath.Dir(path))
-				}
+			err = t.Transform(ctx, rule, u.String(), &res)
+			if cerr := fh.Close(); err == nil && cerr != nil {
+				err = errors.Wrapf(cerr, `failed to write content to %s`, fh.Name())
 			}
-
-			fh, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
 			if err != nil {
-				return errors.Wrapf(err, `failed to open file %s`, path)
+				os.Remove(fh.Name())
+				return errors.Wrap(err, `failed to transform`)
 			}
 
-			defer fh.Close()
-			if _, err := io.Copy(fh, buf); err != nil {
-				return errors.Wrapf(err, `failed to write content to %s`, path)
-			}
-			cacheKey := urlcache.MakeCacheKey("fs", preset, u.String())
-			f.cache.Set(ctx, cacheKey, path)
-			return nil
+			m := res.Metadata(u.String(), preset, rule)
+			m.SHA256 = hex.EncodeToString(h.Sum(nil))
+			return f.commit(ctx, u, preset, fh.Name(), path, m)
 		})
 	}
 
@@ -123,18 +271,218 @@ func (f *Backend) StoreTransformedContent(ctx context.Context, u *url.URL) error
 	return grp.Wait()
 }
 
-func (f *Backend) Delete(ctx context.Context, u *url.URL) error {
+// Fetch writes the stored content for the given url and preset to dst
+func (f *Backend) Fetch(ctx context.Context, u *url.URL, preset string, dst io.Writer) (*metadata.Metadata, error) {
+	path, err := f.EncodeFilename(preset, u.String())
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.TransformationRequiredError{}
+		}
+		return nil, errors.Wrapf(err, `failed to open file %s`, path)
+	}
+	defer fh.Close()
+
+	m, err := readMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var head [512]byte
+	n, err := io.ReadFull(fh, head[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, errors.Wrapf(err, `failed to read file %s`, path)
+	}
+
+	if _, err := dst.Write(head[:n]); err != nil {
+		return nil, errors.Wrap(err, `failed to write content`)
+	}
+	if _, err := io.Copy(dst, fh); err != nil {
+		return nil, errors.Wrapf(err, `failed to read file %s`, path)
+	}
+
+	// Files stored by older versions do not have the content type
+	// recorded, so we need to sniff it from the content
+	if m.ContentType == "" {
+		m.ContentType = http.DetectContentType(head[:n])
+	}
+	return m, nil
+}
+
+// Put stores the given content as the variant for the given url and preset
+func (f *Backend) Put(ctx context.Context, u *url.URL, preset string, content []byte, m *metadata.Metadata) error {
+	path, err := f.EncodeFilename(preset, u.String())
+	if err != nil {
+		return err
+	}
+	fh, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(content)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return errors.Wrapf(err, `failed to write content to %s`, fh.Name())
+	}
+
+	m.SHA256 = util.Checksum(content)
+	return f.commit(ctx, u, preset, fh.Name(), path, m)
+}
+
+// CheckHealth writes a small file under the storage root and removes
+// it. The file is named like the temporary files of variants, so that
+// List and CleanStorageRoot skip it
+func (f *Backend) CheckHealth(ctx context.Context) error {
+	fh, err := createTemp(filepath.Join(f.root, ".sharaq-health"))
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write([]byte("ok"))
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(fh.Name()); err == nil {
+		err = rerr
+	}
+	return errors.Wrap(err, `failed to write to storage root`)
+}
+
+// tempInfix is inserted between the name of a variant and the random
+// suffix of its temporary files
+const tempInfix = ".tmp-"
+
+// createTemp creates a temporary file that the variant stored at path
+// is written to. Variants are written to a temporary file first, and
+// only moved into place by commit after verifying that they were
+// written correctly, so that we never serve truncated files. Each store
+// gets its own file, so that concurrent stores of the same variant do
+// not write over each other
+func createTemp(path string) (*os.File, error) {
+	dir := filepath.Dir(path)
+	if _, err := os.Stat(dir); err != nil {
+		if err := os.MkdirAll(dir, 0744); err != nil {
+			return nil, errors.Wrapf(err, `failed to create directory %s`, dir)
+		}
+	}
+
+	fh, err := ioutil.TempFile(dir, filepath.Base(path)+tempInfix)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to create temporary file for %s`, path)
+	}
+	// TempFile creates files only readable by the owner
+	if err := fh.Chmod(0644); err != nil {
+		fh.Close()
+		os.Remove(fh.Name())
+		return nil, errors.Wrapf(err, `failed to change mode of %s`, fh.Name())
+	}
+	return fh, nil
+}
+
+// isTemp returns true if path is a temporary file created by createTemp
+func isTemp(path string) bool {
+	return strings.HasPrefix(filepath.Ext(path), tempInfix)
+}
+
+// commit verifies the temporary file tmp against m.SHA256, and moves it
+// into place at path
+func (f *Backend) commit(ctx context.Context, u *url.URL, preset, tmp, path string, m *metadata.Metadata) error {
+	log.Debugf(ctx, "Saving to %s...", path)
+
+	sum, err := fileChecksum(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, `failed to read back %s`, tmp)
+	}
+	if sum != m.SHA256 {
+		os.Remove(tmp)
+		return errors.Errorf(`checksum mismatch after writing %s`, tmp)
+	}
+
+	if err := replaceFile(tmp, path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, `failed to rename %s to %s`, tmp, path)
+	}
+
+	if err := writeMetadata(path, m); err != nil {
+		return err
+	}
+
+	f.setCache(ctx, u, preset, path)
+	return nil
+}
+
+// setCache lets the URL cache know about the file that the variant is
+// stored in
+func (f *Backend) setCache(ctx context.Context, u *url.URL, preset, path string) {
+	// don't let the cache point to the file after it has been removed
+	var options []urlcache.SetOption
+	if ttl := f.ttl(preset); ttl > 0 {
+		options = append(options, urlcache.WithExpires(ttl+f.maxStale))
+	}
+	cacheKey := urlcache.MakeCacheKey("fs", preset, u.String())
+	f.cache.Set(ctx, cacheKey, path, options...)
+}
+
+// fileChecksum is util.Checksum for the content of the file at path,
+// without reading it into memory
+func fileChecksum(path string) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Metadata returns the metadata that was recorded when the variant
+// was stored
+func (f *Backend) Metadata(ctx context.Context, u *url.URL, preset string) (*metadata.Metadata, error) {
+	path, err := f.EncodeFilename(preset, u.String())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.TransformationRequiredError{}
+		}
+		return nil, errors.Wrapf(err, `failed to stat file %s`, path)
+	}
+	return readMetadata(path)
+}
+
+func (f *Backend) Delete(ctx context.Context, u *url.URL, presets []string) error {
+	if presets == nil {
+		for preset := range f.presets {
+			presets = append(presets, preset)
+		}
+	}
+
 	var grp *errgroup.Group
 	grp, ctx = errgroup.WithContext(ctx)
 
-	for preset := range f.presets {
+	for _, preset := range presets {
 		preset := preset
 		grp.Go(func() error {
-			path := f.EncodeFilename(preset, u.String())
+			path, err := f.EncodeFilename(preset, u.String())
+			if err != nil {
+				return err
+			}
 			log.Debugf(ctx, " + DELETE filesystem entry %s\n", path)
-			if err := os.Remove(path); err != nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 				return errors.Wrapf(err, `failed to remove path %s`, path)
 			}
+			os.Remove(metadataFilename(path))
 
 			// fallthrough here regardless, because it's better to lose the
 			// cache than to accidentally have one linger
@@ -146,18 +494,65 @@ func (f *Backend) Delete(ctx context.Context, u *url.URL) error {
 	return errors.Wrap(grp.Wait(), `deleting from file system`)
 }
 
+// List calls fn with the metadata of each variant stored under the
+// storage root
+func (f *Backend) List(ctx context.Context, fn func(*metadata.Metadata) error) error {
+	return filepath.Walk(f.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, `failed to walk %s`, path)
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		if filepath.Ext(path) == ".meta" || isTemp(path) {
+			return nil
+		}
+
+		m, err := readMetadata(path)
+		if err != nil {
+			return err
+		}
+		return fn(m)
+	})
+}
+
 func (f *Backend) CleanStorageRoot() error {
-	if f.imageTTL <= 0 {
+	if f.imageTTL <= 0 && len(f.presetTTLs) == 0 {
 		return nil
 	}
 
 	filepath.Walk(f.root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		if filepath.Ext(path) == ".meta" {
+			// sidecars are removed along with their variants, but
+			// clean up the ones that were left behind
+			if _, err := os.Stat(strings.TrimSuffix(path, ".meta")); os.IsNotExist(err) {
+				os.Remove(path)
+			}
+			return nil
+		}
+
+		// The preset is only known from the metadata. Files without
+		// metadata use ImageTTL
+		var preset string
+		if m, err := readMetadata(path); err == nil {
+			preset = m.Preset
+		}
+
+		ttl := f.ttl(preset)
+		if ttl <= 0 {
 			return nil
 		}
 
-		if time.Since(info.ModTime()) > f.imageTTL {
+		// stale files are kept around until MaxStale has passed
+		if time.Since(info.ModTime()) > ttl+f.maxStale {
 			os.Remove(path)
+			os.Remove(metadataFilename(path))
 		}
 		return nil
 	})
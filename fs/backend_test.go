@@ -0,0 +1,475 @@
+package fs
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/internal/util"
+	"github.com/lestrrat-go/sharaq/metadata"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// encodeFilename is EncodeFilename for paths that are known to be valid
+func encodeFilename(t *testing.T, b *Backend, preset, u string) string {
+	path, err := b.EncodeFilename(preset, u)
+	assert.NoError(t, err, "EncodeFilename should succeed")
+	return path
+}
+
+func TestBackend_ContentType(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "creating cache should succeed") {
+		return
+	}
+
+	b, err := NewBackend(&Config{Root: root}, cache, nil, nil)
+	if !assert.NoError(t, err, "creating backend should succeed") {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u, _ := url.Parse("http://example.com/foo")
+	// content that sniffs as plain text
+	if !assert.NoError(t, b.Put(ctx, u, "small", []byte("not really an image"), &metadata.Metadata{ContentType: "image/png"}), "Put should succeed") {
+		return
+	}
+
+	h, err := b.Get(ctx, u, "small")
+	if !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !assert.Equal(t, "image/png", w.Header().Get("Content-Type"), "recorded content type should be used") {
+		return
+	}
+}
+
+func TestBackend_Get(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "creating cache should succeed") {
+		return
+	}
+
+	b, err := NewBackend(&Config{Root: root}, cache, nil, nil)
+	if !assert.NoError(t, err, "creating backend should succeed") {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u, _ := url.Parse("http://example.com/foo")
+	cacheKey := urlcache.MakeCacheKey("fs", "small", u.String())
+	path := encodeFilename(t, b, "small", u.String())
+
+	// miss
+	_, state, err := b.lookup(ctx, u, "small")
+	if !assert.NoError(t, err, "lookup should succeed") {
+		return
+	}
+	if !assert.Equal(t, stateMiss, state, "missing file should be a miss") {
+		return
+	}
+	if _, err := b.Get(ctx, u, "small"); !assert.True(t, errors.IsTransformationRequired(err), "missing file should require transformation") {
+		return
+	}
+
+	// cache hit
+	if !assert.NoError(t, b.Put(ctx, u, "small", []byte("content"), &metadata.Metadata{ContentType: "image/png"}), "Put should succeed") {
+		return
+	}
+	if _, state, _ = b.lookup(ctx, u, "small"); !assert.Equal(t, stateCacheHit, state, "stored file should be a cache hit") {
+		return
+	}
+
+	// disk hit, which fills the cache
+	cache.Delete(ctx, cacheKey)
+	if _, state, _ = b.lookup(ctx, u, "small"); !assert.Equal(t, stateDiskHit, state, "uncached file should be a disk hit") {
+		return
+	}
+	h, err := b.Get(ctx, u, "small")
+	if !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !assert.Equal(t, "content", w.Body.String(), "file should be served once") {
+		return
+	}
+	if !assert.Equal(t, path, cache.Lookup(ctx, cacheKey), "disk hit should fill the cache") {
+		return
+	}
+
+	// cached, but removed behind our back
+	if !assert.NoError(t, os.Remove(path), "Remove should succeed") {
+		return
+	}
+	if _, err := b.Get(ctx, u, "small"); !assert.True(t, errors.IsTransformationRequired(err), "removed file should require transformation") {
+		return
+	}
+	if !assert.Empty(t, cache.Lookup(ctx, cacheKey), "cache should forget removed files") {
+		return
+	}
+}
+
+func TestBackend_Stale(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "creating cache should succeed") {
+		return
+	}
+
+	// "small" is not a known preset, so no regeneration is attempted
+	b, err := NewBackend(&Config{Root: root, ImageTTL: time.Hour, MaxStale: time.Hour}, cache, nil, nil)
+	if !assert.NoError(t, err, "creating backend should succeed") {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u, _ := url.Parse("http://example.com/foo")
+	if !assert.NoError(t, b.Put(ctx, u, "small", []byte("content"), &metadata.Metadata{ContentType: "image/png"}), "Put should succeed") {
+		return
+	}
+
+	serve := func() *httptest.ResponseRecorder {
+		h, err := b.Get(ctx, u, "small")
+		if !assert.NoError(t, err, "Get should succeed") {
+			return nil
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w
+	}
+
+	w := serve()
+	if w == nil || !assert.Empty(t, w.Header().Get("X-Sharaq-Stale"), "fresh file should not be stale") {
+		return
+	}
+
+	path := encodeFilename(t, b, "small", u.String())
+	old := time.Now().Add(-90 * time.Minute)
+	if !assert.NoError(t, os.Chtimes(path, old, old), "Chtimes should succeed") {
+		return
+	}
+
+	w = serve()
+	if w == nil || !assert.Equal(t, "true", w.Header().Get("X-Sharaq-Stale"), "old file should be served as stale") {
+		return
+	}
+	if !assert.Equal(t, "content", w.Body.String(), "stale content should be served") {
+		return
+	}
+
+	// within MaxStale, so it must survive cleanup
+	if !assert.NoError(t, b.CleanStorageRoot(), "CleanStorageRoot should succeed") {
+		return
+	}
+	if _, err := os.Stat(path); !assert.NoError(t, err, "stale file should be kept") {
+		return
+	}
+}
+
+func TestBackend_StaleReadOnly(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "creating cache should succeed") {
+		return
+	}
+
+	var fetched int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, image.NewRGBA(image.Rect(0, 0, 16, 16)))
+	}))
+	defer srv.Close()
+
+	presets := map[string]string{"small": "8x8"}
+	b, err := NewBackend(&Config{Root: root, ImageTTL: time.Hour, MaxStale: time.Hour}, cache, transformer.New(), presets)
+	if !assert.NoError(t, err, "creating backend should succeed") {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u, _ := url.Parse(srv.URL + "/foo.png")
+	if !assert.NoError(t, b.Put(ctx, u, "small", []byte("content"), &metadata.Metadata{ContentType: "image/png"}), "Put should succeed") {
+		return
+	}
+	path := encodeFilename(t, b, "small", u.String())
+	old := time.Now().Add(-90 * time.Minute)
+	if !assert.NoError(t, os.Chtimes(path, old, old), "Chtimes should succeed") {
+		return
+	}
+
+	h, err := b.Get(util.WithReadOnly(ctx), u, "small")
+	if !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !assert.Equal(t, "true", w.Header().Get("X-Sharaq-Stale"), "old file should be served as stale") {
+		return
+	}
+
+	// regeneration would happen in the background
+	time.Sleep(200 * time.Millisecond)
+	if !assert.Equal(t, int32(0), atomic.LoadInt32(&fetched), "source should not be fetched in read-only mode") {
+		return
+	}
+	content, err := ioutil.ReadFile(path)
+	if !assert.NoError(t, err, "stale file should be kept") {
+		return
+	}
+	if !assert.Equal(t, "content", string(content), "stale file should not be regenerated") {
+		return
+	}
+}
+
+func TestBackend_PresetTTL(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "creating cache should succeed") {
+		return
+	}
+
+	c := &Config{
+		Root: root,
+		PresetTTLs: map[string]time.Duration{
+			"hero":  30 * 24 * time.Hour,
+			"email": 48 * time.Hour,
+		},
+	}
+	b, err := NewBackend(c, cache, nil, nil)
+	if !assert.NoError(t, err, "creating backend should succeed") {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u, _ := url.Parse("http://example.com/foo")
+	old := time.Now().Add(-72 * time.Hour)
+	for _, preset := range []string{"hero", "email"} {
+		if !assert.NoError(t, b.Put(ctx, u, preset, []byte("content"), &metadata.Metadata{Preset: preset}), "Put should succeed") {
+			return
+		}
+		if !assert.NoError(t, os.Chtimes(encodeFilename(t, b, preset, u.String()), old, old), "Chtimes should succeed") {
+			return
+		}
+	}
+
+	if !assert.NoError(t, b.CleanStorageRoot(), "CleanStorageRoot should succeed") {
+		return
+	}
+
+	if _, err := os.Stat(encodeFilename(t, b, "hero", u.String())); !assert.NoError(t, err, "hero variant should be kept") {
+		return
+	}
+	path := encodeFilename(t, b, "email", u.String())
+	if _, err := os.Stat(path); !assert.True(t, os.IsNotExist(err), "email variant should be removed") {
+		return
+	}
+	if _, err := os.Stat(metadataFilename(path)); !assert.True(t, os.IsNotExist(err), "email metadata should be removed") {
+		return
+	}
+}
+
+func TestBackend_StoreTransformedContent(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "creating cache should succeed") {
+		return
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/foo.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, image.NewRGBA(image.Rect(0, 0, 16, 16)))
+	}))
+	defer srv.Close()
+
+	presets := map[string]string{"small": "8x8"}
+	b, err := NewBackend(&Config{Root: root}, cache, transformer.New(), presets)
+	if !assert.NoError(t, err, "creating backend should succeed") {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u, _ := url.Parse(srv.URL + "/foo.png")
+	if !assert.NoError(t, b.StoreTransformedContent(ctx, u, presets), "StoreTransformedContent should succeed") {
+		return
+	}
+
+	path := encodeFilename(t, b, "small", u.String())
+	content, err := ioutil.ReadFile(path)
+	if !assert.NoError(t, err, "variant should be stored") {
+		return
+	}
+	m, err := b.Metadata(ctx, u, "small")
+	if !assert.NoError(t, err, "Metadata should succeed") {
+		return
+	}
+	if !assert.Equal(t, util.Checksum(content), m.SHA256, "checksum should match the stored content") {
+		return
+	}
+
+	// failed transformations leave nothing behind
+	missing, _ := url.Parse(srv.URL + "/missing.png")
+	if !assert.Error(t, b.StoreTransformedContent(ctx, missing, presets), "StoreTransformedContent should fail") {
+		return
+	}
+	for _, p := range []string{path, encodeFilename(t, b, "small", missing.String())} {
+		matches, _ := filepath.Glob(p + tempInfix + "*")
+		if !assert.Empty(t, matches, "temporary files of %s should not exist", p) {
+			return
+		}
+	}
+}
+
+func TestBackend_ConcurrentPut(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "creating cache should succeed") {
+		return
+	}
+
+	b, err := NewBackend(&Config{Root: root}, cache, nil, nil)
+	if !assert.NoError(t, err, "creating backend should succeed") {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// stores of the same variant must not write over each other's
+	// temporary files, which would fail the checksum
+	u, _ := url.Parse("http://example.com/foo")
+	contents := make([][]byte, 8)
+	errs := make(chan error, len(contents))
+	for i := range contents {
+		contents[i] = bytes.Repeat([]byte{byte('a' + i)}, 64*1024*(i+1))
+		go func(content []byte) {
+			errs <- b.Put(ctx, u, "small", content, &metadata.Metadata{ContentType: "image/png"})
+		}(contents[i])
+	}
+	for range contents {
+		if !assert.NoError(t, <-errs, "Put should succeed") {
+			return
+		}
+	}
+
+	path := encodeFilename(t, b, "small", u.String())
+	stored, err := ioutil.ReadFile(path)
+	if !assert.NoError(t, err, "variant should be stored") {
+		return
+	}
+	if !assert.Contains(t, contents, stored, "variant should be one of the stored contents") {
+		return
+	}
+	matches, _ := filepath.Glob(path + tempInfix + "*")
+	if !assert.Empty(t, matches, "temporary files should not be left behind") {
+		return
+	}
+}
+
+func TestBackend_PathsUnderRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "sharaq-fs")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	cache, err := urlcache.New(&urlcache.Config{Type: "Memory"})
+	if !assert.NoError(t, err, "creating cache should succeed") {
+		return
+	}
+
+	c := &Config{Root: root}
+	c.Paths.IncludeHost = true
+	b, err := NewBackend(c, cache, nil, nil)
+	if !assert.NoError(t, err, "creating backend should succeed") {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the host is part of the path, and must not be able to refer to
+	// the parent of the storage root
+	u := &url.URL{Scheme: "http", Host: "..", Path: "/foo.jpg"}
+	path := encodeFilename(t, b, "small", u.String())
+	if !assert.True(t, strings.HasPrefix(path, root+string(filepath.Separator)), "path should be under the storage root") {
+		return
+	}
+	if !assert.NoError(t, b.Put(ctx, u, "small", []byte("content"), &metadata.Metadata{ContentType: "image/png"}), "Put should succeed") {
+		return
+	}
+	if _, err := os.Stat(path); !assert.NoError(t, err, "variant should be stored under the storage root") {
+		return
+	}
+}
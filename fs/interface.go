@@ -5,4 +5,21 @@ import "time"
 type Config struct {
 	Root     string
 	ImageTTL time.Duration
+	// MaxStale is how long past ImageTTL files are kept. During that
+	// time they are served as stale, and regenerated in the background.
+	// If 0, files are removed as soon as they are older than ImageTTL
+	MaxStale time.Duration
+	// PresetTTLs overrides ImageTTL for specific presets
+	PresetTTLs map[string]time.Duration
+	// Paths specifies how the paths of files under Root are derived from
+	// the preset and the source URL. Changing it orphans existing files
+	Paths PathConfig
+}
+
+// PathConfig specifies the layout of stored files. The zero value
+// stores files under the crc64 hash of the preset and the source URL
+type PathConfig struct {
+	Hash        string // "crc64" (default), "md5", "sha1", or "sha256"
+	IncludeHost bool   // if true, files are stored under a directory named after the source host
+	Filename    bool   // if true, file names start with the original file name
 }
@@ -0,0 +1,59 @@
+package fs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/metadata"
+)
+
+// Metadata is stored in a sidecar file next to each variant, as the
+// file system has no portable way to attach it to the file itself
+
+func metadataFilename(path string) string {
+	return path + ".meta"
+}
+
+func writeMetadata(path string, m *metadata.Metadata) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, `failed to encode metadata`)
+	}
+
+	// like variants, sidecars are moved into place once written, so
+	// that concurrent stores never leave a mix of both behind
+	fh, err := createTemp(metadataFilename(path))
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(b)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = replaceFile(fh.Name(), metadataFilename(path))
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return errors.Wrapf(err, `failed to write metadata for %s`, path)
+	}
+	return nil
+}
+
+func readMetadata(path string) (*metadata.Metadata, error) {
+	b, err := ioutil.ReadFile(metadataFilename(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &metadata.Metadata{}, nil
+		}
+		return nil, errors.Wrapf(err, `failed to read metadata for %s`, path)
+	}
+
+	var m metadata.Metadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrapf(err, `failed to decode metadata for %s`, path)
+	}
+	return &m, nil
+}
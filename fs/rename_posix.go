@@ -0,0 +1,10 @@
+// +build !windows
+
+package fs
+
+import "os"
+
+// replaceFile moves src to dst, replacing dst if it exists
+func replaceFile(src, dst string) error {
+	return os.Rename(src, dst)
+}
@@ -0,0 +1,20 @@
+package fs
+
+import (
+	"os"
+	"time"
+)
+
+// replaceFile moves src to dst, replacing dst if it exists. On Windows
+// this fails while dst is open, e.g. because it is being served, so the
+// rename is retried for a short while
+func replaceFile(src, dst string) error {
+	var err error
+	for i := 0; i < 5; i++ {
+		if err = os.Rename(src, dst); err == nil {
+			return nil
+		}
+		time.Sleep(time.Duration(i+1) * 50 * time.Millisecond)
+	}
+	return err
+}
@@ -1,6 +1,7 @@
 package gcp
 
 import (
+	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
@@ -14,30 +15,55 @@ import (
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 
+	"github.com/lestrrat-go/sharaq/internal/accesslog"
 	"github.com/lestrrat-go/sharaq/internal/bbpool"
 	"github.com/lestrrat-go/sharaq/internal/errors"
 	"github.com/lestrrat-go/sharaq/internal/httputil"
 	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/throttle"
 	"github.com/lestrrat-go/sharaq/internal/transformer"
 	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/internal/util"
+	"github.com/lestrrat-go/sharaq/metadata"
 )
 
 type StorageBackend struct {
 	bucketName  string
 	cache       *urlcache.URLCache
+	paths       *util.PathScheme // nil for the default layout, see makeStoragePath
 	prefix      string
 	presets     map[string]string
+	redirect    httputil.Redirect // how clients are redirected to variants
 	transformer *transformer.Transformer
 }
 
 func NewBackend(c *Config, cache *urlcache.URLCache, trans *transformer.Transformer, presets map[string]string) (*StorageBackend, error) {
+	if !httputil.ValidRedirectStatus(c.RedirectStatus) {
+		return nil, errors.Errorf(`gcp backend: invalid redirect status %d`, c.RedirectStatus)
+	}
+
+	var paths *util.PathScheme
+	if pc := c.Paths; pc != nil {
+		paths = &util.PathScheme{
+			Hash:        pc.Hash,
+			IncludeHost: pc.IncludeHost,
+			Filename:    pc.Filename,
+		}
+		if err := paths.Validate(); err != nil {
+			return nil, errors.Wrap(err, `gcp backend: invalid 'Paths'`)
+		}
+	}
+
 	return &StorageBackend{
 		bucketName:  c.BucketName,
 		cache:       cache,
+		paths:       paths,
 		prefix:      c.Prefix,
 		presets:     presets,
+		redirect:    httputil.Redirect{Status: c.RedirectStatus, CacheControl: c.RedirectCacheControl},
 		transformer: trans,
 	}, nil
 }
@@ -57,72 +83,84 @@ func (s *StorageBackend) getClient(ctx context.Context) (*storage.Client, error)
 
 func (s *StorageBackend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
 	cacheKey := urlcache.MakeCacheKey("gcp", preset, u.String())
+	entry := accesslog.FromContext(ctx)
 	if cachedURL := s.cache.Lookup(ctx, cacheKey); cachedURL != "" {
+		entry.SetCache(accesslog.CacheHit)
 		log.Debugf(ctx, "Cached entry found for %s:%s -> %s", preset, u.String(), cachedURL)
 		if rand.Float32() < 0.25 {
 			log.Debugf(ctx, "Random check for cached URL %s", cachedURL)
-			res, err := http.Head(cachedURL)
+			res, err := util.HTTPClient(ctx).Head(cachedURL)
 			if err != nil || res.StatusCode != http.StatusOK {
 				log.Debugf(ctx, "Cached entry %s is no longer valid. Deleting", cachedURL)
 				s.cache.Delete(ctx, cacheKey)
 			}
 		}
 
-		return httputil.RedirectContent(cachedURL), nil
+		return s.redirect.To(cachedURL), nil
 	}
+	entry.SetCache(accesslog.CacheMiss)
 
 	cl, err := s.getClient(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, `failed to create client`)
+		return nil, errors.StorageUnavailableError{Err: errors.Wrap(err, `failed to create client`)}
 	}
 
 	path := s.makeStoragePath(preset, u)
 	if _, err := cl.Bucket(s.bucketName).Object(path).Attrs(ctx); err != nil {
+		if err != storage.ErrObjectNotExist {
+			log.Debugf(ctx, "failed to fetch attributes for %s: %s", path, err)
+			return nil, errors.StorageUnavailableError{Err: err}
+		}
 		log.Debugf(ctx, "content at %s does not exist, request transformation", path)
 		return nil, errors.TransformationRequiredError{}
 	}
 
 	specificURL := u.Scheme + "://storage.googleapis.com/" + s.bucketName + "/" + path
-	return httputil.RedirectContent(specificURL), nil
+	return s.redirect.To(specificURL), nil
+}
+
+// VariantPath returns the name of the object that the variant is
+// stored in
+func (s *StorageBackend) VariantPath(u *url.URL, preset string) string {
+	return s.makeStoragePath(preset, u)
 }
 
 func (s *StorageBackend) makeStoragePath(preset string, u *url.URL) string {
-	// Create a path based on the SHA256 hash of this URL
-	h := sha256.New()
-	io.WriteString(h, u.String())
 	list := make([]string, 0, 4)
 	if s.prefix != "" {
 		list = append(list, s.prefix)
 	}
+	if s.paths != nil {
+		list = append(list, preset, s.paths.Key(preset, u.String()))
+		return path.Join(list...)
+	}
+
+	// Create a path based on the SHA256 hash of this URL
+	h := sha256.New()
+	io.WriteString(h, u.String())
 	list = append(list, preset, u.Host, hex.EncodeToString(h.Sum(nil)))
 	return path.Join(list...)
 }
 
-func (s *StorageBackend) StoreTransformedContent(ctx context.Context, u *url.URL) error {
+func (s *StorageBackend) StoreTransformedContent(ctx context.Context, u *url.URL, presets map[string]string) error {
 	log.Debugf(ctx, "StorageBackend: transforming image at url %s", u)
 
-	cl, err := s.getClient(ctx)
-	if err != nil {
-		return errors.Wrap(err, `failed to get client for Store`)
-	}
-
-	bkt := cl.Bucket(s.bucketName)
-
-	var grp *errgroup.Group
-	grp, ctx = errgroup.WithContext(ctx)
+	var grp errors.PresetGroup
+	grp.SetLimit(throttle.Parallelism(ctx))
 
 	// Transformation is completely done by the transformer, so just
 	// hand it over to it
-	for preset, rule := range s.presets {
+	for preset, rule := range presets {
 		t := s.transformer
 		preset := preset
 		rule := rule
-		grp.Go(func() error {
+		grp.Go(preset, func() error {
 			buf := bbpool.Get()
 			defer bbpool.Release(buf)
 
 			var res transformer.Result
 			res.Content = buf
+			res.Preset = preset
 
 			err := t.Transform(ctx, rule, u.String(), &res)
 			if err != nil {
@@ -130,33 +168,164 @@ func (s *StorageBackend) StoreTransformedContent(ctx context.Context, u *url.URL
 			}
 
 			// good, done. save it to Google Storage
-			p := s.makeStoragePath(preset, u)
-			log.Debugf(ctx, "Writing to Google Storage %s...", p)
+			return s.Put(ctx, u, preset, buf.Bytes(), res.Metadata(u.String(), preset, rule))
+		})
+	}
+	return grp.Wait()
+}
 
-			wc := bkt.Object(p).NewWriter(ctx)
+// Fetch writes the stored content for the given url and preset to dst
+func (s *StorageBackend) Fetch(ctx context.Context, u *url.URL, preset string, dst io.Writer) (*metadata.Metadata, error) {
+	cl, err := s.getClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to get client for Fetch`)
+	}
 
-			wc.ContentType = res.ContentType
-			wc.ACL = []storage.ACLRule{
-				{storage.AllUsers, storage.RoleReader},
-			}
+	p := s.makeStoragePath(preset, u)
+	obj := cl.Bucket(s.bucketName).Object(p)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, errors.TransformationRequiredError{}
+		}
+		return nil, errors.Wrapf(err, `failed to fetch attributes for %s`, p)
+	}
+
+	rdr, err := obj.NewReader(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, errors.TransformationRequiredError{}
+		}
+		return nil, errors.Wrapf(err, `failed to open reader for %s`, p)
+	}
+	defer rdr.Close()
+
+	if _, err := io.Copy(dst, rdr); err != nil {
+		return nil, errors.Wrapf(err, `failed to read content from %s`, p)
+	}
+	return metadataFromAttrs(attrs), nil
+}
+
+// Put stores the given content as the variant for the given url and preset
+func (s *StorageBackend) Put(ctx context.Context, u *url.URL, preset string, content []byte, m *metadata.Metadata) error {
+	cl, err := s.getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, `failed to get client for Put`)
+	}
 
-			if _, err := io.Copy(wc, buf); err != nil {
-				return errors.Wrapf(err, `failed to write data to %s`, p)
+	p := s.makeStoragePath(preset, u)
+	log.Debugf(ctx, "Writing to Google Storage %s...", p)
+
+	wc := cl.Bucket(s.bucketName).Object(p).NewWriter(ctx)
+
+	// Google Storage verifies the content against the MD5 hash, and
+	// rejects the upload if they do not match. The rest of the metadata,
+	// including the SHA-256 checksum, is stored as object metadata
+	m.SHA256 = util.Checksum(content)
+	sum := md5.Sum(content)
+	wc.MD5 = sum[:]
+	wc.Metadata = m.Map()
+	wc.ContentType = m.ContentType
+	wc.ACL = []storage.ACLRule{
+		{storage.AllUsers, storage.RoleReader},
+	}
+
+	if _, err := wc.Write(content); err != nil {
+		return errors.Wrapf(err, `failed to write data to %s`, p)
+	}
+
+	if err := wc.Close(); err != nil {
+		return errors.Wrap(err, `failed to properly close writer for google storage`)
+	}
+	cacheKey := urlcache.MakeCacheKey("gcp", preset, u.String())
+	specificURL := u.Scheme + "://storage.googleapis.com/" + s.bucketName + "/" + p
+	s.cache.Set(ctx, cacheKey, specificURL, urlcache.WithExpires(10*time.Minute))
+	return nil
+}
+
+// CheckHealth writes a small object to the bucket and deletes it
+func (s *StorageBackend) CheckHealth(ctx context.Context) error {
+	cl, err := s.getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, `failed to get client for CheckHealth`)
+	}
+
+	obj := cl.Bucket(s.bucketName).Object(path.Join(s.prefix, ".sharaq-health"))
+	wc := obj.NewWriter(ctx)
+	wc.ContentType = "text/plain"
+	if _, err := wc.Write([]byte("ok")); err != nil {
+		return errors.Wrap(err, `failed to write to bucket`)
+	}
+	if err := wc.Close(); err != nil {
+		return errors.Wrap(err, `failed to write to bucket`)
+	}
+	return errors.Wrap(obj.Delete(ctx), `failed to delete from bucket`)
+}
+
+// Metadata returns the metadata that was recorded when the variant
+// was stored
+func (s *StorageBackend) Metadata(ctx context.Context, u *url.URL, preset string) (*metadata.Metadata, error) {
+	cl, err := s.getClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to get client for Metadata`)
+	}
+
+	p := s.makeStoragePath(preset, u)
+	attrs, err := cl.Bucket(s.bucketName).Object(p).Attrs(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, errors.TransformationRequiredError{}
+		}
+		return nil, errors.Wrapf(err, `failed to fetch attributes for %s`, p)
+	}
+	return metadataFromAttrs(attrs), nil
+}
+
+// List calls fn with the metadata of each variant stored in the bucket
+func (s *StorageBackend) List(ctx context.Context, fn func(*metadata.Metadata) error) error {
+	cl, err := s.getClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, `failed to get client for List`)
+	}
+
+	bkt := cl.Bucket(s.bucketName)
+	for preset := range s.presets {
+		prefix := path.Join(s.prefix, preset) + "/"
+		it := bkt.Objects(ctx, &storage.Query{Prefix: prefix})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return errors.Wrapf(err, `failed to list objects under %s`, prefix)
 			}
 
-			if err := wc.Close(); err != nil {
-				return errors.Wrap(err, `failed to properly close writer for google storage`)
+			m := metadataFromAttrs(attrs)
+			if m.Preset == "" {
+				m.Preset = preset
 			}
-			cacheKey := urlcache.MakeCacheKey("gcp", preset, u.String())
-			specificURL := u.Scheme + "://storage.googleapis.com/" + s.bucketName + "/" + s.makeStoragePath(preset, u)
-			s.cache.Set(ctx, cacheKey, specificURL, urlcache.WithExpires(10*time.Minute))
-			return nil
-		})
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
 	}
-	return grp.Wait()
+	return nil
+}
+
+func metadataFromAttrs(attrs *storage.ObjectAttrs) *metadata.Metadata {
+	return metadata.FromMap(attrs.ContentType, func(k string) string {
+		return attrs.Metadata[k]
+	})
 }
 
-func (s *StorageBackend) Delete(ctx context.Context, u *url.URL) error {
+func (s *StorageBackend) Delete(ctx context.Context, u *url.URL, presets []string) error {
+	if presets == nil {
+		for preset := range s.presets {
+			presets = append(presets, preset)
+		}
+	}
+
 	cl, err := s.getClient(ctx)
 	if err != nil {
 		return errors.Wrap(err, `failed to get client for Delete`)
@@ -167,16 +336,19 @@ func (s *StorageBackend) Delete(ctx context.Context, u *url.URL) error {
 	var grp *errgroup.Group
 	grp, ctx = errgroup.WithContext(ctx)
 
-	for preset := range s.presets {
+	for _, preset := range presets {
 		preset := preset
 		grp.Go(func() error {
 			// delete the cache regardless, because it's better to lose the
 			// cache than to accidentally have one linger
-			defer s.cache.Delete(ctx, urlcache.MakeCacheKey(preset, u.String()))
+			defer s.cache.Delete(ctx, urlcache.MakeCacheKey("gcp", preset, u.String()))
 
 			p := s.makeStoragePath(preset, u)
 			log.Debugf(ctx, " + DELETE Google Storage entry %s\n", p)
-			return bkt.Object(p).Delete(ctx)
+			if err := bkt.Object(p).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+				return err
+			}
+			return nil
 		})
 	}
 
@@ -3,4 +3,24 @@ package gcp
 type Config struct {
 	BucketName string `env:"bucket_name"`
 	Prefix string
+
+	// RedirectStatus is the status used to redirect clients to stored
+	// variants: 301, 302 (default), 303, 307, or 308
+	RedirectStatus int
+	// RedirectCacheControl, if specified, is sent as the Cache-Control
+	// header along with redirects
+	RedirectCacheControl string
+
+	// Paths, if specified, stores variants under the same layout as the
+	// fs backend, instead of the SHA-256 hash of the source URL under
+	// its host. Changing it orphans existing variants
+	Paths *PathConfig
+}
+
+// PathConfig specifies the layout of object names under
+// "<prefix>/<preset>/", as for fs.PathConfig
+type PathConfig struct {
+	Hash        string // "crc64" (default), "md5", "sha1", or "sha256"
+	IncludeHost bool   // if true, names start with the source host
+	Filename    bool   // if true, the last element starts with the original file name
 }
@@ -0,0 +1,236 @@
+package sharaq
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/errreport"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"golang.org/x/net/context"
+)
+
+// healthMonitor periodically checks the backends that implement
+// HealthChecker. Backends that do not are assumed to be healthy
+type healthMonitor struct {
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+	targets   []*healthTarget
+	dual      *dualBackend // nil unless a previous backend is configured
+}
+
+type healthTarget struct {
+	name    string
+	checker HealthChecker
+
+	mu        sync.Mutex
+	failures  int // consecutive failed checks
+	healthy   bool
+	lastError string
+	checkedAt time.Time
+}
+
+type healthStatus struct {
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type readyResponse struct {
+	Ready      bool                    `json:"ready"`
+	FailedOver bool                    `json:"failed_over"`
+	Backends   map[string]healthStatus `json:"backends"`
+	Engine     healthStatus            `json:"engine"`
+}
+
+func newHealthMonitor(hc *HealthConfig, b Backend) *healthMonitor {
+	hm := &healthMonitor{
+		interval:  hc.Interval,
+		timeout:   hc.Timeout,
+		threshold: hc.Threshold,
+	}
+
+	add := func(name string, b Backend) {
+		if checker, ok := b.(HealthChecker); ok {
+			hm.targets = append(hm.targets, &healthTarget{name: name, checker: checker, healthy: true})
+		}
+	}
+	if cb, ok := b.(*contentBackend); ok {
+		b = cb.backend
+	}
+	if d, ok := b.(*dualBackend); ok {
+		hm.dual = d
+		add("backend", d.current)
+		add("previous", d.previous)
+	} else {
+		add("backend", b)
+	}
+	return hm
+}
+
+// run checks the backends every interval until ctx is canceled
+func (hm *healthMonitor) run(ctx context.Context) {
+	if len(hm.targets) == 0 {
+		return
+	}
+
+	t := time.NewTicker(hm.interval)
+	defer t.Stop()
+	for {
+		hm.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// check checks each backend once, and fails over to the previous
+// backend if the backend is unhealthy and the previous one is not
+func (hm *healthMonitor) check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, ht := range hm.targets {
+		wg.Add(1)
+		go func(ht *healthTarget) {
+			defer wg.Done()
+			ht.record(ctx, hm.probe(ctx, ht), hm.threshold)
+		}(ht)
+	}
+	wg.Wait()
+
+	if hm.dual == nil {
+		return
+	}
+	failOver := !hm.healthy("backend") && hm.healthy("previous")
+	if hm.dual.failOver(failOver) {
+		if failOver {
+			log.Debugf(ctx, "Backend is unhealthy, failing over to the previous backend")
+			metrics.Count("health.failover", 1)
+		} else {
+			log.Debugf(ctx, "Backend is healthy again, failing back")
+			metrics.Count("health.failback", 1)
+		}
+	}
+}
+
+// probe calls CheckHealth, and gives up after the timeout. Not all
+// storage clients honor ctx, so the check is abandoned instead
+func (hm *healthMonitor) probe(ctx context.Context, ht *healthTarget) error {
+	ctx, cancel := context.WithTimeout(ctx, hm.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- ht.checker.CheckHealth(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ht *healthTarget) record(ctx context.Context, err error, threshold int) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+
+	ht.checkedAt = time.Now()
+	if err == nil {
+		if !ht.healthy {
+			log.Debugf(ctx, "Health check of %s succeeded", ht.name)
+		}
+		ht.failures = 0
+		ht.healthy = true
+		ht.lastError = ""
+		return
+	}
+
+	log.Debugf(ctx, "Health check of %s failed: %s", ht.name, err)
+	metrics.Count("health.failed", 1, "backend:"+ht.name)
+	ht.failures++
+	ht.lastError = err.Error()
+	if ht.failures >= threshold {
+		ht.healthy = false
+	}
+}
+
+func (ht *healthTarget) status() healthStatus {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	return healthStatus{
+		Healthy:   ht.healthy,
+		Error:     ht.lastError,
+		CheckedAt: ht.checkedAt,
+	}
+}
+
+// healthy returns false if the named backend is known to be unhealthy
+func (hm *healthMonitor) healthy(name string) bool {
+	for _, ht := range hm.targets {
+		if ht.name == name {
+			return ht.status().Healthy
+		}
+	}
+	return true
+}
+
+// ready returns true if requests can be served, either by the backend
+// or by the previous backend that it failed over to
+func (hm *healthMonitor) ready() bool {
+	if hm.dual != nil {
+		return hm.healthy("backend") || hm.healthy("previous")
+	}
+	return hm.healthy("backend")
+}
+
+// selfTest runs the self-test of the transformer for the output formats
+// of the configured presets, and keeps the result for /ready. The test
+// does not depend on the network or the backend, so it is only run
+// when the server is initialized
+func (s *Server) selfTest(ctx context.Context) error {
+	rules := make([]string, 0, len(s.config.Presets))
+	for _, rule := range s.config.Presets {
+		rules = append(rules, rule)
+	}
+
+	err := transformer.SelfTest(ctx, rules)
+	s.engine = healthStatus{Healthy: err == nil, CheckedAt: time.Now()}
+	if err != nil {
+		log.Debugf(ctx, "Transformer self-test failed: %s", err)
+		metrics.Count("health.selftest.failed", 1)
+		s.engine.Error = err.Error()
+		s.reportError(ctx, &errreport.Event{Kind: errreport.KindTransform, Err: err})
+	}
+	return err
+}
+
+// handleReady replies with 200 if the backends can serve requests and
+// the transformer passed its self-test, and with 503 otherwise, for use
+// as a readiness probe by load balancers
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	hm := s.health
+	resp := readyResponse{
+		Ready:    hm.ready() && s.engine.Healthy,
+		Backends: make(map[string]healthStatus, len(hm.targets)),
+		Engine:   s.engine,
+	}
+	if hm.dual != nil {
+		resp.FailedOver = hm.dual.failingOver()
+	}
+	for _, ht := range hm.targets {
+		resp.Backends[ht.name] = ht.status()
+	}
+
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,44 @@
+// +build quic,!appengine
+
+package sharaq
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/context"
+)
+
+const http3Available = true
+
+// serveHTTP3 serves h over HTTP/3 on the UDP port of addr until ctx is
+// done. The returned handler wraps h, and advertises HTTP/3 to clients
+// of the TCP listener via Alt-Svc
+func serveHTTP3(ctx context.Context, addr string, tlsConfig *tls.Config, h http.Handler) (http.Handler, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, `binding to UDP address failed`)
+	}
+
+	srv := &http3.Server{
+		Addr:      addr,
+		Handler:   h,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+	go srv.Serve(conn)
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+		conn.Close()
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			srv.SetQUICHeaders(w.Header())
+		}
+		h.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,17 @@
+// +build !quic appengine
+
+package sharaq
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const http3Available = false
+
+func serveHTTP3(_ context.Context, _ string, _ *tls.Config, _ http.Handler) (http.Handler, error) {
+	return nil, errors.New(`HTTP/3 support is not compiled in: build with -tags quic`)
+}
@@ -0,0 +1,118 @@
+package sharaq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"golang.org/x/net/context"
+)
+
+const (
+	// IdempotencyKeyHeader is sent by clients that retry guardian
+	// requests, so that the result of the first attempt is replayed
+	// instead of transforming the images again
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotencyReplayedHeader is set on responses that were replayed
+	IdempotencyReplayedHeader = "Idempotency-Replayed"
+
+	idempotencyPending = "pending"
+)
+
+// idempotentResult is the outcome of a guardian request, as recorded
+// in the URL cache
+type idempotentResult struct {
+	Request string `json:"request"` // identifies the url and presets
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+func idempotencyCacheKey(key string) string {
+	return urlcache.MakeCacheKey("idempotency", key)
+}
+
+// idempotentRequest identifies a guardian request, so that keys that are
+// reused for different requests can be detected
+func idempotentRequest(u *url.URL, presets map[string]string) string {
+	names := make([]string, 0, len(presets))
+	for preset := range presets {
+		names = append(names, preset)
+	}
+	sort.Strings(names)
+	return u.String() + " " + strings.Join(names, ",")
+}
+
+// replayIdempotent replies with the recorded result if a request with
+// the same key was already processed. Otherwise the key is marked as
+// pending, and false is returned so that the request gets processed
+func (s *Server) replayIdempotent(ctx context.Context, w http.ResponseWriter, r *http.Request, key string, u *url.URL, presets map[string]string) bool {
+	cacheKey := idempotencyCacheKey(key)
+	request := idempotentRequest(u, presets)
+
+	v := s.cache.Lookup(ctx, cacheKey)
+	if v == "" {
+		err := s.cache.SetNX(ctx, cacheKey, idempotencyPending, urlcache.WithExpires(s.config.Idempotency.Window))
+		if err == nil {
+			return false
+		}
+		// somebody else got there first
+		v = idempotencyPending
+	}
+
+	if v == idempotencyPending {
+		httpError(w, r, `a request with the same Idempotency-Key is being processed`, http.StatusConflict)
+		return true
+	}
+
+	var res idempotentResult
+	if err := json.Unmarshal([]byte(v), &res); err != nil {
+		log.Debugf(ctx, "Discarding malformed result for Idempotency-Key %s: %s", key, err)
+		s.cache.Delete(ctx, cacheKey)
+		httpError(w, r, `a request with the same Idempotency-Key is being processed`, http.StatusConflict)
+		return true
+	}
+	if res.Request != request {
+		httpError(w, r, `Idempotency-Key was used for a different request`, http.StatusUnprocessableEntity)
+		return true
+	}
+
+	log.Debugf(ctx, "Replaying result for Idempotency-Key %s", key)
+	metrics.Count("guardian.replayed", 1)
+	w.Header().Set(IdempotencyReplayedHeader, "true")
+	if res.Status >= 400 {
+		httpError(w, r, res.Message, res.Status)
+		return true
+	}
+	w.WriteHeader(res.Status)
+	return true
+}
+
+// recordIdempotent records the result of a request that was processed
+// after replayIdempotent returned false. Server errors are not recorded,
+// so that retries get another chance
+func (s *Server) recordIdempotent(ctx context.Context, key string, u *url.URL, presets map[string]string, status int, err error) {
+	cacheKey := idempotencyCacheKey(key)
+	if status >= 500 {
+		s.cache.Delete(ctx, cacheKey)
+		return
+	}
+
+	res := idempotentResult{
+		Request: idempotentRequest(u, presets),
+		Status:  status,
+	}
+	if err != nil {
+		res.Message = err.Error()
+	}
+	buf, jerr := json.Marshal(res)
+	if jerr != nil {
+		s.cache.Delete(ctx, cacheKey)
+		return
+	}
+	s.cache.Set(ctx, cacheKey, string(buf), urlcache.WithExpires(s.config.Idempotency.Window))
+}
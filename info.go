@@ -0,0 +1,91 @@
+package sharaq
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"net/http"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/imageinfo"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/phash"
+	"github.com/lestrrat-go/sharaq/internal/placeholder"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/util"
+)
+
+type infoResponse struct {
+	*imageinfo.Info
+	URL            string `json:"url"`
+	Source         string `json:"source"` // "stored" or "origin"
+	DominantColor  string `json:"dominant_color,omitempty"`
+	BlurHash       string `json:"blurhash,omitempty"`
+	PerceptualHash string `json:"phash,omitempty"`
+}
+
+// handleInfo replies with information about the source image. The
+// stored copy of the original is used if available, so that the origin
+// is not hit
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	ctx := util.RequestCtx(r)
+
+	u, err := s.getTargetURL(r)
+	if err != nil {
+		log.Debugf(ctx, "Bad url: %s", err)
+		httpError(w, r, "Bad url", http.StatusBadRequest)
+		return
+	}
+
+	if !s.allowedTarget(u) {
+		httpError(w, r, "Specified url not allowed", http.StatusForbidden)
+		return
+	}
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	source := "origin"
+	if storage, ok := s.backend.(Storage); ok {
+		if _, ok := s.config.Presets[OriginalPreset]; ok {
+			if _, err := storage.Fetch(ctx, u, OriginalPreset, buf); err == nil {
+				source = "stored"
+			} else {
+				buf.Reset()
+			}
+		}
+	}
+
+	if source == "origin" {
+		// An empty rule fetches the image as is
+		var res transformer.Result
+		res.Content = buf
+		if err := s.transformer.Transform(ctx, "", u.String(), &res); err != nil {
+			log.Debugf(ctx, "failed to fetch %s: %s", u, err)
+			httpError(w, r, "Failed to fetch image", http.StatusBadGateway)
+			return
+		}
+	}
+
+	info, err := imageinfo.Inspect(buf.Bytes())
+	if err != nil {
+		log.Debugf(ctx, "failed to inspect %s: %s", u, err)
+		httpError(w, r, "Failed to decode image", http.StatusUnprocessableEntity)
+		return
+	}
+
+	resp := infoResponse{
+		Info:   info,
+		URL:    u.String(),
+		Source: source,
+	}
+
+	// These are the same values that are stored along with each variant
+	if m, _, err := image.Decode(bytes.NewReader(buf.Bytes())); err == nil {
+		resp.DominantColor, resp.BlurHash = placeholder.Compute(m)
+		resp.PerceptualHash = phash.Format(phash.DHash(m))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -1,34 +1,165 @@
 package sharaq
 
 import (
+	"io"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sync"
 	"time"
 
 	"github.com/lestrrat-go/sharaq/aws"
+	"github.com/lestrrat-go/sharaq/errreport"
+	"github.com/lestrrat-go/sharaq/events"
 	"github.com/lestrrat-go/sharaq/fs"
 	"github.com/lestrrat-go/sharaq/gcp"
+	"github.com/lestrrat-go/sharaq/internal/kvconfig"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/throttle"
 	"github.com/lestrrat-go/sharaq/internal/transformer"
 	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/metadata"
 	"golang.org/x/net/context"
+	"golang.org/x/sync/singleflight"
 )
 
 type Server struct {
-	backend     Backend
-	config      *Config
-	cache       *urlcache.URLCache
-	bucketName  string
-	logConfig   *LogConfig
-	tokens      map[string]struct{} // tokens required to accept administrative requests
-	transformer *transformer.Transformer
-	whitelist   []*regexp.Regexp
+	adminAccess     *accessControl
+	auditLog        io.Writer  // nil if Config.AuditLog is not specified
+	auditMu         sync.Mutex // serializes writes to auditLog
+	backend         Backend
+	budget          *byteBudget // counts bytes against Config.Budget. survives reloads
+	config          *Config
+	configReporter  errreport.Reporter // created from config
+	csrfKey         []byte             // used to sign CSRF tokens for the view page
+	custom          components         // specified via options to NewServer
+	dynamic         *dynamicConfig     // nil unless Config.Dynamic is specified
+	engine          healthStatus       // result of the transformer self-test, see selfTest
+	duplicateMu     sync.Mutex         // serializes updates of the duplicate index
+	cache           *urlcache.URLCache
+	bucketName      string
+	errorReporter   errreport.Reporter // set via SetErrorReporter
+	configPublisher events.Publisher   // created from config
+	eventPublisher  events.Publisher   // set via SetEventPublisher
+	eventSem        chan struct{}      // limits the number of events in flight. nil if events are not published
+	guardianAccess  *accessControl
+	handlers        map[string]http.Handler // by role, for roles with middleware
+	health          *healthMonitor          // nil unless Config.Health is specified
+	inflight        singleflight.Group      // misses being transformed, by url
+	jobs            *jobTracker             // in-flight transformations
+	mirror          *mirror                 // nil unless mirroring is enabled
+	presetSources   map[string][]*regexp.Regexp
+	presetTemplates []*presetTemplate       // sorted by name
+	readOnly        readOnlyMode            // see Config.ReadOnly. survives reloads
+	reloadCh        chan struct{}           // see Reload
+	rejectedConfig  string                  // fingerprint of config files that failed to parse, see Watch
+	notFoundImage   []byte                  // served with 404 for missing source images
+	stale           *staleCache             // last known variants, for the "stale" fallback policy
+	textOverlays    map[string]*textOverlay // by preset
+	throttle        *throttle.Throttle      // nil unless Config.Throttle is specified
+	hostLimiter     *throttle.HostLimiter   // nil unless Jobs.HostRate(s) are specified
+	internalAccess  *accessControl          // clients allowed to request internal presets without a signature
+	internalPresets map[string]struct{}     // presets and preset templates restricted to internal clients
+	tokens          map[string]struct{}     // tokens required to accept administrative requests
+	transformer     *transformer.Transformer
+	whitelist       []*regexp.Regexp
 }
 
+// Backend stores variants of source images. StoreTransformedContent
+// stores each preset independently, and the bundled backends report
+// which presets failed (see FailedPresets). Delete removes the variants
+// for the given presets. If the list of presets is nil, the variants for
+// all presets are removed
 type Backend interface {
 	Get(context.Context, *url.URL, string) (http.Handler, error)
-	StoreTransformedContent(context.Context, *url.URL) error
-	Delete(context.Context, *url.URL) error
+	StoreTransformedContent(context.Context, *url.URL, map[string]string) error
+	Delete(context.Context, *url.URL, []string) error
+}
+
+// Storage is implemented by backends that allow direct access to the
+// individual variants that they store. This is used by maintenance tools
+// such as `sharaq migrate`, which need to move content between backends
+// without going through the transformer.
+//
+// Fetch writes the content of the variant to the given writer, and
+// returns the metadata that was recorded when it was stored. If the
+// variant does not exist, an error for which
+// errors.IsTransformationRequired() returns true is returned.
+//
+// Put verifies that the content was stored correctly, and records the
+// given metadata along with it. The SHA-256 checksum of the content is
+// computed by Put, and overwrites the one in the metadata.
+//
+// Metadata returns the metadata for the variant without fetching its
+// content. Variants stored by older versions of sharaq may have
+// incomplete metadata.
+type Storage interface {
+	Fetch(context.Context, *url.URL, string, io.Writer) (*metadata.Metadata, error)
+	Put(context.Context, *url.URL, string, []byte, *metadata.Metadata) error
+	Metadata(context.Context, *url.URL, string) (*metadata.Metadata, error)
+}
+
+// Lister is implemented by backends that can enumerate the variants
+// that they store. The given function is called with the metadata of
+// each variant. This is used by `sharaq gc` to find variants whose
+// source no longer exists.
+type Lister interface {
+	List(context.Context, func(*metadata.Metadata) error) error
+}
+
+// LifecycleManager is implemented by backends whose storage can expire
+// variants by itself. ApplyLifecycle configures the storage according
+// to the backend configuration, and returns a description of the rules.
+// If dryRun is true, nothing is changed
+type LifecycleManager interface {
+	ApplyLifecycle(ctx context.Context, dryRun bool) ([]string, error)
+}
+
+// Locator is implemented by backends that can tell where a variant is
+// stored. VariantPath returns the path of the variant as it appears in
+// the logs of the storage (e.g. the object key), which is what the
+// reverse index maps back to the source URL
+type Locator interface {
+	VariantPath(*url.URL, string) string
+}
+
+// HealthChecker is implemented by backends that can probe their
+// storage, by writing and deleting a small object. CheckHealth returns
+// an error if the storage cannot be written to
+type HealthChecker interface {
+	CheckHealth(context.Context) error
+}
+
+// HealthConfig enables periodic health checks of the backends, which
+// are reported by /ready. If a previous backend is configured, requests
+// fail over to it while the backend is unhealthy
+type HealthConfig struct {
+	Interval  time.Duration // time between checks. default is 30 seconds
+	Timeout   time.Duration // time after which a check fails. default is 10 seconds
+	Threshold int           // number of consecutive failed checks after which a backend is unhealthy. default is 2
+}
+
+// WatchConfig makes the server reload its config file when the file,
+// or one of the files that it includes, changes. Files are compared by
+// content, so that updates done by replacing symlinks (e.g. mounted
+// Kubernetes ConfigMaps) are noticed
+type WatchConfig struct {
+	Interval time.Duration // time between checks. default is 10 seconds
+}
+
+// DuplicateIndexConfig enables the duplicate index, which finds source
+// images that look alike by their perceptual hashes (see
+// /admin/duplicates)
+type DuplicateIndexConfig struct {
+	TTL         time.Duration // how long entries are kept after the source was last transformed. default is 30 days
+	BucketSize  int           // maximum number of sources listed per bucket. default is 100
+	MaxDistance int           // default number of bits that hashes of duplicates may differ in, up to 7. default is 5
+}
+
+// ReverseIndexConfig enables the reverse index, which maps the paths of
+// stored variants back to their source URLs (see /admin/lookup)
+type ReverseIndexConfig struct {
+	TTL time.Duration // how long entries are kept after the variant was last stored. default is 30 days
 }
 
 type LogConfig struct {
@@ -37,23 +168,340 @@ type LogConfig struct {
 	RotationTime time.Duration
 	MaxAge       time.Duration
 	Location     string
+	Format       string // "combined" (default), "combined+extras", or "json"
 }
 
 type BackendConfig struct {
 	Amazon     aws.Config // AWS specific config
-	Type       string     // "aws" or "gcp" ("fs" for local debugging)
+	Type       string     // "aws" or "gcp" ("fs" or "memory" for local debugging and tests)
 	FileSystem fs.Config  // File system specific config
 	Google     gcp.Config `env:"gcp"` // Google specific config
+
+	// Previous is the backend that is being migrated away from. If
+	// specified, variants are written to both backends, and read from
+	// this backend if they are not found in the new one
+	Previous *BackendConfig
+
+	// ContentKeys makes variants be stored under the checksum of their
+	// source image instead of its URL. The same image published under
+	// several URLs is transformed and stored only once, and an image
+	// that changes at the same URL gets new variants. It can not be
+	// used with Previous
+	ContentKeys bool
+}
+
+// AccessConfig restricts access to administrative endpoints
+type AccessConfig struct {
+	AllowFrom         []string // list of networks (CIDR) or addresses allowed to connect. if empty, all are allowed
+	RequireClientCert bool     // require a TLS client certificate signed by TLS.ClientCAFile
+}
+
+// InternalPresetsConfig restricts presets to internal clients, such as
+// large "original quality" presets that should not be public. The
+// dispatcher only serves these presets to clients allowed by AllowFrom,
+// and to requests with a valid signature (see Signing)
+type InternalPresetsConfig struct {
+	Presets   []string // names of presets or preset templates
+	AllowFrom []string // list of networks (CIDR) or addresses allowed to request them without a signature
+}
+
+// IdempotencyConfig controls how guardian requests that are sent with
+// an Idempotency-Key header are replayed
+type IdempotencyConfig struct {
+	Window time.Duration // how long results are replayed. default is 24 hours
+}
+
+// JobsConfig controls when variants requested via the guardian are
+// generated, so that bulk imports do not overwhelm the origin
+type JobsConfig struct {
+	HostRate  float64            // origin fetches per second to each source host. 0 means unlimited
+	HostBurst int                // fetches allowed at once before HostRate applies. default is 1
+	HostRates map[string]float64 // HostRate for specific source hosts
+	MaxDelay  time.Duration      // how far in the future not_before may be. default is 24 hours
+
+	// Parallelism is the number of presets of a job that are transformed
+	// at once. Lower values trade latency for peak memory. 0 means all
+	// of them. Guardian requests may override it ("parallelism")
+	Parallelism int
+}
+
+// PlaceholderConfig enables /placeholder/{preset}, which serves solid
+// images with the dimensions of the preset, for development environments
+// that do not have the real images
+type PlaceholderConfig struct {
+	Background   string // color in RRGGBB form, used unless "bg" is given. default is "cccccc"
+	CacheControl string // default is "public, max-age=86400"
+}
+
+// VersioningConfig enables dispatcher URLs that carry a version token
+// ("v"), which are served with a long-lived Cache-Control header
+type VersioningConfig struct {
+	CacheControl string // default is "public, max-age=31536000, immutable"
+}
+
+// ThrottleConfig keeps batch work (POST requests to the guardian) from
+// slowing down interactive work (variants generated on a miss)
+type ThrottleConfig struct {
+	// BatchCPUBudget is the fraction (0 to 1) of GOMAXPROCS that batch
+	// work may use. Batch work also waits while interactive work keeps
+	// all CPUs busy
+	BatchCPUBudget float64
+}
+
+// ListenerConfig specifies an additional address to listen on, and
+// the roles served there (see RoleDispatch and friends)
+type ListenerConfig struct {
+	Addr   string
+	Roles  []string
+	TLS    *TLSConfig    // if nil, plain HTTP is served
+	Access *AccessConfig // restrictions for all requests to this listener
+}
+
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string // CA used to verify client certificates. required for RequireClientCert
+	HTTP3        bool   // also serve HTTP/3 (QUIC) on the same UDP port. requires building with -tags quic
+}
+
+// AuditConfig specifies where deletions are recorded
+type AuditConfig struct {
+	File string // entries are appended to this file, which is never rotated or truncated by sharaq
+}
+
+// CompressionConfig enables gzip compression of responses. Images are
+// never compressed
+type CompressionConfig struct {
+	Routes []string // path prefixes of routes to compress. default is /admin/, /info, and /sign
+}
+
+// BudgetConfig limits the number of bytes fetched from the origin and
+// stored in the backend per clock hour and per UTC day. While a budget
+// is exceeded, misses are redirected to the origin without transforming
+// them, and guardian requests are rejected. 0 means no limit
+type BudgetConfig struct {
+	OriginBytesPerHour int64
+	OriginBytesPerDay  int64
+	UploadBytesPerHour int64
+	UploadBytesPerDay  int64
+}
+
+// FallbackConfig specifies what to do when the backend storage cannot
+// be reached
+type FallbackConfig struct {
+	Policy     string        // "origin" (default), "stale", or "unavailable"
+	RetryAfter time.Duration // Retry-After sent by "unavailable". default is 30 seconds
+	StaleSize  int           // number of variants remembered by "stale". default is 10000
+	StaleBytes int64         // total size of the variants remembered by "stale". default is 64MB
+}
+
+// LimitsConfig caps the size of requests. Requests exceeding these
+// limits are rejected with 413
+type LimitsConfig struct {
+	MaxQuerySize  int           // maximum length of the query string in bytes. default is 8KB
+	MaxBodySize   int64         // maximum size of the request body in bytes. default is 1MB
+	MaxFormValues int           // maximum number of query and form values. default is 100
+	MaxWait       time.Duration // longest wait=... honored by the dispatcher. default is 10 seconds
+}
+
+// FlagConfig is a feature flag, which changes the transformation rules
+// of presets for a portion of source images. Use it to roll out changes
+// to encoder settings gradually, and to compare them against the
+// current settings
+type FlagConfig struct {
+	Percent float64  // percentage of source URLs that the flag is enabled for, from 0 to 100
+	Rule    string   // options appended to the rule of each preset, such as "linear,q80"
+	Presets []string // presets that the flag applies to. default is all but "original"
+}
+
+// UpstreamConfig makes this instance an edge of another sharaq instance,
+// the upstream, which generates variants on its behalf. Misses are
+// requested from the upstream, instead of being transformed here, and
+// the variants are then stored in the backend of the edge
+type UpstreamConfig struct {
+	URL   string        // base URL of the upstream, such as "http://sharaq.central:9090/"
+	Token string        // sent as the Sharaq-Token header. must be one of the Tokens of the upstream
+	Wait  time.Duration // how long the upstream may take to generate a missing variant. default is 10 seconds
+}
+
+// MirrorConfig specifies a sharaq instance that receives copies of a
+// portion of GET requests to the dispatcher, for example to try out
+// a new version against real traffic. Responses from the mirror are
+// discarded
+type MirrorConfig struct {
+	URL         string        // base URL of the mirror, such as "http://canary:9090/"
+	Percent     float64       // percentage of requests to mirror, from 0 to 100
+	Timeout     time.Duration // time limit for each mirrored request. default is 5 seconds
+	MaxInFlight int           // requests beyond this many in flight are not mirrored. default is 100
+}
+
+// NormalizationConfig specifies how source URLs are canonicalized, in
+// addition to what is always done (see util.NormalizeURL)
+type NormalizationConfig struct {
+	// StripParams lists query parameters that are removed from source
+	// URLs, such as "fbclid". Names ending in "*" are prefixes ("utm_*")
+	StripParams []string
+}
+
+// NotFoundConfig specifies what to do after the origin replied with
+// 404 or 410 for a source image
+type NotFoundConfig struct {
+	TTL         time.Duration // how long to reply with 404 without checking the origin again. default is 10 minutes
+	Placeholder string        // path to an image that is served along with the 404 status
+}
+
+// PresetTemplate defines a family of presets, whose names contain the
+// width and/or height of the variant, such as "thumb-{w}x{h}". Each
+// dimension must be within its bounds, so that only a limited number
+// of variants can be created
+type PresetTemplate struct {
+	Rule         string   // rule with {w} and {h} placeholders. default is "{w}x{h}"
+	MinWidth     int      // minimum value of {w}
+	MaxWidth     int      // maximum value of {w}. required if the name contains {w}
+	MinHeight    int      // minimum value of {h}
+	MaxHeight    int      // maximum value of {h}. required if the name contains {h}
+	AspectRatios []string // allowed ratios of {w} to {h}, such as "4:3". any ratio is allowed if empty
+}
+
+// TextOverlayConfig allows dispatcher requests for a preset to have
+// text, such as "SOLD OUT", drawn onto the variant. The text is given
+// as the "text" parameter, which must be signed. Each text creates a
+// separate variant, so only the listed texts are accepted
+type TextOverlayConfig struct {
+	Texts      []string // texts that may be drawn. required
+	Font       string   // "basic" (default), "inconsolata", or "inconsolata-bold"
+	Size       int      // height of the text in pixels. default is 1/8 of the variant
+	Position   string   // "c", "n", "s", "e", "w", "ne", "nw", "se" (default), or "sw"
+	Color      string   // color of the text as RRGGBB. default is white
+	Background string   // color of the box behind the text as RRGGBB. no box if empty
+}
+
+// SigningConfig enables signed dispatcher URLs, which expire after
+// a given time. See SignURL
+type SigningConfig struct {
+	Key        string        // secret key used to sign URLs
+	Required   bool          // reject dispatcher requests without a valid signature
+	BaseURL    string        // base URL of signed URLs returned by /sign. default is derived from the request
+	DefaultTTL time.Duration // used by /sign if ttl is not specified. default is 24 hours
+	MaxTTL     time.Duration // maximum ttl accepted by /sign. default is 30 days
+}
+
+// OriginalPreset is the name of the built-in preset that stores the
+// untransformed source image. See OriginalConfig
+const OriginalPreset = "original"
+
+// OriginalConfig configures the built-in "original" preset, which stores
+// a copy of the source image in the backend
+type OriginalConfig struct {
+	Strip bool // re-encode the image, which strips metadata such as EXIF
+}
+
+// OriginConfig controls how source images are fetched
+type OriginConfig struct {
+	UserAgent string            // default is "sharaq/<version>"
+	Headers   map[string]string // additional headers sent with each request
+	MaxSize   int64             // maximum size of source images in bytes. 0 means no limit
+
+	// RedirectStatus is the status used to redirect clients to the
+	// source image when a variant is not available: 301, 302 (default),
+	// 303, 307, or 308
+	RedirectStatus int
+	// RedirectCacheControl, if specified, is sent as the Cache-Control
+	// header along with redirects to the source image
+	RedirectCacheControl string
+
+	// ResultCacheSize is the number of bytes of transformed images kept
+	// in memory, keyed by the checksum of the source image. When the
+	// same image is published under different URLs, this process
+	// transforms it only once. To store it only once as well, see
+	// BackendConfig.ContentKeys. 0 disables the cache
+	ResultCacheSize int64
+
+	// SpoolThreshold is the size in bytes above which source images are
+	// spooled to a temporary file in SpoolDir while they are transformed,
+	// instead of being held in memory. 0 means never
+	SpoolThreshold int64
+	SpoolDir       string // default is the system temporary directory
+
+	// Rewrites are applied in order to the URLs of source images before
+	// they are fetched. Variants are still stored under the original URL
+	Rewrites []RewriteRule
+}
+
+// RewriteRule rewrites the URLs of source images that match it, for
+// example to fetch them from an internal host instead of a public CDN
+type RewriteRule struct {
+	Match       string   // regular expression matched against the source URL
+	Replace     string   // replacement for the matched part, which may refer to submatches ($1). if empty, the URL is kept
+	StripParams []string // query parameters removed from matching URLs. names ending in "*" are prefixes
+}
+
+type MetricsConfig struct {
+	Type    string // "statsd". metrics are discarded if empty
+	Statsd  metrics.StatsdConfig
+	Presets []string // presets used as tag values. default is all keys of Presets. others are tagged as "other"
+
+	// QualitySamplePercent is the percentage (0 to 100) of
+	// transformations whose output is compared against the image
+	// before encoding. PSNR and SSIM are reported as histograms
+	QualitySamplePercent float64
+	// QualityBaseline, if specified, is a format that sampled images
+	// are additionally encoded in, so that the current encoding can be
+	// compared against it (e.g. "jpeg" while migrating to another format)
+	QualityBaseline string
 }
 
 type Config struct {
-	filename  string
-	AccessLog *LogConfig // access log. if nil, logs to stderr
-	Backend   BackendConfig
-	Debug     bool
-	Listen    string // listen on this address. default is 0.0.0.0:9090
-	Presets   map[string]string
-	Tokens    []string
-	URLCache  *urlcache.Config
-	Whitelist []string
+	defaults        []string // names of parameters that were filled in with default values
+	environment     string   // overlay that was applied, if any
+	filename        string
+	files           []string // config files that were read, including includes and the overlay
+	fingerprint     string   // checksum of files, see Watch
+	loadedAt        time.Time
+	AccessLog       *LogConfig    // access log. if nil, logs to stderr
+	Admin           *AccessConfig // restrictions for /admin/ endpoints
+	AuditLog        *AuditConfig  // log of deletions. if nil, logs to the debug log
+	Backend         BackendConfig
+	Budget          *BudgetConfig      // if non-nil, limits the bytes fetched and stored per hour and day
+	Compression     *CompressionConfig // if non-nil, compresses non-image responses
+	Debug           bool
+	Dynamic         *kvconfig.Config      // if non-nil, reads Presets, Whitelist and Flags from Consul or etcd
+	DuplicateIndex  *DuplicateIndexConfig // if non-nil, enables /admin/duplicates
+	ErrorReport     *errreport.Config
+	Events          *events.Config        // if non-nil, publishes an event for each stored or deleted variant
+	Fallback        FallbackConfig        // what to do when the backend is unavailable
+	Flags           map[string]FlagConfig // feature flags, by name
+	Guardian        *AccessConfig         // restrictions for POST and DELETE requests
+	Idempotency     IdempotencyConfig     // replay of guardian requests with Idempotency-Key
+	Jobs            JobsConfig            // scheduling of guardian requests
+	Limits          LimitsConfig          // maximum sizes of requests
+	Listen          string                // listen on this address. default is 0.0.0.0:9090
+	Listeners       []ListenerConfig      // if specified, used instead of Listen and TLS
+	Metrics         *MetricsConfig
+	Middleware      map[string][]MiddlewareConfig // built-in middleware, by role
+	Mirror          *MirrorConfig                 // if non-nil, GET requests are mirrored to another instance
+	Normalization   NormalizationConfig           // canonicalization of source URLs
+	Internal        *InternalPresetsConfig        // if non-nil, restricts presets to internal clients
+	Health          *HealthConfig                 // if non-nil, enables health checks of the backends and /ready
+	NotFound        NotFoundConfig                // what to do when source images do not exist
+	Origin          OriginConfig
+	Placeholders    *PlaceholderConfig  // if non-nil, enables /placeholder/{preset}
+	ReadOnly        bool                // if true, variants are served, but never transformed, stored or deleted
+	ReverseIndex    *ReverseIndexConfig // if non-nil, enables /admin/lookup
+	Original        *OriginalConfig     // if non-nil, enables the "original" preset
+	Presets         map[string]string
+	PresetMaxBytes  map[string]int64             // maximum size of JPEG variants in bytes, by preset
+	PresetSources   map[string][]string          // patterns of source URLs that each preset may be applied to
+	PresetTemplates map[string]PresetTemplate    // parameterized presets such as "thumb-{w}x{h}"
+	Profiles        map[string][]string          // named sets of presets that guardian requests may target ("profile")
+	Signing         *SigningConfig               // if non-nil, enables signed dispatcher URLs
+	TextOverlays    map[string]TextOverlayConfig // text drawn onto variants of presets, by preset
+	Throttle        *ThrottleConfig              // if nil, batch work is not throttled
+	TLS             *TLSConfig
+	Tokens          []string
+	Upstream        *UpstreamConfig // if non-nil, variants are generated by another sharaq instance
+	URLCache        *urlcache.Config
+	Versioning      *VersioningConfig // if non-nil, enables versioned dispatcher URLs
+	Watch           *WatchConfig      // if non-nil, reloads the config file when it changes
+	Whitelist       []string
 }
@@ -0,0 +1,259 @@
+// Package accesslog implements access logs that carry sharaq specific
+// information about each request, such as the preset that was requested,
+// and whether the URL cache was hit or not.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"golang.org/x/net/context"
+)
+
+// Possible values for Entry.Cache
+const (
+	CacheHit      = "hit"
+	CacheMiss     = "miss"
+	CacheNegative = "negative"
+)
+
+// Formats that can be specified in the access log configuration
+const (
+	FormatCombined       = "combined"
+	FormatCombinedExtras = "combined+extras"
+	FormatJSON           = "json"
+)
+
+// Entry holds the sharaq specific bits of information about a request.
+// Handlers and backends fill it in as they process the request. All
+// methods are safe to call on a nil *Entry, so that code does not need
+// to care if access logging is enabled or not
+type Entry struct {
+	mu            sync.Mutex
+	preset        string
+	sourceHost    string
+	cache         string
+	backend       string
+	transformTime time.Duration
+}
+
+type entryKey struct{}
+
+// WithEntry returns a new context that carries the given entry
+func WithEntry(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, entryKey{}, e)
+}
+
+// FromContext returns the entry associated with the context, or nil
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(entryKey{}).(*Entry)
+	return e
+}
+
+func (e *Entry) SetPreset(s string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.preset = s
+	e.mu.Unlock()
+}
+
+func (e *Entry) SetSourceHost(s string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.sourceHost = s
+	e.mu.Unlock()
+}
+
+func (e *Entry) SetCache(s string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.cache = s
+	e.mu.Unlock()
+}
+
+// Cache returns the URL cache status recorded so far
+func (e *Entry) Cache() string {
+	if e == nil {
+		return ""
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cache
+}
+
+func (e *Entry) SetBackend(s string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.backend = s
+	e.mu.Unlock()
+}
+
+func (e *Entry) SetTransformTime(d time.Duration) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.transformTime = d
+	e.mu.Unlock()
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+type handler struct {
+	format string
+	h      http.Handler
+	mu     sync.Mutex
+	out    io.Writer
+}
+
+// Wrap creates a handler that logs each request to out using the
+// specified format (FormatCombinedExtras or FormatJSON)
+func Wrap(h http.Handler, out io.Writer, format string) http.Handler {
+	return &handler{
+		format: format,
+		h:      h,
+		out:    out,
+	}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	e := &Entry{}
+	rw := &responseWriter{ResponseWriter: w}
+
+	h.h.ServeHTTP(rw, r.WithContext(WithEntry(r.Context(), e)))
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	e.mu.Lock()
+	switch h.format {
+	case FormatJSON:
+		writeJSON(buf, r, rw, e, start)
+	default:
+		writeCombinedExtras(buf, r, rw, e, start)
+	}
+	e.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buf.WriteTo(h.out)
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func writeCombinedExtras(buf io.Writer, r *http.Request, rw *responseWriter, e *Entry, start time.Time) {
+	fmt.Fprintf(buf, "%s - - [%s] \"%s %s %s\" %d %d %q %q",
+		remoteHost(r),
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method,
+		r.URL.RequestURI(),
+		r.Proto,
+		rw.status,
+		rw.size,
+		dash(r.Referer()),
+		dash(r.UserAgent()),
+	)
+	fmt.Fprintf(buf, " preset=%s src=%s cache=%s backend=%s transform=%.3f elapsed=%.3f\n",
+		dash(e.preset),
+		dash(e.sourceHost),
+		dash(e.cache),
+		dash(e.backend),
+		e.transformTime.Seconds(),
+		time.Since(start).Seconds(),
+	)
+}
+
+type jsonEntry struct {
+	Time          string  `json:"time"`
+	RemoteHost    string  `json:"remote_host"`
+	Method        string  `json:"method"`
+	URI           string  `json:"uri"`
+	Protocol      string  `json:"protocol"`
+	Status        int     `json:"status"`
+	Size          int64   `json:"size"`
+	Referer       string  `json:"referer,omitempty"`
+	UserAgent     string  `json:"user_agent,omitempty"`
+	Preset        string  `json:"preset,omitempty"`
+	SourceHost    string  `json:"source_host,omitempty"`
+	Cache         string  `json:"cache,omitempty"`
+	Backend       string  `json:"backend,omitempty"`
+	TransformTime float64 `json:"transform_time,omitempty"`
+	Elapsed       float64 `json:"elapsed"`
+}
+
+func writeJSON(buf io.Writer, r *http.Request, rw *responseWriter, e *Entry, start time.Time) {
+	json.NewEncoder(buf).Encode(jsonEntry{
+		Time:          start.Format(time.RFC3339),
+		RemoteHost:    remoteHost(r),
+		Method:        r.Method,
+		URI:           r.URL.RequestURI(),
+		Protocol:      r.Proto,
+		Status:        rw.status,
+		Size:          rw.size,
+		Referer:       r.Referer(),
+		UserAgent:     r.UserAgent(),
+		Preset:        e.preset,
+		SourceHost:    e.sourceHost,
+		Cache:         e.cache,
+		Backend:       e.backend,
+		TransformTime: e.transformTime.Seconds(),
+		Elapsed:       time.Since(start).Seconds(),
+	})
+}
+
+// ValidFormat returns true if the given format name is known
+func ValidFormat(s string) bool {
+	switch s {
+	case "", FormatCombined, FormatCombinedExtras, FormatJSON:
+		return true
+	}
+	return false
+}
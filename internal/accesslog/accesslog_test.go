@@ -0,0 +1,56 @@
+package accesslog_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/sharaq/internal/accesslog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLog(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := accesslog.FromContext(r.Context())
+		e.SetPreset("small")
+		e.SetSourceHost("images.example.com")
+		e.SetCache(accesslog.CacheHit)
+		e.SetBackend("fs")
+		w.WriteHeader(http.StatusFound)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/?url=http://images.example.com/a.jpg&preset=small", nil)
+		accesslog.Wrap(h, &out, accesslog.FormatJSON).ServeHTTP(w, r)
+
+		var v map[string]interface{}
+		if !assert.NoError(t, json.Unmarshal(out.Bytes(), &v), "log line should be valid JSON") {
+			return
+		}
+		assert.Equal(t, "small", v["preset"], "preset should match")
+		assert.Equal(t, "images.example.com", v["source_host"], "source_host should match")
+		assert.Equal(t, "hit", v["cache"], "cache should match")
+		assert.Equal(t, "fs", v["backend"], "backend should match")
+		assert.Equal(t, float64(http.StatusFound), v["status"], "status should match")
+	})
+	t.Run("combined+extras", func(t *testing.T) {
+		var out bytes.Buffer
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/?url=http://images.example.com/a.jpg&preset=small", nil)
+		accesslog.Wrap(h, &out, accesslog.FormatCombinedExtras).ServeHTTP(w, r)
+
+		l := out.String()
+		assert.True(t, strings.Contains(l, " 302 0 "), "status and size should be logged")
+		assert.True(t, strings.Contains(l, "preset=small src=images.example.com cache=hit backend=fs"), "extras should be logged")
+	})
+	t.Run("nil entry", func(t *testing.T) {
+		// Methods must be safe to call when access logging is disabled
+		e := accesslog.FromContext(httptest.NewRequest("GET", "/", nil).Context())
+		e.SetCache(accesslog.CacheMiss)
+	})
+}
@@ -1,9 +1,22 @@
 package errors
 
 import (
+	stderrors "errors"
+
 	daverr "github.com/pkg/errors"
 )
 
+// Kinds of errors. Errors are tagged with these using WithKind, so that
+// callers can branch on them using IsKind
+var (
+	ErrSourceNotAllowed = stderrors.New("source not allowed")
+	ErrPresetUnknown    = stderrors.New("unknown preset")
+	ErrSourceNotFound   = stderrors.New("source not found")
+	ErrSourceTooLarge   = stderrors.New("source too large")
+	ErrTransformFailed  = stderrors.New("transformation failed")
+	ErrStorage          = stderrors.New("storage error")
+)
+
 type transformationRequiredError interface {
 	TransformationRequired() bool
 }
@@ -12,6 +25,14 @@ type causer interface {
 	Cause() error
 }
 
+type unwrapper interface {
+	Unwrap() error
+}
+
+type kinder interface {
+	Is(error) bool
+}
+
 type TransformationRequiredError struct{}
 
 func (e TransformationRequiredError) Error() string {
@@ -36,6 +57,94 @@ func IsTransformationRequired(err error) bool {
 	return false
 }
 
+type storageUnavailableError interface {
+	StorageUnavailable() bool
+}
+
+// StorageUnavailableError is returned by backends when the underlying
+// storage could not be reached, as opposed to the variant not existing
+type StorageUnavailableError struct {
+	Err error
+}
+
+func (e StorageUnavailableError) Error() string {
+	if e.Err == nil {
+		return "storage unavailable"
+	}
+	return "storage unavailable: " + e.Err.Error()
+}
+func (e StorageUnavailableError) StorageUnavailable() bool {
+	return true
+}
+func (e StorageUnavailableError) Is(kind error) bool {
+	return kind == ErrStorage
+}
+
+func IsStorageUnavailable(err error) bool {
+	for err != nil {
+		if sue, ok := err.(storageUnavailableError); ok {
+			return sue.StorageUnavailable()
+		}
+
+		c, ok := err.(causer)
+		if !ok {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
+
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e kindError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+func (e kindError) Cause() error {
+	return e.err
+}
+func (e kindError) Unwrap() error {
+	return e.err
+}
+func (e kindError) Is(kind error) bool {
+	return kind == e.kind
+}
+
+// WithKind tags err with the given kind. If err is nil, WithKind
+// returns nil
+func WithKind(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return kindError{kind: kind, err: err}
+}
+
+// IsKind returns true if err, or any error that it wraps, is of
+// the given kind
+func IsKind(err, kind error) bool {
+	for err != nil {
+		if err == kind {
+			return true
+		}
+		if k, ok := err.(kinder); ok && k.Is(kind) {
+			return true
+		}
+
+		switch v := err.(type) {
+		case causer:
+			err = v.Cause()
+		case unwrapper:
+			err = v.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
 func New(s string) error {
 	return daverr.New(s)
 }
@@ -51,3 +160,7 @@ func Wrap(err error, s string) error {
 func Wrapf(err error, s string, args ...interface{}) error {
 	return daverr.Wrapf(err, s, args...)
 }
+
+func Cause(err error) error {
+	return daverr.Cause(err)
+}
@@ -0,0 +1,115 @@
+package errors
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// PresetErrors maps presets to the errors that kept their variants from
+// being stored. Backends return it from StoreTransformedContent, so that
+// callers can tell which variants were stored
+type PresetErrors map[string]error
+
+// Presets returns the names of the failed presets, sorted
+func (e PresetErrors) Presets() []string {
+	names := make([]string, 0, len(e))
+	for preset := range e {
+		names = append(names, preset)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e PresetErrors) Error() string {
+	names := e.Presets()
+	msgs := make([]string, len(names))
+	for i, preset := range names {
+		msgs[i] = preset + ": " + e[preset].Error()
+	}
+	return "failed to store presets (" + strings.Join(msgs, "; ") + ")"
+}
+
+// Is returns true if the errors of all failed presets are of the
+// given kind
+func (e PresetErrors) Is(kind error) bool {
+	if len(e) == 0 {
+		return false
+	}
+	for _, err := range e {
+		if !IsKind(err, kind) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetPresetErrors returns the PresetErrors in err, if any
+func GetPresetErrors(err error) (PresetErrors, bool) {
+	for err != nil {
+		if pe, ok := err.(PresetErrors); ok {
+			return pe, true
+		}
+
+		c, ok := err.(causer)
+		if !ok {
+			return nil, false
+		}
+		err = c.Cause()
+	}
+	return nil, false
+}
+
+// PresetGroup runs a function for each preset in its own goroutine.
+// Unlike errgroup.Group, a failing preset does not cancel the others
+type PresetGroup struct {
+	errs PresetErrors
+	mu   sync.Mutex
+	sem  chan struct{}
+	wg   sync.WaitGroup
+}
+
+// SetLimit limits the number of presets that run at once. n <= 0 means
+// no limit. It must be called before Go
+func (g *PresetGroup) SetLimit(n int) {
+	if n <= 0 {
+		g.sem = nil
+		return
+	}
+	g.sem = make(chan struct{}, n)
+}
+
+// Go calls f for the given preset in a new goroutine. If the number of
+// presets running has reached the limit, f waits for one of them to
+// finish
+func (g *PresetGroup) Go(preset string, f func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if g.sem != nil {
+			g.sem <- struct{}{}
+			defer func() { <-g.sem }()
+		}
+		err := f()
+		if err == nil {
+			return
+		}
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.errs == nil {
+			g.errs = make(PresetErrors)
+		}
+		g.errs[preset] = err
+	}()
+}
+
+// Wait waits for all presets, and returns their errors as PresetErrors,
+// or nil if all of them succeeded
+func (g *PresetGroup) Wait() error {
+	g.wg.Wait()
+	if len(g.errs) == 0 {
+		return nil
+	}
+	return g.errs
+}
@@ -0,0 +1,48 @@
+package errors
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresetGroup_SetLimit(t *testing.T) {
+	var mu sync.Mutex
+	var running, peak int
+
+	var grp PresetGroup
+	grp.SetLimit(2)
+	for _, preset := range []string{"small", "medium", "large", "huge"} {
+		preset := preset
+		grp.Go(preset, func() error {
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if preset == "huge" {
+				return New(`too large`)
+			}
+			return nil
+		})
+	}
+
+	err := grp.Wait()
+	pe, ok := GetPresetErrors(err)
+	if !assert.True(t, ok, "error should be PresetErrors") {
+		return
+	}
+	if !assert.Equal(t, []string{"huge"}, pe.Presets(), "only the failed preset should be reported") {
+		return
+	}
+	assert.Equal(t, 2, peak, "at most 2 presets should run at once")
+}
@@ -0,0 +1,33 @@
+// Package flags carries the feature flags that are enabled for a
+// request, so that code far from the request (such as the transformer)
+// can tag its metrics with them
+package flags
+
+import (
+	"golang.org/x/net/context"
+)
+
+type flagsKey struct{}
+
+// With returns a new context that carries the given enabled flags
+func With(ctx context.Context, names []string) context.Context {
+	return context.WithValue(ctx, flagsKey{}, names)
+}
+
+// Get returns the flags enabled in the context
+func Get(ctx context.Context) []string {
+	if ctx == nil {
+		return nil
+	}
+	names, _ := ctx.Value(flagsKey{}).([]string)
+	return names
+}
+
+// Tags returns metrics tags for the flags enabled in the context, such
+// as "flag:fastresize". tags are appended to the result
+func Tags(ctx context.Context, tags ...string) []string {
+	for _, name := range Get(ctx) {
+		tags = append(tags, "flag:"+name)
+	}
+	return tags
+}
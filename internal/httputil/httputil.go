@@ -3,18 +3,57 @@ package httputil
 import (
 	"net/http"
 
+	"github.com/lestrrat-go/sharaq/internal/log"
 	"github.com/lestrrat-go/sharaq/internal/util"
-	"google.golang.org/appengine/log"
 )
 
-type redirectContent string
+// Redirect specifies how clients are redirected. The zero value
+// redirects with 302 and no Cache-Control header
+type Redirect struct {
+	Status       int
+	CacheControl string
+}
+
+// ValidRedirectStatus returns true if code can be used as the status of
+// a Redirect. 0 means the default
+func ValidRedirectStatus(code int) bool {
+	switch code {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// To returns a handler that redirects to u
+func (r Redirect) To(u string) http.Handler {
+	return redirectContent{Redirect: r, url: u}
+}
+
+type redirectContent struct {
+	Redirect
+	url string
+}
 
 func (s redirectContent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Debugf(util.RequestCtx(r), "Object %s exists. Redirecting to proper location", string(s))
-	w.Header().Add("Location", string(s))
-	w.WriteHeader(http.StatusFound)
+	log.Debugf(util.RequestCtx(r), "Redirecting to %s", s.url)
+	if s.CacheControl != "" {
+		w.Header().Set("Cache-Control", s.CacheControl)
+	}
+	w.Header().Add("Location", s.url)
+	status := s.Status
+	if status == 0 {
+		status = http.StatusFound
+	}
+	w.WriteHeader(status)
+}
+
+// IsRedirect returns true if h was created by Redirect.To, that is, if
+// it redirects clients instead of serving content
+func IsRedirect(h http.Handler) bool {
+	_, ok := h.(redirectContent)
+	return ok
 }
 
 func RedirectContent(u string) http.Handler {
-	return redirectContent(u)
+	return Redirect{}.To(u)
 }
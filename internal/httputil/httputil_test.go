@@ -0,0 +1,44 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		redirect     Redirect
+		status       int
+		cacheControl string
+	}{
+		{Redirect{}, http.StatusFound, ""},
+		{Redirect{Status: http.StatusTemporaryRedirect, CacheControl: "max-age=60"}, http.StatusTemporaryRedirect, "max-age=60"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.redirect.To("http://example.com/foo.jpg").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if !assert.Equal(t, tt.status, w.Code, "status should match") {
+			return
+		}
+		if !assert.Equal(t, "http://example.com/foo.jpg", w.Header().Get("Location"), "Location should match") {
+			return
+		}
+		if !assert.Equal(t, tt.cacheControl, w.Header().Get("Cache-Control"), "Cache-Control should match") {
+			return
+		}
+	}
+
+	if !assert.False(t, ValidRedirectStatus(http.StatusOK), "200 is not a redirect") {
+		return
+	}
+	if !assert.True(t, IsRedirect(RedirectContent("http://example.com/foo.jpg")), "redirects should be detected") {
+		return
+	}
+	if !assert.False(t, IsRedirect(http.NotFoundHandler()), "other handlers are not redirects") {
+		return
+	}
+}
@@ -0,0 +1,259 @@
+// Package imageinfo extracts basic information from encoded images
+// without fully decoding them
+package imageinfo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io/ioutil"
+
+	// Register decoders for image.DecodeConfig
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+)
+
+// Info describes an image
+type Info struct {
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Format       string `json:"format"`
+	Size         int64  `json:"size"`
+	Orientation  int    `json:"orientation,omitempty"` // EXIF orientation (1-8), 0 if not present
+	ColorModel   string `json:"color_model"`
+	ColorProfile string `json:"color_profile,omitempty"` // description of the embedded ICC profile, if any
+}
+
+// Inspect returns information about the encoded image in b
+func Inspect(b []byte) (*Info, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to decode image`)
+	}
+
+	info := &Info{
+		Width:      cfg.Width,
+		Height:     cfg.Height,
+		Format:     format,
+		Size:       int64(len(b)),
+		ColorModel: colorModelName(cfg.ColorModel),
+	}
+
+	switch format {
+	case "jpeg":
+		info.Orientation, info.ColorProfile = inspectJPEG(b)
+	case "png":
+		info.ColorProfile = inspectPNG(b)
+	}
+	return info, nil
+}
+
+func colorModelName(m color.Model) string {
+	switch m {
+	case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model:
+		return "rgb"
+	case color.GrayModel, color.Gray16Model:
+		return "gray"
+	case color.YCbCrModel:
+		return "ycbcr"
+	case color.CMYKModel:
+		return "cmyk"
+	}
+	if _, ok := m.(color.Palette); ok {
+		return "paletted"
+	}
+	return "unknown"
+}
+
+// inspectJPEG walks the JPEG markers up to the start of the image data,
+// and extracts the EXIF orientation and the ICC profile description
+func inspectJPEG(b []byte) (int, string) {
+	var orientation int
+	var icc []byte
+
+	if len(b) < 2 || b[0] != 0xFF || b[1] != 0xD8 {
+		return 0, ""
+	}
+
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			break
+		}
+		marker := b[i+1]
+		if marker == 0xDA || marker == 0xD9 { // start of scan, end of image
+			break
+		}
+		l := int(binary.BigEndian.Uint16(b[i+2:]))
+		if l < 2 || i+2+l > len(b) {
+			break
+		}
+		seg := b[i+4 : i+2+l]
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")):
+			orientation = exifOrientation(seg[6:])
+		case marker == 0xE2 && bytes.HasPrefix(seg, []byte("ICC_PROFILE\x00")) && len(seg) > 14:
+			// Profiles larger than a segment are split into chunks,
+			// which appear in order
+			icc = append(icc, seg[14:]...)
+		}
+		i += 2 + l
+	}
+
+	return orientation, iccDescription(icc)
+}
+
+// exifOrientation reads the orientation tag from IFD0 of the given
+// TIFF structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd, ok := fits(order.Uint32(tiff[4:]), len(tiff)-2)
+	if !ok {
+		return 0
+	}
+
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			return int(order.Uint16(tiff[e+8:]))
+		}
+	}
+	return 0
+}
+
+// inspectPNG extracts the ICC profile description from the iCCP chunk,
+// or reports "sRGB" if the sRGB chunk is present
+func inspectPNG(b []byte) string {
+	const signatureLen = 8
+	for i := signatureLen; i+8 <= len(b); {
+		l, ok := fits(binary.BigEndian.Uint32(b[i:]), len(b)-i-8)
+		if !ok {
+			break
+		}
+		typ := string(b[i+4 : i+8])
+		data := b[i+8 : i+8+l]
+
+		switch typ {
+		case "sRGB":
+			return "sRGB"
+		case "iCCP":
+			// profile name, null separator, compression method, profile
+			if n := bytes.IndexByte(data, 0); n >= 0 && n+2 <= len(data) {
+				r, err := zlib.NewReader(bytes.NewReader(data[n+2:]))
+				if err != nil {
+					return string(data[:n])
+				}
+				icc, err := ioutil.ReadAll(r)
+				if err != nil {
+					return string(data[:n])
+				}
+				if desc := iccDescription(icc); desc != "" {
+					return desc
+				}
+				return string(data[:n])
+			}
+		case "IDAT", "IEND":
+			return ""
+		}
+		i += 12 + l // length, type, data, crc
+	}
+	return ""
+}
+
+// iccDescription returns the profile description ('desc' tag) of
+// the given ICC profile
+func iccDescription(icc []byte) string {
+	const headerLen = 128
+	if len(icc) < headerLen+4 {
+		return ""
+	}
+
+	n, ok := fits(binary.BigEndian.Uint32(icc[headerLen:]), (len(icc)-headerLen-4)/12)
+	if !ok {
+		return ""
+	}
+	for i := 0; i < n; i++ {
+		e := headerLen + 4 + i*12
+		if e+12 > len(icc) {
+			return ""
+		}
+		if string(icc[e:e+4]) != "desc" {
+			continue
+		}
+
+		off, ok := fits(binary.BigEndian.Uint32(icc[e+4:]), len(icc))
+		if !ok {
+			return ""
+		}
+		size, ok := fits(binary.BigEndian.Uint32(icc[e+8:]), len(icc)-off)
+		if !ok || size < 12 {
+			return ""
+		}
+		return descText(icc[off : off+size])
+	}
+	return ""
+}
+
+// descText decodes a 'desc' (ICC v2) or 'mluc' (ICC v4) tag
+func descText(tag []byte) string {
+	switch string(tag[:4]) {
+	case "desc":
+		l, ok := fits(binary.BigEndian.Uint32(tag[8:]), len(tag)-12)
+		if !ok || l == 0 {
+			return ""
+		}
+		return string(bytes.TrimRight(tag[12:12+l], "\x00"))
+	case "mluc":
+		// Use the first record. Strings are UTF-16BE
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+		off, ok := fits(binary.BigEndian.Uint32(tag[24:]), len(tag))
+		if !ok {
+			return ""
+		}
+		l, ok := fits(binary.BigEndian.Uint32(tag[20:]), len(tag)-off)
+		if !ok {
+			return ""
+		}
+		s := tag[off : off+l]
+		runes := make([]rune, 0, len(s)/2)
+		for i := 0; i+1 < len(s); i += 2 {
+			runes = append(runes, rune(binary.BigEndian.Uint16(s[i:])))
+		}
+		return string(runes)
+	}
+	return ""
+}
+
+// fits converts v, a length or offset read from the image, to an int if
+// it is at most max. Checking before converting keeps values from going
+// negative where int has 32 bits
+func fits(v uint32, max int) (int, bool) {
+	if max < 0 || uint64(v) > uint64(max) {
+		return 0, false
+	}
+	return int(v), true
+}
@@ -0,0 +1,70 @@
+package imageinfo
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspect_PNG(t *testing.T) {
+	var buf bytes.Buffer
+	if !assert.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 30, 20))), "png.Encode should succeed") {
+		return
+	}
+
+	info, err := Inspect(buf.Bytes())
+	if !assert.NoError(t, err, "Inspect should succeed") {
+		return
+	}
+	assert.Equal(t, 30, info.Width, "width should match")
+	assert.Equal(t, 20, info.Height, "height should match")
+	assert.Equal(t, "png", info.Format, "format should match")
+	assert.Equal(t, int64(buf.Len()), info.Size, "size should match")
+}
+
+func TestInspect_JPEGOrientation(t *testing.T) {
+	var buf bytes.Buffer
+	if !assert.NoError(t, jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil), "jpeg.Encode should succeed") {
+		return
+	}
+
+	// APP1 segment with a big-endian TIFF structure containing a single
+	// orientation (0x0112) entry in IFD0
+	exif := []byte{
+		'E', 'x', 'i', 'f', 0, 0,
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		0, 1,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0,
+		0, 0, 0, 0,
+	}
+	seg := append([]byte{0xFF, 0xE1, 0, byte(len(exif) + 2)}, exif...)
+
+	b := buf.Bytes()
+	withExif := append(append(append([]byte{}, b[:2]...), seg...), b[2:]...)
+
+	info, err := Inspect(withExif)
+	if !assert.NoError(t, err, "Inspect should succeed") {
+		return
+	}
+	assert.Equal(t, "jpeg", info.Format, "format should match")
+	assert.Equal(t, 6, info.Orientation, "orientation should match")
+	assert.Equal(t, "gray", info.ColorModel, "color model should match")
+}
+
+func TestExifOrientation_BadOffset(t *testing.T) {
+	// IFD0 offsets that do not fit in an int on 32-bit platforms must
+	// not wrap around
+	for _, tiff := range [][]byte{
+		{'M', 'M', 0, 42, 0xFF, 0xFF, 0xFF, 0xF0, 0, 1},
+		{'I', 'I', 42, 0, 0xF0, 0xFF, 0xFF, 0xFF, 1, 0},
+		{'M', 'M', 0, 42, 0, 0, 0, 9, 0, 1},
+	} {
+		if !assert.Equal(t, 0, exifOrientation(tiff), "orientation should be unknown") {
+			return
+		}
+	}
+}
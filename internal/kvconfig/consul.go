@@ -0,0 +1,66 @@
+package kvconfig
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// consulWait is how long Consul holds blocking queries open
+const consulWait = "5m"
+
+type consul struct {
+	client *http.Client
+	addr   string
+	key    string
+	token  string
+}
+
+// Get uses a blocking query, so that changes are seen as soon as they
+// are made
+func (c *consul) Get(ctx context.Context, index uint64) ([]byte, uint64, error) {
+	v := url.Values{"raw": {""}}
+	if index > 0 {
+		v.Set("index", strconv.FormatUint(index, 10))
+		v.Set("wait", consulWait)
+	}
+	req, err := http.NewRequest(http.MethodGet, c.addr+"/v1/kv/"+c.key+"?"+v.Encode(), nil)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, `failed to create consul request`)
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, `failed to query consul`)
+	}
+	defer res.Body.Close()
+
+	newIndex, err := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, errors.Errorf(`consul responded without a valid X-Consul-Index`)
+	}
+	// the index may go backwards, e.g. after a snapshot restore
+	if newIndex < index {
+		newIndex = 0
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, `failed to read consul response`)
+		}
+		return b, newIndex, nil
+	case http.StatusNotFound:
+		return nil, newIndex, nil
+	default:
+		return nil, 0, errors.Errorf(`consul responded with status %d`, res.StatusCode)
+	}
+}
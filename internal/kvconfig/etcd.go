@@ -0,0 +1,93 @@
+package kvconfig
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// etcd reads the key using the JSON gateway of the v3 API. Changes are
+// noticed by polling the modification revision of the key
+type etcd struct {
+	client   *http.Client
+	addr     string
+	key      string
+	token    string
+	interval time.Duration
+}
+
+type etcdRangeRequest struct {
+	Key string `json:"key"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []struct {
+		Value       string `json:"value"`
+		ModRevision string `json:"mod_revision"` // int64 values are encoded as strings
+	} `json:"kvs"`
+}
+
+func (e *etcd) Get(ctx context.Context, index uint64) ([]byte, uint64, error) {
+	for {
+		value, rev, err := e.get(ctx)
+		if err != nil || index == 0 || rev != index {
+			return value, rev, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(e.interval):
+		}
+	}
+}
+
+func (e *etcd) get(ctx context.Context) ([]byte, uint64, error) {
+	body, err := json.Marshal(etcdRangeRequest{Key: base64.StdEncoding.EncodeToString([]byte(e.key))})
+	if err != nil {
+		return nil, 0, errors.Wrap(err, `failed to encode etcd request`)
+	}
+	req, err := http.NewRequest(http.MethodPost, e.addr+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, `failed to create etcd request`)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.token != "" {
+		req.Header.Set("Authorization", e.token)
+	}
+
+	res, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, `failed to query etcd`)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, errors.Errorf(`etcd responded with status %d`, res.StatusCode)
+	}
+
+	var rr etcdRangeResponse
+	if err := json.NewDecoder(res.Body).Decode(&rr); err != nil {
+		return nil, 0, errors.Wrap(err, `failed to decode etcd response`)
+	}
+	if len(rr.Kvs) == 0 {
+		return nil, 0, nil
+	}
+
+	kv := rr.Kvs[0]
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, `failed to decode etcd value`)
+	}
+	rev, err := strconv.ParseUint(kv.ModRevision, 10, 64)
+	if err != nil {
+		return nil, 0, errors.Errorf(`invalid mod_revision '%s' from etcd`, kv.ModRevision)
+	}
+	return value, rev, nil
+}
@@ -0,0 +1,71 @@
+// Package kvconfig reads a document from a key/value store (Consul or
+// etcd), and waits for it to change. Only the parts of the HTTP APIs
+// that are needed for this are implemented
+package kvconfig
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// DefaultInterval is the default time between polls of stores that do
+// not support blocking queries (etcd)
+const DefaultInterval = 2 * time.Second
+
+type Config struct {
+	Type     string        // "consul" or "etcd"
+	Addr     string        // base URL of the HTTP API, such as "http://127.0.0.1:8500"
+	Key      string        // key holding the document
+	Token    string        // ACL token (consul) or authentication token (etcd), if required
+	Interval time.Duration // time between polls (etcd) or after errors. default is DefaultInterval
+}
+
+// Source reads the document. Get returns the value of the key along
+// with its modification index. If index is non-zero, Get waits until
+// the index differs from the given one, or ctx is done. A missing key
+// is reported as a nil value
+type Source interface {
+	Get(ctx context.Context, index uint64) ([]byte, uint64, error)
+}
+
+// Validate returns an error if c is not usable
+func Validate(c *Config) error {
+	switch c.Type {
+	case "consul", "etcd":
+	default:
+		return errors.Errorf(`unknown key/value store type '%s'`, c.Type)
+	}
+	if !strings.HasPrefix(c.Addr, "http://") && !strings.HasPrefix(c.Addr, "https://") {
+		return errors.Errorf(`invalid key/value store address '%s'`, c.Addr)
+	}
+	if c.Key == "" {
+		return errors.New(`key is required`)
+	}
+	if c.Interval < 0 {
+		return errors.New(`interval must not be negative`)
+	}
+	return nil
+}
+
+// New creates a Source for the store described by c
+func New(c *Config) (Source, error) {
+	if err := Validate(c); err != nil {
+		return nil, err
+	}
+
+	interval := c.Interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	addr := strings.TrimSuffix(c.Addr, "/")
+	switch c.Type {
+	case "consul":
+		return &consul{client: &http.Client{}, addr: addr, key: strings.TrimPrefix(c.Key, "/"), token: c.Token}, nil
+	default:
+		return &etcd{client: &http.Client{Timeout: 10 * time.Second}, addr: addr, key: c.Key, token: c.Token, interval: interval}, nil
+	}
+}
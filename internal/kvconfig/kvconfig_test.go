@@ -0,0 +1,135 @@
+package kvconfig
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestConsul(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/sharaq/config" || r.Header.Get("X-Consul-Token") != "t0ken" {
+			w.Header().Set("X-Consul-Index", "1")
+			http.NotFound(w, r)
+			return
+		}
+		// pretend that the value changes while the query blocks
+		if r.FormValue("index") == "10" {
+			w.Header().Set("X-Consul-Index", "11")
+			w.Write([]byte(`{"v":2}`))
+			return
+		}
+		w.Header().Set("X-Consul-Index", "10")
+		w.Write([]byte(`{"v":1}`))
+	}))
+	defer srv.Close()
+
+	src, err := New(&Config{Type: "consul", Addr: srv.URL, Key: "sharaq/config", Token: "t0ken"})
+	if !assert.NoError(t, err, "New should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	v, index, err := src.Get(ctx, 0)
+	if !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, `{"v":1}`, string(v), "value should be returned") {
+		return
+	}
+	v, index, err = src.Get(ctx, index)
+	if !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, `{"v":2}`, string(v), "changed value should be returned") {
+		return
+	}
+	if !assert.Equal(t, uint64(11), index, "index should be returned") {
+		return
+	}
+
+	src, _ = New(&Config{Type: "consul", Addr: srv.URL, Key: "missing"})
+	v, _, err = src.Get(ctx, 0)
+	if !assert.NoError(t, err, "Get should succeed for missing keys") {
+		return
+	}
+	if !assert.Nil(t, v, "missing keys should have no value") {
+		return
+	}
+}
+
+func TestEtcd(t *testing.T) {
+	revisions := make(chan string, 2)
+	revisions <- "5"
+	revisions <- "5"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req etcdRangeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		key, _ := base64.StdEncoding.DecodeString(req.Key)
+		if r.URL.Path != "/v3/kv/range" || string(key) != "/sharaq/config" {
+			w.Write([]byte(`{"header":{}}`))
+			return
+		}
+
+		rev, value := "6", `{"v":2}`
+		select {
+		case rev = <-revisions:
+			value = `{"v":1}`
+		default:
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kvs": []map[string]string{{
+				"value":        base64.StdEncoding.EncodeToString([]byte(value)),
+				"mod_revision": rev,
+			}},
+		})
+	}))
+	defer srv.Close()
+
+	src, err := New(&Config{Type: "etcd", Addr: srv.URL, Key: "/sharaq/config", Interval: 10 * time.Millisecond})
+	if !assert.NoError(t, err, "New should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	v, index, err := src.Get(ctx, 0)
+	if !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, `{"v":1}`, string(v), "value should be returned") {
+		return
+	}
+	if !assert.Equal(t, uint64(5), index, "mod_revision should be returned") {
+		return
+	}
+
+	// polls until the revision changes
+	v, index, err = src.Get(ctx, index)
+	if !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, `{"v":2}`, string(v), "changed value should be returned") {
+		return
+	}
+	if !assert.Equal(t, uint64(6), index, "mod_revision should be returned") {
+		return
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []Config{
+		{Type: "zookeeper", Addr: "http://127.0.0.1:2181", Key: "x"},
+		{Type: "consul", Addr: "127.0.0.1:8500", Key: "x"},
+		{Type: "etcd", Addr: "http://127.0.0.1:2379"},
+	} {
+		if !assert.Error(t, Validate(&c), "invalid config should be rejected") {
+			return
+		}
+	}
+}
@@ -5,9 +5,13 @@ package log
 import (
 	"log"
 
+	"github.com/lestrrat-go/sharaq/internal/requestid"
 	"golang.org/x/net/context"
 )
 
-func Debugf(_ context.Context, f string, args ...interface{}) {
+func Debugf(ctx context.Context, f string, args ...interface{}) {
+	if id := requestid.Get(ctx); id != "" {
+		f = "[" + id + "] " + f
+	}
 	log.Printf(f, args...)
 }
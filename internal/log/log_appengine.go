@@ -2,6 +2,15 @@
 
 package log
 
-import "google.golang.org/appengine/log"
+import (
+	"github.com/lestrrat-go/sharaq/internal/requestid"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
 
-var Debugf = log.Debugf
+func Debugf(ctx context.Context, f string, args ...interface{}) {
+	if id := requestid.Get(ctx); id != "" {
+		f = "[" + id + "] " + f
+	}
+	log.Debugf(ctx, f, args...)
+}
@@ -0,0 +1,69 @@
+// Package metrics provides a process-wide sink for metrics. By default
+// all metrics are discarded. Call SetSink to start emitting them.
+package metrics
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Sink is the interface for metric emitters. Tags are given as
+// "key:value" strings
+type Sink interface {
+	Count(name string, value int64, tags ...string)
+	Timing(name string, d time.Duration, tags ...string)
+	Gauge(name string, value float64, tags ...string)
+	Histogram(name string, value float64, tags ...string)
+}
+
+type nullSink struct{}
+
+func (nullSink) Count(string, int64, ...string)          {}
+func (nullSink) Timing(string, time.Duration, ...string) {}
+func (nullSink) Gauge(string, float64, ...string)        {}
+func (nullSink) Histogram(string, float64, ...string)    {}
+
+var mu sync.RWMutex
+var sink Sink = nullSink{}
+
+// SetSink replaces the current sink. If the previous sink implements
+// io.Closer, it is closed. Passing nil discards all metrics
+func SetSink(s Sink) {
+	if s == nil {
+		s = nullSink{}
+	}
+
+	mu.Lock()
+	prev := sink
+	sink = s
+	mu.Unlock()
+
+	if c, ok := prev.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func current() Sink {
+	mu.RLock()
+	defer mu.RUnlock()
+	return sink
+}
+
+func Count(name string, value int64, tags ...string) {
+	current().Count(name, value, tags...)
+}
+
+func Timing(name string, d time.Duration, tags ...string) {
+	current().Timing(name, d, tags...)
+}
+
+func Gauge(name string, value float64, tags ...string) {
+	current().Gauge(name, value, tags...)
+}
+
+// Histogram records a value whose distribution is of interest, rather
+// than just the latest value
+func Histogram(name string, value float64, tags ...string) {
+	current().Histogram(name, value, tags...)
+}
@@ -0,0 +1,34 @@
+package metrics
+
+// Presets are used as tag values, and are client controlled (for
+// example, via preset templates). To keep the number of distinct tag
+// values bounded, only presets that are explicitly allowed are used
+// as is, and the rest are reported as "other"
+
+const otherPreset = "other"
+
+var presets map[string]struct{}
+
+// SetPresets specifies the presets that may be used as tag values
+func SetPresets(names []string) {
+	m := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		m[name] = struct{}{}
+	}
+
+	mu.Lock()
+	presets = m
+	mu.Unlock()
+}
+
+// PresetTag returns the "preset:<name>" tag for the given preset
+func PresetTag(preset string) string {
+	mu.RLock()
+	_, ok := presets[preset]
+	mu.RUnlock()
+
+	if !ok {
+		preset = otherPreset
+	}
+	return "preset:" + preset
+}
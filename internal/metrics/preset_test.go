@@ -0,0 +1,15 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresetTag(t *testing.T) {
+	SetPresets([]string{"small", "large"})
+	defer SetPresets(nil)
+
+	assert.Equal(t, "preset:small", PresetTag("small"), "allowed presets should be used as is")
+	assert.Equal(t, "preset:other", PresetTag("thumb-100x100"), "other presets should be reported as other")
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maximum size of a single UDP payload. This is the value recommended
+// by statsd for commodity networks
+const statsdMaxPayload = 1432
+
+// Statsd is a Sink that pushes metrics to a statsd server. Tags are
+// sent using the Datadog extension (|#tag1,tag2)
+type Statsd struct {
+	conn    net.Conn
+	done    chan struct{}
+	mu      sync.Mutex
+	pending bytes.Buffer
+	prefix  string
+	tags    []string
+	wg      sync.WaitGroup
+}
+
+type StatsdConfig struct {
+	Addr          string        // host:port of the statsd server. default is 127.0.0.1:8125
+	Prefix        string        // prefix prepended to all metric names
+	FlushInterval time.Duration // default is 1 second
+	Tags          []string      // tags that are added to all metrics
+}
+
+func NewStatsd(c *StatsdConfig) (*Statsd, error) {
+	addr := c.Addr
+	if addr == "" {
+		addr = "127.0.0.1:8125"
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to connect to statsd at %s`, addr)
+	}
+
+	interval := c.FlushInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	prefix := c.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+
+	s := &Statsd{
+		conn:   conn,
+		done:   make(chan struct{}),
+		prefix: prefix,
+		tags:   c.Tags,
+	}
+
+	s.wg.Add(1)
+	go s.flushLoop(interval)
+	return s, nil
+}
+
+func (s *Statsd) flushLoop(interval time.Duration) {
+	defer s.wg.Done()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			s.mu.Lock()
+			s.flush()
+			s.mu.Unlock()
+			return
+		case <-t.C:
+			s.mu.Lock()
+			s.flush()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// flush must be called while holding the lock
+func (s *Statsd) flush() {
+	if s.pending.Len() == 0 {
+		return
+	}
+	// Errors are ignored: metrics are best effort
+	s.conn.Write(bytes.TrimSuffix(s.pending.Bytes(), []byte{'\n'}))
+	s.pending.Reset()
+}
+
+func (s *Statsd) emit(name, value, kind string, tags []string) {
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "%s%s:%s|%s", s.prefix, name, value, kind)
+	if len(s.tags) > 0 || len(tags) > 0 {
+		line.WriteString("|#")
+		line.WriteString(strings.Join(append(append([]string(nil), s.tags...), tags...), ","))
+	}
+	line.WriteByte('\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending.Len()+line.Len() > statsdMaxPayload {
+		s.flush()
+	}
+	s.pending.Write(line.Bytes())
+}
+
+func (s *Statsd) Count(name string, value int64, tags ...string) {
+	s.emit(name, fmt.Sprintf("%d", value), "c", tags)
+}
+
+func (s *Statsd) Timing(name string, d time.Duration, tags ...string) {
+	s.emit(name, fmt.Sprintf("%f", d.Seconds()*1000), "ms", tags)
+}
+
+func (s *Statsd) Gauge(name string, value float64, tags ...string) {
+	s.emit(name, fmt.Sprintf("%f", value), "g", tags)
+}
+
+func (s *Statsd) Histogram(name string, value float64, tags ...string) {
+	s.emit(name, fmt.Sprintf("%f", value), "h", tags)
+}
+
+// Close flushes pending metrics and releases the connection
+func (s *Statsd) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return s.conn.Close()
+}
@@ -0,0 +1,46 @@
+package metrics_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err, "net.ListenPacket should succeed") {
+		return
+	}
+	defer conn.Close()
+
+	s, err := metrics.NewStatsd(&metrics.StatsdConfig{
+		Addr:          conn.LocalAddr().String(),
+		Prefix:        "sharaq",
+		FlushInterval: time.Hour,
+		Tags:          []string{"env:test"},
+	})
+	if !assert.NoError(t, err, "metrics.NewStatsd should succeed") {
+		return
+	}
+
+	s.Count("dispatcher.requests", 1, "preset:small")
+	s.Gauge("queue.length", 3)
+	s.Histogram("transform.quality.ssim", 0.5, "format:png")
+	// Close flushes pending metrics
+	if !assert.NoError(t, s.Close(), "Close should succeed") {
+		return
+	}
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if !assert.NoError(t, err, "ReadFrom should succeed") {
+		return
+	}
+
+	expected := "sharaq.dispatcher.requests:1|c|#env:test,preset:small\nsharaq.queue.length:3.000000|g|#env:test\nsharaq.transform.quality.ssim:0.500000|h|#env:test,format:png"
+	assert.Equal(t, expected, string(buf[:n]), "payload should match")
+}
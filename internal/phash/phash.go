@@ -0,0 +1,64 @@
+// Package phash computes perceptual hashes of images. Unlike checksums,
+// perceptual hashes of images that look alike (such as the same image
+// resized, recompressed, or slightly edited) differ in only a few bits
+package phash
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// Size is the number of bits in a hash
+const Size = 64
+
+// DHash returns the difference hash of m. The image is reduced to 9x8
+// gray pixels, and each bit tells whether a pixel is brighter than its
+// neighbor to the right
+func DHash(m image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(m, 9, 8, imaging.Box))
+
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if luminance(small, x, y) > luminance(small, x+1, y) {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+func luminance(m *image.NRGBA, x, y int) uint8 {
+	return m.Pix[m.PixOffset(x, y)]
+}
+
+// Distance returns the number of bits that differ between a and b
+func Distance(a, b uint64) int {
+	var n int
+	for x := a ^ b; x != 0; x &= x - 1 {
+		n++
+	}
+	return n
+}
+
+// Format returns h as 16 hex digits
+func Format(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+// Parse parses a hash returned by Format
+func Parse(s string) (uint64, error) {
+	if len(s) != Size/4 {
+		return 0, errors.Errorf(`invalid perceptual hash '%s'`, s)
+	}
+	h, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, `invalid perceptual hash '%s'`, s)
+	}
+	return h, nil
+}
@@ -0,0 +1,65 @@
+package phash
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+)
+
+// gradient creates an image that gets brighter from left to right (or
+// right to left, if reverse is true), with a dark square in the middle
+func gradient(w, h int, reverse bool) image.Image {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(x * 255 / w)
+			if reverse {
+				v = 255 - v
+			}
+			if x > w/3 && x < w*2/3 && y > h/3 && y < h*2/3 {
+				v = 0
+			}
+			m.Set(x, y, color.NRGBA{v, v, v, 0xff})
+		}
+	}
+	return m
+}
+
+func TestDHash(t *testing.T) {
+	orig := DHash(gradient(300, 200, false))
+
+	resized := DHash(imaging.Resize(gradient(300, 200, false), 150, 100, imaging.Lanczos))
+	if !assert.True(t, Distance(orig, resized) <= 3, "resized image should be near: %d", Distance(orig, resized)) {
+		return
+	}
+
+	reversed := DHash(gradient(300, 200, true))
+	if !assert.True(t, Distance(orig, reversed) > 10, "different image should be far: %d", Distance(orig, reversed)) {
+		return
+	}
+}
+
+func TestFormat(t *testing.T) {
+	h := uint64(0x00ff00ff00ff00ff)
+	s := Format(h)
+	if !assert.Equal(t, "00ff00ff00ff00ff", s, "hash should be formatted as 16 hex digits") {
+		return
+	}
+	got, err := Parse(s)
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Equal(t, h, got, "hash should round trip") {
+		return
+	}
+	for _, s := range []string{"", "00ff", "zzzzzzzzzzzzzzzz"} {
+		_, err := Parse(s)
+		if !assert.Error(t, err, "Parse should fail for '%s'", s) {
+			return
+		}
+	}
+	assert.Equal(t, 8, Distance(0, 0xff), "distance should count differing bits")
+}
@@ -0,0 +1,171 @@
+// Package placeholder computes compact representations of images that
+// front-ends can render while the actual image loads
+package placeholder
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Components used for BlurHash. 4x3 is the recommended default
+const (
+	xComponents = 4
+	yComponents = 3
+)
+
+// Images are scaled down to this width before computing placeholders.
+// The result is practically the same, at a fraction of the cost
+const sampleWidth = 32
+
+// Compute returns the dominant color (as "#rrggbb") and the BlurHash
+// of the given image
+func Compute(m image.Image) (string, string) {
+	if m.Bounds().Dx() > sampleWidth {
+		m = imaging.Resize(m, sampleWidth, 0, imaging.Box)
+	}
+	return DominantColor(m), BlurHash(m)
+}
+
+// DominantColor returns the most common color in the image, as "#rrggbb".
+// Colors are bucketed by their upper 4 bits per channel, and the average
+// color of the most populated bucket is returned
+func DominantColor(m image.Image) string {
+	type bucket struct {
+		n       int
+		r, g, b uint64
+	}
+
+	var buckets [4096]bucket
+	var best int
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := m.At(x, y).RGBA()
+			if a == 0 {
+				continue
+			}
+			r, g, bl = r>>8, g>>8, bl>>8
+			i := int(r>>4)<<8 | int(g>>4)<<4 | int(bl>>4)
+			buckets[i].n++
+			buckets[i].r += uint64(r)
+			buckets[i].g += uint64(g)
+			buckets[i].b += uint64(bl)
+			if buckets[i].n > buckets[best].n {
+				best = i
+			}
+		}
+	}
+
+	bk := buckets[best]
+	if bk.n == 0 {
+		return ""
+	}
+	n := uint64(bk.n)
+	return fmt.Sprintf("#%02x%02x%02x", bk.r/n, bk.g/n, bk.b/n)
+}
+
+// BlurHash returns the BlurHash (https://blurha.sh) of the image
+func BlurHash(m image.Image) string {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+
+	// Convert to linear RGB once, as this is the expensive part
+	linear := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := m.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			linear[y*w+x] = [3]float64{
+				sRGBToLinear(int(r >> 8)),
+				sRGBToLinear(int(g >> 8)),
+				sRGBToLinear(int(bl >> 8)),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1.0
+			}
+
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := linear[y*w+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+			scale := normalisation / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var buf bytes.Buffer
+	encode83(&buf, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		var actualMax float64
+		for _, f := range ac {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		encode83(&buf, quantisedMax, 1)
+	} else {
+		encode83(&buf, 0, 1)
+	}
+
+	encode83(&buf, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		encode83(&buf, q(f[0])*19*19+q(f[1])*19+q(f[2]), 2)
+	}
+	return buf.String()
+}
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encode83(buf *bytes.Buffer, v, length int) {
+	for i := 1; i <= length; i++ {
+		digit := (v / int(math.Pow(83, float64(length-i)))) % 83
+		buf.WriteByte(base83[digit])
+	}
+}
+
+func sRGBToLinear(v int) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
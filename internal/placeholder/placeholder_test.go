@@ -0,0 +1,33 @@
+package placeholder
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompute(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	draw.Draw(m, m.Bounds(), &image.Uniform{color.RGBA{255, 0, 0, 255}}, image.ZP, draw.Src)
+
+	dominant, hash := Compute(m)
+	if !assert.Equal(t, "#ff0000", dominant, "dominant color should be red") {
+		return
+	}
+
+	// 1 character for the size flag, 1 for the maximum AC value,
+	// 4 for the DC component (i.e. the average color), and 2 for each
+	// of the 11 AC components
+	if !assert.Len(t, hash, 28, "blurhash should be 28 characters long") {
+		return
+	}
+	if !assert.Equal(t, "L", hash[:1], "size flag should denote 4x3 components") {
+		return
+	}
+	if !assert.Equal(t, "TI:j", hash[2:6], "DC component should be red") {
+		return
+	}
+}
@@ -0,0 +1,60 @@
+// Package requestid manages the identifiers that are assigned to each
+// request, so that log lines, error reports, and origin fetches that
+// belong to the same request can be correlated
+package requestid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"golang.org/x/net/context"
+)
+
+// HeaderName is the name of the HTTP header used to carry request IDs,
+// both inbound (if the client or a proxy already assigned one) and outbound
+const HeaderName = "X-Request-ID"
+
+// maximum length of an incoming request ID that we are willing to honor
+const maxLength = 128
+
+type idKey struct{}
+
+// New generates a new random request ID
+func New() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Valid returns true if the given string can be used as a request ID.
+// We are strict about what we accept, as the value ends up in log files
+// and response headers
+func Valid(s string) bool {
+	if len(s) == 0 || len(s) > maxLength {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':' || c == '/' || c == '+' || c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// With returns a new context that carries the given request ID
+func With(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey{}, id)
+}
+
+// Get returns the request ID associated with the context, or the empty string
+func Get(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(idKey{}).(string)
+	return id
+}
@@ -0,0 +1,113 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"golang.org/x/net/context"
+)
+
+// pruneThreshold is the number of hosts above which hosts that are no
+// longer limited are forgotten
+const pruneThreshold = 1024
+
+// HostLimiter spaces out work per host, so that each host sees at most
+// a given rate of requests after an initial burst
+type HostLimiter struct {
+	mu        sync.Mutex
+	burst     int
+	intervals map[string]time.Duration
+	interval  time.Duration
+	next      map[string]time.Time // theoretical arrival time of the next request, by host
+}
+
+// NewHostLimiter creates a HostLimiter that allows rate requests per
+// second to each host, and rates[host] to specific hosts. A rate of 0
+// means unlimited
+func NewHostLimiter(rate float64, burst int, rates map[string]float64) *HostLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &HostLimiter{
+		burst:     burst,
+		intervals: make(map[string]time.Duration, len(rates)),
+		interval:  rateInterval(rate),
+		next:      make(map[string]time.Time),
+	}
+	for host, r := range rates {
+		l.intervals[host] = rateInterval(r)
+	}
+	return l
+}
+
+func rateInterval(rate float64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// Wait waits until a request to host may be made. An error is returned
+// if ctx is canceled while waiting. A nil HostLimiter never waits
+func (l *HostLimiter) Wait(ctx context.Context, host string) error {
+	if l == nil {
+		return nil
+	}
+
+	interval, ok := l.intervals[host]
+	if !ok {
+		interval = l.interval
+	}
+	if interval == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	tat, ok := l.next[host]
+	if !ok {
+		l.prune(now)
+	}
+	if tat.Before(now) {
+		tat = now
+	}
+	l.next[host] = tat.Add(interval)
+	l.mu.Unlock()
+
+	wait := tat.Sub(now) - time.Duration(l.burst-1)*interval
+	if wait <= 0 {
+		return nil
+	}
+
+	metrics.Timing("throttle.host.wait", wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// give the slot back, unless somebody else has queued behind us
+	l.mu.Lock()
+	if l.next[host].Equal(tat.Add(interval)) {
+		l.next[host] = tat
+	}
+	l.mu.Unlock()
+	metrics.Count("throttle.host.canceled", 1)
+	return ctx.Err()
+}
+
+// prune forgets hosts that are not limited anymore. The caller must
+// hold l.mu
+func (l *HostLimiter) prune(now time.Time) {
+	if len(l.next) < pruneThreshold {
+		return
+	}
+	for host, tat := range l.next {
+		if tat.Before(now) {
+			delete(l.next, host)
+		}
+	}
+}
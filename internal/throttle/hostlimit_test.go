@@ -0,0 +1,48 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestHostLimiter(t *testing.T) {
+	l := NewHostLimiter(10, 2, map[string]float64{"fast.example.com": 0})
+	ctx := context.Background()
+
+	// the burst is allowed right away
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if !assert.NoError(t, l.Wait(ctx, "example.com"), "Wait should succeed") {
+			return
+		}
+	}
+	if !assert.True(t, time.Since(start) < 50*time.Millisecond, "burst should not wait") {
+		return
+	}
+
+	// hosts are limited independently, and may be exempted
+	for _, host := range []string{"other.example.com", "fast.example.com", "fast.example.com", "fast.example.com"} {
+		start = time.Now()
+		if !assert.NoError(t, l.Wait(ctx, host), "Wait should succeed") {
+			return
+		}
+		if !assert.True(t, time.Since(start) < 50*time.Millisecond, "%s should not wait", host) {
+			return
+		}
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if !assert.Error(t, l.Wait(timeoutCtx, "example.com"), "Wait should time out") {
+		return
+	}
+
+	start = time.Now()
+	if !assert.NoError(t, l.Wait(ctx, "example.com"), "Wait should succeed") {
+		return
+	}
+	assert.True(t, time.Since(start) >= 50*time.Millisecond, "requests beyond the burst should be spaced out")
+}
@@ -0,0 +1,24 @@
+package throttle
+
+import "golang.org/x/net/context"
+
+type parallelismKey struct{}
+
+// WithParallelism returns a new context that limits how many presets of
+// a job are transformed at once. n <= 0 means all of them
+func WithParallelism(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, parallelismKey{}, n)
+}
+
+// Parallelism returns the number of presets of a job that may be
+// transformed at once, or 0 if all of them may
+func Parallelism(ctx context.Context) int {
+	if ctx == nil {
+		return 0
+	}
+	n, _ := ctx.Value(parallelismKey{}).(int)
+	if n < 0 {
+		return 0
+	}
+	return n
+}
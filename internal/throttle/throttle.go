@@ -0,0 +1,158 @@
+// Package throttle keeps batch work (such as bulk pre-generation of
+// variants) from competing with interactive work for the CPUs.
+//
+// At most GOMAXPROCS tasks run at once, and batch work never occupies
+// more than its budget of the CPUs by itself. Tasks that cannot run are
+// queued in two levels: whenever a CPU becomes available, queued
+// interactive tasks are started first, and queued batch tasks are only
+// started while no interactive task is waiting. Running tasks are never
+// interrupted
+package throttle
+
+import (
+	"container/list"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"golang.org/x/net/context"
+)
+
+type priority int
+
+const (
+	interactive priority = iota
+	batch
+	numPriorities
+)
+
+func (p priority) tag() string {
+	if p == interactive {
+		return "priority:interactive"
+	}
+	return "priority:batch"
+}
+
+// waiter is a queued task. ready is closed once the task may start
+type waiter struct {
+	ready   chan struct{}
+	started bool
+}
+
+// Throttle counts running tasks and queues the ones that cannot run yet
+type Throttle struct {
+	mu       sync.Mutex
+	batchMax int
+	cpus     int
+	queues   [numPriorities]*list.List // of *waiter
+	running  [numPriorities]int
+}
+
+// New creates a Throttle that allows batch work to use budget (0 to 1)
+// of GOMAXPROCS. At least one batch task is allowed to run
+func New(budget float64) *Throttle {
+	cpus := runtime.GOMAXPROCS(0)
+	batchMax := int(float64(cpus) * budget)
+	if batchMax < 1 {
+		batchMax = 1
+	}
+	t := &Throttle{
+		batchMax: batchMax,
+		cpus:     cpus,
+	}
+	for i := range t.queues {
+		t.queues[i] = list.New()
+	}
+	return t
+}
+
+// Interactive waits until an interactive task may start, and returns
+// the function that must be called when it is done. Interactive tasks
+// only wait while every CPU is busy, and are started before any queued
+// batch task. An error is returned if ctx is canceled while waiting.
+// A nil Throttle never waits
+func (t *Throttle) Interactive(ctx context.Context) (func(), error) {
+	return t.acquire(ctx, interactive)
+}
+
+// Batch waits until a batch task may start, and returns the function
+// that must be called when it is done. An error is returned if ctx is
+// canceled while waiting. A nil Throttle never waits
+func (t *Throttle) Batch(ctx context.Context) (func(), error) {
+	return t.acquire(ctx, batch)
+}
+
+func (t *Throttle) acquire(ctx context.Context, p priority) (func(), error) {
+	if t == nil {
+		return func() {}, nil
+	}
+
+	release := func() { t.release(p) }
+
+	start := time.Now()
+	t.mu.Lock()
+	// tasks that are already queued go first
+	if t.queues[p].Len() == 0 && t.canStart(p) {
+		t.running[p]++
+		t.mu.Unlock()
+		metrics.Timing("throttle.wait", 0, p.tag())
+		return release, nil
+	}
+	w := &waiter{ready: make(chan struct{})}
+	e := t.queues[p].PushBack(w)
+	t.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		metrics.Timing("throttle.wait", time.Since(start), p.tag())
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	if w.started {
+		// started while we were giving up. hand the CPU to somebody else
+		t.running[p]--
+		t.dispatch()
+	} else {
+		t.queues[p].Remove(e)
+	}
+	t.mu.Unlock()
+	metrics.Count("throttle.canceled", 1, p.tag())
+	return nil, ctx.Err()
+}
+
+// canStart returns true if a task of priority p may start now, without
+// considering the tasks queued at the same priority. The caller must
+// hold t.mu
+func (t *Throttle) canStart(p priority) bool {
+	if t.running[interactive]+t.running[batch] >= t.cpus {
+		return false
+	}
+	if p == batch {
+		return t.running[batch] < t.batchMax && t.queues[interactive].Len() == 0
+	}
+	return true
+}
+
+func (t *Throttle) release(p priority) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running[p]--
+	t.dispatch()
+}
+
+// dispatch starts as many queued tasks as possible, interactive tasks
+// first. The caller must hold t.mu
+func (t *Throttle) dispatch() {
+	for p := interactive; p < numPriorities; p++ {
+		q := t.queues[p]
+		for q.Len() > 0 && t.canStart(p) {
+			w := q.Remove(q.Front()).(*waiter)
+			w.started = true
+			t.running[p]++
+			close(w.ready)
+		}
+	}
+}
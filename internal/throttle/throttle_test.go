@@ -0,0 +1,167 @@
+package throttle
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestThrottle(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	th := New(0.5)
+	ctx := context.Background()
+
+	// two of four CPUs may be used by batch work
+	var done []func()
+	for i := 0; i < 2; i++ {
+		release, err := th.Batch(ctx)
+		if !assert.NoError(t, err, "Batch should succeed") {
+			return
+		}
+		done = append(done, release)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := th.Batch(timeoutCtx); !assert.Error(t, err, "Batch should wait beyond the budget") {
+		return
+	}
+
+	// interactive work occupies the remaining CPUs
+	var interactive []func()
+	for i := 0; i < 2; i++ {
+		release, err := th.Interactive(ctx)
+		if !assert.NoError(t, err, "Interactive should succeed") {
+			return
+		}
+		interactive = append(interactive, release)
+	}
+
+	// releasing a batch task does not help while the CPUs are busy
+	done[0]()
+	release, err := th.Interactive(ctx)
+	if !assert.NoError(t, err, "Interactive should take the released CPU") {
+		return
+	}
+	interactive = append(interactive, release)
+
+	timeoutCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := th.Batch(timeoutCtx); !assert.Error(t, err, "Batch should wait while the CPUs are busy") {
+		return
+	}
+
+	started := make(chan struct{})
+	go func() {
+		release, err := th.Batch(ctx)
+		if err == nil {
+			release()
+		}
+		close(started)
+	}()
+
+	for _, release := range interactive {
+		release()
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Batch should proceed once interactive work is done")
+	}
+	done[1]()
+}
+
+func TestThrottle_Priority(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	th := New(1)
+	ctx := context.Background()
+
+	running, err := th.Batch(ctx)
+	if !assert.NoError(t, err, "Batch should succeed") {
+		return
+	}
+
+	order := make(chan string, 2)
+	queue := func(name string, acquire func(context.Context) (func(), error)) {
+		release, err := acquire(ctx)
+		if err != nil {
+			return
+		}
+		order <- name
+		release()
+	}
+
+	// the batch task is queued first, but the interactive one preempts it
+	go queue("batch", th.Batch)
+	for !queued(th, batch) {
+		time.Sleep(time.Millisecond)
+	}
+	go queue("interactive", th.Interactive)
+	for !queued(th, interactive) {
+		time.Sleep(time.Millisecond)
+	}
+
+	running()
+	for _, expected := range []string{"interactive", "batch"} {
+		select {
+		case name := <-order:
+			if !assert.Equal(t, expected, name, "tasks should start by priority") {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "queued tasks should start")
+			return
+		}
+	}
+}
+
+func TestThrottle_Cancel(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	th := New(1)
+	ctx := context.Background()
+
+	running, err := th.Interactive(ctx)
+	if !assert.NoError(t, err, "Interactive should succeed") {
+		return
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := th.Batch(timeoutCtx); !assert.Error(t, err, "Batch should time out") {
+		return
+	}
+	if !assert.False(t, queued(th, batch), "canceled tasks should leave the queue") {
+		return
+	}
+
+	running()
+	release, err := th.Batch(ctx)
+	if !assert.NoError(t, err, "Batch should succeed") {
+		return
+	}
+	release()
+}
+
+func TestThrottle_Nil(t *testing.T) {
+	var th *Throttle
+	for _, acquire := range []func(context.Context) (func(), error){th.Interactive, th.Batch} {
+		release, err := acquire(context.Background())
+		if !assert.NoError(t, err, "nil Throttle should never fail") {
+			return
+		}
+		release()
+	}
+}
+
+func queued(th *Throttle, p priority) bool {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	return th.queues[p].Len() > 0
+}
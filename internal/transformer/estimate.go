@@ -0,0 +1,366 @@
+package transformer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"golang.org/x/net/context"
+)
+
+// estimateHeaderBytes is the number of bytes of the source image that
+// are fetched to estimate the size of a variant. This is enough for the
+// headers of JPEG images with typical EXIF data, as well as PNG and GIF.
+// Larger JPEG metadata is skipped, see decodeJPEGConfig
+const estimateHeaderBytes = 64 << 10
+
+// estimateMaxSkips is the number of JPEG metadata segments larger than
+// estimateHeaderBytes that are skipped before giving up
+const estimateMaxSkips = 4
+
+// ratioWindow is the number of recent variants that the compression
+// ratios are averaged over
+const ratioWindow = 100
+
+// maxRatioRules limits the number of rules that compression ratios are
+// recorded for, as preset templates can produce any number of them
+const maxRatioRules = 1000
+
+// defaultBytesPerPixel is used for output formats that no variants
+// have been generated in yet
+var defaultBytesPerPixel = map[string]float64{
+	"gif":  0.5,
+	"jpeg": 0.4,
+	"png":  1.5,
+}
+
+// Sources of the compression ratio used by an estimate
+const (
+	BasisSource  = "source"  // the source image is used as is
+	BasisRule    = "rule"    // variants generated with the same rule
+	BasisFormat  = "format"  // variants generated in the same format
+	BasisDefault = "default" // no variants have been generated yet
+)
+
+// Estimate is the estimated result of a transformation
+type Estimate struct {
+	SourceWidth  int
+	SourceHeight int
+	SourceFormat string
+	SourceSize   int64 // -1 if the origin did not tell
+	Width        int
+	Height       int
+	Format       string
+	Size         int64
+	Basis        string
+	Samples      int64 // number of variants that the ratio is based on
+}
+
+// compressionRatios keeps the average number of bytes per pixel of the
+// variants generated by this process, per rule and per output format
+type compressionRatios struct {
+	mu     sync.Mutex
+	rules  map[string]*compressionRatio
+	format map[string]*compressionRatio
+}
+
+type compressionRatio struct {
+	bytesPerPixel float64
+	samples       int64
+}
+
+func (r *compressionRatio) add(v float64) {
+	r.samples++
+	n := r.samples
+	if n > ratioWindow {
+		n = ratioWindow
+	}
+	r.bytesPerPixel += (v - r.bytesPerPixel) / float64(n)
+}
+
+func newCompressionRatios() *compressionRatios {
+	return &compressionRatios{
+		rules:  make(map[string]*compressionRatio),
+		format: make(map[string]*compressionRatio),
+	}
+}
+
+// record adds a variant of the given size and number of pixels
+func (c *compressionRatios) record(rule, format string, pixels int, size int64) {
+	if c == nil || pixels <= 0 || size <= 0 {
+		return
+	}
+	v := float64(size) / float64(pixels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r, ok := c.rules[rule]; ok {
+		r.add(v)
+	} else if len(c.rules) < maxRatioRules {
+		r = &compressionRatio{}
+		r.add(v)
+		c.rules[rule] = r
+	}
+
+	r, ok := c.format[format]
+	if !ok {
+		r = &compressionRatio{}
+		c.format[format] = r
+	}
+	r.add(v)
+}
+
+// lookup returns the number of bytes per pixel expected of a variant
+// generated with rule in format, along with its basis
+func (c *compressionRatios) lookup(rule, format string) (float64, string, int64) {
+	if c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if r, ok := c.rules[rule]; ok {
+			return r.bytesPerPixel, BasisRule, r.samples
+		}
+		if r, ok := c.format[format]; ok {
+			return r.bytesPerPixel, BasisFormat, r.samples
+		}
+	}
+	return defaultBytesPerPixel[format], BasisDefault, 0
+}
+
+// Estimate estimates the result of applying the transformation
+// specified by options to the image at u, without transforming it. Only
+// the beginning of the source image is fetched, to read its dimensions.
+// The size is extrapolated from the variants that this transformer has
+// generated so far
+func (t *Transformer) Estimate(ctx context.Context, options string, u string) (*Estimate, error) {
+	req, err := t.newRequest(ctx, t.sourceURL(u))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", estimateHeaderBytes-1))
+
+	res, err := newClient(ctx, t).Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to fetch remote image`)
+	}
+	defer res.Body.Close()
+
+	var est Estimate
+	switch res.StatusCode {
+	case http.StatusOK:
+		est.SourceSize = res.ContentLength
+	case http.StatusPartialContent:
+		est.SourceSize = contentRangeTotal(res.Header.Get("Content-Range"))
+	case http.StatusNotFound, http.StatusGone:
+		return nil, errors.WithKind(errors.ErrSourceNotFound, errors.Errorf(`failed to fetch remote image: %d`, res.StatusCode))
+	default:
+		return nil, errors.Errorf(`failed to fetch remote image: %d`, res.StatusCode)
+	}
+
+	header, err := ioutil.ReadAll(io.LimitReader(res.Body, estimateHeaderBytes))
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to read image header`)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(header))
+	if err != nil {
+		// JPEG images may start with metadata (EXIF, XMP, ICC profiles)
+		// that does not fit in what was fetched. Skip it, and try again
+		// with what follows
+		cfg, format, err = t.decodeJPEGConfig(ctx, u, res, header, err)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to decode image header`)
+	}
+	est.SourceWidth, est.SourceHeight, est.SourceFormat = cfg.Width, cfg.Height, format
+
+	opt := ParseOptions(options)
+	if opt == emptyOptions || (opt.NoUpscale && fitsSize(cfg.Width, cfg.Height, opt) && !opt.Strip && (opt.Format == "" || opt.Format == format) && opt.Rotate == 0 && !opt.FlipVertical && !opt.FlipHorizontal && opt.Text == "" && (opt.MaxBytes == 0 || (est.SourceSize >= 0 && est.SourceSize <= opt.MaxBytes))) {
+		est.Width, est.Height, est.Format = cfg.Width, cfg.Height, format
+		est.Size = est.SourceSize
+		est.Basis = BasisSource
+		return &est, nil
+	}
+
+	est.Width, est.Height = outputSize(cfg.Width, cfg.Height, opt)
+	est.Format = format
+	if opt.Format != "" {
+		est.Format = opt.Format
+	}
+	if _, ok := encoders[est.Format]; !ok {
+		est.Format = fallbackFormats[0]
+	}
+
+	bpp, basis, samples := t.ratios.lookup(opt.String(), est.Format)
+	est.Size = int64(math.Ceil(bpp * float64(est.Width*est.Height)))
+	if est.Format == "jpeg" && opt.MaxBytes > 0 && est.Size > opt.MaxBytes {
+		// see encodeMaxBytes
+		est.Size = opt.MaxBytes
+	}
+	est.Basis, est.Samples = basis, samples
+	return &est, nil
+}
+
+// decodeJPEGConfig decodes the header of a JPEG image whose metadata
+// segments extend past header, the beginning of the image as read from
+// res. The segments are skipped, by requesting the bytes that follow
+// them, or by discarding them if the origin does not support ranges.
+// If header is not such an image, err is returned as is
+func (t *Transformer) decodeJPEGConfig(ctx context.Context, u string, res *http.Response, header []byte, err error) (image.Config, string, error) {
+	// start is the offset in the source image of header[2]. The SOI
+	// marker that precedes it is kept when skipping
+	start := int64(2)
+	consumed := int64(len(header))
+	for i := 0; i < estimateMaxSkips; i++ {
+		end, ok := jpegMetadataEnd(header)
+		if !ok {
+			return image.Config{}, "", err
+		}
+		next := start + end - 2
+
+		var rest []byte
+		if res.StatusCode == http.StatusPartialContent {
+			rest, err = t.fetchRange(ctx, u, next)
+		} else {
+			rest, err = discardAndRead(res.Body, next-consumed)
+			consumed = next + int64(len(rest))
+		}
+		if err != nil {
+			return image.Config{}, "", err
+		}
+
+		header = append([]byte{0xFF, 0xD8}, rest...)
+		start = next
+		var cfg image.Config
+		var format string
+		cfg, format, err = image.DecodeConfig(bytes.NewReader(header))
+		if err == nil {
+			return cfg, format, nil
+		}
+	}
+	return image.Config{}, "", err
+}
+
+// jpegMetadataEnd returns the offset in b, the beginning of a JPEG
+// image, of the end of the metadata segments that fit in b, or of the
+// one that extends past it. It returns false if b is not a JPEG image,
+// or if its metadata segments are followed by other segments within b
+func jpegMetadataEnd(b []byte) (int64, bool) {
+	if len(b) < 2 || b[0] != 0xFF || b[1] != 0xD8 {
+		return 0, false
+	}
+
+	i := 2
+	for i+4 <= len(b) {
+		if b[i] != 0xFF {
+			return 0, false
+		}
+		marker := b[i+1]
+		if marker == 0xFF {
+			// fill byte
+			i++
+			continue
+		}
+		if (marker < 0xE0 || marker > 0xEF) && marker != 0xFE {
+			// not APPn or COM
+			return 0, false
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(b[i+2:]))
+		if end > len(b) {
+			return int64(end), true
+		}
+		i = end
+	}
+	if i > 2 && i < len(b) && b[i] == 0xFF {
+		// the next segment starts too close to the end of b
+		return int64(i), true
+	}
+	return 0, false
+}
+
+// fetchRange fetches estimateHeaderBytes of the image at u, starting at
+// offset
+func (t *Transformer) fetchRange(ctx context.Context, u string, offset int64) ([]byte, error) {
+	req, err := t.newRequest(ctx, t.sourceURL(u))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+estimateHeaderBytes-1))
+
+	res, err := newClient(ctx, t).Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to fetch remote image`)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return nil, errors.Errorf(`failed to fetch remote image: %d`, res.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, estimateHeaderBytes))
+}
+
+// discardAndRead discards n bytes of r, and reads estimateHeaderBytes
+// of what follows
+func discardAndRead(r io.Reader, n int64) ([]byte, error) {
+	if _, err := io.CopyN(ioutil.Discard, r, n); err != nil {
+		return nil, errors.Wrap(err, `failed to skip image metadata`)
+	}
+	return ioutil.ReadAll(io.LimitReader(r, estimateHeaderBytes))
+}
+
+// contentRangeTotal returns the complete length given in a
+// Content-Range header, or -1 if it is unknown
+func contentRangeTotal(s string) int64 {
+	i := strings.LastIndexByte(s, '/')
+	if i < 0 {
+		return -1
+	}
+	n, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// outputSize returns the size of the image that transformImage
+// produces from an image of the given size
+func outputSize(imgW, imgH int, opt Options) (int, int) {
+	opt = orientedSize(imgW, imgH, opt)
+
+	w, h := targetSize(imgW, imgH, opt)
+	switch {
+	case w == 0 && h == 0:
+		w, h = imgW, imgH
+	case opt.Fit && w != 0 && h != 0:
+		if imgW > w || imgH > h {
+			srcAspect := float64(imgW) / float64(imgH)
+			if srcAspect > float64(w)/float64(h) {
+				h = scaled(w, 1/srcAspect)
+			} else {
+				w = scaled(h, srcAspect)
+			}
+		} else {
+			w, h = imgW, imgH
+		}
+	case w == 0:
+		w = scaled(h, float64(imgW)/float64(imgH))
+	case h == 0:
+		h = scaled(w, float64(imgH)/float64(imgW))
+	}
+
+	if opt.Rotate == 90 || opt.Rotate == 270 {
+		w, h = h, w
+	}
+	return w, h
+}
+
+func scaled(n int, ratio float64) int {
+	return int(math.Max(1, math.Floor(float64(n)*ratio+0.5)))
+}
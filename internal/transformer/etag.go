@@ -0,0 +1,44 @@
+package transformer
+
+import (
+	"net/http"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/requestid"
+	"golang.org/x/net/context"
+)
+
+// SourceETag returns the ETag of the image at u, as sent by the origin
+// in response to a HEAD request. It is empty if the origin does not
+// send one
+func (t *Transformer) SourceETag(ctx context.Context, u string) (string, error) {
+	cl := newClient(ctx, t)
+	req, err := http.NewRequest(http.MethodHead, t.sourceURL(u), nil)
+	if err != nil {
+		return "", errors.Wrap(err, `failed to create request`)
+	}
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	if id := requestid.Get(ctx); id != "" {
+		req.Header.Set(requestid.HeaderName, id)
+	}
+
+	res, err := cl.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, `failed to fetch remote image`)
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return "", errors.WithKind(errors.ErrSourceNotFound, errors.Errorf(`failed to fetch remote image: %d`, res.StatusCode))
+	default:
+		return "", errors.Errorf(`failed to fetch remote image: %d`, res.StatusCode)
+	}
+	return res.Header.Get("ETag"), nil
+}
@@ -0,0 +1,227 @@
+package transformer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"golang.org/x/net/context"
+)
+
+// sourceSpool is a source image fetched from the origin. It is shared
+// by all transformations that asked for the same source while it was
+// being fetched, so it must not be modified.
+//
+// The content is held in memory, unless it is larger than the spool
+// threshold, in which case it is kept in a temporary file that is
+// removed once every transformation sharing it has called release
+type sourceSpool struct {
+	status     string
+	statusCode int
+	proto      string
+	header     http.Header
+	content    []byte   // only read for successful responses
+	file       *os.File // if non-nil, the content is in this file
+	size       int64
+	sha256     string
+
+	mu   sync.Mutex
+	refs int
+}
+
+// reader returns a reader over the spooled content. Readers are
+// independent of each other, and may be used concurrently
+func (s *sourceSpool) reader() io.ReadSeeker {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return bytes.NewReader(s.content)
+}
+
+// response returns a response for req with a copy of the spooled
+// header and a reader over the spooled content
+func (s *sourceSpool) response(req *http.Request) *http.Response {
+	header := make(http.Header, len(s.header))
+	for k, v := range s.header {
+		header[k] = append([]string(nil), v...)
+	}
+	return &http.Response{
+		Status:        s.status,
+		StatusCode:    s.statusCode,
+		Proto:         s.proto,
+		Header:        header,
+		Body:          ioutil.NopCloser(s.reader()),
+		ContentLength: s.size,
+		Request:       req,
+	}
+}
+
+// release is called by each transformation once it is done with the
+// spool. The temporary file is removed after the last one
+func (s *sourceSpool) release() {
+	s.mu.Lock()
+	s.refs--
+	done := s.refs == 0
+	s.mu.Unlock()
+
+	if done && s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
+
+// fetchGroup coalesces concurrent fetches of the same source, so that
+// the presets of a job fetch the origin once instead of once each.
+// Unlike resultCache, nothing is kept once the fetch is done
+type fetchGroup struct {
+	mu    sync.Mutex
+	calls map[string]*fetchCall
+
+	spoolThreshold int64  // sources larger than this are spooled to disk. 0 means never
+	spoolDir       string // if empty, os.TempDir() is used
+}
+
+type fetchCall struct {
+	done  chan struct{}
+	spool *sourceSpool
+	err   error
+	refs  int // number of callers waiting for this fetch
+}
+
+// do calls fetch, unless a fetch for the same key is in progress, in
+// which case its result is shared. Callers must release the returned
+// spool when they are done with it
+func (g *fetchGroup) do(key string, fetch func() (*sourceSpool, error)) (*sourceSpool, error) {
+	if g == nil {
+		spool, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		spool.refs = 1
+		return spool, nil
+	}
+
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		c.refs++
+		g.mu.Unlock()
+		metrics.Count("origin.coalesced", 1)
+		<-c.done
+		return c.spool, c.err
+	}
+	c := &fetchCall{done: make(chan struct{}), refs: 1}
+	if g.calls == nil {
+		g.calls = make(map[string]*fetchCall)
+	}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.spool, c.err = fetch()
+
+	// nobody can join once the call is removed, so the number of
+	// callers that will release the spool is known from here on
+	g.mu.Lock()
+	delete(g.calls, key)
+	if c.err == nil {
+		c.spool.refs = c.refs
+	}
+	g.mu.Unlock()
+	close(c.done)
+
+	return c.spool, c.err
+}
+
+// fetchSource fetches the source image requested by req, and spools it
+// in memory, or on disk if it is larger than the spool threshold
+func (t *TransformingTransport) fetchSource(ctx context.Context, cl *http.Client, req *http.Request) (*sourceSpool, error) {
+	start := time.Now()
+	resp, err := cl.Do(req)
+	logOriginResponse(ctx, req.URL, resp, err, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	spool := &sourceSpool{
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+		proto:      resp.Proto,
+		header:     resp.Header,
+	}
+	if resp.StatusCode != http.StatusOK {
+		return spool, nil
+	}
+
+	if err := t.limit(resp); err != nil {
+		return nil, err
+	}
+
+	var threshold int64
+	var dir string
+	if g := t.fetches; g != nil {
+		threshold, dir = g.spoolThreshold, g.spoolDir
+	}
+
+	h := sha256.New()
+	body := io.TeeReader(resp.Body, h)
+
+	// read up to the threshold in memory, and only go to disk if
+	// there is more than that
+	var buf bytes.Buffer
+	if resp.ContentLength > 0 && (threshold == 0 || resp.ContentLength <= threshold) {
+		buf.Grow(int(resp.ContentLength))
+	}
+	if threshold > 0 {
+		_, err = io.CopyN(&buf, body, threshold+1)
+		if err == io.EOF {
+			err = nil
+		}
+	} else {
+		_, err = buf.ReadFrom(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if threshold == 0 || int64(buf.Len()) <= threshold {
+		spool.content = buf.Bytes()
+		spool.size = int64(buf.Len())
+		spool.sha256 = hex.EncodeToString(h.Sum(nil))
+		t.countFetch(spool.size)
+		return spool, nil
+	}
+
+	f, err := ioutil.TempFile(dir, "sharaq-source-")
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create spool file`)
+	}
+	n, err := io.Copy(f, io.MultiReader(&buf, body))
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, `failed to spool source image`)
+	}
+	log.Debugf(ctx, "Spooled %d bytes of %s to %s", n, req.URL, f.Name())
+	metrics.Count("origin.spooled", 1)
+
+	spool.file = f
+	spool.size = n
+	spool.sha256 = hex.EncodeToString(h.Sum(nil))
+	t.countFetch(spool.size)
+	return spool, nil
+}
+
+func (t *TransformingTransport) countFetch(n int64) {
+	if t.onFetch != nil {
+		t.onFetch(n)
+	}
+}
@@ -0,0 +1,30 @@
+package transformer
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ObserveFunc is called by Transform for each result with a preset,
+// along with the time it took to generate it. The content of the result
+// must not be used
+type ObserveFunc func(result *Result, elapsed time.Duration)
+
+type observerKey struct{}
+
+// WithObserver returns a new context that makes Transform report its
+// results to f. This allows callers to learn about the variants that a
+// backend generated, without the backend having to report them
+func WithObserver(ctx context.Context, f ObserveFunc) context.Context {
+	return context.WithValue(ctx, observerKey{}, f)
+}
+
+func observe(ctx context.Context, result *Result, elapsed time.Duration) {
+	if ctx == nil {
+		return
+	}
+	if f, ok := ctx.Value(observerKey{}).(ObserveFunc); ok && f != nil {
+		f(result, elapsed)
+	}
+}
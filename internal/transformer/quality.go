@@ -0,0 +1,179 @@
+package transformer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"golang.org/x/net/context"
+)
+
+// maxPSNR is reported for images that are identical to the reference,
+// where PSNR would be infinite
+const maxPSNR = 100
+
+// ssimBlock is the size of the windows over which SSIM is computed
+const ssimBlock = 8
+
+// qualitySampler measures how much encoding degrades a sampled
+// fraction of transformed images. The encoded output is decoded again
+// and compared against the image before it was encoded. If a baseline
+// format is given, the image is also encoded in that format and
+// measured the same way, so that both encodings can be compared on
+// the same images
+type qualitySampler struct {
+	percent  float64
+	baseline string
+}
+
+// WithQualitySampling enables measuring PSNR and SSIM of percent (0 to
+// 100) of all transformations. If baseline is non-empty, each sampled
+// image is additionally encoded in that format for comparison
+func WithQualitySampling(percent float64, baseline string) Option {
+	return OptionFunc(func(t *Transformer) {
+		if percent > 0 {
+			t.quality = &qualitySampler{percent: percent, baseline: baseline}
+		} else {
+			t.quality = nil
+		}
+	})
+}
+
+// ValidFormat returns true if images can be encoded in format f
+func ValidFormat(f string) bool {
+	_, ok := encoders[f]
+	return ok
+}
+
+// ValidColor returns true if s is a color in RRGGBB form
+func ValidColor(s string) bool {
+	_, err := parseColor(s)
+	return err == nil
+}
+
+// sample returns true if the current transformation should be measured
+func (q *qualitySampler) sample() bool {
+	if q == nil {
+		return false
+	}
+	return rand.Float64()*100 < q.percent
+}
+
+// measure compares encoded, which is ref encoded as format, against
+// ref. The baseline format, if any, is measured as well. Results are
+// reported as the transform.quality.psnr and transform.quality.ssim
+// histograms. Failures are only logged, as they do not affect the
+// transformation itself
+func (q *qualitySampler) measure(ctx context.Context, ref image.Image, encoded []byte, format string, quality int) {
+	if err := report(ref, encoded, format, "encoding:current"); err != nil {
+		log.Debugf(ctx, "failed to measure quality of %s: %s", format, err)
+	}
+
+	if q.baseline == "" || q.baseline == format {
+		return
+	}
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+	if err := encoders[q.baseline](buf, ref, quality); err != nil {
+		log.Debugf(ctx, "failed to encode baseline as %s: %s", q.baseline, err)
+		return
+	}
+	if err := report(ref, buf.Bytes(), q.baseline, "encoding:baseline"); err != nil {
+		log.Debugf(ctx, "failed to measure quality of %s: %s", q.baseline, err)
+	}
+}
+
+func report(ref image.Image, encoded []byte, format, tag string) error {
+	m, _, err := image.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		return errors.Wrap(err, `failed to decode encoded image`)
+	}
+	if m.Bounds().Size() != ref.Bounds().Size() {
+		return errors.Errorf(`size mismatch: %v != %v`, m.Bounds().Size(), ref.Bounds().Size())
+	}
+
+	tags := []string{"format:" + format, tag}
+	metrics.Histogram("transform.quality.psnr", psnr(ref, m), tags...)
+	metrics.Histogram("transform.quality.ssim", ssim(ref, m), tags...)
+	return nil
+}
+
+// psnr returns the peak signal-to-noise ratio in dB between the RGB
+// channels of a and b, which must be the same size
+func psnr(a, b image.Image) float64 {
+	ab, bb := a.Bounds(), b.Bounds()
+	var sum float64
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			r1, g1, b1, _ := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range []float64{
+				float64(r1>>8) - float64(r2>>8),
+				float64(g1>>8) - float64(g2>>8),
+				float64(b1>>8) - float64(b2>>8),
+			} {
+				sum += d * d
+			}
+		}
+	}
+
+	n := float64(ab.Dx() * ab.Dy() * 3)
+	if sum == 0 || n == 0 {
+		return maxPSNR
+	}
+	return math.Min(maxPSNR, 10*math.Log10(255*255/(sum/n)))
+}
+
+// ssim returns the mean structural similarity of the luma of a and b,
+// which must be the same size. It is computed over non-overlapping
+// blocks rather than a sliding window, which is cheaper and close
+// enough for comparing encoders
+func ssim(a, b image.Image) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+
+	ab, bb := a.Bounds(), b.Bounds()
+	var total float64
+	var blocks int
+	for by := 0; by < ab.Dy(); by += ssimBlock {
+		for bx := 0; bx < ab.Dx(); bx += ssimBlock {
+			var sa, sb, saa, sbb, sab, n float64
+			for y := by; y < by+ssimBlock && y < ab.Dy(); y++ {
+				for x := bx; x < bx+ssimBlock && x < ab.Dx(); x++ {
+					va := luma(a.At(ab.Min.X+x, ab.Min.Y+y))
+					vb := luma(b.At(bb.Min.X+x, bb.Min.Y+y))
+					sa += va
+					sb += vb
+					saa += va * va
+					sbb += vb * vb
+					sab += va * vb
+					n++
+				}
+			}
+			ma, mb := sa/n, sb/n
+			va, vb := saa/n-ma*ma, sbb/n-mb*mb
+			cov := sab/n - ma*mb
+			total += ((2*ma*mb + c1) * (2*cov + c2)) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			blocks++
+		}
+	}
+
+	if blocks == 0 {
+		return 1
+	}
+	return total / float64(blocks)
+}
+
+func luma(c color.Color) float64 {
+	r, g, b, _ := c.RGBA()
+	return 0.299*float64(r>>8) + 0.587*float64(g>>8) + 0.114*float64(b>>8)
+}
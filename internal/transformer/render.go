@@ -0,0 +1,243 @@
+package transformer
+
+import (
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/inconsolata"
+	"golang.org/x/image/math/fixed"
+)
+
+// Dimensions of placeholders for rules that do not specify a size in
+// pixels
+const (
+	defaultPlaceholderWidth  = 640
+	defaultPlaceholderHeight = 480
+)
+
+// RenderPlaceholder creates an image of the size specified by the rule,
+// filled with bg (in RRGGBB form) and with text drawn in the middle.
+// If text is empty, the dimensions are used. If only the width or the
+// height is specified in pixels, the image is square, and if neither
+// is, it is 640x480
+func RenderPlaceholder(rule, text, bg string) (image.Image, error) {
+	opt := ParseOptions(rule)
+	var width, height int
+	if opt.Width > 1 {
+		width = int(opt.Width)
+	}
+	if opt.Height > 1 {
+		height = int(opt.Height)
+	}
+	switch {
+	case width == 0 && height == 0:
+		width, height = defaultPlaceholderWidth, defaultPlaceholderHeight
+	case width == 0:
+		width = height
+	case height == 0:
+		height = width
+	}
+
+	fill, err := parseColor(bg)
+	if err != nil {
+		return nil, err
+	}
+	if text == "" {
+		text = strconv.Itoa(width) + "x" + strconv.Itoa(height)
+	}
+
+	m := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(m, m.Bounds(), image.NewUniform(fill), image.ZP, draw.Src)
+	drawLabel(m, text, labelColor(fill))
+	return m, nil
+}
+
+// labelColor returns black or white, whichever stands out more on bg
+func labelColor(bg color.Color) color.Color {
+	r, g, b, _ := bg.RGBA()
+	if 299*r+587*g+114*b > 1000*0x7fff {
+		return color.Black
+	}
+	return color.White
+}
+
+// drawLabel draws text in the middle of m. The text is rendered with a
+// small bitmap font, and scaled up to about half the width of m
+func drawLabel(m draw.Image, text string, c color.Color) {
+	face := basicfont.Face7x13
+	tw := font.MeasureString(face, text).Ceil()
+	th := face.Height
+	if tw == 0 {
+		return
+	}
+
+	label := image.NewNRGBA(image.Rect(0, 0, tw, th))
+	d := font.Drawer{
+		Dst:  label,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(0, face.Ascent),
+	}
+	d.DrawString(text)
+
+	b := m.Bounds()
+	scale := b.Dx() / 2 / tw
+	if s := b.Dy() / 2 / th; s < scale {
+		scale = s
+	}
+	var scaled image.Image = label
+	if scale > 1 {
+		scaled = imaging.Resize(label, tw*scale, th*scale, imaging.NearestNeighbor)
+	}
+
+	sb := scaled.Bounds()
+	at := image.Pt(b.Min.X+(b.Dx()-sb.Dx())/2, b.Min.Y+(b.Dy()-sb.Dy())/2)
+	draw.Draw(m, sb.Sub(sb.Min).Add(at), scaled, sb.Min, draw.Over)
+}
+
+// fonts are the fonts that text may be drawn in. They are bitmap fonts,
+// which are scaled up by whole numbers to keep them crisp
+var fonts = map[string]*basicfont.Face{
+	"basic":            basicfont.Face7x13,
+	"inconsolata":      inconsolata.Regular8x16,
+	"inconsolata-bold": inconsolata.Bold8x16,
+}
+
+// textPositions maps the positions that text may be drawn at to the
+// side of the image that it is aligned with, horizontally and vertically:
+// -1 for left or top, 0 for center, and 1 for right or bottom
+var textPositions = map[string][2]int{
+	"c":  {0, 0},
+	"n":  {0, -1},
+	"s":  {0, 1},
+	"e":  {1, 0},
+	"w":  {-1, 0},
+	"ne": {1, -1},
+	"nw": {-1, -1},
+	"se": {1, 1},
+	"sw": {-1, 1},
+}
+
+// ValidFont returns true if name is the name of a font that text may be
+// drawn in
+func ValidFont(name string) bool {
+	_, ok := fonts[name]
+	return ok
+}
+
+// ValidTextPosition returns true if pos is a position that text may be
+// drawn at
+func ValidTextPosition(pos string) bool {
+	_, ok := textPositions[pos]
+	return ok
+}
+
+// EncodeText encodes text for the "text" option, which may not contain
+// commas
+func EncodeText(text string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(text))
+}
+
+// DecodeText decodes text encoded by EncodeText
+func DecodeText(s string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return "", errors.Wrap(err, `invalid text`)
+	}
+	if len(b) == 0 {
+		return "", errors.New(`empty text`)
+	}
+	return string(b), nil
+}
+
+// textPadding is the space between the text and the edges of its box,
+// as well as between the box and the edges of the image, in unscaled
+// pixels
+const textPadding = 2
+
+// drawText returns a copy of m with opt.Text drawn onto it
+func drawText(m image.Image, opt Options) image.Image {
+	face, ok := fonts[opt.Font]
+	if !ok {
+		face = basicfont.Face7x13
+	}
+	tw := font.MeasureString(face, opt.Text).Ceil()
+	if tw == 0 {
+		return m
+	}
+	lw, lh := tw+2*textPadding, face.Height+2*textPadding
+
+	fg := color.Color(color.White)
+	if opt.TextColor != "" {
+		fg, _ = parseColor(opt.TextColor)
+	}
+	label := image.NewNRGBA(image.Rect(0, 0, lw, lh))
+	if opt.TextBackground != "" {
+		bg, _ := parseColor(opt.TextBackground)
+		draw.Draw(label, label.Bounds(), image.NewUniform(bg), image.ZP, draw.Src)
+	}
+	d := font.Drawer{
+		Dst:  label,
+		Src:  image.NewUniform(fg),
+		Face: face,
+		Dot:  fixed.P(textPadding, textPadding+face.Ascent),
+	}
+	d.DrawString(opt.Text)
+
+	out := imaging.Clone(m)
+	b := out.Bounds()
+
+	// scale the text to the requested height, but keep it (and the
+	// padding around it) within the image
+	size := opt.FontSize
+	if size == 0 {
+		size = b.Dy() / 8
+	}
+	scale := size / face.Height
+	if s := b.Dx() / (lw + 2*textPadding); s < scale {
+		scale = s
+	}
+	if s := b.Dy() / (lh + 2*textPadding); s < scale {
+		scale = s
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	var scaled image.Image = label
+	if scale > 1 {
+		scaled = imaging.Resize(label, lw*scale, lh*scale, imaging.NearestNeighbor)
+	}
+
+	sb := scaled.Bounds()
+	pos, ok := textPositions[opt.TextPosition]
+	if !ok {
+		pos = textPositions["se"]
+	}
+	margin := textPadding * scale
+	at := image.Pt(
+		b.Min.X+align(pos[0], b.Dx(), sb.Dx(), margin),
+		b.Min.Y+align(pos[1], b.Dy(), sb.Dy(), margin),
+	)
+	draw.Draw(out, sb.Sub(sb.Min).Add(at), scaled, sb.Min, draw.Over)
+	return out
+}
+
+// align returns the offset of an object of the given length within a
+// space of the given length, aligned with the start (-1), the center (0),
+// or the end (1) of the space
+func align(side, space, length, margin int) int {
+	switch side {
+	case -1:
+		return margin
+	case 1:
+		return space - length - margin
+	}
+	return (space - length) / 2
+}
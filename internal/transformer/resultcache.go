@@ -0,0 +1,74 @@
+package transformer
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+)
+
+// resultCache holds recently transformed images, keyed by the hash of
+// the source content and the options used. This allows the same image
+// published under different URLs to be transformed only once by this
+// process. Entries are evicted in LRU order when the total size exceeds
+// maxBytes
+type resultCache struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	size     int64
+	maxBytes int64
+}
+
+type cachedResult struct {
+	key     string
+	content []byte
+	rep     transformReport
+}
+
+func newResultCache(maxBytes int64) *resultCache {
+	return &resultCache{
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		maxBytes: maxBytes,
+	}
+}
+
+func (c *resultCache) get(key string) (*cachedResult, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		metrics.Count("transform.result_cache.miss", 1)
+		return nil, false
+	}
+	metrics.Count("transform.result_cache.hit", 1)
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedResult), true
+}
+
+func (c *resultCache) add(r *cachedResult) {
+	if c == nil || int64(len(r.content)) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[r.key]; ok {
+		return
+	}
+	c.entries[r.key] = c.lru.PushFront(r)
+	c.size += int64(len(r.content))
+	for c.size > c.maxBytes {
+		e := c.lru.Back()
+		old := c.lru.Remove(e).(*cachedResult)
+		delete(c.entries, old.key)
+		c.size -= int64(len(old.content))
+	}
+}
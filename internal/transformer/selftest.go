@@ -0,0 +1,144 @@
+package transformer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"sort"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"golang.org/x/net/context"
+)
+
+// Size of the fixture used by SelfTest, and of the variants made from it
+const (
+	selfTestWidth  = 64
+	selfTestHeight = 48
+)
+
+// selfTestTolerance is how far the average of each channel of a variant
+// may be from that of the fixture. Resizing, and lossy encoders such as
+// JPEG and the GIF palette, move it a little, but never this much
+const selfTestTolerance = 16
+
+// SelfTest checks that the engine can decode, transform, and encode
+// images in each output format that the given rules may produce. A
+// generated fixture is encoded in each format, resized, and decoded
+// again, and the result must have the expected format, size, and
+// average color. Rules that keep the format of the source image may
+// produce any supported format
+func SelfTest(ctx context.Context, rules []string) error {
+	for _, format := range selfTestFormats(rules) {
+		if err := selfTestFormat(ctx, format); err != nil {
+			return errors.Wrapf(err, `self-test of format %s failed`, format)
+		}
+	}
+	return nil
+}
+
+// selfTestFormats returns the output formats that rules may produce,
+// including the fallback formats, sorted
+func selfTestFormats(rules []string) []string {
+	seen := make(map[string]struct{})
+	for _, f := range fallbackFormats {
+		seen[f] = struct{}{}
+	}
+	for _, rule := range rules {
+		if opt := ParseOptions(rule); opt.Format != "" {
+			seen[opt.Format] = struct{}{}
+			continue
+		}
+		for f := range encoders {
+			seen[f] = struct{}{}
+		}
+	}
+
+	formats := make([]string, 0, len(seen))
+	for f := range seen {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// selfTestFixture returns an opaque gradient, whose average color is
+// known without looking at it
+func selfTestFixture() image.Image {
+	m := image.NewNRGBA(image.Rect(0, 0, selfTestWidth, selfTestHeight))
+	for y := 0; y < selfTestHeight; y++ {
+		for x := 0; x < selfTestWidth; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(x * 255 / (selfTestWidth - 1)),
+				G: uint8(y * 255 / (selfTestHeight - 1)),
+				B: 0x80,
+				A: 0xff,
+			})
+		}
+	}
+	return m
+}
+
+func selfTestFormat(ctx context.Context, format string) error {
+	fixture := selfTestFixture()
+
+	var src bytes.Buffer
+	enc, ok := encoders[format]
+	if !ok {
+		return errors.Errorf(`unsupported output format %s`, format)
+	}
+	if err := enc(&src, fixture, jpegQuality); err != nil {
+		return errors.Wrap(err, `failed to encode fixture`)
+	}
+
+	var dst bytes.Buffer
+	var rep transformReport
+	w, h := selfTestWidth/2, selfTestHeight/2
+	opt := Options{Width: float64(w), Height: float64(h), Format: format}
+	if err := transform(ctx, &dst, &src, opt, &rep); err != nil {
+		return errors.Wrap(err, `failed to transform fixture`)
+	}
+	if rep.format != format {
+		return errors.Errorf(`variant was encoded as %s`, rep.format)
+	}
+
+	m, decoded, err := image.Decode(&dst)
+	if err != nil {
+		return errors.Wrap(err, `failed to decode variant`)
+	}
+	if decoded != format {
+		return errors.Errorf(`variant was decoded as %s`, decoded)
+	}
+	if b := m.Bounds(); b.Dx() != w || b.Dy() != h {
+		return errors.Errorf(`variant is %dx%d, expected %dx%d`, b.Dx(), b.Dy(), w, h)
+	}
+
+	want := averageColor(fixture)
+	got := averageColor(m)
+	for i := range want {
+		if d := got[i] - want[i]; d > selfTestTolerance || d < -selfTestTolerance {
+			return errors.Errorf(`average color of variant is %v, expected about %v`, got, want)
+		}
+	}
+	return nil
+}
+
+// averageColor returns the average of the red, green, and blue channels
+// of m, from 0 to 255
+func averageColor(m image.Image) [3]int {
+	var sum [3]uint64
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := m.At(x, y).RGBA()
+			sum[0] += uint64(r >> 8)
+			sum[1] += uint64(g >> 8)
+			sum[2] += uint64(bl >> 8)
+		}
+	}
+
+	n := uint64(b.Dx() * b.Dy())
+	if n == 0 {
+		return [3]int{}
+	}
+	return [3]int{int(sum[0] / n), int(sum[1] / n), int(sum[2] / n)}
+}
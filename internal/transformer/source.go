@@ -0,0 +1,116 @@
+package transformer
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"golang.org/x/net/context"
+)
+
+// Source is a source image that has been fetched from the origin. Its
+// checksum is known before it is transformed, and it can be transformed
+// into any number of variants without fetching it again
+type Source struct {
+	spool *sourceSpool
+	t     *TransformingTransport
+}
+
+// FetchSource fetches the source image at u. Like Transform, errors are
+// of kind errors.ErrTransformFailed, and missing sources are reported
+// as errors.ErrSourceNotFound. The source must be released once it is
+// no longer needed
+func (t *Transformer) FetchSource(ctx context.Context, u string) (src *Source, err error) {
+	defer func() {
+		err = errors.WithKind(errors.ErrTransformFailed, err)
+	}()
+
+	tt := newTransport(ctx, t)
+	req, err := t.newRequest(ctx, t.sourceURL(u))
+	if err != nil {
+		return nil, err
+	}
+
+	cl := http.Client{
+		Transport: tt.transport,
+	}
+	spool, err := tt.fetches.do(req.URL.String(), func() (*sourceSpool, error) {
+		return tt.fetchSource(ctx, &cl, req)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to fetch remote image`)
+	}
+
+	switch spool.statusCode {
+	case http.StatusOK:
+		return &Source{spool: spool, t: tt}, nil
+	case http.StatusNotFound, http.StatusGone:
+		spool.release()
+		return nil, errors.WithKind(errors.ErrSourceNotFound, errors.Errorf(`failed to fetch remote image: %d`, spool.statusCode))
+	default:
+		spool.release()
+		return nil, errors.Errorf(`failed to fetch remote image: %d`, spool.statusCode)
+	}
+}
+
+// SHA256 returns the hex encoded SHA-256 checksum of the source
+func (s *Source) SHA256() string {
+	return s.spool.sha256
+}
+
+// Release must be called once the source is no longer needed. The
+// source may not be used afterwards
+func (s *Source) Release() {
+	s.spool.release()
+}
+
+// Transform is like Transformer.Transform, but transforms the source
+// instead of fetching it again
+func (s *Source) Transform(ctx context.Context, options string, result *Result) (err error) {
+	defer func() {
+		err = errors.WithKind(errors.ErrTransformFailed, err)
+	}()
+
+	start := time.Now()
+	result.SourceSHA256 = s.spool.sha256
+	result.SourceETag = s.spool.header.Get("ETag")
+	result.ContentType = s.spool.header.Get("Content-Type")
+
+	opt := ParseOptions(options)
+	if opt == emptyOptions {
+		// passed through as is
+		n, err := io.Copy(result.Content, s.spool.reader())
+		if err != nil {
+			return errors.Wrap(err, `failed to copy image`)
+		}
+		result.Size = n
+	} else {
+		r, err := s.t.transformSpool(ctx, s.spool, opt)
+		if err != nil {
+			return err
+		}
+		n, err := result.Content.Write(r.content)
+		if err != nil {
+			return errors.Wrap(err, `failed to write transformed image`)
+		}
+		result.Size = int64(n)
+
+		rep := r.rep
+		if rep.placeholderValues.BlurHash != "" {
+			result.Placeholder = rep.placeholderValues
+		}
+		result.PerceptualHash = rep.phash
+		if rep.format != "" {
+			result.ContentType = "image/" + rep.format
+			if rep.format != rep.requested {
+				result.FormatFallback = rep.requested
+			}
+		}
+	}
+
+	if result.Preset != "" {
+		observePreset(ctx, result, time.Since(start))
+	}
+	return nil
+}
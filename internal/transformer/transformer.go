@@ -1,80 +1,371 @@
 package transformer
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/flags"
 	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/phash"
+	"github.com/lestrrat-go/sharaq/internal/placeholder"
+	"github.com/lestrrat-go/sharaq/internal/requestid"
 	"github.com/lestrrat-go/sharaq/internal/util"
-	"github.com/pkg/errors"
+	"github.com/lestrrat-go/sharaq/metadata"
 	"golang.org/x/net/context"
 )
 
+// Engine and EngineVersion identify the code that generates variants.
+// They are recorded along with each stored variant, so that variants
+// can be selectively regenerated when the engine changes. Bump
+// EngineVersion whenever a change affects the output
+const (
+	Engine        = "imaging"
+	EngineVersion = "1"
+)
+
 // Transformer is based on imageproxy by Will Norris. Code was shamelessly
 // stolen from there.
-type Transformer struct{}
+type Transformer struct {
+	fetches   *fetchGroup
+	headers   http.Header
+	maxSize   int64
+	onFetch   func(int64) // if non-nil, called with the size of each source fetched from the origin
+	quality   *qualitySampler
+	ratios    *compressionRatios
+	results   *resultCache
+	rewrite   func(string) string // if non-nil, applied to source URLs before they are fetched
+	transport http.RoundTripper   // if nil, the platform default is used
+	upstream  UpstreamFunc        // if non-nil, variants are requested from an upstream server
+	userAgent string
+}
+
+type Option interface {
+	Configure(*Transformer)
+}
+
+type OptionFunc func(*Transformer)
+
+func (f OptionFunc) Configure(t *Transformer) {
+	f(t)
+}
+
+// WithUserAgent specifies the User-Agent header sent when fetching images
+func WithUserAgent(s string) Option {
+	return OptionFunc(func(t *Transformer) {
+		t.userAgent = s
+	})
+}
+
+// WithHeaders specifies additional headers sent when fetching images
+func WithHeaders(h http.Header) Option {
+	return OptionFunc(func(t *Transformer) {
+		t.headers = h
+	})
+}
+
+// WithRewriter specifies a function that rewrites the URLs of source
+// images before they are fetched, for example to fetch from an internal
+// host instead of a public one
+func WithRewriter(f func(string) string) Option {
+	return OptionFunc(func(t *Transformer) {
+		t.rewrite = f
+	})
+}
+
+// sourceURL returns the URL that the source image at u is fetched from
+func (t *Transformer) sourceURL(u string) string {
+	if t.rewrite == nil {
+		return u
+	}
+	return t.rewrite(u)
+}
+
+// WithResultCacheSize enables caching of transformed images in memory,
+// keyed by the hash of the source content (see resultCache). n is the
+// maximum number of bytes held. 0 disables the cache
+func WithResultCacheSize(n int64) Option {
+	return OptionFunc(func(t *Transformer) {
+		if n > 0 {
+			t.results = newResultCache(n)
+		} else {
+			t.results = nil
+		}
+	})
+}
+
+// WithTransport specifies the transport used to fetch source images,
+// instead of the platform default
+func WithTransport(rt http.RoundTripper) Option {
+	return OptionFunc(func(t *Transformer) {
+		t.transport = rt
+	})
+}
+
+// WithSpooling makes source images larger than threshold bytes be
+// spooled to a temporary file in dir while they are transformed,
+// instead of being held in memory. If dir is empty, os.TempDir() is
+// used. A threshold of 0 disables spooling
+func WithSpooling(threshold int64, dir string) Option {
+	return OptionFunc(func(t *Transformer) {
+		t.fetches.spoolThreshold = threshold
+		t.fetches.spoolDir = dir
+	})
+}
+
+// WithFetchCounter specifies a function that is called with the number
+// of bytes of each source image fetched from the origin. Sources shared
+// by several presets are counted once
+func WithFetchCounter(f func(int64)) Option {
+	return OptionFunc(func(t *Transformer) {
+		t.onFetch = f
+	})
+}
+
+// WithMaxSourceSize specifies the maximum size in bytes of source
+// images. Larger images are rejected. 0 means no limit
+func WithMaxSourceSize(n int64) Option {
+	return OptionFunc(func(t *Transformer) {
+		t.maxSize = n
+	})
+}
 
 type TransformingTransport struct {
+	fetches   *fetchGroup
+	maxSize   int64
+	onFetch   func(int64)
+	quality   *qualitySampler
+	ratios    *compressionRatios
+	results   *resultCache
 	transport http.RoundTripper
 }
 
 type Result struct {
 	Content     io.Writer
 	ContentType string
+	Preset      string // if specified, per-preset metrics are recorded, and the variant may be requested from an upstream
 	Size        int64
+	Placeholder Placeholder
+	// FormatFallback is the format that the image could not be encoded
+	// in. If non-empty, ContentType is the format that was used instead
+	FormatFallback string
+	// SourceSHA256 is the hex encoded SHA-256 checksum of the source
+	// image, before it was transformed
+	SourceSHA256 string
+	// SourceETag is the ETag that the origin sent with the source image
+	SourceETag string
+	// PerceptualHash is the difference hash of the source image (see the
+	// phash package). It is only available if the image was transformed
+	PerceptualHash string
+}
+
+// Placeholder holds values computed from the source image, which
+// front-ends can use to render something while the image loads. They
+// are only available if the image was actually transformed
+type Placeholder struct {
+	DominantColor string
+	BlurHash      string
+}
+
+// Headers used to pass the placeholder values from the transport to
+// Transform. They are always removed from origin responses, so that
+// origins cannot inject them
+const (
+	headerDominantColor  = "X-Sharaq-Dominant-Color"
+	headerBlurHash       = "X-Sharaq-Blurhash"
+	headerFormatFallback = "X-Sharaq-Format-Fallback"
+	headerSourceSHA256   = "X-Sharaq-Source-Sha256"
+	headerPerceptualHash = "X-Sharaq-Phash"
+)
+
+// Metadata returns the metadata to be stored along with the result of
+// transforming the image at u using the given preset and rule
+func (r *Result) Metadata(u, preset, rule string) *metadata.Metadata {
+	return &metadata.Metadata{
+		SourceURL:      u,
+		Preset:         preset,
+		Rule:           rule,
+		ContentType:    r.ContentType,
+		Engine:         Engine,
+		EngineVersion:  EngineVersion,
+		DominantColor:  r.Placeholder.DominantColor,
+		BlurHash:       r.Placeholder.BlurHash,
+		FormatFallback: r.FormatFallback,
+		SourceSHA256:   r.SourceSHA256,
+		SourceETag:     r.SourceETag,
+		PerceptualHash: r.PerceptualHash,
+		CreatedAt:      time.Now(),
+	}
 }
 
-func New() *Transformer {
-	return &Transformer{}
+func New(options ...Option) *Transformer {
+	t := &Transformer{
+		fetches: &fetchGroup{},
+		ratios:  newCompressionRatios(),
+	}
+	for _, o := range options {
+		o.Configure(t)
+	}
+	return t
 }
 
 // Transform takes a string that specifies the transformation,
 // the url of the target, and populates the given result object
-// if transformation was successful
-func (t *Transformer) Transform(ctx context.Context, options string, u string, result *Result) error {
+// if transformation was successful. Errors are of kind
+// errors.ErrTransformFailed
+func (t *Transformer) Transform(ctx context.Context, options string, u string, result *Result) (err error) {
+	defer func() {
+		err = errors.WithKind(errors.ErrTransformFailed, err)
+	}()
+
+	start := time.Now()
+	if t.upstream != nil && result.Preset != "" {
+		if err := t.transformUpstream(ctx, u, result); err != nil {
+			return err
+		}
+		observePreset(ctx, result, time.Since(start))
+		return nil
+	}
+
+	u = t.sourceURL(u)
+	passthrough := true
 	if opts := ParseOptions(options); opts != emptyOptions {
 		u += "#" + opts.String()
+		passthrough = false
 	}
 
 	// Create a client here (this could be different for appengine)
-	cl := newClient(ctx)
-	res, err := cl.Get(u)
+	cl := newClient(ctx, t)
+	req, err := t.newRequest(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	res, err := cl.Do(req)
 	if err != nil {
 		return errors.Wrap(err, `failed to fetch remote image`)
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return errors.WithKind(errors.ErrSourceNotFound, errors.Errorf(`failed to fetch remote image: %d`, res.StatusCode))
+	default:
 		return errors.Errorf(`failed to fetch remote image: %d`, res.StatusCode)
 	}
 
-	if _, err := io.CopyN(result.Content, res.Body, res.ContentLength); err != nil {
+	// when the image is passed through as is, the content is the source,
+	// which may come without a Content-Length (e.g. chunked)
+	h := sha256.New()
+	dst := io.MultiWriter(result.Content, h)
+	var n int64
+	if res.ContentLength < 0 {
+		n, err = io.Copy(dst, res.Body)
+	} else {
+		n, err = io.CopyN(dst, res.Body, res.ContentLength)
+	}
+	if err != nil {
 		return errors.Wrap(err, `failed to read transformed content`)
 	}
+	result.SourceSHA256 = res.Header.Get(headerSourceSHA256)
+	if passthrough {
+		result.SourceSHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	result.SourceETag = res.Header.Get("ETag")
 	result.ContentType = res.Header.Get("Content-Type")
-	result.Size = res.ContentLength
+	result.Size = n
+	result.Placeholder.DominantColor = res.Header.Get(headerDominantColor)
+	result.Placeholder.BlurHash = res.Header.Get(headerBlurHash)
+	result.FormatFallback = res.Header.Get(headerFormatFallback)
+	result.PerceptualHash = res.Header.Get(headerPerceptualHash)
 
+	if result.Preset != "" {
+		observePreset(ctx, result, time.Since(start))
+	}
 	return nil
 }
 
+// observePreset records the metrics of a variant, and passes it to the
+// observer in ctx, if any
+func observePreset(ctx context.Context, result *Result, elapsed time.Duration) {
+	tags := flags.Tags(ctx, metrics.PresetTag(result.Preset))
+	metrics.Timing("transform.preset.duration", elapsed, tags...)
+	metrics.Count("transform.preset.bytes", result.Size, tags...)
+	observe(ctx, result, elapsed)
+}
+
+// newRequest creates a request for the source image at u
+func (t *Transformer) newRequest(ctx context.Context, u string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create request`)
+	}
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	if id := requestid.Get(ctx); id != "" {
+		req.Header.Set(requestid.HeaderName, id)
+	}
+	return req, nil
+}
+
+// TransformContent applies the transformation specified by options to
+// the encoded image read from src, and writes the result to dst. Unlike
+// Transform, no remote fetching is involved.
+func (t *Transformer) TransformContent(ctx context.Context, options string, dst io.Writer, src io.Reader) error {
+	return errors.WithKind(errors.ErrTransformFailed, transform(ctx, dst, src, ParseOptions(options), nil))
+}
+
 func (t *TransformingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	ctx := util.TransportCtx(t.transport)
+	if id := req.Header.Get(requestid.HeaderName); id != "" {
+		ctx = requestid.With(ctx, id)
+	}
+
 	if req.URL.Fragment == "" {
 		// normal requests pass through
 		log.Debugf(ctx, "fetching remote URL: %v", req.URL)
-		return t.transport.RoundTrip(req)
+		start := time.Now()
+		resp, err := t.transport.RoundTrip(req)
+		logOriginResponse(ctx, req.URL, resp, err, time.Since(start))
+		if err != nil {
+			return nil, err
+		}
+		resp.Header.Del(headerDominantColor)
+		resp.Header.Del(headerBlurHash)
+		resp.Header.Del(headerFormatFallback)
+		resp.Header.Del(headerSourceSHA256)
+		resp.Header.Del(headerPerceptualHash)
+		if err := t.limit(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if t.onFetch != nil {
+			resp.Body = &countedBody{ReadCloser: resp.Body, onClose: t.onFetch}
+		}
+		return resp, nil
 	}
 
 	u := *req.URL
@@ -83,48 +374,166 @@ func (t *TransformingTransport) RoundTrip(req *http.Request) (*http.Response, er
 	cl := http.Client{
 		Transport: t.transport,
 	}
-	resp, err := cl.Get(u.String())
+	origReq, err := http.NewRequest(http.MethodGet, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
+	origReq.Header = req.Header
+
+	// The presets of a job ask for the same source at the same time
+	spool, err := t.fetches.do(u.String(), func() (*sourceSpool, error) {
+		return t.fetchSource(ctx, &cl, origReq)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer spool.release()
+
+	resp := spool.response(origReq)
 	if resp.StatusCode != http.StatusOK {
 		return resp, nil
 	}
-	defer resp.Body.Close()
 
-	img := bbpool.Get()
-	defer bbpool.Release(img)
+	srcHash := spool.sha256
+	result, err := t.transformSpool(ctx, spool, ParseOptions(req.URL.Fragment))
+	if err != nil {
+		return nil, err
+	}
+	rep := result.rep
+
+	resp.Header.Del(headerDominantColor)
+	resp.Header.Del(headerBlurHash)
+	resp.Header.Del(headerFormatFallback)
+	resp.Header.Del(headerPerceptualHash)
+	resp.Header.Set(headerSourceSHA256, srcHash)
+	if ph := rep.placeholderValues; ph.BlurHash != "" {
+		resp.Header.Set(headerDominantColor, ph.DominantColor)
+		resp.Header.Set(headerBlurHash, ph.BlurHash)
+	}
+	if rep.phash != "" {
+		resp.Header.Set(headerPerceptualHash, rep.phash)
+	}
+	if rep.format != "" {
+		resp.Header.Set("Content-Type", "image/"+rep.format)
+		if rep.format != rep.requested {
+			resp.Header.Set(headerFormatFallback, rep.requested)
+		}
+	}
 
-	opt := ParseOptions(req.URL.Fragment)
-	if err := transform(ctx, img, resp.Body, opt); err != nil {
+	// The body reads the result as is. It is either cached, which
+	// never modifies it, or used by this response only
+	resp.Header.Set("Content-Length", strconv.Itoa(len(result.content)))
+	resp.ContentLength = int64(len(result.content))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(result.content))
+	resp.Request = req
+	return resp, nil
+}
+
+// transformSpool applies opt to the spooled source. The same image may
+// be published under several URLs, so results are cached by content
+// rather than by URL
+func (t *TransformingTransport) transformSpool(ctx context.Context, spool *sourceSpool, opt Options) (*cachedResult, error) {
+	key := spool.sha256 + "#" + opt.String()
+	if result, ok := t.results.get(key); ok {
+		return result, nil
+	}
+
+	// Cached results are copied out of the pooled buffer. Without the
+	// cache, the result is only used once, so it gets its own buffer
+	// instead
+	var img *bytes.Buffer
+	if t.results != nil {
+		img = bbpool.Get()
+		defer bbpool.Release(img)
+	} else {
+		img = &bytes.Buffer{}
+	}
+
+	rep := transformReport{placeholder: true}
+	if t.quality.sample() {
+		rep.quality = t.quality
+	}
+	if err := transform(ctx, img, spool.reader(), opt, &rep); err != nil {
 		return nil, err
 	}
+	t.ratios.record(opt.String(), rep.format, rep.width*rep.height, int64(img.Len()))
 
-	buf := bbpool.Get()
-	defer bbpool.Release(buf)
+	result := &cachedResult{
+		key:     key,
+		content: img.Bytes(),
+		rep:     rep,
+	}
+	if t.results != nil {
+		result.content = append([]byte(nil), result.content...)
+		t.results.add(result)
+	}
+	return result, nil
+}
 
-	// replay response with transformed image and updated content length
-	fmt.Fprintf(buf, "%s %s\r\n", resp.Proto, resp.Status)
-	resp.Header.WriteSubset(buf, map[string]bool{"Content-Length": true})
-	fmt.Fprintf(buf, "Content-Length: %d\r\n\r\n", img.Len())
+// limit rejects responses that are larger than the maximum source size
+func (t *TransformingTransport) limit(resp *http.Response) error {
+	if t.maxSize <= 0 {
+		return nil
+	}
+	if resp.ContentLength > t.maxSize {
+		return errors.WithKind(errors.ErrSourceTooLarge, errors.Errorf(`source is %d bytes, limit is %d`, resp.ContentLength, t.maxSize))
+	}
+	// Content-Length may be missing or lying
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: t.maxSize, limit: t.maxSize}
+	return nil
+}
 
-	if _, err := img.WriteTo(buf); err != nil {
-		return nil, errors.Wrap(err, `failed to write transformed image`)
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	limit     int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errors.WithKind(errors.ErrSourceTooLarge, errors.Errorf(`source exceeds limit of %d bytes`, b.limit))
+	}
+	// read one byte more than allowed, so we can tell if the limit
+	// was exceeded
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, errors.WithKind(errors.ErrSourceTooLarge, errors.Errorf(`source exceeds limit of %d bytes`, b.limit))
 	}
+	return n, err
+}
 
-	// This buffer may NOT be allocated from the bufferpool
-	// because it is then used by bufio.Reader, which doesn't
-	// immediately finish reading.
-	//
-	// Without this, we run the risk of releasing the buffer
-	// before bufio gets the chance to read it all
-	//
-	// Furthermore, we copy the bytes here (by creating a string)
-	// to make absolutely sure that we don't accidentally reuse
-	// the buffer somewhere
-	outbuf := bufio.NewReader(bytes.NewBufferString(buf.String()))
+// countedBody reports the number of bytes that were read when it is
+// closed
+type countedBody struct {
+	io.ReadCloser
+	n       int64
+	onClose func(int64)
+}
 
-	return http.ReadResponse(outbuf, req)
+func (b *countedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countedBody) Close() error {
+	if f := b.onClose; f != nil {
+		b.onClose = nil
+		f(b.n)
+	}
+	return b.ReadCloser.Close()
+}
+
+func logOriginResponse(ctx context.Context, u *url.URL, resp *http.Response, err error, elapsed time.Duration) {
+	if err != nil {
+		log.Debugf(ctx, "origin fetch %s failed after %.3fs: %s", u, elapsed.Seconds(), err)
+		return
+	}
+	log.Debugf(ctx, "origin fetch %s responded with %d in %.3fs", u, resp.StatusCode, elapsed.Seconds())
 }
 
 // URLError reports a malformed URL error.
@@ -153,6 +562,59 @@ type Options struct {
 
 	FlipVertical   bool
 	FlipHorizontal bool
+
+	// If true, the image is decoded and re-encoded even if no other
+	// transformation is requested. This strips metadata such as EXIF
+	Strip bool
+
+	// Output format: "gif", "jpeg", or "png". The format of the source
+	// image is used if empty
+	Format string
+
+	// Color (as RRGGBB) that transparent pixels are flattened onto when
+	// the output format has no transparency. Default is white
+	Background string
+
+	// If either is non-zero, these are used instead of Width and Height
+	// for portrait (taller than wide) source images
+	PortraitWidth  float64
+	PortraitHeight float64
+
+	// If true, source images that already fit in the requested size are
+	// used as is, instead of being decoded and re-encoded. Strip, Format,
+	// rotations, flips and Text still force the image to be re-encoded
+	NoUpscale bool
+
+	// Compression quality of JPEG output, from 1 to 100. Default is 95
+	Quality int
+
+	// Resample filter used when resizing: "nearest", "box", "linear",
+	// "catmullrom", or "lanczos" (default)
+	Filter string
+
+	// If non-zero, JPEG output is re-encoded at lower qualities until it
+	// is no larger than this many bytes. See encodeMaxBytes
+	MaxBytes int64
+
+	// Text drawn onto the image, such as "SOLD OUT". The remaining
+	// options are only used if Text is non-empty
+	Text string
+
+	// Name of the font that Text is drawn in. See fonts
+	Font string
+
+	// Height of the text in pixels. The font is scaled by a whole number,
+	// so the actual height may be smaller. Default is 1/8 of the image
+	FontSize int
+
+	// Where the text is drawn: "c" (center), "n", "s", "e", "w", "ne",
+	// "nw", "se" (default), or "sw"
+	TextPosition string
+
+	// Colors (as RRGGBB) of the text, and of the box behind it. Default is
+	// white text without a box
+	TextColor      string
+	TextBackground string
 }
 
 var emptyOptions = Options{}
@@ -162,6 +624,9 @@ func (o Options) String() string {
 	defer bbpool.Release(buf)
 
 	fmt.Fprintf(buf, "%vx%v", o.Width, o.Height)
+	if o.PortraitWidth != 0 || o.PortraitHeight != 0 {
+		fmt.Fprintf(buf, "|%vx%v", o.PortraitWidth, o.PortraitHeight)
+	}
 	if o.Fit {
 		buf.WriteString(",fit")
 	}
@@ -174,6 +639,45 @@ func (o Options) String() string {
 	if o.FlipHorizontal {
 		buf.WriteString(",fh")
 	}
+	if o.Strip {
+		buf.WriteString(",strip")
+	}
+	if o.Format != "" {
+		buf.WriteString("," + o.Format)
+	}
+	if o.Background != "" {
+		buf.WriteString(",bg" + o.Background)
+	}
+	if o.NoUpscale {
+		buf.WriteString(",noupscale")
+	}
+	if o.Quality != 0 {
+		fmt.Fprintf(buf, ",q%d", o.Quality)
+	}
+	if o.Filter != "" {
+		buf.WriteString("," + o.Filter)
+	}
+	if o.MaxBytes != 0 {
+		fmt.Fprintf(buf, ",maxbytes%d", o.MaxBytes)
+	}
+	if o.Text != "" {
+		buf.WriteString(",text" + EncodeText(o.Text))
+	}
+	if o.Font != "" {
+		buf.WriteString(",font" + o.Font)
+	}
+	if o.FontSize != 0 {
+		fmt.Fprintf(buf, ",fontsize%d", o.FontSize)
+	}
+	if o.TextPosition != "" {
+		buf.WriteString(",at" + o.TextPosition)
+	}
+	if o.TextColor != "" {
+		buf.WriteString(",fg" + o.TextColor)
+	}
+	if o.TextBackground != "" {
+		buf.WriteString(",badge" + o.TextBackground)
+	}
 	return buf.String()
 }
 
@@ -203,6 +707,10 @@ func (o Options) String() string {
 // resized to fit the specified dimension, scaling the other dimension as
 // needed to maintain the aspect ratio.
 //
+// Two sizes separated by "|", such as "360x216|216x360", specify separate sizes
+// for landscape and portrait source images. The second size is used if the
+// source image is taller than it is wide.
+//
 // If the "fit" option is specified together with a width and height value, the
 // image will be resized to fit within a containing box of the specified size.
 // As always, the original aspect ratio will be preserved. Specifying the "fit"
@@ -217,6 +725,46 @@ func (o Options) String() string {
 // The "fv" option will flip the image vertically. The "fh" option will flip
 // the image horizontally. Images are flipped after being rotated.
 //
+// Output Format
+//
+// The "gif", "jpeg" (or "jpg"), and "png" options convert the image to the
+// given format. By default the format of the source image is kept.
+//
+// The "bg{RRGGBB}" option specifies the color that transparent pixels are
+// flattened onto when the output format is JPEG, which has no transparency.
+// The default is white.
+//
+// Encoder Settings
+//
+// The "q{quality}" option sets the compression quality of JPEG output, from 1
+// to 100. The default is 95.
+//
+// The "nearest", "box", "linear", "catmullrom", and "lanczos" options select
+// the filter used when resizing. The default is "lanczos", which gives the
+// best quality, but is the slowest.
+//
+// The "maxbytes{bytes}" option limits the size of JPEG output. Images that
+// are larger are encoded again at lower qualities, a bounded number of times,
+// and the highest quality that fits is used. If none fits, the smallest
+// result is used.
+//
+// Text
+//
+// The "text{text}" option draws text onto the image, after all other
+// transformations. The text is encoded as by EncodeText, so that it may
+// contain commas. "font{name}" selects the font ("basic" (default),
+// "inconsolata", or "inconsolata-bold"), "fontsize{pixels}" the height of
+// the text, "at{position}" where it is drawn ("c", "n", "s", "e", "w",
+// "ne", "nw", "se" (default), or "sw"), "fg{RRGGBB}" its color (default
+// white), and "badge{RRGGBB}" the color of a box drawn behind it.
+//
+// Small Sources
+//
+// Images are never resized to be larger than the source image. By default,
+// sources that are smaller than the requested size are still re-encoded. The
+// "noupscale" option stores such sources as they are, unless another option
+// such as "strip" or a format requires re-encoding them.
+//
 // Examples
 //
 // 	0x0       - no resizing
@@ -228,6 +776,11 @@ func (o Options) String() string {
 // 	150,fit   - scale to fit 150 pixels square, no cropping
 // 	100,r90   - 100 pixels square, rotated 90 degrees
 // 	100,fv,fh - 100 pixels square, flipped horizontal and vertical
+// 	360x216|216x360 - 360 by 216 pixels, or 216 by 360 pixels for portrait images
+// 	100,jpeg  - 100 pixels square, as JPEG with a white background
+// 	100,jpeg,bg000000 - 100 pixels square, as JPEG with a black background
+// 	100,noupscale - 100 pixels square, or the source as is if it is smaller
+// 	100,textU09MRCBPVVQ,badgecc0000 - 100 pixels square, with "SOLD OUT" on a red box
 func ParseOptions(str string) Options {
 	var options Options
 
@@ -239,27 +792,87 @@ func ParseOptions(str string) Options {
 			options.FlipVertical = true
 		case opt == "fh":
 			options.FlipHorizontal = true
-		case len(opt) > 2 && opt[:1] == "r":
-			options.Rotate, _ = strconv.Atoi(opt[1:])
-		case strings.ContainsRune(opt, 'x'):
-			size := strings.SplitN(opt, "x", 2)
-			if w := size[0]; w != "" {
-				options.Width, _ = strconv.ParseFloat(w, 64)
+		case opt == "strip":
+			options.Strip = true
+		case opt == "noupscale":
+			options.NoUpscale = true
+		case resampleFilters[opt] != nil:
+			options.Filter = opt
+		case strings.HasPrefix(opt, "text"):
+			if text, err := DecodeText(opt[len("text"):]); err == nil {
+				options.Text = text
 			}
-			if h := size[1]; h != "" {
-				options.Height, _ = strconv.ParseFloat(h, 64)
+		case strings.HasPrefix(opt, "fontsize"):
+			if n, err := strconv.Atoi(opt[len("fontsize"):]); err == nil && n > 0 {
+				options.FontSize = n
 			}
-		default:
-			if size, err := strconv.ParseFloat(opt, 64); err == nil {
-				options.Width = size
-				options.Height = size
+		case strings.HasPrefix(opt, "font"):
+			if _, ok := fonts[opt[len("font"):]]; ok {
+				options.Font = opt[len("font"):]
+			}
+		case strings.HasPrefix(opt, "at"):
+			if _, ok := textPositions[opt[len("at"):]]; ok {
+				options.TextPosition = opt[len("at"):]
+			}
+		case len(opt) == 8 && opt[:2] == "fg":
+			if _, err := parseColor(opt[2:]); err == nil {
+				options.TextColor = opt[2:]
 			}
+		case len(opt) == 11 && opt[:5] == "badge":
+			if _, err := parseColor(opt[5:]); err == nil {
+				options.TextBackground = opt[5:]
+			}
+		case strings.HasPrefix(opt, "maxbytes"):
+			if n, err := strconv.ParseInt(opt[len("maxbytes"):], 10, 64); err == nil && n > 0 {
+				options.MaxBytes = n
+			}
+		case len(opt) > 1 && opt[:1] == "q":
+			if q, err := strconv.Atoi(opt[1:]); err == nil && q >= 1 && q <= 100 {
+				options.Quality = q
+			}
+		case opt == "gif", opt == "jpeg", opt == "png":
+			options.Format = opt
+		case opt == "jpg":
+			options.Format = "jpeg"
+		case len(opt) == 8 && opt[:2] == "bg":
+			if _, err := parseColor(opt[2:]); err == nil {
+				options.Background = opt[2:]
+			}
+		case len(opt) > 2 && opt[:1] == "r":
+			options.Rotate, _ = strconv.Atoi(opt[1:])
+		case strings.ContainsRune(opt, '|'):
+			sizes := strings.SplitN(opt, "|", 2)
+			parseSize(sizes[0], &options.Width, &options.Height)
+			parseSize(sizes[1], &options.PortraitWidth, &options.PortraitHeight)
+		default:
+			parseSize(opt, &options.Width, &options.Height)
 		}
 	}
 
 	return options
 }
 
+// parseSize parses a size option of the form "{width}x{height}" or
+// "{size}" into w and h. Omitted values are left untouched. See
+// ParseOptions
+func parseSize(s string, w, h *float64) {
+	if strings.ContainsRune(s, 'x') {
+		size := strings.SplitN(s, "x", 2)
+		if v := size[0]; v != "" {
+			*w, _ = strconv.ParseFloat(v, 64)
+		}
+		if v := size[1]; v != "" {
+			*h, _ = strconv.ParseFloat(v, 64)
+		}
+		return
+	}
+
+	if size, err := strconv.ParseFloat(s, 64); err == nil {
+		*w = size
+		*h = size
+	}
+}
+
 // Request is an imageproxy request which includes a remote URL of an image to
 // proxy, and an optional set of transformations to perform.
 type Request struct {
@@ -314,19 +927,73 @@ func NewRequest(r *http.Request) (*Request, error) {
 	return req, nil
 }
 
+// maxBytesAttempts limits the number of times an image is encoded to fit
+// in the size given by the "maxbytes" option
+const maxBytesAttempts = 8
+
+// minQuality is the lowest quality used to fit an image in the size given
+// by the "maxbytes" option
+const minQuality = 10
+
 // compression quality of resized jpegs
 const jpegQuality = 95
 
 // resample filter used when resizing images
 var resampleFilter = imaging.Lanczos
 
-// Transform the provided image.  img should contain the raw bytes of an
-// encoded image in one of the supported formats (gif, jpeg, or png).  The
-// bytes of a similarly encoded image is returned.
-func transform(ctx context.Context, dst io.Writer, img io.Reader, opt Options) error {
+// resampleFilters are the filters that may be selected by name
+var resampleFilters = map[string]*imaging.ResampleFilter{
+	"nearest":    &imaging.NearestNeighbor,
+	"box":        &imaging.Box,
+	"linear":     &imaging.Linear,
+	"catmullrom": &imaging.CatmullRom,
+	"lanczos":    &imaging.Lanczos,
+}
+
+// encoders encode images in each supported output format. quality is
+// only used by formats that support it, and is never 0
+var encoders = map[string]func(w io.Writer, m image.Image, quality int) error{
+	"gif": func(w io.Writer, m image.Image, _ int) error {
+		return gif.Encode(w, m, nil)
+	},
+	"jpeg": func(w io.Writer, m image.Image, quality int) error {
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: quality})
+	},
+	"png": func(w io.Writer, m image.Image, _ int) error {
+		return png.Encode(w, m)
+	},
+}
+
+// fallbackFormats are tried in order when an image can not be encoded
+// in the requested format
+var fallbackFormats = []string{"png", "jpeg"}
+
+// transformReport describes what transform did
+type transformReport struct {
+	placeholder       bool            // if true, placeholderValues are computed
+	placeholderValues Placeholder     // computed from the source image
+	phash             string          // of the source image, computed along with placeholderValues
+	requested         string          // format that the output should have been encoded in
+	format            string          // format of the output. differs from requested after a fallback
+	quality           *qualitySampler // if non-nil, the quality of the output is measured
+	width, height     int             // of the output, if it was encoded by transform
+}
+
+// transform applies opt to the image read from img, and writes the
+// result to dst. If rep is non-nil, it is populated with information
+// about the transformation
+func transform(ctx context.Context, dst io.Writer, img io.Reader, opt Options, rep *transformReport) (err error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// Image decoders have been known to panic on malformed input.
+	// Don't let one bad image take down the whole process
+	defer func() {
+		if v := recover(); v != nil {
+			err = errors.Errorf(`panic while transforming image: %v`, v)
+		}
+	}()
+
 	if opt.String() == emptyOptions.String() { // XXX WTF. This is bad. fix it
 		// bail if no transformation was requested
 		n, err := io.Copy(dst, img)
@@ -337,6 +1004,28 @@ func transform(ctx context.Context, dst io.Writer, img io.Reader, opt Options) e
 		return nil
 	}
 
+	var src io.ReadSeeker
+	var srcOffset int64
+	if opt.NoUpscale {
+		// keep the encoded source around, in case it is used as is.
+		// Spooled sources can simply be read again
+		if rs, ok := img.(io.ReadSeeker); ok {
+			off, err := rs.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return errors.Wrap(err, `failed to read image`)
+			}
+			src, srcOffset = rs, off
+		} else {
+			buf := bbpool.Get()
+			defer bbpool.Release(buf)
+			if _, err := io.Copy(buf, img); err != nil {
+				return errors.Wrap(err, `failed to read image`)
+			}
+			src = bytes.NewReader(buf.Bytes())
+			img = src
+		}
+	}
+
 	log.Debugf(ctx, "Transforming image with rule '%#v'", opt)
 	// decode image
 	m, format, err := image.Decode(img)
@@ -344,40 +1033,249 @@ func transform(ctx context.Context, dst io.Writer, img io.Reader, opt Options) e
 		return errors.Wrap(err, `failed to decode image`)
 	}
 
+	if rep != nil && rep.placeholder {
+		ph := &rep.placeholderValues
+		ph.DominantColor, ph.BlurHash = placeholder.Compute(m)
+		rep.phash = phash.Format(phash.DHash(m))
+	}
+
+	if opt.NoUpscale && fits(m, opt) && !opt.Strip && (opt.Format == "" || opt.Format == format) && opt.Rotate == 0 && !opt.FlipVertical && !opt.FlipHorizontal && opt.Text == "" && (opt.MaxBytes == 0 || withinBytes(src, srcOffset, opt.MaxBytes)) {
+		log.Debugf(ctx, "source fits in %s, using it as is", opt)
+		if _, err := src.Seek(srcOffset, io.SeekStart); err != nil {
+			return errors.Wrap(err, `failed to rewind image`)
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			return errors.Wrap(err, `failed to copy image`)
+		}
+		if rep != nil {
+			rep.requested = format
+			rep.format = format
+		}
+		return nil
+	}
+
 	m = transformImage(m, opt)
 
-	// encode image
-	switch format {
-	case "gif":
-		gif.Encode(dst, m, nil)
-	case "jpeg":
-		jpeg.Encode(dst, m, &jpeg.Options{Quality: jpegQuality})
-	case "png":
-		png.Encode(dst, m)
+	if opt.Format != "" {
+		format = opt.Format
+	}
+
+	bg := color.Color(color.White)
+	if opt.Background != "" {
+		bg, _ = parseColor(opt.Background)
+	}
+
+	quality := jpegQuality
+	if opt.Quality != 0 {
+		quality = opt.Quality
 	}
 
+	var out *bytes.Buffer
+	if rep != nil && rep.quality != nil {
+		out = bbpool.Get()
+		defer bbpool.Release(out)
+		dst = io.MultiWriter(dst, out)
+	}
+
+	var used string
+	if opt.MaxBytes > 0 {
+		used, quality, err = encodeMaxBytes(ctx, dst, m, format, bg, quality, opt.MaxBytes)
+	} else {
+		used, err = encode(ctx, dst, m, format, bg, quality)
+	}
+	if err != nil {
+		return err
+	}
+	if out != nil {
+		ref := m
+		if used == "jpeg" {
+			ref = flatten(m, bg)
+		}
+		rep.quality.measure(ctx, ref, out.Bytes(), used, quality)
+	}
+	if rep != nil {
+		rep.requested = format
+		rep.format = used
+		rep.width, rep.height = m.Bounds().Dx(), m.Bounds().Dy()
+	}
 	return nil
 }
 
+// withinBytes returns true if the rest of src, starting at off, is no
+// larger than max bytes
+func withinBytes(src io.Seeker, off, max int64) bool {
+	end, err := src.Seek(0, io.SeekEnd)
+	return err == nil && end-off <= max
+}
+
+// parseColor parses a color in RRGGBB form
+func parseColor(s string) (color.Color, error) {
+	if len(s) != 6 {
+		return nil, errors.Errorf(`invalid color %s`, s)
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, `invalid color %s`, s)
+	}
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// flatten draws m onto the background color bg, so that it can be
+// encoded in formats without transparency. Opaque images are returned
+// as is
+func flatten(m image.Image, bg color.Color) image.Image {
+	if o, ok := m.(interface {
+		Opaque() bool
+	}); ok && o.Opaque() {
+		return m
+	}
+
+	b := m.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.NewUniform(bg), image.ZP, draw.Src)
+	draw.Draw(dst, b, m, b.Min, draw.Over)
+	return dst
+}
+
+// encode writes m to dst in the given format. If that fails, the
+// formats in fallbackFormats are tried instead. The format that was
+// actually used is returned. Transparent pixels are flattened onto bg
+// for formats without transparency
+func encode(ctx context.Context, dst io.Writer, m image.Image, format string, bg color.Color, quality int) (string, error) {
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	// nothing may be written to dst until encoding succeeds, as a
+	// failed encoder may have written partial output
+	try := func(f string) error {
+		enc, ok := encoders[f]
+		if !ok {
+			return errors.Errorf(`unsupported output format %s`, f)
+		}
+		buf.Reset()
+		if f == "jpeg" {
+			return enc(buf, flatten(m, bg), quality)
+		}
+		return enc(buf, m, quality)
+	}
+
+	err := try(format)
+	used := format
+	if err != nil {
+		log.Debugf(ctx, "failed to encode image as %s: %s", format, err)
+		for _, f := range fallbackFormats {
+			if f == format {
+				continue
+			}
+			if ferr := try(f); ferr != nil {
+				log.Debugf(ctx, "failed to encode image as %s: %s", f, ferr)
+				continue
+			}
+			log.Debugf(ctx, "encoded image as %s instead of %s", f, format)
+			metrics.Count("transform.format_fallback", 1, "format:"+format)
+			err = nil
+			used = f
+			break
+		}
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, `failed to encode image as %s`, format)
+	}
+
+	if _, err := buf.WriteTo(dst); err != nil {
+		return "", errors.Wrap(err, `failed to write encoded image`)
+	}
+	return used, nil
+}
+
+// encodeMaxBytes is like encode, but JPEG output that is larger than max
+// bytes is encoded again, searching for the highest quality below the
+// given one that fits. The quality that was used is returned
+func encodeMaxBytes(ctx context.Context, dst io.Writer, m image.Image, format string, bg color.Color, quality int, max int64) (string, int, error) {
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	used, err := encode(ctx, buf, m, format, bg, quality)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// only JPEG has a quality to lower
+	if used == "jpeg" && int64(buf.Len()) > max {
+		best := append([]byte(nil), buf.Bytes()...)
+		bestQuality := quality
+		fit := false
+
+		lo, hi := minQuality, quality-1
+		for attempts := 1; attempts < maxBytesAttempts && lo <= hi; attempts++ {
+			q := (lo + hi) / 2
+			buf.Reset()
+			if _, err := encode(ctx, buf, m, used, bg, q); err != nil {
+				return "", 0, err
+			}
+			if int64(buf.Len()) <= max {
+				best, bestQuality, fit = append(best[:0], buf.Bytes()...), q, true
+				lo = q + 1
+				continue
+			}
+			if !fit && buf.Len() < len(best) {
+				best, bestQuality = append(best[:0], buf.Bytes()...), q
+			}
+			hi = q - 1
+		}
+
+		if !fit {
+			log.Debugf(ctx, "could not encode image in %d bytes, using %d bytes at quality %d", max, len(best), bestQuality)
+			metrics.Count("transform.max_bytes.exceeded", 1)
+		}
+		buf.Reset()
+		buf.Write(best)
+		quality = bestQuality
+	}
+
+	if _, err := buf.WriteTo(dst); err != nil {
+		return "", 0, errors.Wrap(err, `failed to write encoded image`)
+	}
+	return used, quality, nil
+}
+
 // transformImage modifies the image m based on the transformations specified
 // in opt.
-func transformImage(m image.Image, opt Options) image.Image {
-	// convert percentage width and height values to absolute values
-	imgW := m.Bounds().Max.X - m.Bounds().Min.X
-	imgH := m.Bounds().Max.Y - m.Bounds().Min.Y
-	var w, h int
+// fits returns true if m is no larger than the size requested by opt.
+// Percentages are always considered to be smaller than m
+func fits(m image.Image, opt Options) bool {
+	return fitsSize(m.Bounds().Dx(), m.Bounds().Dy(), opt)
+}
+
+// fitsSize is the equivalent of fits for an image of the given size
+func fitsSize(imgW, imgH int, opt Options) bool {
+	opt = orientedSize(imgW, imgH, opt)
+	if (0 < opt.Width && opt.Width < 1) || (0 < opt.Height && opt.Height < 1) {
+		return false
+	}
+	return (opt.Width <= 0 || float64(imgW) <= opt.Width) && (opt.Height <= 0 || float64(imgH) <= opt.Height)
+}
+
+// orientedSize returns opt with the portrait size, if any, used as the
+// size for images taller than they are wide
+func orientedSize(imgW, imgH int, opt Options) Options {
+	if imgH > imgW && (opt.PortraitWidth != 0 || opt.PortraitHeight != 0) {
+		opt.Width, opt.Height = opt.PortraitWidth, opt.PortraitHeight
+	}
+	return opt
+}
+
+// targetSize returns the size that opt asks an image of the given size
+// to be resized to. 0 means that the dimension is not constrained
+func targetSize(imgW, imgH int, opt Options) (w, h int) {
 	if 0 < opt.Width && opt.Width < 1 {
 		w = int(float64(imgW) * opt.Width)
-	} else if opt.Width < 0 {
-		w = 0
-	} else {
+	} else if opt.Width > 0 {
 		w = int(opt.Width)
 	}
 	if 0 < opt.Height && opt.Height < 1 {
 		h = int(float64(imgH) * opt.Height)
-	} else if opt.Height < 0 {
-		h = 0
-	} else {
+	} else if opt.Height > 0 {
 		h = int(opt.Height)
 	}
 
@@ -388,16 +1286,28 @@ func transformImage(m image.Image, opt Options) image.Image {
 	if h > imgH {
 		h = imgH
 	}
+	return w, h
+}
+
+func transformImage(m image.Image, opt Options) image.Image {
+	imgW := m.Bounds().Max.X - m.Bounds().Min.X
+	imgH := m.Bounds().Max.Y - m.Bounds().Min.Y
+	opt = orientedSize(imgW, imgH, opt)
+
+	filter := resampleFilter
+	if f, ok := resampleFilters[opt.Filter]; ok {
+		filter = *f
+	}
 
 	// resize
-	if w != 0 || h != 0 {
+	if w, h := targetSize(imgW, imgH, opt); w != 0 || h != 0 {
 		if opt.Fit {
-			m = imaging.Fit(m, w, h, resampleFilter)
+			m = imaging.Fit(m, w, h, filter)
 		} else {
 			if w == 0 || h == 0 {
-				m = imaging.Resize(m, w, h, resampleFilter)
+				m = imaging.Resize(m, w, h, filter)
 			} else {
-				m = imaging.Thumbnail(m, w, h, resampleFilter)
+				m = imaging.Thumbnail(m, w, h, filter)
 			}
 		}
 	}
@@ -420,5 +1330,10 @@ func transformImage(m image.Image, opt Options) image.Image {
 		m = imaging.Rotate270(m)
 	}
 
+	// text is drawn last, so that it is upright and not resized
+	if opt.Text != "" {
+		m = drawText(m, opt)
+	}
+
 	return m
 }
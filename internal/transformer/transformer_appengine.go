@@ -9,10 +9,22 @@ import (
 	"google.golang.org/appengine/urlfetch"
 )
 
-func newClient(ctx context.Context) *http.Client {
-	return &http.Client{
-		Transport: &TransformingTransport{
-			transport: &urlfetch.Transport{Context: ctx},
-		},
+func newClient(ctx context.Context, t *Transformer) *http.Client {
+	return &http.Client{Transport: newTransport(ctx, t)}
+}
+
+func newTransport(ctx context.Context, t *Transformer) *TransformingTransport {
+	transport := t.transport
+	if transport == nil {
+		transport = &urlfetch.Transport{Context: ctx}
+	}
+	return &TransformingTransport{
+		fetches:   t.fetches,
+		maxSize:   t.maxSize,
+		onFetch:   t.onFetch,
+		quality:   t.quality,
+		ratios:    t.ratios,
+		results:   t.results,
+		transport: transport,
 	}
 }
@@ -8,10 +8,22 @@ import (
 	"golang.org/x/net/context"
 )
 
-func newClient(ctx context.Context) *http.Client {
-	return &http.Client{
-		Transport: &TransformingTransport{
-			transport: &http.Transport{},
-		},
+func newClient(ctx context.Context, t *Transformer) *http.Client {
+	return &http.Client{Transport: newTransport(ctx, t)}
+}
+
+func newTransport(ctx context.Context, t *Transformer) *TransformingTransport {
+	transport := t.transport
+	if transport == nil {
+		transport = &http.Transport{}
+	}
+	return &TransformingTransport{
+		fetches:   t.fetches,
+		maxSize:   t.maxSize,
+		onFetch:   t.onFetch,
+		quality:   t.quality,
+		ratios:    t.ratios,
+		results:   t.results,
+		transport: transport,
 	}
 }
@@ -3,6 +3,9 @@
 package transformer
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"image"
 	"image/color"
 	"image/draw"
@@ -10,12 +13,24 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/metadata"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 )
@@ -30,8 +45,20 @@ func TestOptions_String(t *testing.T) {
 			"0x0",
 		},
 		{
-			Options{1, 2, true, 90, true, true},
-			"1x2,fit,r90,fv,fh",
+			Options{Width: 3, Height: 2, PortraitWidth: 2, PortraitHeight: 3},
+			"3x2|2x3",
+		},
+		{
+			Options{Width: 100, Height: 100, Format: "jpeg", MaxBytes: 50000},
+			"100x100,jpeg,maxbytes50000",
+		},
+		{
+			Options{1, 2, true, 90, true, true, true, "jpeg", "ffffff", 0, 0, true, 0, "", 0, "", "", 0, "", "", ""},
+			"1x2,fit,r90,fv,fh,strip,jpeg,bgffffff,noupscale",
+		},
+		{
+			Options{Width: 100, Height: 100, Text: "SOLD OUT", Font: "inconsolata", FontSize: 32, TextPosition: "nw", TextColor: "ffffff", TextBackground: "cc0000"},
+			"100x100,textU09MRCBPVVQ,fontinconsolata,fontsize32,atnw,fgffffff,badgecc0000",
 		},
 	}
 
@@ -66,6 +93,32 @@ func TestParseOptions(t *testing.T) {
 		{"r90", Options{Rotate: 90}},
 		{"fv", Options{FlipVertical: true}},
 		{"fh", Options{FlipHorizontal: true}},
+		{"strip", Options{Strip: true}},
+		{"png", Options{Format: "png"}},
+		{"jpg", Options{Format: "jpeg"}},
+		{"bg00ff00", Options{Background: "00ff00"}},
+		{"noupscale", Options{NoUpscale: true}},
+		{"q80", Options{Quality: 80}},
+		{"q0", Options{}},
+		{"q101", Options{}},
+		{"linear", Options{Filter: "linear"}},
+		{"maxbytes50000", Options{MaxBytes: 50000}},
+		{"maxbytes0", Options{}},
+		{"maxbytes", Options{}},
+		{"bgzzzzzz", emptyOptions},
+		{"textU09MRCBPVVQ", Options{Text: "SOLD OUT"}},
+		{"text", Options{}},
+		{"text!!", Options{}},
+		{"fontinconsolata-bold", Options{Font: "inconsolata-bold"}},
+		{"fontcomic", Options{}},
+		{"fontsize24", Options{FontSize: 24}},
+		{"fontsize0", Options{}},
+		{"atnw", Options{TextPosition: "nw"}},
+		{"atx", Options{}},
+		{"fgff0000", Options{TextColor: "ff0000"}},
+		{"badgecc0000", Options{TextBackground: "cc0000"}},
+		{"360x216|216x360", Options{Width: 360, Height: 216, PortraitWidth: 216, PortraitHeight: 360}},
+		{"100|x50", Options{Width: 100, Height: 100, PortraitHeight: 50}},
 
 		// duplicate flags (last one wins)
 		{"1x2,3x4", Options{Width: 3, Height: 4}},
@@ -78,8 +131,8 @@ func TestParseOptions(t *testing.T) {
 		{"FOO,1,BAR,r90,BAZ", Options{Width: 1, Height: 1, Rotate: 90}},
 
 		// all flags, in different orders
-		{"1x2,fit,r90,fv,fh", Options{1, 2, true, 90, true, true}},
-		{"r90,fh,1x2,fv,fit", Options{1, 2, true, 90, true, true}},
+		{"1x2,fit,r90,fv,fh,strip,jpeg,bgffffff,noupscale", Options{1, 2, true, 90, true, true, true, "jpeg", "ffffff", 0, 0, true, 0, "", 0, "", "", 0, "", "", ""}},
+		{"bgffffff,noupscale,r90,strip,jpeg,fh,1x2,fv,fit", Options{1, 2, true, 90, true, true, true, "jpeg", "ffffff", 0, 0, true, 0, "", 0, "", "", 0, "", "", ""}},
 	}
 
 	for _, tt := range tests {
@@ -236,7 +289,7 @@ func TestTransform(t *testing.T) {
 
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
-			if !assert.NoError(t, transform(ctx, dst, src, emptyOptions), "Transform with encoder should succeed") {
+			if !assert.NoError(t, transform(ctx, dst, src, emptyOptions, nil), "Transform with encoder should succeed") {
 				return
 			}
 
@@ -259,7 +312,7 @@ func TestTransform(t *testing.T) {
 
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
-			if !assert.NoError(t, transform(ctx, dst, src, Options{Width: -1, Height: -1}), "Transform with encoder %s returned unexpected error", tt.name) {
+			if !assert.NoError(t, transform(ctx, dst, src, Options{Width: -1, Height: -1}, nil), "Transform with encoder %s returned unexpected error", tt.name) {
 				return
 			}
 
@@ -283,7 +336,7 @@ func TestTransform(t *testing.T) {
 		defer bbpool.Release(dst)
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		if !assert.Error(t, transform(ctx, dst, src, Options{Width: 1}), "Transform with invalid image input did not return expected err") {
+		if !assert.Error(t, transform(ctx, dst, src, Options{Width: 1}, nil), "Transform with invalid image input did not return expected err") {
 			return
 		}
 	})
@@ -343,6 +396,16 @@ func TestTransformImage(t *testing.T) {
 			Options{Width: 1, Height: 1},
 			newImage(1, 1, red),
 		},
+		{ // landscape source uses the first size
+			newImage(100, 50, red),
+			Options{Width: 20, Height: 10, PortraitWidth: 10, PortraitHeight: 20},
+			newImage(20, 10, red),
+		},
+		{ // portrait source uses the second size
+			newImage(50, 100, red),
+			Options{Width: 20, Height: 10, PortraitWidth: 10, PortraitHeight: 20},
+			newImage(10, 20, red),
+		},
 		{ // percentage values
 			newImage(100, 100, red),
 			Options{Width: 0.50, Height: 0.25},
@@ -393,3 +456,821 @@ func TestTransformImage(t *testing.T) {
 		}
 	}
 }
+
+func TestDrawText(t *testing.T) {
+	black := color.NRGBA{0, 0, 0, 255}
+	src := newImage(64, 64, black)
+
+	tests := []struct {
+		opt    Options
+		inside image.Point // top left corner of the box
+	}{
+		// the default size is too small to scale the font
+		{Options{Text: "A", TextPosition: "nw", TextBackground: "ff0000"}, image.Pt(2, 2)},
+		// 3 times as large, 33x51 including the padding
+		{Options{Text: "A", FontSize: 39, TextBackground: "ff0000"}, image.Pt(64-33-6, 64-51-6)},
+	}
+
+	for _, tt := range tests {
+		m := drawText(src, tt.opt)
+		if got := color.NRGBAModel.Convert(m.At(tt.inside.X, tt.inside.Y)); got != red {
+			t.Errorf("drawText(%v) drew %v at %v, want %v", tt.opt, got, tt.inside, red)
+		}
+		if got := color.NRGBAModel.Convert(m.At(tt.inside.X-1, tt.inside.Y-1)); got != black {
+			t.Errorf("drawText(%v) drew %v outside of the box, want %v", tt.opt, got, black)
+		}
+	}
+
+	if got := color.NRGBAModel.Convert(src.At(2, 2)); got != black {
+		t.Errorf("drawText modified the source image")
+	}
+}
+
+func TestTransformer_Headers(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		png.Encode(w, newImage(2, 2, red))
+	}))
+	defer srv.Close()
+
+	h := make(http.Header)
+	h.Set("X-Origin-Secret", "foo")
+	tr := New(WithUserAgent("sharaq/test"), WithHeaders(h))
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var res Result
+	res.Content = buf
+	if !assert.NoError(t, tr.Transform(ctx, "1x1", srv.URL+"/foo.png", &res), "Transform should succeed") {
+		return
+	}
+
+	assert.Equal(t, "sharaq/test", got.Get("User-Agent"), "User-Agent should match")
+	assert.Equal(t, "foo", got.Get("X-Origin-Secret"), "extra headers should be sent")
+}
+
+func TestTransformer_Upstream(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("origin should not be contacted for presets: %s", r.URL)
+		png.Encode(w, newImage(2, 2, red))
+	}))
+	defer origin.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("preset") != "small" {
+			http.NotFound(w, r)
+			return
+		}
+		m := metadata.Metadata{ContentType: "image/png", SourceETag: `"abc"`, PerceptualHash: "00ff00ff00ff00ff"}
+		m.SetHeader(w.Header())
+		w.Write([]byte("variant of " + r.FormValue("url")))
+	}))
+	defer srv.Close()
+
+	tr := New(WithUpstream(func(preset, u string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, srv.URL+"/?"+url.Values{"url": {u}, "preset": {preset}}.Encode(), nil)
+	}))
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	u := origin.URL + "/foo.png"
+	res := Result{Content: buf, Preset: "small"}
+	if !assert.NoError(t, tr.Transform(ctx, "1x1", u, &res), "Transform should succeed") {
+		return
+	}
+	if !assert.Equal(t, "variant of "+u, buf.String(), "content should come from the upstream") {
+		return
+	}
+	if !assert.Equal(t, "image/png", res.ContentType, "content type should match") {
+		return
+	}
+	if !assert.Equal(t, `"abc"`, res.SourceETag, "source ETag should be taken from the metadata") {
+		return
+	}
+	if !assert.Equal(t, "00ff00ff00ff00ff", res.PerceptualHash, "perceptual hash should be taken from the metadata") {
+		return
+	}
+
+	buf.Reset()
+	res = Result{Content: buf, Preset: "large"}
+	err := tr.Transform(ctx, "2x2", u, &res)
+	if !assert.True(t, errors.IsKind(err, errors.ErrSourceNotFound), "missing variants should be reported as missing sources") {
+		return
+	}
+}
+
+func TestTransformer_MaxSourceSize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		png.Encode(w, newImage(64, 64, red))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, rule := range []string{"", "1x1"} {
+		buf := bbpool.Get()
+		var res Result
+		res.Content = buf
+
+		err := New(WithMaxSourceSize(16)).Transform(ctx, rule, srv.URL+"/foo.png", &res)
+		bbpool.Release(buf)
+		if !assert.True(t, errors.IsKind(err, errors.ErrSourceTooLarge), "error should be ErrSourceTooLarge (rule = '%s')", rule) {
+			return
+		}
+		if !assert.True(t, errors.IsKind(err, errors.ErrTransformFailed), "error should be ErrTransformFailed (rule = '%s')", rule) {
+			return
+		}
+	}
+}
+
+func TestTransformer_ChunkedSource(t *testing.T) {
+	var src bytes.Buffer
+	if !assert.NoError(t, png.Encode(&src, newImage(64, 64, red)), "encoding should succeed") {
+		return
+	}
+
+	// writing in parts, with a flush in between, makes the response
+	// chunked, without a Content-Length
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		b := src.Bytes()
+		w.Write(b[:len(b)/2])
+		w.(http.Flusher).Flush()
+		w.Write(b[len(b)/2:])
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+	res := Result{Content: buf}
+	if !assert.NoError(t, New().Transform(ctx, "", srv.URL+"/foo.png", &res), "Transform should succeed") {
+		return
+	}
+	if !assert.Equal(t, src.Bytes(), buf.Bytes(), "source should be passed through as is") {
+		return
+	}
+	if !assert.Equal(t, int64(src.Len()), res.Size, "size should be the number of bytes written") {
+		return
+	}
+}
+
+func TestTransformer_FormatFallback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		gif.Encode(w, newImage(2, 2, red), nil)
+	}))
+	defer srv.Close()
+
+	orig := encoders["gif"]
+	encoders["gif"] = func(io.Writer, image.Image, int) error {
+		return errors.New(`gif encoder is broken`)
+	}
+	defer func() { encoders["gif"] = orig }()
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var res Result
+	res.Content = buf
+	if !assert.NoError(t, New().Transform(ctx, "1x1", srv.URL+"/foo.gif", &res), "Transform should succeed") {
+		return
+	}
+	if !assert.Equal(t, "image/png", res.ContentType, "content type should be the fallback format") {
+		return
+	}
+	if !assert.Equal(t, "gif", res.FormatFallback, "requested format should be reported") {
+		return
+	}
+	if !assert.Equal(t, "gif", res.Metadata(srv.URL+"/foo.gif", "small", "1x1").FormatFallback, "fallback should be recorded in metadata") {
+		return
+	}
+	if _, err := png.Decode(buf); !assert.NoError(t, err, "output should be a png") {
+		return
+	}
+}
+
+func TestTransform_Flatten(t *testing.T) {
+	transparent := color.NRGBA{0, 0, 0, 0}
+
+	tests := []struct {
+		name string
+		opt  Options
+		want color.NRGBA
+	}{
+		{"default background", Options{Format: "jpeg"}, color.NRGBA{255, 255, 255, 255}},
+		{"green background", Options{Format: "jpeg", Background: "00ff00"}, green},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := bbpool.Get()
+			defer bbpool.Release(src)
+
+			dst := bbpool.Get()
+			defer bbpool.Release(dst)
+
+			if !assert.NoError(t, png.Encode(src, newImage(8, 8, transparent)), "encode should succeed") {
+				return
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var rep transformReport
+			if !assert.NoError(t, transform(ctx, dst, src, tt.opt, &rep), "transform should succeed") {
+				return
+			}
+			if !assert.Equal(t, "jpeg", rep.format, "output should be jpeg") {
+				return
+			}
+
+			m, err := jpeg.Decode(dst)
+			if !assert.NoError(t, err, "output should be a jpeg") {
+				return
+			}
+
+			r, g, b, _ := m.At(4, 4).RGBA()
+			got := color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}
+			for i, v := range []uint8{got.R, got.G, got.B} {
+				w := []uint8{tt.want.R, tt.want.G, tt.want.B}[i]
+				if !assert.InDelta(t, w, v, 8, "transparent pixels should be flattened onto the background (got %v)", got) {
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestTransformer_ResultCache(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, newImage(2, 2, red))
+	}))
+	defer srv.Close()
+
+	var encoded int
+	orig := encoders["png"]
+	encoders["png"] = func(w io.Writer, m image.Image, q int) error {
+		encoded++
+		return orig(w, m, q)
+	}
+	defer func() { encoders["png"] = orig }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tr := New(WithResultCacheSize(1 << 20))
+	var sums []string
+	// same content, different URLs
+	for _, u := range []string{srv.URL + "/foo.png", srv.URL + "/bar.png"} {
+		buf := bbpool.Get()
+		defer bbpool.Release(buf)
+
+		var res Result
+		res.Content = buf
+		if !assert.NoError(t, tr.Transform(ctx, "1x1", u, &res), "Transform should succeed") {
+			return
+		}
+		if !assert.Equal(t, "image/png", res.ContentType, "content type should be png") {
+			return
+		}
+		sums = append(sums, res.Metadata(u, "small", "1x1").SourceSHA256)
+	}
+
+	if !assert.Equal(t, 1, encoded, "image should be transformed once") {
+		return
+	}
+	if !assert.NotEmpty(t, sums[0], "source checksum should be recorded") {
+		return
+	}
+	if !assert.Equal(t, sums[0], sums[1], "source checksums should match") {
+		return
+	}
+}
+
+func TestTransformer_FetchCoalescing(t *testing.T) {
+	var mu sync.Mutex
+	var fetched int
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched++
+		mu.Unlock()
+
+		<-release
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, newImage(4, 4, red))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tr := New()
+	rules := []string{"1x1", "2x2", "3x3"}
+	errs := make(chan error, len(rules))
+	for _, rule := range rules {
+		rule := rule
+		go func() {
+			var res Result
+			res.Content = &bytes.Buffer{}
+			errs <- tr.Transform(ctx, rule, srv.URL+"/foo.png", &res)
+		}()
+	}
+
+	// let all transformations ask for the source before it arrives
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	for range rules {
+		if !assert.NoError(t, <-errs, "Transform should succeed") {
+			return
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, fetched, "source should be fetched once")
+}
+
+func TestTransformer_FetchSource(t *testing.T) {
+	var src bytes.Buffer
+	png.Encode(&src, newImage(4, 4, red))
+	sum := sha256.Sum256(src.Bytes())
+
+	var fetched int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/foo.png" {
+			http.NotFound(w, r)
+			return
+		}
+		fetched++
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src.Bytes())
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tr := New()
+	s, err := tr.FetchSource(ctx, srv.URL+"/foo.png")
+	if !assert.NoError(t, err, "FetchSource should succeed") {
+		return
+	}
+	defer s.Release()
+	if !assert.Equal(t, hex.EncodeToString(sum[:]), s.SHA256(), "checksum should be known before transforming") {
+		return
+	}
+
+	for _, rule := range []string{"", "1x1", "2x2"} {
+		var buf bytes.Buffer
+		res := Result{Content: &buf}
+		if !assert.NoError(t, s.Transform(ctx, rule, &res), "Transform should succeed (rule = '%s')", rule) {
+			return
+		}
+		if !assert.Equal(t, "image/png", res.ContentType, "content type should be png (rule = '%s')", rule) {
+			return
+		}
+		if !assert.Equal(t, s.SHA256(), res.SourceSHA256, "source checksum should be recorded (rule = '%s')", rule) {
+			return
+		}
+		if !assert.Equal(t, int64(buf.Len()), res.Size, "size should match (rule = '%s')", rule) {
+			return
+		}
+		if rule == "" && !assert.Equal(t, src.Bytes(), buf.Bytes(), "source should be passed through as is") {
+			return
+		}
+	}
+	if !assert.Equal(t, 1, fetched, "source should be fetched once") {
+		return
+	}
+
+	_, err = tr.FetchSource(ctx, srv.URL+"/bar.png")
+	if !assert.True(t, errors.IsKind(err, errors.ErrSourceNotFound), "missing sources should be ErrSourceNotFound") {
+		return
+	}
+}
+
+func TestTransformingTransport_RoundTrip(t *testing.T) {
+	var src bytes.Buffer
+	png.Encode(&src, newImage(4, 4, red))
+	sum := sha256.Sum256(src.Bytes())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(src.Bytes())
+	}))
+	defer srv.Close()
+
+	cl := http.Client{Transport: newTransport(context.Background(), New())}
+	res, err := cl.Get(srv.URL + "/foo.png#2x2")
+	if !assert.NoError(t, err, "Get should succeed") {
+		return
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if !assert.NoError(t, err, "reading the body should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "status should be kept") {
+		return
+	}
+	if !assert.Equal(t, int64(len(content)), res.ContentLength, "ContentLength should match the transformed image") {
+		return
+	}
+	if !assert.Equal(t, strconv.Itoa(len(content)), res.Header.Get("Content-Length"), "Content-Length should match the transformed image") {
+		return
+	}
+	if !assert.Equal(t, `"v1"`, res.Header.Get("ETag"), "headers of the source should be kept") {
+		return
+	}
+	if !assert.Equal(t, hex.EncodeToString(sum[:]), res.Header.Get(headerSourceSHA256), "source checksum should be set") {
+		return
+	}
+
+	img, err := png.Decode(bytes.NewReader(content))
+	if !assert.NoError(t, err, "body should be a png") {
+		return
+	}
+	if !assert.Equal(t, image.Rect(0, 0, 2, 2), img.Bounds(), "image should be transformed") {
+		return
+	}
+}
+
+func TestTransformer_Spooling(t *testing.T) {
+	var src bytes.Buffer
+	png.Encode(&src, newImage(64, 64, red))
+	sum := sha256.Sum256(src.Bytes())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src.Bytes())
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "sharaq-spool-test-")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	tr := New(WithSpooling(16, dir))
+	for _, rule := range []string{"8x8", "128x128,noupscale"} {
+		var res Result
+		var content bytes.Buffer
+		res.Content = &content
+		if !assert.NoError(t, tr.Transform(context.Background(), rule, srv.URL+"/foo.png", &res), "Transform should succeed") {
+			return
+		}
+		if !assert.Equal(t, hex.EncodeToString(sum[:]), res.SourceSHA256, "checksum should be computed while spooling") {
+			return
+		}
+		if _, _, err := image.Decode(&content); !assert.NoError(t, err, "result should be an image") {
+			return
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if !assert.NoError(t, err, "ReadDir should succeed") {
+		return
+	}
+	assert.Len(t, files, 0, "spool files should be removed")
+}
+
+type histogramSink struct {
+	values map[string]float64
+}
+
+func (histogramSink) Count(string, int64, ...string)          {}
+func (histogramSink) Timing(string, time.Duration, ...string) {}
+func (histogramSink) Gauge(string, float64, ...string)        {}
+func (s histogramSink) Histogram(name string, value float64, tags ...string) {
+	s.values[name+"|"+strings.Join(tags, ",")] = value
+}
+
+func TestTransform_QualitySampling(t *testing.T) {
+	sink := histogramSink{values: make(map[string]float64)}
+	metrics.SetSink(sink)
+	defer metrics.SetSink(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a gradient, so that lossy encoding actually loses something
+	src := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			src.Set(x, y, color.RGBA{R: uint8(x * 8), G: uint8(y * 8), B: uint8((x + y) * 4), A: 0xff})
+		}
+	}
+	in := bbpool.Get()
+	defer bbpool.Release(in)
+	if !assert.NoError(t, png.Encode(in, src), "png.Encode should succeed") {
+		return
+	}
+
+	out := bbpool.Get()
+	defer bbpool.Release(out)
+	rep := transformReport{quality: &qualitySampler{percent: 100, baseline: "jpeg"}}
+	if !assert.NoError(t, transform(ctx, out, in, ParseOptions("16x16,q10"), &rep), "transform should succeed") {
+		return
+	}
+
+	// png is lossless
+	if !assert.Equal(t, float64(maxPSNR), sink.values["transform.quality.psnr|format:png,encoding:current"], "png PSNR should be maximal") {
+		return
+	}
+	if !assert.InDelta(t, 1, sink.values["transform.quality.ssim|format:png,encoding:current"], 1e-9, "png SSIM should be 1") {
+		return
+	}
+	if !assert.True(t, sink.values["transform.quality.psnr|format:jpeg,encoding:baseline"] < maxPSNR, "jpeg PSNR should be lower") {
+		return
+	}
+	if !assert.True(t, sink.values["transform.quality.ssim|format:jpeg,encoding:baseline"] < 1, "jpeg SSIM should be lower") {
+		return
+	}
+}
+
+func TestTransform_NoUpscale(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := bbpool.Get()
+	defer bbpool.Release(src)
+	if !assert.NoError(t, png.Encode(src, newImage(2, 2, red)), "encode should succeed") {
+		return
+	}
+	// decoders ignore data after the image, but re-encoding drops it
+	orig := append(append([]byte(nil), src.Bytes()...), "trailer"...)
+
+	tests := []struct {
+		rule string
+		same bool
+	}{
+		{"100x100,noupscale", true},
+		{"100x,noupscale", true},
+		{"1x1,noupscale", false},
+		{"100x100,noupscale,strip", false},
+		{"100x100", false},
+	}
+
+	for _, tt := range tests {
+		dst := bbpool.Get()
+		defer bbpool.Release(dst)
+
+		var rep transformReport
+		if !assert.NoError(t, transform(ctx, dst, bytes.NewReader(orig), ParseOptions(tt.rule), &rep), "transform should succeed for %s", tt.rule) {
+			return
+		}
+		if !assert.Equal(t, tt.same, bytes.Equal(orig, dst.Bytes()), "source should be used as is for %s: %t", tt.rule, tt.same) {
+			return
+		}
+		if !assert.Equal(t, "png", rep.format, "format should be reported for %s", tt.rule) {
+			return
+		}
+	}
+}
+
+func TestOutputSize(t *testing.T) {
+	for _, rule := range []string{"", "100x100", "100x100,fit", "200x", "x50", "0.5x", "1000x1000", "50x50|20x80", "100x50,r90"} {
+		for _, size := range [][2]int{{400, 200}, {200, 400}, {60, 60}} {
+			opt := ParseOptions(rule)
+			b := transformImage(newImage(size[0], size[1], red), opt).Bounds()
+			w, h := outputSize(size[0], size[1], opt)
+			if !assert.Equal(t, []int{b.Dx(), b.Dy()}, []int{w, h}, "output size of %dx%d with '%s' should match", size[0], size[1], rule) {
+				return
+			}
+		}
+	}
+}
+
+func TestTransformer_Estimate(t *testing.T) {
+	src := bbpool.Get()
+	defer bbpool.Release(src)
+	if !assert.NoError(t, png.Encode(src, newImage(400, 200, red)), "encode should succeed") {
+		return
+	}
+	content := src.Bytes()
+
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "foo.png", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tr := New()
+	estimate := func(rule string) *Estimate {
+		est, err := tr.Estimate(ctx, rule, srv.URL+"/foo.png")
+		if !assert.NoError(t, err, "Estimate should succeed for '%s'", rule) {
+			return nil
+		}
+		return est
+	}
+
+	est := estimate("100x100,fit")
+	if est == nil {
+		return
+	}
+	if !assert.Equal(t, "bytes=0-65535", ranges[0], "only the beginning of the source should be requested") {
+		return
+	}
+	if !assert.Equal(t, Estimate{
+		SourceWidth:  400,
+		SourceHeight: 200,
+		SourceFormat: "png",
+		SourceSize:   int64(len(content)),
+		Width:        100,
+		Height:       50,
+		Format:       "png",
+		Size:         int64(100 * 50 * defaultBytesPerPixel["png"]),
+		Basis:        BasisDefault,
+	}, *est, "estimate without history should use the default ratio") {
+		return
+	}
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+	res := Result{Content: buf}
+	if !assert.NoError(t, tr.Transform(ctx, "100x100,fit", srv.URL+"/foo.png", &res), "Transform should succeed") {
+		return
+	}
+
+	est = estimate("100x100,fit")
+	if est == nil {
+		return
+	}
+	if !assert.Equal(t, BasisRule, est.Basis, "estimate should be based on the rule") {
+		return
+	}
+	if !assert.InDelta(t, res.Size, est.Size, 1, "estimate should match the previous result") {
+		return
+	}
+
+	est = estimate("200x")
+	if est == nil {
+		return
+	}
+	if !assert.Equal(t, BasisFormat, est.Basis, "estimate should be based on the format") {
+		return
+	}
+	if !assert.Equal(t, []int{200, 100}, []int{est.Width, est.Height}, "size should be estimated") {
+		return
+	}
+
+	est = estimate("")
+	if est == nil {
+		return
+	}
+	if !assert.Equal(t, BasisSource, est.Basis, "source should be used as is") {
+		return
+	}
+	assert.Equal(t, int64(len(content)), est.Size, "size should be that of the source")
+}
+
+func TestTransformer_EstimateLargeEXIF(t *testing.T) {
+	src := bbpool.Get()
+	defer bbpool.Release(src)
+	if !assert.NoError(t, jpeg.Encode(src, newImage(400, 200, red), nil), "encode should succeed") {
+		return
+	}
+
+	// APP1 segments of 60KB each, so that the frame header is well past
+	// the first estimateHeaderBytes
+	var content []byte
+	content = append(content, src.Bytes()[:2]...)
+	for i := 0; i < 3; i++ {
+		seg := make([]byte, 60<<10)
+		copy(seg, "Exif\x00\x00")
+		content = append(content, 0xFF, 0xE1, byte((len(seg)+2)>>8), byte(len(seg)+2))
+		content = append(content, seg...)
+	}
+	content = append(content, src.Bytes()[2:]...)
+
+	for _, ranges := range []bool{true, false} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !ranges {
+				w.Write(content)
+				return
+			}
+			http.ServeContent(w, r, "foo.jpg", time.Time{}, bytes.NewReader(content))
+		}))
+
+		est, err := New().Estimate(context.Background(), "100x100,fit", srv.URL+"/foo.jpg")
+		srv.Close()
+		if !assert.NoError(t, err, "Estimate should succeed (ranges: %t)", ranges) {
+			return
+		}
+		if !assert.Equal(t, []interface{}{400, 200, "jpeg"}, []interface{}{est.SourceWidth, est.SourceHeight, est.SourceFormat}, "source should be decoded (ranges: %t)", ranges) {
+			return
+		}
+		if !assert.Equal(t, []int{100, 50}, []int{est.Width, est.Height}, "size should be estimated (ranges: %t)", ranges) {
+			return
+		}
+	}
+}
+
+func TestTransform_MaxBytes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// noise does not compress well, so that quality matters
+	rnd := rand.New(rand.NewSource(1))
+	m := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	rnd.Read(m.Pix)
+	for i := 3; i < len(m.Pix); i += 4 {
+		m.Pix[i] = 0xff
+	}
+	src := bbpool.Get()
+	defer bbpool.Release(src)
+	if !assert.NoError(t, png.Encode(src, m), "encode should succeed") {
+		return
+	}
+
+	sizeAt := func(q int) int {
+		buf := bbpool.Get()
+		defer bbpool.Release(buf)
+		if !assert.NoError(t, jpeg.Encode(buf, m, &jpeg.Options{Quality: q}), "encode should succeed") {
+			return 0
+		}
+		return buf.Len()
+	}
+
+	tests := []struct {
+		max      int
+		min, got int // bounds of the size of the result
+	}{
+		{sizeAt(jpegQuality) + 1, sizeAt(jpegQuality), sizeAt(jpegQuality)},
+		{sizeAt(50), sizeAt(40), sizeAt(50)},
+		{10, sizeAt(minQuality), sizeAt(minQuality)}, // impossible, the smallest is used
+	}
+
+	for _, tt := range tests {
+		dst := bbpool.Get()
+		defer bbpool.Release(dst)
+
+		rule := "jpeg,strip,maxbytes" + strconv.Itoa(tt.max)
+		var rep transformReport
+		if !assert.NoError(t, transform(ctx, dst, bytes.NewReader(src.Bytes()), ParseOptions(rule), &rep), "transform should succeed for %s", rule) {
+			return
+		}
+		if !assert.True(t, tt.min <= dst.Len() && dst.Len() <= tt.got, "size of the result should be between %d and %d for %s: %d", tt.min, tt.got, rule, dst.Len()) {
+			return
+		}
+		if !assert.Equal(t, "jpeg", rep.format, "format should be reported for %s", rule) {
+			return
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		rules   []string
+		formats []string
+	}{
+		{nil, []string{"jpeg", "png"}},
+		{[]string{"100x100,png", "200x200,jpg"}, []string{"jpeg", "png"}},
+		{[]string{"100x100,gif"}, []string{"gif", "jpeg", "png"}},
+		{[]string{"100x100"}, []string{"gif", "jpeg", "png"}},
+	}
+	for _, tt := range tests {
+		if !assert.Equal(t, tt.formats, selfTestFormats(tt.rules), "formats of %v should be tested", tt.rules) {
+			return
+		}
+	}
+
+	if !assert.NoError(t, SelfTest(context.Background(), []string{"100x100"}), "SelfTest should succeed") {
+		return
+	}
+
+	orig := encoders["png"]
+	defer func() { encoders["png"] = orig }()
+	encoders["png"] = func(io.Writer, image.Image, int) error {
+		return errors.New(`broken encoder`)
+	}
+	if !assert.Error(t, SelfTest(context.Background(), nil), "SelfTest should fail with a broken encoder") {
+		return
+	}
+}
@@ -0,0 +1,69 @@
+package transformer
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/requestid"
+	"github.com/lestrrat-go/sharaq/metadata"
+	"golang.org/x/net/context"
+)
+
+// UpstreamFunc creates the request for the variant of the image at u
+// for the given preset, to be sent to an upstream server
+type UpstreamFunc func(preset, u string) (*http.Request, error)
+
+// WithUpstream makes Transform request variants from an upstream server
+// instead of transforming source images itself. This only applies to
+// results that specify a preset. The upstream replies with the content
+// of the variant, and its metadata as headers (see metadata.SetHeader)
+func WithUpstream(f UpstreamFunc) Option {
+	return OptionFunc(func(t *Transformer) {
+		t.upstream = f
+	})
+}
+
+// transformUpstream populates result with the variant of the image at u
+// returned by the upstream
+func (t *Transformer) transformUpstream(ctx context.Context, u string, result *Result) error {
+	req, err := t.upstream(result.Preset, u)
+	if err != nil {
+		return errors.Wrap(err, `failed to create upstream request`)
+	}
+	if id := requestid.Get(ctx); id != "" {
+		req.Header.Set(requestid.HeaderName, id)
+	}
+
+	log.Debugf(ctx, "requesting %s (%s) from upstream", u, result.Preset)
+	res, err := newClient(ctx, t).Do(req)
+	if err != nil {
+		return errors.Wrap(err, `failed to fetch variant from upstream`)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return errors.WithKind(errors.ErrSourceNotFound, errors.Errorf(`failed to fetch variant from upstream: %d`, res.StatusCode))
+	default:
+		return errors.Errorf(`failed to fetch variant from upstream: %d`, res.StatusCode)
+	}
+
+	n, err := io.Copy(result.Content, res.Body)
+	if err != nil {
+		return errors.Wrap(err, `failed to read variant from upstream`)
+	}
+
+	m := metadata.FromHeader(res.Header)
+	result.ContentType = m.ContentType
+	result.Size = n
+	result.Placeholder.DominantColor = m.DominantColor
+	result.Placeholder.BlurHash = m.BlurHash
+	result.FormatFallback = m.FormatFallback
+	result.SourceSHA256 = m.SourceSHA256
+	result.SourceETag = m.SourceETag
+	result.PerceptualHash = m.PerceptualHash
+	return nil
+}
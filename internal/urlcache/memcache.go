@@ -1,14 +1,18 @@
 package urlcache
 
-import "github.com/lestrrat-go/sharaq/cache"
+import (
+	"github.com/lestrrat-go/sharaq/cache"
+	"github.com/pkg/errors"
+)
 
 func newMemcached(c *Config) (*URLCache, error) {
-	memd := c.Memcached
-	servers := memd.Addr
-	expires := c.Expires
+	memd, err := cache.NewMemcacheFromConfig(&c.Memcached)
+	if err != nil {
+		return nil, errors.Wrap(err, `urlcache: failed to create memcached client`)
+	}
 
 	return &URLCache{
-		cache:   cache.NewMemcache(servers...),
-		expires: expires,
+		cache:   memd,
+		expires: c.Expires,
 	}, nil
 }
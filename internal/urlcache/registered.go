@@ -0,0 +1,18 @@
+package urlcache
+
+import (
+	"github.com/lestrrat-go/sharaq/cache"
+	"github.com/pkg/errors"
+)
+
+func newRegistered(c *Config) (*URLCache, error) {
+	d, err := cache.NewDriver(c.Type, c.Options)
+	if err != nil {
+		return nil, errors.Wrap(err, `urlcache: failed to create cache`)
+	}
+
+	return &URLCache{
+		cache:   d,
+		expires: c.Expires,
+	}, nil
+}
@@ -12,23 +12,22 @@ import (
 	"github.com/pkg/errors"
 )
 
-type cacheBackend interface {
-	Get(context.Context, string, interface{}) error
-	Set(context.Context, string, []byte, int32) error
-	SetNX(context.Context, string, []byte, int32) error
-	Delete(context.Context, string) error
-}
-
 type URLCache struct {
-	cache   cacheBackend
+	cache   cache.Driver
 	expires int32
+	timeout time.Duration
 }
 
+// DefaultTimeout is the default time limit for each cache operation
+const DefaultTimeout = time.Second
+
 type Config struct {
 	Type      string
 	Memcached cache.MemcacheConfig
 	Redis     cache.RedisConfig
 	Expires   int32
+	Timeout   time.Duration     // time limit for each operation. default is DefaultTimeout
+	Options   map[string]string // passed to drivers registered with cache.Register
 }
 
 func New(c *Config) (*URLCache, error) {
@@ -36,13 +35,49 @@ func New(c *Config) (*URLCache, error) {
 		c = &Config{}
 	}
 
+	var uc *URLCache
+	var err error
 	switch c.Type {
 	case "Redis":
-		return newRedis(c)
+		uc, err = newRedis(c)
 	case "Memcached":
-		return newMemcached(c)
+		uc, err = newMemcached(c)
+	case "Memory":
+		uc, err = newMemory(c)
 	default:
-		return nil, errors.Errorf(`urlcache: unknown backend type "%s"`, c.Type)
+		uc, err = newRegistered(c)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	uc.timeout = c.Timeout
+	if uc.timeout <= 0 {
+		uc.timeout = DefaultTimeout
+	}
+	return uc, nil
+}
+
+// do runs fn, giving up when the context is canceled or the operation
+// times out. Not all cache drivers honor contexts, so fn is run in a
+// separate goroutine, which is left behind if it does not return in time
+func (c *URLCache) do(ctx context.Context, fn func(context.Context) error) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn(ctx)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), `urlcache operation did not complete`)
 	}
 }
 
@@ -56,11 +91,19 @@ func MakeCacheKey(v ...string) string {
 }
 
 func (c *URLCache) Lookup(ctx context.Context, key string) string {
-	var s string
-	if err := c.cache.Get(ctx, key, &s); err == nil {
-		return s
+	ch := make(chan string, 1)
+	err := c.do(ctx, func(ctx context.Context) error {
+		var s string
+		if err := c.cache.Get(ctx, key, &s); err != nil {
+			return err
+		}
+		ch <- s
+		return nil
+	})
+	if err != nil {
+		return ""
 	}
-	return ""
+	return <-ch
 }
 
 type SetOption interface {
@@ -91,7 +134,9 @@ func (c *URLCache) Set(ctx context.Context, key, value string, options ...SetOpt
 			expires = int32(o.Value().(time.Duration) / time.Second)
 		}
 	}
-	return c.cache.Set(ctx, key, []byte(value), expires)
+	return c.do(ctx, func(ctx context.Context) error {
+		return c.cache.Set(ctx, key, []byte(value), expires)
+	})
 }
 
 func (c *URLCache) SetNX(ctx context.Context, key, value string, options ...SetOption) error {
@@ -102,9 +147,13 @@ func (c *URLCache) SetNX(ctx context.Context, key, value string, options ...SetO
 			expires = int32(o.Value().(time.Duration) / time.Second)
 		}
 	}
-	return c.cache.SetNX(ctx, key, []byte(value), expires)
+	return c.do(ctx, func(ctx context.Context) error {
+		return c.cache.SetNX(ctx, key, []byte(value), expires)
+	})
 }
 
 func (c *URLCache) Delete(ctx context.Context, key string) error {
-	return c.cache.Delete(ctx, key)
+	return c.do(ctx, func(ctx context.Context) error {
+		return c.cache.Delete(ctx, key)
+	})
 }
@@ -0,0 +1,87 @@
+package urlcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/cache"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// hungBackend never replies, like a memcached server that accepted the
+// connection but stopped responding
+type hungBackend struct {
+	done chan struct{}
+}
+
+func (b hungBackend) Get(context.Context, string, interface{}) error {
+	<-b.done
+	return nil
+}
+func (b hungBackend) Set(context.Context, string, []byte, int32) error {
+	<-b.done
+	return nil
+}
+func (b hungBackend) SetNX(context.Context, string, []byte, int32) error {
+	<-b.done
+	return nil
+}
+func (b hungBackend) Delete(context.Context, string) error {
+	<-b.done
+	return nil
+}
+
+func TestURLCache_Timeout(t *testing.T) {
+	b := hungBackend{done: make(chan struct{})}
+	defer close(b.done)
+
+	c := &URLCache{cache: b, timeout: 50 * time.Millisecond}
+	ctx := context.Background()
+
+	start := time.Now()
+	if !assert.Empty(t, c.Lookup(ctx, "foo"), "Lookup should miss") {
+		return
+	}
+	if !assert.Error(t, c.Set(ctx, "foo", "bar"), "Set should time out") {
+		return
+	}
+	if !assert.True(t, time.Since(start) < time.Second, "operations should not hang") {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if !assert.Error(t, c.Delete(ctx, "foo"), "Delete should honor canceled context") {
+		return
+	}
+}
+
+func TestRegisteredDriver(t *testing.T) {
+	var got map[string]string
+	cache.Register("urlcache-test", func(options map[string]string) (cache.Driver, error) {
+		got = options
+		return cache.NewMemory(), nil
+	})
+
+	c, err := New(&Config{Type: "urlcache-test", Options: map[string]string{"Endpoint": "kv.example.com"}})
+	if !assert.NoError(t, err, "New should succeed for registered drivers") {
+		return
+	}
+	if !assert.Equal(t, "kv.example.com", got["Endpoint"], "options should be passed to the factory") {
+		return
+	}
+
+	ctx := context.Background()
+	if !assert.NoError(t, c.Set(ctx, "foo", "bar"), "Set should succeed") {
+		return
+	}
+	if !assert.Equal(t, "bar", c.Lookup(ctx, "foo"), "Lookup should return the stored value") {
+		return
+	}
+
+	_, err = New(&Config{Type: "urlcache-unknown"})
+	if !assert.Error(t, err, "New should fail for unknown drivers") {
+		return
+	}
+}
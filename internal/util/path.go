@@ -0,0 +1,115 @@
+package util
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+
+	"github.com/lestrrat-go/sharaq/internal/crc64"
+	"github.com/pkg/errors"
+)
+
+// Hash algorithms for PathScheme
+const (
+	HashCRC64  = "crc64"
+	HashMD5    = "md5"
+	HashSHA1   = "sha1"
+	HashSHA256 = "sha256"
+)
+
+// maxFilenamePrefix is the number of bytes of the original file name
+// that are kept in paths
+const maxFilenamePrefix = 40
+
+// PathScheme specifies how paths are derived from a preset and the
+// source URL. The zero value generates the same paths as HashedPath
+type PathScheme struct {
+	Hash        string // "crc64" (default), "md5", "sha1", or "sha256"
+	IncludeHost bool   // if true, paths start with the host of the source URL
+	Filename    bool   // if true, the original file name is prepended to the hash
+}
+
+// Validate returns an error if the hash algorithm is unknown
+func (ps PathScheme) Validate() error {
+	switch ps.Hash {
+	case "", HashCRC64, HashMD5, HashSHA1, HashSHA256:
+		return nil
+	}
+	return errors.Errorf(`unknown hash algorithm '%s'`, ps.Hash)
+}
+
+// Path returns the path for the variant of urlstr for preset. Given a
+// hash of "abcdef", the path is "a/ab/abc/abcd/abcdef", preceded by the
+// host if IncludeHost is set, and with the last element becoming
+// "photo.jpg_abcdef" if Filename is set
+func (ps PathScheme) Path(preset, urlstr string) string {
+	v := ps.sum(preset, urlstr)
+
+	var list []string
+	u, err := url.Parse(urlstr)
+	if ps.IncludeHost && err == nil && u.Host != "" {
+		host := sanitizePathElement(u.Host)
+		if host[0] == '.' {
+			// hosts such as ".." must not refer to parent directories
+			host = "_" + host[1:]
+		}
+		list = append(list, host)
+	}
+	list = append(list, v[0:1], v[0:2], v[0:3], v[0:4])
+	if ps.Filename && err == nil {
+		switch name := path.Base(u.Path); name {
+		case "/", ".":
+		default:
+			if len(name) > maxFilenamePrefix {
+				name = name[:maxFilenamePrefix]
+			}
+			v = sanitizePathElement(name) + "_" + v
+		}
+	}
+	list = append(list, v)
+	return filepath.Join(list...)
+}
+
+// Key is like Path, but always separates elements with "/", for object
+// stores such as S3 and Google Storage
+func (ps PathScheme) Key(preset, urlstr string) string {
+	return filepath.ToSlash(ps.Path(preset, urlstr))
+}
+
+func (ps PathScheme) sum(s ...string) string {
+	var h hash.Hash
+	switch ps.Hash {
+	case HashMD5:
+		h = md5.New()
+	case HashSHA1:
+		h = sha1.New()
+	case HashSHA256:
+		h = sha256.New()
+	default:
+		return crc64.EncodeString(s...)
+	}
+	for _, v := range s {
+		io.WriteString(h, v)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sanitizePathElement replaces the characters of s that may not be
+// safe in file names or object keys with "_"
+func sanitizePathElement(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,20 @@
+package util
+
+import "golang.org/x/net/context"
+
+type readOnlyKey struct{}
+
+// WithReadOnly returns a new context that tells backends not to store
+// anything while serving a request, e.g. by regenerating stale variants
+func WithReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyKey{}, true)
+}
+
+// IsReadOnly returns true if ctx was created by WithReadOnly
+func IsReadOnly(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	v, _ := ctx.Value(readOnlyKey{}).(bool)
+	return v
+}
@@ -1,9 +1,12 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strings"
 
 	"github.com/lestrrat-go/sharaq/internal/crc64"
 	"github.com/pkg/errors"
@@ -40,12 +43,109 @@ func GetTargetURL(r *http.Request) (*url.URL, error) {
 		return nil, errors.New("empty host")
 	}
 
-	return u, nil
+	return NormalizeURL(u), nil
 }
 
+// NormalizeURL modifies u so that URLs pointing to the same source
+// have the same string representation, which is what storage paths
+// and cache keys are derived from. The scheme and host are lower
+// cased, default ports and dot segments are removed, and the fragment
+// is dropped. The query is kept as is, as sources may use it for
+// versioning (e.g. "?v=123") or signatures that depend on its exact form
+func NormalizeURL(u *url.URL) *url.URL {
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && strings.HasSuffix(u.Host, ":80")) || (u.Scheme == "https" && strings.HasSuffix(u.Host, ":443")) {
+		u.Host = u.Host[:strings.LastIndexByte(u.Host, ':')]
+	}
+	if p := removeDotSegments(u.Path); p != u.Path {
+		u.Path = p
+		u.RawPath = ""
+	}
+	u.Fragment = ""
+	return u
+}
+
+// removeDotSegments resolves "." and ".." segments as described in
+// RFC 3986 section 5.2.4. Unlike path.Clean, empty segments and
+// trailing slashes are kept, as origins may treat them differently
+func removeDotSegments(p string) string {
+	if !strings.Contains(p, ".") {
+		return p
+	}
+
+	segments := strings.Split(p, "/")
+	out := make([]string, 0, len(segments))
+	for i, s := range segments {
+		last := i == len(segments)-1
+		switch s {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			// never go above the root
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, s)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+// StripQueryParams removes query parameters whose names match any of
+// the patterns from u. A pattern ending in "*" matches names that
+// start with the rest of the pattern (e.g. "utm_*"). The remaining
+// parameters are kept as they were, in the same order and with the
+// same escaping, as origins may depend on either
+func StripQueryParams(u *url.URL, patterns []string) *url.URL {
+	if u.RawQuery == "" || len(patterns) == 0 {
+		return u
+	}
+
+	params := strings.Split(u.RawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		name := param
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name = name[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !matchParam(name, patterns) {
+			kept = append(kept, param)
+		}
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	return u
+}
+
+func matchParam(name string, patterns []string) bool {
+	for _, pat := range patterns {
+		if pat == name || (strings.HasSuffix(pat, "*") && strings.HasPrefix(name, pat[:len(pat)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// HashedPath returns a path made of the crc64 hash of s, split into
+// directories. See PathScheme for other layouts
 func HashedPath(s ...string) string {
 	v := crc64.EncodeString(s...)
 	// given "abcdef", generates "a/ab/abc/abcd/abcdef"
 	return filepath.Join(v[0:1], v[0:2], v[0:3], v[0:4], v)
 }
 
+// Checksum returns the hex encoded SHA-256 digest of the given content.
+// This is what is stored alongside variants to allow verification
+func Checksum(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
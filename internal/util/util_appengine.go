@@ -5,13 +5,18 @@ package util
 import (
 	"net/http"
 
+	"github.com/lestrrat-go/sharaq/internal/requestid"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/urlfetch"
 )
 
 func RequestCtx(r *http.Request) context.Context {
-	return appengine.NewContext(r)
+	ctx := appengine.NewContext(r)
+	if id := requestid.Get(r.Context()); id != "" {
+		ctx = requestid.With(ctx, id)
+	}
+	return ctx
 }
 
 func TransportCtx(t http.RoundTripper) context.Context {
@@ -20,3 +25,9 @@ func TransportCtx(t http.RoundTripper) context.Context {
 	}
 	return context.Background()
 }
+
+// HTTPClient returns the client to be used for outbound requests.
+// Under appengine, this must go through urlfetch
+func HTTPClient(ctx context.Context) *http.Client {
+	return urlfetch.Client(ctx)
+}
@@ -15,3 +15,8 @@ func RequestCtx(r *http.Request) context.Context {
 func TransportCtx(t http.RoundTripper) context.Context {
 	return context.Background()
 }
+
+// HTTPClient returns the client to be used for outbound requests
+func HTTPClient(_ context.Context) *http.Client {
+	return http.DefaultClient
+}
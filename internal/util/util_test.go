@@ -0,0 +1,81 @@
+package util
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"http://example.com/foo.jpg", "http://example.com/foo.jpg"},
+		{"HTTP://Example.COM/foo.jpg", "http://example.com/foo.jpg"},
+		{"http://example.com:80/foo.jpg", "http://example.com/foo.jpg"},
+		{"https://example.com:443/foo.jpg", "https://example.com/foo.jpg"},
+		{"http://example.com:8080/foo.jpg", "http://example.com:8080/foo.jpg"},
+		{"http://example.com/a/./b/../foo.jpg", "http://example.com/a/foo.jpg"},
+		{"http://example.com/../foo.jpg", "http://example.com/foo.jpg"},
+		{"http://example.com/a..b/foo.jpg", "http://example.com/a..b/foo.jpg"},
+		{"http://example.com/foo.jpg?b=2&a=1#top", "http://example.com/foo.jpg?b=2&a=1"},
+		{"http://example.com/foo.jpg?sig=a%2Fb+c", "http://example.com/foo.jpg?sig=a%2Fb+c"},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.in)
+		if !assert.NoError(t, err, "url.Parse should succeed") {
+			return
+		}
+		if !assert.Equal(t, tt.want, NormalizeURL(u).String(), "normalized %s", tt.in) {
+			return
+		}
+	}
+}
+
+func TestStripQueryParams(t *testing.T) {
+	u, _ := url.Parse("http://example.com/foo.jpg?v=1&utm_source=mail&utm_medium=x&fbclid=abc")
+	if !assert.Equal(t, "http://example.com/foo.jpg?v=1", StripQueryParams(u, []string{"utm_*", "fbclid"}).String(), "tracking parameters should be removed") {
+		return
+	}
+
+	u, _ = url.Parse("http://example.com/foo.jpg?z=1&utm_source=mail&sig=a%2Fb+c&a")
+	if !assert.Equal(t, "http://example.com/foo.jpg?z=1&sig=a%2Fb+c&a", StripQueryParams(u, []string{"utm_*"}).String(), "other parameters should be kept as is") {
+		return
+	}
+
+	u, _ = url.Parse("http://example.com/foo.jpg?utm_source=mail")
+	if !assert.Equal(t, "http://example.com/foo.jpg", StripQueryParams(u, []string{"utm_*"}).String(), "empty queries should be dropped") {
+		return
+	}
+}
+
+func TestPathScheme(t *testing.T) {
+	const u = "http://example.com:8080/images/My Photo.jpg"
+	if !assert.Equal(t, HashedPath("small", u), PathScheme{}.Path("small", u), "default scheme should match HashedPath") {
+		return
+	}
+
+	ps := PathScheme{Hash: HashSHA256, IncludeHost: true, Filename: true}
+	p := ps.Path("small", u)
+	if !assert.Regexp(t, `^example\.com_8080/[0-9a-f]/[0-9a-f]{2}/[0-9a-f]{3}/[0-9a-f]{4}/My_Photo\.jpg_[0-9a-f]{64}$`, filepath.ToSlash(p), "path should contain the host and file name") {
+		return
+	}
+	if !assert.Equal(t, filepath.ToSlash(p), ps.Key("small", u), "keys should be separated by slashes") {
+		return
+	}
+
+	for _, host := range []string{"..", "."} {
+		p := filepath.ToSlash(ps.Path("small", "http://"+host+"/a.jpg"))
+		if !assert.Regexp(t, `^_\.?/[0-9a-f]/[0-9a-f]{2}/[0-9a-f]{3}/[0-9a-f]{4}/a\.jpg_[0-9a-f]{64}$`, p, "host '%s' should not refer to a parent directory", host) {
+			return
+		}
+	}
+
+	if !assert.Error(t, PathScheme{Hash: "rot13"}.Validate(), "unknown hash algorithms should be rejected") {
+		return
+	}
+}
@@ -0,0 +1,85 @@
+package sharaq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/crc64"
+)
+
+// job describes a transformation that is currently being processed
+// by this instance
+type job struct {
+	Hash      string    `json:"hash"`
+	URL       string    `json:"url"`
+	Presets   []string  `json:"presets"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// jobTracker keeps track of in-flight transformations, so that they can
+// be inspected via the admin API. Unlike the processing flag in the url
+// cache, this only knows about jobs running in this process
+type jobTracker struct {
+	mu   sync.Mutex
+	jobs map[*job]struct{}
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{
+		jobs: make(map[*job]struct{}),
+	}
+}
+
+func (t *jobTracker) start(u *url.URL, presets map[string]string) *job {
+	j := &job{
+		Hash:      crc64.EncodeString(u.String()),
+		URL:       u.String(),
+		Presets:   make([]string, 0, len(presets)),
+		StartedAt: time.Now(),
+	}
+	for preset := range presets {
+		j.Presets = append(j.Presets, preset)
+	}
+	sort.Strings(j.Presets)
+
+	t.mu.Lock()
+	t.jobs[j] = struct{}{}
+	t.mu.Unlock()
+	return j
+}
+
+func (t *jobTracker) finish(j *job) {
+	t.mu.Lock()
+	delete(t.jobs, j)
+	t.mu.Unlock()
+}
+
+// list returns the in-flight jobs, oldest first
+func (t *jobTracker) list() []job {
+	t.mu.Lock()
+	list := make([]job, 0, len(t.jobs))
+	for j := range t.jobs {
+		list = append(list, *j)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartedAt.Before(list[j].StartedAt)
+	})
+	return list
+}
+
+// handleAdminJobs replies with the list of in-flight transformations
+func (s *Server) handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.jobs.list())
+}
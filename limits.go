@@ -0,0 +1,50 @@
+package sharaq
+
+import (
+	"net/http"
+
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/util"
+)
+
+// errBodyTooLarge is the message of the error returned by readers
+// created by http.MaxBytesReader. Older versions of Go do not have a
+// dedicated error type
+const errBodyTooLarge = "http: request body too large"
+
+// limitRequest rejects requests whose query string, body, or form are
+// larger than the configured limits, and parses the form. Returns false
+// if the request was rejected
+func (s *Server) limitRequest(w http.ResponseWriter, r *http.Request) bool {
+	lc := s.config.Limits
+	if len(r.URL.RawQuery) > lc.MaxQuerySize {
+		httpError(w, r, "query string too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if r.ContentLength > lc.MaxBodySize {
+		httpError(w, r, "request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	// Content-Length may be missing, or lying
+	r.Body = http.MaxBytesReader(w, r.Body, lc.MaxBodySize)
+	if err := r.ParseForm(); err != nil {
+		log.Debugf(util.RequestCtx(r), "Failed to parse form: %s", err)
+		if err.Error() == errBodyTooLarge {
+			httpError(w, r, "request body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			httpError(w, r, "invalid form", http.StatusBadRequest)
+		}
+		return false
+	}
+
+	var n int
+	for _, values := range r.Form {
+		n += len(values)
+	}
+	if n > lc.MaxFormValues {
+		httpError(w, r, "too many form values", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package sharaq
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+)
+
+// maxLintDimension is the largest width or height that presets may ask
+// for without a warning. Variants are never larger than their sources,
+// so larger values do no harm, but are usually typos
+const maxLintDimension = 8192
+
+// Lint returns warnings about presets that are valid, but are likely
+// mistakes: presets with the same rule, rules and preset templates with
+// absurd dimensions, and presets that no profile refers to, if there
+// are profiles. The warnings are sorted
+func (c *Config) Lint() []string {
+	var warnings []string
+	warnings = append(warnings, lintDuplicateRules(c.Presets)...)
+	warnings = append(warnings, lintDimensions(c.Presets, c.PresetTemplates)...)
+	warnings = append(warnings, lintUnreferenced(c.Presets, c.Profiles)...)
+	sort.Strings(warnings)
+	return warnings
+}
+
+// lintDuplicateRules warns about presets whose rules are the same once
+// parsed, such as "200x200,jpg" and "200x200,jpeg"
+func lintDuplicateRules(presets map[string]string) []string {
+	byRule := make(map[string][]string)
+	for preset, rule := range presets {
+		if preset == OriginalPreset {
+			continue
+		}
+		key := transformer.ParseOptions(rule).String()
+		byRule[key] = append(byRule[key], preset)
+	}
+
+	var warnings []string
+	for rule, names := range byRule {
+		if len(names) < 2 {
+			continue
+		}
+		sort.Strings(names)
+		warnings = append(warnings, fmt.Sprintf(`presets '%s' have the same rule '%s'`, strings.Join(names, `', '`), rule))
+	}
+	return warnings
+}
+
+// lintDimensions warns about rules and preset templates that ask for
+// widths or heights larger than maxLintDimension
+func lintDimensions(presets map[string]string, templates map[string]PresetTemplate) []string {
+	var warnings []string
+	for preset, rule := range presets {
+		opt := transformer.ParseOptions(rule)
+		for _, v := range []float64{opt.Width, opt.Height, opt.PortraitWidth, opt.PortraitHeight} {
+			if v > maxLintDimension {
+				warnings = append(warnings, fmt.Sprintf(`preset '%s' has a dimension larger than %d: '%s'`, preset, maxLintDimension, rule))
+				break
+			}
+		}
+	}
+	for name, pt := range templates {
+		if pt.MaxWidth > maxLintDimension || pt.MaxHeight > maxLintDimension {
+			warnings = append(warnings, fmt.Sprintf(`preset template '%s' allows dimensions larger than %d`, name, maxLintDimension))
+		}
+	}
+	return warnings
+}
+
+// lintUnreferenced warns about presets that are not in any profile. If
+// pipelines target profiles, such presets are only generated by
+// requests that do not name a profile, which is usually an oversight
+func lintUnreferenced(presets map[string]string, profiles map[string][]string) []string {
+	if len(profiles) == 0 {
+		return nil
+	}
+
+	referenced := make(map[string]struct{})
+	for _, names := range profiles {
+		for _, preset := range names {
+			referenced[preset] = struct{}{}
+		}
+	}
+
+	var warnings []string
+	for preset := range presets {
+		if preset == OriginalPreset {
+			continue
+		}
+		if _, ok := referenced[preset]; !ok {
+			warnings = append(warnings, fmt.Sprintf(`preset '%s' is not in any profile`, preset))
+		}
+	}
+	return warnings
+}
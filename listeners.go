@@ -0,0 +1,122 @@
+package sharaq
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"golang.org/x/net/context"
+)
+
+// Roles that listeners can serve
+const (
+	RoleDispatch = "dispatch" // GET of variants, /info, /estimate, /placeholder/
+	RoleGuardian = "guardian" // POST and DELETE of variants, /sign
+	RoleAdmin    = "admin"    // /admin/
+	RoleDebug    = "debug"    // /debug/pprof/. never served unless explicitly listed
+)
+
+// defaultRoles are served by the listener specified by Config.Listen
+var defaultRoles = []string{RoleDispatch, RoleGuardian, RoleAdmin}
+
+func validRole(role string) bool {
+	switch role {
+	case RoleDispatch, RoleGuardian, RoleAdmin, RoleDebug:
+		return true
+	}
+	return false
+}
+
+func validateListenerConfig(lc *ListenerConfig) error {
+	if lc.Addr == "" {
+		return errors.New(`listener address is required`)
+	}
+	if len(lc.Roles) == 0 {
+		return errors.Errorf(`listener %s has no roles`, lc.Addr)
+	}
+	for _, role := range lc.Roles {
+		if !validRole(role) {
+			return errors.Errorf(`listener %s has unknown role '%s'`, lc.Addr, role)
+		}
+	}
+	return nil
+}
+
+// listeners returns the listeners to serve on. If none are configured,
+// a single listener is created from Listen and TLS
+func (c *Config) listeners() []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	return []ListenerConfig{{
+		Addr:  c.Listen,
+		Roles: defaultRoles,
+		TLS:   c.TLS,
+	}}
+}
+
+type rolesKey struct{}
+
+// listenerHandler restricts requests received by a listener to its
+// roles and access restrictions
+type listenerHandler struct {
+	access  *accessControl
+	handler http.Handler
+	roles   map[string]struct{}
+}
+
+func newListenerHandler(lc *ListenerConfig, h http.Handler) (*listenerHandler, error) {
+	access, err := newAccessControl(lc.Access)
+	if err != nil {
+		return nil, errors.Wrapf(err, `invalid access config for listener %s`, lc.Addr)
+	}
+
+	roles := make(map[string]struct{}, len(lc.Roles))
+	for _, role := range lc.Roles {
+		roles[role] = struct{}{}
+	}
+	return &listenerHandler{
+		access:  access,
+		handler: h,
+		roles:   roles,
+	}, nil
+}
+
+func (h *listenerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.access.allowed(r) {
+		httpError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	h.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rolesKey{}, h.roles)))
+}
+
+// hasRole returns true if the listener that received r serves role.
+// Requests that did not go through a listener (e.g. when the Server is
+// used as an http.Handler by another program) may use all roles but
+// RoleDebug
+func hasRole(r *http.Request, role string) bool {
+	roles, ok := r.Context().Value(rolesKey{}).(map[string]struct{})
+	if !ok {
+		return role != RoleDebug
+	}
+	_, ok = roles[role]
+	return ok
+}
+
+// requestRole returns the role required to serve r
+func requestRole(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/debug/"):
+		return RoleDebug
+	case strings.HasPrefix(r.URL.Path, "/admin/"):
+		return RoleAdmin
+	case r.URL.Path == "/sign", r.URL.Path == "/variant":
+		return RoleGuardian
+	case r.URL.Path == "/info", r.URL.Path == "/estimate":
+		return RoleDispatch
+	case r.Method == http.MethodPost || r.Method == http.MethodDelete:
+		return RoleGuardian
+	default:
+		return RoleDispatch
+	}
+}
@@ -0,0 +1,188 @@
+// Package memory implements a storage backend that keeps variants in
+// the process memory. It is meant to be used in tests and for local
+// debugging: variants are lost when the process exits
+package memory
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/throttle"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/util"
+	"github.com/lestrrat-go/sharaq/metadata"
+)
+
+type Backend struct {
+	mu          sync.RWMutex
+	presets     map[string]string
+	transformer *transformer.Transformer
+	variants    map[variantKey]*variant
+}
+
+type variantKey struct {
+	preset string
+	url    string
+}
+
+type variant struct {
+	content  []byte
+	metadata metadata.Metadata
+}
+
+func (v *variant) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if v.metadata.ContentType != "" {
+		w.Header().Set("Content-Type", v.metadata.ContentType)
+	}
+	http.ServeContent(w, r, "", v.metadata.CreatedAt, bytes.NewReader(v.content))
+}
+
+func NewBackend(trans *transformer.Transformer, presets map[string]string) *Backend {
+	return &Backend{
+		presets:     presets,
+		transformer: trans,
+		variants:    make(map[variantKey]*variant),
+	}
+}
+
+func (b *Backend) lookup(u *url.URL, preset string) (*variant, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	v, ok := b.variants[variantKey{preset: preset, url: u.String()}]
+	return v, ok
+}
+
+func (b *Backend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
+	v, ok := b.lookup(u, preset)
+	if !ok {
+		return nil, errors.TransformationRequiredError{}
+	}
+	return v, nil
+}
+
+func (b *Backend) StoreTransformedContent(ctx context.Context, u *url.URL, presets map[string]string) error {
+	log.Debugf(ctx, "Backend: transforming image at url %s", u)
+
+	var grp errors.PresetGroup
+	grp.SetLimit(throttle.Parallelism(ctx))
+
+	for preset, rule := range presets {
+		t := b.transformer
+		preset := preset
+		rule := rule
+		grp.Go(preset, func() error {
+			buf := bbpool.Get()
+			defer bbpool.Release(buf)
+
+			var res transformer.Result
+			res.Content = buf
+			res.Preset = preset
+
+			if err := t.Transform(ctx, rule, u.String(), &res); err != nil {
+				return errors.Wrap(err, `failed to transform`)
+			}
+
+			return b.Put(ctx, u, preset, buf.Bytes(), res.Metadata(u.String(), preset, rule))
+		})
+	}
+	return grp.Wait()
+}
+
+// Fetch writes the stored content for the given url and preset to dst
+func (b *Backend) Fetch(ctx context.Context, u *url.URL, preset string, dst io.Writer) (*metadata.Metadata, error) {
+	v, ok := b.lookup(u, preset)
+	if !ok {
+		return nil, errors.TransformationRequiredError{}
+	}
+
+	if _, err := dst.Write(v.content); err != nil {
+		return nil, errors.Wrap(err, `failed to write content`)
+	}
+	m := v.metadata
+	return &m, nil
+}
+
+// Put stores the given content as the variant for the given url and preset
+func (b *Backend) Put(ctx context.Context, u *url.URL, preset string, content []byte, m *metadata.Metadata) error {
+	m.SHA256 = util.Checksum(content)
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = time.Now()
+	}
+
+	// content is usually backed by a pooled buffer, so make a copy
+	v := &variant{
+		content:  append([]byte(nil), content...),
+		metadata: *m,
+	}
+
+	b.mu.Lock()
+	b.variants[variantKey{preset: preset, url: u.String()}] = v
+	b.mu.Unlock()
+	return nil
+}
+
+// Metadata returns the metadata that was recorded when the variant
+// was stored
+func (b *Backend) Metadata(ctx context.Context, u *url.URL, preset string) (*metadata.Metadata, error) {
+	v, ok := b.lookup(u, preset)
+	if !ok {
+		return nil, errors.TransformationRequiredError{}
+	}
+	m := v.metadata
+	return &m, nil
+}
+
+func (b *Backend) Delete(ctx context.Context, u *url.URL, presets []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if presets == nil {
+		for preset := range b.presets {
+			presets = append(presets, preset)
+		}
+	}
+	for _, preset := range presets {
+		delete(b.variants, variantKey{preset: preset, url: u.String()})
+	}
+	return nil
+}
+
+// List calls fn with the metadata of each stored variant, ordered by
+// source URL and preset
+func (b *Backend) List(ctx context.Context, fn func(*metadata.Metadata) error) error {
+	b.mu.RLock()
+	list := make([]metadata.Metadata, 0, len(b.variants))
+	for _, v := range b.variants {
+		list = append(list, v.metadata)
+	}
+	b.mu.RUnlock()
+
+	sort.Sort(byURLAndPreset(list))
+
+	for i := range list {
+		if err := fn(&list[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type byURLAndPreset []metadata.Metadata
+
+func (l byURLAndPreset) Len() int      { return len(l) }
+func (l byURLAndPreset) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byURLAndPreset) Less(i, j int) bool {
+	if l[i].SourceURL != l[j].SourceURL {
+		return l[i].SourceURL < l[j].SourceURL
+	}
+	return l[i].Preset < l[j].Preset
+}
@@ -0,0 +1,133 @@
+// Package metadata describes the information that is stored alongside
+// each variant, so that we can later tell where it came from and how it
+// was generated
+package metadata
+
+import (
+	"net/http"
+	"time"
+)
+
+// Metadata is stored with each variant. Backends store it in whatever
+// form is natural to them (object metadata, sidecar files, etc)
+type Metadata struct {
+	SourceURL     string `json:"source_url"`
+	Preset        string `json:"preset"`
+	Rule          string `json:"rule"`
+	ContentType   string `json:"content_type"`
+	Engine        string `json:"engine"`
+	EngineVersion string `json:"engine_version"`
+	SHA256        string `json:"sha256"`
+	DominantColor string `json:"dominant_color,omitempty"`
+	BlurHash      string `json:"blurhash,omitempty"`
+	// FormatFallback is the format that the variant should have been
+	// encoded in, if encoding failed and ContentType was used instead
+	FormatFallback string `json:"format_fallback,omitempty"`
+	// SourceSHA256 is the SHA-256 checksum of the source image. Variants
+	// of the same image published under different URLs share this value
+	SourceSHA256 string `json:"source_sha256,omitempty"`
+	// SourceETag is the ETag that the origin sent with the source image
+	SourceETag string `json:"source_etag,omitempty"`
+	// PerceptualHash is the difference hash of the source image, as 16
+	// hex digits. Variants of images that look alike have similar hashes
+	PerceptualHash string    `json:"phash,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Keys used when metadata is stored as a flat list of key/value pairs.
+// These must be valid as HTTP header names, as they end up as such
+// for some backends (e.g. x-amz-meta-source-url)
+const (
+	keySourceURL      = "source-url"
+	keyPreset         = "preset"
+	keyRule           = "rule"
+	keyEngine         = "engine"
+	keyEngineVersion  = "engine-version"
+	keySHA256         = "sha256"
+	keyDominantColor  = "dominant-color"
+	keyBlurHash       = "blurhash"
+	keyFormatFallback = "format-fallback"
+	keySourceSHA256   = "source-sha256"
+	keySourceETag     = "source-etag"
+	keyPerceptualHash = "phash"
+	keyCreatedAt      = "created-at"
+)
+
+// Map returns the metadata as a flat list of key/value pairs. The content
+// type is not included, as all backends have a dedicated field for it
+func (m *Metadata) Map() map[string]string {
+	v := map[string]string{
+		keySourceURL:     m.SourceURL,
+		keyPreset:        m.Preset,
+		keyRule:          m.Rule,
+		keyEngine:        m.Engine,
+		keyEngineVersion: m.EngineVersion,
+		keySHA256:        m.SHA256,
+	}
+	if m.BlurHash != "" {
+		v[keyDominantColor] = m.DominantColor
+		v[keyBlurHash] = m.BlurHash
+	}
+	if m.FormatFallback != "" {
+		v[keyFormatFallback] = m.FormatFallback
+	}
+	if m.SourceSHA256 != "" {
+		v[keySourceSHA256] = m.SourceSHA256
+	}
+	if m.SourceETag != "" {
+		v[keySourceETag] = m.SourceETag
+	}
+	if m.PerceptualHash != "" {
+		v[keyPerceptualHash] = m.PerceptualHash
+	}
+	if !m.CreatedAt.IsZero() {
+		v[keyCreatedAt] = m.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	return v
+}
+
+// FromMap creates metadata from key/value pairs. get is called to
+// retrieve each value, which allows the caller to apply its own
+// key mangling (e.g. adding prefixes, canonicalizing)
+func FromMap(contentType string, get func(string) string) *Metadata {
+	m := &Metadata{
+		SourceURL:      get(keySourceURL),
+		Preset:         get(keyPreset),
+		Rule:           get(keyRule),
+		ContentType:    contentType,
+		Engine:         get(keyEngine),
+		EngineVersion:  get(keyEngineVersion),
+		SHA256:         get(keySHA256),
+		DominantColor:  get(keyDominantColor),
+		BlurHash:       get(keyBlurHash),
+		FormatFallback: get(keyFormatFallback),
+		SourceSHA256:   get(keySourceSHA256),
+		SourceETag:     get(keySourceETag),
+		PerceptualHash: get(keyPerceptualHash),
+	}
+	if t, err := time.Parse(time.RFC3339, get(keyCreatedAt)); err == nil {
+		m.CreatedAt = t
+	}
+	return m
+}
+
+// HeaderPrefix is prepended to the keys of metadata that is sent as HTTP
+// headers, such as from an upstream sharaq instance to its edges
+const HeaderPrefix = "X-Sharaq-Meta-"
+
+// SetHeader adds the metadata to h, including the content type
+func (m *Metadata) SetHeader(h http.Header) {
+	for k, v := range m.Map() {
+		h.Set(HeaderPrefix+k, v)
+	}
+	if m.ContentType != "" {
+		h.Set("Content-Type", m.ContentType)
+	}
+}
+
+// FromHeader creates metadata from headers set by SetHeader
+func FromHeader(h http.Header) *Metadata {
+	return FromMap(h.Get("Content-Type"), func(k string) string {
+		return h.Get(HeaderPrefix + k)
+	})
+}
@@ -0,0 +1,47 @@
+package metadata
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadata_RoundTrip(t *testing.T) {
+	m := &Metadata{
+		SourceURL:      "http://example.com/foo.jpg",
+		Preset:         "small",
+		Rule:           "100x100",
+		ContentType:    "image/jpeg",
+		Engine:         "imaging",
+		EngineVersion:  "1",
+		SHA256:         "deadbeef",
+		DominantColor:  "#ff0000",
+		BlurHash:       "LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+		FormatFallback: "gif",
+		SourceSHA256:   "cafebabe",
+		SourceETag:     `"abc123"`,
+		PerceptualHash: "00ff00ff00ff00ff",
+		CreatedAt:      time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	v := m.Map()
+	if !assert.NotContains(t, v, "content-type", "content type is not included") {
+		return
+	}
+
+	got := FromMap("image/jpeg", func(k string) string { return v[k] })
+	if !assert.Equal(t, m, got, "metadata should round trip") {
+		return
+	}
+
+	h := make(http.Header)
+	m.SetHeader(h)
+	if !assert.Equal(t, "image/jpeg", h.Get("Content-Type"), "content type should be set") {
+		return
+	}
+	if !assert.Equal(t, m, FromHeader(h), "metadata should round trip through headers") {
+		return
+	}
+}
@@ -0,0 +1,150 @@
+package sharaq
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+)
+
+// Middleware wraps the handler of a role, for example to authenticate
+// requests, enforce quotas, or add headers. See WithMiddleware
+type Middleware func(http.Handler) http.Handler
+
+// Types of built-in middleware (see MiddlewareConfig)
+const (
+	MiddlewareHeaders     = "headers"
+	MiddlewareBasicAuth   = "basicauth"
+	MiddlewareConcurrency = "concurrency"
+)
+
+// MiddlewareConfig specifies one of the built-in middleware
+type MiddlewareConfig struct {
+	Type string // "headers", "basicauth", or "concurrency"
+
+	// Headers are set on every response ("headers")
+	Headers map[string]string
+	// Users maps user names to passwords ("basicauth")
+	Users map[string]string
+	// Realm is sent along with 401 responses ("basicauth"). default is "sharaq"
+	Realm string
+	// Max is the number of requests served at once ("concurrency").
+	// Requests beyond that are rejected with 503
+	Max int
+}
+
+// WithMiddleware adds middleware to the requests of the given role
+// (RoleDispatch, RoleGuardian, ...). Middleware run in the order they
+// are given, before the ones from Config.Middleware, and only see
+// requests that passed the role and limit checks
+func WithMiddleware(role string, mws ...Middleware) Option {
+	return OptionFunc(func(s *Server) {
+		if s.custom.middleware == nil {
+			s.custom.middleware = make(map[string][]Middleware)
+		}
+		s.custom.middleware[role] = append(s.custom.middleware[role], mws...)
+	})
+}
+
+// newHandlers creates the handlers of the roles that have middleware
+func (s *Server) newHandlers() error {
+	chains := make(map[string][]Middleware)
+	for role, mws := range s.custom.middleware {
+		if !validRole(role) {
+			return errors.Errorf(`middleware for unknown role '%s'`, role)
+		}
+		chains[role] = append(chains[role], mws...)
+	}
+	for role, mcs := range s.config.Middleware {
+		if !validRole(role) {
+			return errors.Errorf(`middleware for unknown role '%s'`, role)
+		}
+		for _, mc := range mcs {
+			mw, err := newMiddleware(&mc)
+			if err != nil {
+				return errors.Wrapf(err, `invalid middleware for role '%s'`, role)
+			}
+			chains[role] = append(chains[role], mw)
+		}
+	}
+
+	s.handlers = make(map[string]http.Handler, len(chains))
+	for role, mws := range chains {
+		var h http.Handler = http.HandlerFunc(s.route)
+		for i := len(mws) - 1; i >= 0; i-- {
+			h = mws[i](h)
+		}
+		s.handlers[role] = h
+	}
+	return nil
+}
+
+func newMiddleware(mc *MiddlewareConfig) (Middleware, error) {
+	switch mc.Type {
+	case MiddlewareHeaders:
+		return headersMiddleware(mc.Headers), nil
+	case MiddlewareBasicAuth:
+		if len(mc.Users) == 0 {
+			return nil, errors.New(`basicauth requires Users`)
+		}
+		realm := mc.Realm
+		if realm == "" {
+			realm = "sharaq"
+		}
+		return basicAuthMiddleware(mc.Users, realm), nil
+	case MiddlewareConcurrency:
+		if mc.Max <= 0 {
+			return nil, errors.New(`concurrency requires a positive Max`)
+		}
+		return concurrencyMiddleware(mc.Max), nil
+	default:
+		return nil, errors.Errorf(`unknown middleware type '%s'`, mc.Type)
+	}
+}
+
+func headersMiddleware(headers map[string]string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for k, v := range headers {
+				w.Header().Set(k, v)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func basicAuthMiddleware(users map[string]string, realm string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, password, ok := r.BasicAuth()
+			if ok {
+				expected, known := users[user]
+				ok = known && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+			}
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+				httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func concurrencyMiddleware(max int) Middleware {
+	sem := make(chan struct{}, max)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case sem <- struct{}{}:
+			default:
+				metrics.Count("middleware.concurrency.rejected", 1)
+				httpError(w, r, "Too many requests in progress", http.StatusServiceUnavailable)
+				return
+			}
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
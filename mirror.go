@@ -0,0 +1,116 @@
+package sharaq
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/requestid"
+	"github.com/lestrrat-go/sharaq/internal/util"
+)
+
+// mirrorHeader is set on mirrored requests. Requests that carry it are
+// never mirrored again, so that two instances mirroring to each other
+// do not loop
+const mirrorHeader = "X-Sharaq-Mirror"
+
+// mirror sends copies of dispatcher requests to another sharaq
+// instance. Responses are discarded
+type mirror struct {
+	base    *url.URL
+	percent float64
+	timeout time.Duration
+	sem     chan struct{} // limits the number of requests in flight
+}
+
+func validateMirrorConfig(mc *MirrorConfig) error {
+	u, err := url.Parse(mc.URL)
+	if err != nil {
+		return errors.Wrap(err, `invalid mirror URL`)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf(`invalid mirror URL %s`, mc.URL)
+	}
+	if mc.Percent < 0 || mc.Percent > 100 {
+		return errors.Errorf(`mirror percentage must be between 0 and 100, got %v`, mc.Percent)
+	}
+	return nil
+}
+
+func newMirror(mc *MirrorConfig) (*mirror, error) {
+	if err := validateMirrorConfig(mc); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(mc.URL)
+	return &mirror{
+		base:    u,
+		percent: mc.Percent,
+		timeout: mc.Timeout,
+		sem:     make(chan struct{}, mc.MaxInFlight),
+	}, nil
+}
+
+// maybeMirror sends a copy of r to the mirror, if r was picked by the
+// configured percentage. It never blocks: requests are dropped if too
+// many are already in flight
+func (s *Server) maybeMirror(r *http.Request) {
+	m := s.mirror
+	if m == nil || r.Header.Get(mirrorHeader) != "" {
+		return
+	}
+	if rand.Float64()*100 >= m.percent {
+		return
+	}
+
+	select {
+	case m.sem <- struct{}{}:
+	default:
+		metrics.Count("mirror.dropped", 1)
+		return
+	}
+
+	ctx := util.RequestCtx(r)
+	u := *m.base
+	u.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		<-m.sem
+		return
+	}
+	req.Header.Set(mirrorHeader, "1")
+	if id := requestid.Get(ctx); id != "" {
+		req.Header.Set(requestid.HeaderName, id)
+	}
+	for _, name := range []string{"Accept", "User-Agent"} {
+		if v := r.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+
+	// The dispatcher replies with redirects, which we do not want to follow
+	cl := *util.HTTPClient(ctx)
+	cl.Timeout = m.timeout
+	cl.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	go func() {
+		defer func() { <-m.sem }()
+
+		res, err := cl.Do(req)
+		if err != nil {
+			log.Debugf(ctx, "Mirrored request to %s failed: %s", u.String(), err)
+			metrics.Count("mirror.errors", 1)
+			return
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		metrics.Count("mirror.sent", 1)
+	}()
+}
@@ -0,0 +1,25 @@
+package sharaq
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/lestrrat-go/sharaq/internal/util"
+)
+
+// NormalizeURL canonicalizes the source URL u, so that trivially
+// different URLs for the same source share their variants. This is
+// applied to all source URLs before they are used, including those
+// given to the command line tools
+func (s *Server) NormalizeURL(u *url.URL) *url.URL {
+	return util.StripQueryParams(util.NormalizeURL(u), s.config.Normalization.StripParams)
+}
+
+// getTargetURL returns the normalized source URL given in the request
+func (s *Server) getTargetURL(r *http.Request) (*url.URL, error) {
+	u, err := util.GetTargetURL(r)
+	if err != nil {
+		return nil, err
+	}
+	return s.NormalizeURL(u), nil
+}
@@ -0,0 +1,70 @@
+package sharaq
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/lestrrat-go/sharaq/internal/accesslog"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"golang.org/x/net/context"
+)
+
+// When the origin replies with 404 or 410 for a source image, we
+// remember it in the URL cache for NotFound.TTL. Until then, dispatcher
+// requests for its variants are answered with 404, instead of redirecting
+// clients to a broken origin URL over and over again
+
+func notFoundCacheKey(u *url.URL) string {
+	return urlcache.MakeCacheKey("notfound", u.String())
+}
+
+func (s *Server) loadNotFoundImage() error {
+	fn := s.config.NotFound.Placeholder
+	if fn == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return errors.Wrapf(err, `failed to read %s`, fn)
+	}
+	s.notFoundImage = b
+	return nil
+}
+
+func (s *Server) recordNotFound(ctx context.Context, u *url.URL) {
+	log.Debugf(ctx, "Source %s does not exist, remembering for %s", u, s.config.NotFound.TTL)
+	metrics.Count("origin.notfound", 1)
+	s.cache.Set(ctx, notFoundCacheKey(u), "1", urlcache.WithExpires(s.config.NotFound.TTL))
+}
+
+func (s *Server) forgetNotFound(ctx context.Context, u *url.URL) {
+	s.cache.Delete(ctx, notFoundCacheKey(u))
+}
+
+// serveNotFound replies with 404 if the source image at u is known not
+// to exist. It returns false if nothing was written
+func (s *Server) serveNotFound(ctx context.Context, w http.ResponseWriter, r *http.Request, u *url.URL) bool {
+	if s.cache.Lookup(ctx, notFoundCacheKey(u)) == "" {
+		return false
+	}
+
+	accesslog.FromContext(ctx).SetCache(accesslog.CacheNegative)
+	metrics.Count("dispatcher.notfound", 1)
+
+	if s.notFoundImage == nil {
+		httpError(w, r, "Not Found", http.StatusNotFound)
+		return true
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(s.notFoundImage))
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.notFoundImage)))
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(s.notFoundImage)
+	return true
+}
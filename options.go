@@ -0,0 +1,165 @@
+package sharaq
+
+import (
+	"net/http"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+)
+
+// Option customizes a Server created by NewServer. Components that are
+// given as options are used instead of the ones that would otherwise be
+// created from the configuration, which allows embedding programs to
+// compose their own stacks
+type Option interface {
+	Configure(*Server)
+}
+
+type OptionFunc func(*Server)
+
+func (f OptionFunc) Configure(s *Server) {
+	f(s)
+}
+
+// components holds the parts of a Server that were specified via
+// options. They survive configuration reloads
+type components struct {
+	backend     Backend
+	cache       *urlcache.URLCache
+	middleware  map[string][]Middleware // by role
+	presets     map[string]string
+	transformer *transformer.Transformer
+	transport   http.RoundTripper
+}
+
+// Transformer fetches source images and creates variants from them.
+// Create one with NewTransformer
+type Transformer struct {
+	t *transformer.Transformer
+}
+
+// URLCache remembers where variants are stored, and coordinates work
+// between instances. Create one with NewURLCache
+type URLCache struct {
+	c *urlcache.URLCache
+}
+
+// WithBackend specifies the storage backend. Backend in the
+// configuration is ignored
+func WithBackend(b Backend) Option {
+	return OptionFunc(func(s *Server) {
+		s.custom.backend = b
+	})
+}
+
+// WithCache specifies the URL cache, such as one created by
+// NewURLCache. URLCache in the configuration is ignored
+func WithCache(c *URLCache) Option {
+	return OptionFunc(func(s *Server) {
+		s.custom.cache = c.c
+	})
+}
+
+// WithPresets specifies the preset definitions, replacing Presets in
+// the configuration
+func WithPresets(presets map[string]string) Option {
+	return OptionFunc(func(s *Server) {
+		s.custom.presets = make(map[string]string, len(presets))
+		for name, rule := range presets {
+			s.custom.presets[name] = rule
+		}
+	})
+}
+
+// WithTransformer specifies the transformer, such as one created by
+// NewTransformer. Origin in the configuration is ignored
+func WithTransformer(t *Transformer) Option {
+	return OptionFunc(func(s *Server) {
+		s.custom.transformer = t.t
+	})
+}
+
+// WithTransport specifies the transport used to fetch source images
+// when the transformer is created from the configuration
+func WithTransport(rt http.RoundTripper) Option {
+	return OptionFunc(func(s *Server) {
+		s.custom.transport = rt
+	})
+}
+
+// NewTransformer creates the transformer described by c.Origin and
+// c.Metrics. If rt is non-nil, it is used to fetch source images. c is
+// not modified
+func NewTransformer(c *Config, rt http.RoundTripper) (*Transformer, error) {
+	t, err := newTransformer(c.withDefaults(), rt)
+	if err != nil {
+		return nil, err
+	}
+	return &Transformer{t: t}, nil
+}
+
+// newTransformer is NewTransformer, with additional options that are
+// not derived from the configuration. Defaults must already be applied
+// to c
+func newTransformer(c *Config, rt http.RoundTripper, extra ...transformer.Option) (*transformer.Transformer, error) {
+	oc := c.Origin
+	options := []transformer.Option{
+		transformer.WithUserAgent(oc.UserAgent),
+	}
+
+	if oc.MaxSize > 0 {
+		options = append(options, transformer.WithMaxSourceSize(oc.MaxSize))
+	}
+
+	if oc.ResultCacheSize > 0 {
+		options = append(options, transformer.WithResultCacheSize(oc.ResultCacheSize))
+	}
+
+	if oc.SpoolThreshold > 0 {
+		options = append(options, transformer.WithSpooling(oc.SpoolThreshold, oc.SpoolDir))
+	}
+
+	if mc := c.Metrics; mc != nil && mc.QualitySamplePercent > 0 {
+		options = append(options, transformer.WithQualitySampling(mc.QualitySamplePercent, mc.QualityBaseline))
+	}
+
+	if len(oc.Headers) > 0 {
+		h := make(http.Header)
+		for k, v := range oc.Headers {
+			h.Set(k, v)
+		}
+		options = append(options, transformer.WithHeaders(h))
+	}
+
+	rewrite, err := newRewriter(oc.Rewrites)
+	if err != nil {
+		return nil, errors.Wrap(err, `invalid Origin.Rewrites`)
+	}
+	if rewrite != nil {
+		options = append(options, transformer.WithRewriter(rewrite))
+	}
+
+	if uc := c.Upstream; uc != nil {
+		f, err := newUpstreamFunc(uc)
+		if err != nil {
+			return nil, errors.Wrap(err, `invalid Upstream`)
+		}
+		options = append(options, transformer.WithUpstream(f))
+	}
+
+	if rt != nil {
+		options = append(options, transformer.WithTransport(rt))
+	}
+	return transformer.New(append(options, extra...)...), nil
+}
+
+// NewURLCache creates the URL cache described by c.URLCache. c is not
+// modified
+func NewURLCache(c *Config) (*URLCache, error) {
+	uc, err := urlcache.New(c.withDefaults().URLCache)
+	if err != nil {
+		return nil, err
+	}
+	return &URLCache{c: uc}, nil
+}
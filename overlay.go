@@ -0,0 +1,155 @@
+package sharaq
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+)
+
+// textVariantSeparator separates the name of the preset from the text
+// in the names of variants with text overlays, such as "event~sold-out"
+const textVariantSeparator = "~"
+
+// maxOverlayText is the maximum length of overlay texts in bytes. They
+// have to fit on the image, after all
+const maxOverlayText = 64
+
+// textOverlay is the compiled form of a TextOverlayConfig
+type textOverlay struct {
+	TextOverlayConfig
+	slugs map[string]string // text to slug
+	texts map[string]string // slug to text
+}
+
+func compileTextOverlay(preset string, oc TextOverlayConfig) (*textOverlay, error) {
+	if len(oc.Texts) == 0 {
+		return nil, errors.Errorf(`text overlay of preset '%s' has no texts`, preset)
+	}
+
+	o := textOverlay{
+		TextOverlayConfig: oc,
+		slugs:             make(map[string]string, len(oc.Texts)),
+		texts:             make(map[string]string, len(oc.Texts)),
+	}
+	for _, text := range oc.Texts {
+		if len(text) > maxOverlayText {
+			return nil, errors.Errorf(`text overlay of preset '%s' has text longer than %d bytes`, preset, maxOverlayText)
+		}
+		slug := textSlug(text)
+		if slug == "" {
+			return nil, errors.Errorf(`text overlay of preset '%s' has text '%s' without letters or digits`, preset, text)
+		}
+		if other, ok := o.texts[slug]; ok {
+			return nil, errors.Errorf(`text overlay of preset '%s' has texts '%s' and '%s', which can not be told apart`, preset, other, text)
+		}
+		o.slugs[text] = slug
+		o.texts[slug] = text
+	}
+	return &o, nil
+}
+
+// textSlug returns the form of text used in variant names: lower case
+// letters and digits, with anything else in between replaced by "-"
+func textSlug(text string) string {
+	var buf []byte
+	dash := false
+	for _, c := range []byte(strings.ToLower(text)) {
+		if ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') {
+			if dash && len(buf) > 0 {
+				buf = append(buf, '-')
+			}
+			buf = append(buf, c)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	return string(buf)
+}
+
+// rule returns the options that are appended to the rule of the preset
+// to draw text. See transformer.ParseOptions
+func (o *textOverlay) rule(text string) string {
+	rule := ",text" + transformer.EncodeText(text)
+	if o.Font != "" {
+		rule += ",font" + o.Font
+	}
+	if o.Size != 0 {
+		rule += ",fontsize" + strconv.Itoa(o.Size)
+	}
+	if o.Position != "" {
+		rule += ",at" + o.Position
+	}
+	if o.Color != "" {
+		rule += ",fg" + o.Color
+	}
+	if o.Background != "" {
+		rule += ",badge" + o.Background
+	}
+	return rule
+}
+
+// splitTextVariant returns the preset and the text of a variant with a
+// text overlay, such as "event~sold-out"
+func (s *Server) splitTextVariant(variant string) (string, string, bool) {
+	i := strings.LastIndex(variant, textVariantSeparator)
+	if i < 0 {
+		return "", "", false
+	}
+	preset := variant[:i]
+	o, ok := s.textOverlays[preset]
+	if !ok {
+		return "", "", false
+	}
+	if _, static := s.config.Presets[preset]; !static {
+		return "", "", false
+	}
+	text, ok := o.texts[variant[i+len(textVariantSeparator):]]
+	if !ok {
+		return "", "", false
+	}
+	return preset, text, true
+}
+
+// isTextVariant returns true if preset names a variant with a text
+// overlay. The signature of a variant covers its text, so clients must
+// request these with "text" and "sig", and never by name
+func (s *Server) isTextVariant(preset string) bool {
+	if _, static := s.config.Presets[preset]; static {
+		return false
+	}
+	_, _, ok := s.splitTextVariant(preset)
+	return ok
+}
+
+// textVariant returns the name of the variant of preset with text drawn
+// onto it
+func (s *Server) textVariant(preset, text string) (string, error) {
+	o, ok := s.textOverlays[preset]
+	if !ok {
+		return "", errors.WithKind(ErrPresetUnknown, errors.Errorf(`preset '%s' does not accept text`, preset))
+	}
+	slug, ok := o.slugs[text]
+	if !ok {
+		return "", errors.WithKind(ErrPresetUnknown, errors.Errorf(`text %s is not allowed for preset '%s'`, strconv.Quote(text), preset))
+	}
+	return preset + textVariantSeparator + slug, nil
+}
+
+// textVariants returns the names of all variants of preset with text
+// drawn onto them, sorted
+func (s *Server) textVariants(preset string) []string {
+	o, ok := s.textOverlays[preset]
+	if !ok {
+		return nil
+	}
+	variants := make([]string, 0, len(o.texts))
+	for slug := range o.texts {
+		variants = append(variants, preset+textVariantSeparator+slug)
+	}
+	sort.Strings(variants)
+	return variants
+}
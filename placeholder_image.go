@@ -0,0 +1,65 @@
+package sharaq
+
+import (
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/util"
+)
+
+// maxPlaceholderText is the number of characters of "text" that are drawn
+const maxPlaceholderText = 100
+
+// handlePlaceholder replies with a generated PNG image with the
+// dimensions of the preset in /placeholder/{preset}. Nothing is fetched
+// from the origin, nor stored in the backend
+func (s *Server) handlePlaceholder(w http.ResponseWriter, r *http.Request) {
+	ctx := util.RequestCtx(r)
+
+	pc := s.config.Placeholders
+	if pc == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	preset := strings.TrimPrefix(r.URL.Path, "/placeholder/")
+	rule, ok := s.lookupPreset(preset)
+	if !ok || s.isTextVariant(preset) {
+		httpError(w, r, "preset '"+preset+"' is not defined", http.StatusNotFound)
+		return
+	}
+
+	text := r.FormValue("text")
+	if runes := []rune(text); len(runes) > maxPlaceholderText {
+		text = string(runes[:maxPlaceholderText])
+	}
+	bg := strings.TrimPrefix(r.FormValue("bg"), "#")
+	if bg == "" {
+		bg = pc.Background
+	}
+
+	m, err := transformer.RenderPlaceholder(rule, text, bg)
+	if err != nil {
+		log.Debugf(ctx, "failed to render placeholder: %s", err)
+		httpError(w, r, "Bad placeholder parameters", http.StatusBadRequest)
+		return
+	}
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+	if err := png.Encode(buf, m); err != nil {
+		log.Debugf(ctx, "failed to encode placeholder: %s", err)
+		httpError(w, r, "Failed to encode placeholder", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Cache-Control", pc.CacheControl)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,266 @@
+package sharaq
+
+import (
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq/internal/bbpool"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/metadata"
+	"golang.org/x/net/context"
+)
+
+// presetTemplate is the compiled form of a PresetTemplate
+type presetTemplate struct {
+	PresetTemplate
+	name   string
+	re     *regexp.Regexp
+	widx   int // index of the {w} submatch, 0 if not present
+	hidx   int // index of the {h} submatch, 0 if not present
+	ratios [][2]int
+}
+
+var templateParamRx = regexp.MustCompile(`\\\{[wh]\\\}`)
+
+func compilePresetTemplate(name string, t PresetTemplate) (*presetTemplate, error) {
+	pt := presetTemplate{
+		PresetTemplate: t,
+		name:           name,
+	}
+	if pt.Rule == "" {
+		pt.Rule = "{w}x{h}"
+	}
+
+	nw, nh := strings.Count(name, "{w}"), strings.Count(name, "{h}")
+	if nw > 1 || nh > 1 || nw+nh == 0 {
+		return nil, errors.Errorf(`preset template '%s' must contain {w} and/or {h} once each`, name)
+	}
+
+	// Turn "thumb-{w}x{h}" into ^thumb-([0-9]+)x([0-9]+)$
+	var i int
+	pat := templateParamRx.ReplaceAllStringFunc(regexp.QuoteMeta(name), func(s string) string {
+		i++
+		if s == `\{w\}` {
+			pt.widx = i
+		} else {
+			pt.hidx = i
+		}
+		return `([0-9]+)`
+	})
+
+	if pt.widx > 0 && pt.MaxWidth <= 0 {
+		return nil, errors.Errorf(`preset template '%s' requires MaxWidth`, name)
+	}
+	if pt.hidx > 0 && pt.MaxHeight <= 0 {
+		return nil, errors.Errorf(`preset template '%s' requires MaxHeight`, name)
+	}
+
+	re, err := regexp.Compile(`^` + pat + `$`)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to compile preset template '%s'`, name)
+	}
+	pt.re = re
+
+	for _, ratio := range pt.AspectRatios {
+		var r [2]int
+		parts := strings.Split(ratio, ":")
+		if len(parts) == 2 {
+			r[0], _ = strconv.Atoi(parts[0])
+			r[1], _ = strconv.Atoi(parts[1])
+		}
+		if r[0] <= 0 || r[1] <= 0 {
+			return nil, errors.Errorf(`preset template '%s' has invalid aspect ratio '%s'`, name, ratio)
+		}
+		pt.ratios = append(pt.ratios, r)
+	}
+
+	return &pt, nil
+}
+
+// rule returns the rule for the given preset name, if it is an
+// instance of this template that satisfies its constraints
+func (pt *presetTemplate) rule(preset string) (string, bool) {
+	m := pt.re.FindStringSubmatch(preset)
+	if m == nil {
+		return "", false
+	}
+
+	var w, h int
+	if pt.widx > 0 {
+		var ok bool
+		if w, ok = dimension(m[pt.widx], pt.MinWidth, pt.MaxWidth); !ok {
+			return "", false
+		}
+	}
+	if pt.hidx > 0 {
+		var ok bool
+		if h, ok = dimension(m[pt.hidx], pt.MinHeight, pt.MaxHeight); !ok {
+			return "", false
+		}
+	}
+
+	if len(pt.ratios) > 0 && w > 0 && h > 0 && !pt.matchRatio(w, h) {
+		return "", false
+	}
+
+	// Dimensions that are not part of the name are left empty, which
+	// means "proportional" in rules such as "{w}x{h}"
+	var ws, hs string
+	if w > 0 {
+		ws = strconv.Itoa(w)
+	}
+	if h > 0 {
+		hs = strconv.Itoa(h)
+	}
+	return strings.NewReplacer("{w}", ws, "{h}", hs).Replace(pt.Rule), true
+}
+
+// matchRatio returns true if w:h matches one of the allowed aspect
+// ratios, allowing for rounding of either dimension
+func (pt *presetTemplate) matchRatio(w, h int) bool {
+	for _, r := range pt.ratios {
+		if int(math.Floor(float64(w*r[1])/float64(r[0])+0.5)) == h {
+			return true
+		}
+		if int(math.Floor(float64(h*r[0])/float64(r[1])+0.5)) == w {
+			return true
+		}
+	}
+	return false
+}
+
+// dimension parses s, and checks that it is within the bounds. Only
+// the canonical form is accepted, so that "thumb-010x10" and
+// "thumb-10x10" do not create separate variants
+func dimension(s string, min, max int) (int, bool) {
+	v, err := strconv.Atoi(s)
+	if err != nil || strconv.Itoa(v) != s {
+		return 0, false
+	}
+	if v <= 0 || v < min || v > max {
+		return 0, false
+	}
+	return v, true
+}
+
+// lookupPreset returns the rule for the given preset, which may be
+// one of the presets in the configuration, an instance of one of the
+// preset templates, or a variant of a preset with a text overlay
+func (s *Server) lookupPreset(preset string) (string, bool) {
+	if rule, ok := s.config.Presets[preset]; ok {
+		return s.withMaxBytes(preset, rule), true
+	}
+	if pt := s.matchTemplate(preset); pt != nil {
+		rule, ok := pt.rule(preset)
+		if !ok {
+			return "", false
+		}
+		return s.withMaxBytes(pt.name, rule), true
+	}
+	if base, text, ok := s.splitTextVariant(preset); ok {
+		return s.withMaxBytes(base, s.config.Presets[base]+s.textOverlays[base].rule(text)), true
+	}
+	return "", false
+}
+
+// withMaxBytes returns rule with the maxbytes option of PresetMaxBytes
+// appended, if there is one for preset. Instances of preset templates
+// and text variants are given the limit of the template or preset that
+// they are derived from
+func (s *Server) withMaxBytes(preset, rule string) string {
+	n, ok := s.config.PresetMaxBytes[preset]
+	if !ok {
+		return rule
+	}
+	if rule != "" {
+		rule += ","
+	}
+	return rule + "maxbytes" + strconv.FormatInt(n, 10)
+}
+
+// matchTemplate returns the template that the preset name matches, if any
+func (s *Server) matchTemplate(preset string) *presetTemplate {
+	for _, pt := range s.presetTemplates {
+		if pt.re.MatchString(preset) {
+			return pt
+		}
+	}
+	return nil
+}
+
+// templateInstancesPreset is the preset under which the names of the
+// instances of preset templates that were generated for a URL are
+// recorded, so that they can be deleted along with the other variants.
+// It may not be used as the name of a preset
+const templateInstancesPreset = "_instances"
+
+// templateInstances returns the instances of preset templates that
+// were recorded for u, sorted
+func (s *Server) templateInstances(ctx context.Context, u *url.URL) ([]string, error) {
+	storage, ok := s.backend.(Storage)
+	if !ok {
+		return nil, nil
+	}
+
+	buf := bbpool.Get()
+	defer bbpool.Release(buf)
+	if _, err := storage.Fetch(ctx, u, templateInstancesPreset, buf); err != nil {
+		if errors.IsTransformationRequired(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, `failed to fetch preset template instances of %s`, u)
+	}
+	if buf.Len() == 0 {
+		return nil, nil
+	}
+	return strings.Split(buf.String(), "\n"), nil
+}
+
+// recordInstances adds the instances of preset templates among presets
+// to the record of u. The record is written even if it already lists
+// them, so that it does not expire before the variants that it lists.
+// The caller must hold the processing flag of u
+func (s *Server) recordInstances(ctx context.Context, u *url.URL, presets map[string]string) error {
+	var added []string
+	for preset := range presets {
+		if s.matchTemplate(preset) != nil {
+			added = append(added, preset)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	storage, ok := s.backend.(Storage)
+	if !ok {
+		return nil
+	}
+
+	instances, err := s.templateInstances(ctx, u)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]struct{}, len(instances))
+	for _, preset := range instances {
+		known[preset] = struct{}{}
+	}
+	for _, preset := range added {
+		if _, ok := known[preset]; !ok {
+			instances = append(instances, preset)
+		}
+	}
+	sort.Strings(instances)
+
+	m := &metadata.Metadata{
+		SourceURL:   u.String(),
+		Preset:      templateInstancesPreset,
+		ContentType: "text/plain",
+	}
+	if err := storage.Put(ctx, u, templateInstancesPreset, []byte(strings.Join(instances, "\n")), m); err != nil {
+		return errors.Wrapf(err, `failed to record preset template instances of %s`, u)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package sharaq
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/util"
+)
+
+// readOnlyMode disables everything that writes to the backend, for
+// maintenance windows or when the storage is in trouble. Stored
+// variants are still served, and misses are redirected to the origin
+// without being transformed. It is enabled by Config.ReadOnly, and can
+// be toggled at runtime via the admin API
+type readOnlyMode struct {
+	enabled    int32
+	configured bool // Config.ReadOnly, as of the last call to configure
+}
+
+func (m *readOnlyMode) on() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+func (m *readOnlyMode) set(v bool) {
+	var i int32
+	if v {
+		i = 1
+	}
+	atomic.StoreInt32(&m.enabled, i)
+}
+
+// configure applies Config.ReadOnly. Toggles made via the admin API are
+// kept across reloads, unless the reload changes Config.ReadOnly
+func (m *readOnlyMode) configure(v bool) {
+	if v == m.configured {
+		return
+	}
+	m.configured = v
+	m.set(v)
+}
+
+// rejectReadOnly replies with 503 if the server is in read-only mode.
+// It returns false if nothing was written
+func (s *Server) rejectReadOnly(w http.ResponseWriter, r *http.Request) bool {
+	if !s.readOnly.on() {
+		return false
+	}
+	metrics.Count("readonly.rejected", 1)
+	httpError(w, r, "Server is in read-only mode", http.StatusServiceUnavailable)
+	return true
+}
+
+type adminReadOnlyResponse struct {
+	Configured bool `json:"configured"`
+	Enabled    bool `json:"enabled"`
+}
+
+// handleAdminReadOnly reports and toggles read-only mode. POST with
+// enabled=true or enabled=false to toggle it
+func (s *Server) handleAdminReadOnly(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		v, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			httpError(w, r, "Bad value for enabled", http.StatusBadRequest)
+			return
+		}
+		s.readOnly.set(v)
+		log.Debugf(util.RequestCtx(r), "Read-only mode set to %t", v)
+	default:
+		httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adminReadOnlyResponse{
+		Configured: s.config.ReadOnly,
+		Enabled:    s.readOnly.on(),
+	})
+}
@@ -0,0 +1,98 @@
+package sharaq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/internal/util"
+	"golang.org/x/net/context"
+)
+
+// The reverse index maps the paths of stored variants (as they appear
+// in storage access logs) back to the source URL and preset, so that
+// hot objects can be traced back to where they came from. Entries are
+// kept in the URL cache, and refreshed every time the variant is stored
+
+type reverseEntry struct {
+	Path   string `json:"path"`
+	URL    string `json:"url"`
+	Preset string `json:"preset"`
+}
+
+func reverseCacheKey(p string) string {
+	return urlcache.MakeCacheKey("reverse", normalizeVariantPath(p))
+}
+
+// normalizeVariantPath strips the leading slash, which some logs
+// include in object keys and some do not
+func normalizeVariantPath(p string) string {
+	return strings.TrimPrefix(p, "/")
+}
+
+// indexVariants records the paths of the variants of u for presets in
+// the reverse index. Failures are only logged, as the index is merely
+// a debugging aid
+func (s *Server) indexVariants(ctx context.Context, u *url.URL, presets map[string]string) {
+	rc := s.config.ReverseIndex
+	if rc == nil {
+		return
+	}
+	loc, ok := s.backend.(Locator)
+	if !ok {
+		return
+	}
+
+	for preset := range presets {
+		p := normalizeVariantPath(loc.VariantPath(u, preset))
+		if p == "" {
+			continue
+		}
+		b, err := json.Marshal(reverseEntry{Path: p, URL: u.String(), Preset: preset})
+		if err != nil {
+			continue
+		}
+		if err := s.cache.Set(ctx, reverseCacheKey(p), string(b), urlcache.WithExpires(rc.TTL)); err != nil {
+			log.Debugf(ctx, "Failed to index %s: %s", p, err)
+		}
+	}
+}
+
+// handleAdminLookup replies with the source URL and preset of the
+// variant stored at the given path
+func (s *Server) handleAdminLookup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.config.ReverseIndex == nil {
+		httpError(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	p := r.FormValue("path")
+	if p == "" {
+		httpError(w, r, "path parameter missing", http.StatusBadRequest)
+		return
+	}
+
+	ctx := util.RequestCtx(r)
+	v := s.cache.Lookup(ctx, reverseCacheKey(p))
+	if v == "" {
+		httpError(w, r, "path is not indexed", http.StatusNotFound)
+		return
+	}
+
+	var entry reverseEntry
+	if err := json.Unmarshal([]byte(v), &entry); err != nil {
+		log.Debugf(ctx, "Broken reverse index entry for %s: %s", p, err)
+		httpError(w, r, "path is not indexed", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
@@ -0,0 +1,49 @@
+package sharaq
+
+import (
+	"net/url"
+	"regexp"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/util"
+)
+
+type rewriteRule struct {
+	re          *regexp.Regexp
+	replace     string
+	stripParams []string
+}
+
+// newRewriter compiles the rules into a function that rewrites source
+// URLs. It returns nil if there are no rules
+func newRewriter(rules []RewriteRule) (func(string) string, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	compiled := make([]rewriteRule, len(rules))
+	for i, rule := range rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, errors.Wrapf(err, `invalid rewrite rule '%s'`, rule.Match)
+		}
+		compiled[i] = rewriteRule{re: re, replace: rule.Replace, stripParams: rule.StripParams}
+	}
+
+	return func(s string) string {
+		for _, rule := range compiled {
+			if !rule.re.MatchString(s) {
+				continue
+			}
+			if rule.replace != "" {
+				s = rule.re.ReplaceAllString(s, rule.replace)
+			}
+			if len(rule.stripParams) > 0 {
+				if u, err := url.Parse(s); err == nil {
+					s = util.StripQueryParams(u, rule.stripParams).String()
+				}
+			}
+		}
+		return s
+	}, nil
+}
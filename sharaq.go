@@ -3,32 +3,61 @@ package sharaq
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
 	"encoding/json"
 	"net/http"
 	"net/url"
 	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/lestrrat-go/sharaq/aws"
+	"github.com/lestrrat-go/sharaq/errreport"
 	"github.com/lestrrat-go/sharaq/fs"
 	"github.com/lestrrat-go/sharaq/gcp"
+	"github.com/lestrrat-go/sharaq/internal/accesslog"
 	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/flags"
+	"github.com/lestrrat-go/sharaq/internal/httputil"
 	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/metrics"
+	"github.com/lestrrat-go/sharaq/internal/requestid"
+	"github.com/lestrrat-go/sharaq/internal/throttle"
 	"github.com/lestrrat-go/sharaq/internal/transformer"
 	"github.com/lestrrat-go/sharaq/internal/urlcache"
 	"github.com/lestrrat-go/sharaq/internal/util"
+	"github.com/lestrrat-go/sharaq/memory"
 	"golang.org/x/net/context"
 )
 
-func NewServer(c *Config) (*Server, error) {
+// NewServer creates a new Server. Components that are not specified
+// via options are created from c when Initialize is called
+func NewServer(c *Config, options ...Option) (*Server, error) {
 	// Just so that we don't barf...
 	if c == nil {
 		c = &Config{}
 	}
 
 	s := &Server{
-		config: c,
+		config:   c,
+		jobs:     newJobTracker(),
+		reloadCh: make(chan struct{}, 1),
+	}
+	for _, o := range options {
+		o.Configure(s)
+	}
+	if p := s.custom.presets; p != nil {
+		c.Presets = p
+	}
+
+	c.applyDefaults()
+
+	s.csrfKey = make([]byte, 32)
+	if _, err := rand.Read(s.csrfKey); err != nil {
+		return nil, errors.Wrap(err, `failed to generate CSRF key`)
 	}
 
 	if len(c.Tokens) > 0 {
@@ -42,14 +71,59 @@ func NewServer(c *Config) (*Server, error) {
 		}
 	}
 
-	s.whitelist = make([]*regexp.Regexp, len(c.Whitelist))
-	for i, pat := range c.Whitelist {
-		re, err := regexp.Compile(pat)
+	var err error
+	s.guardianAccess, err = newAccessControl(c.Guardian)
+	if err != nil {
+		return nil, errors.Wrap(err, `invalid Guardian access config`)
+	}
+	s.adminAccess, err = newAccessControl(c.Admin)
+	if err != nil {
+		return nil, errors.Wrap(err, `invalid Admin access config`)
+	}
+
+	s.whitelist, err = compileWhitelist(c.Whitelist)
+	if err != nil {
+		return nil, err
+	}
+
+	if dc := c.Dynamic; dc != nil {
+		if !dynamicSupported {
+			return nil, errors.New(`Dynamic is not supported on appengine`)
+		}
+		s.dynamic, err = newDynamicConfig(dc)
 		if err != nil {
+			return nil, errors.Wrap(err, `invalid Dynamic config`)
+		}
+	}
+
+	if _, err := newRewriter(c.Origin.Rewrites); err != nil {
+		return nil, errors.Wrap(err, `invalid Origin.Rewrites`)
+	}
+
+	if uc := c.Upstream; uc != nil {
+		if err := validateUpstreamConfig(uc); err != nil {
+			return nil, errors.Wrap(err, `invalid Upstream config`)
+		}
+	}
+
+	if c.Backend.ContentKeys {
+		if err := validateContentKeys(c); err != nil {
 			return nil, err
 		}
-		s.whitelist[i] = re
 	}
+
+	if c.Signing != nil && c.Signing.Key == "" {
+		return nil, errors.New(`Signing.Key is required`)
+	}
+
+	if err := s.configurePresets(c); err != nil {
+		return nil, err
+	}
+
+	if err := s.newHandlers(); err != nil {
+		return nil, err
+	}
+
 	if c.Debug {
 		s.dumpConfig()
 	}
@@ -57,22 +131,307 @@ func NewServer(c *Config) (*Server, error) {
 	return s, nil
 }
 
+// configurePresets compiles the settings that refer to presets, such as
+// PresetTemplates and TextOverlays, and checks that the presets that
+// they refer to exist. This is also how dynamic settings are checked
+// before they are applied, see dynamicConfig
+func (s *Server) configurePresets(c *Config) error {
+	var err error
+	names := make([]string, 0, len(c.PresetTemplates))
+	for name := range c.PresetTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pt, err := compilePresetTemplate(name, c.PresetTemplates[name])
+		if err != nil {
+			return err
+		}
+		s.presetTemplates = append(s.presetTemplates, pt)
+	}
+
+	if _, ok := c.Presets[templateInstancesPreset]; ok && len(c.PresetTemplates) > 0 {
+		return errors.Errorf(`preset '%s' is reserved for PresetTemplates`, templateInstancesPreset)
+	}
+
+	s.presetSources = make(map[string][]*regexp.Regexp)
+	for preset, pats := range c.PresetSources {
+		_, ok := c.Presets[preset]
+		if _, isTemplate := c.PresetTemplates[preset]; !ok && !isTemplate {
+			return errors.Errorf(`PresetSources refers to unknown preset '%s'`, preset)
+		}
+		for _, pat := range pats {
+			re, err := regexp.Compile(pat)
+			if err != nil {
+				return err
+			}
+			s.presetSources[preset] = append(s.presetSources[preset], re)
+		}
+	}
+
+	for preset := range c.PresetMaxBytes {
+		_, ok := c.Presets[preset]
+		if _, isTemplate := c.PresetTemplates[preset]; !ok && !isTemplate {
+			return errors.Errorf(`PresetMaxBytes refers to unknown preset '%s'`, preset)
+		}
+	}
+
+	if ic := c.Internal; ic != nil {
+		if c.Signing == nil && len(ic.AllowFrom) == 0 {
+			return errors.New(`Internal requires AllowFrom or Signing`)
+		}
+		s.internalAccess, err = newAccessControl(&AccessConfig{AllowFrom: ic.AllowFrom})
+		if err != nil {
+			return errors.Wrap(err, `invalid Internal access config`)
+		}
+		s.internalPresets = make(map[string]struct{}, len(ic.Presets))
+		for _, preset := range ic.Presets {
+			_, ok := c.Presets[preset]
+			if _, isTemplate := c.PresetTemplates[preset]; !ok && !isTemplate {
+				return errors.Errorf(`Internal refers to unknown preset '%s'`, preset)
+			}
+			s.internalPresets[preset] = struct{}{}
+		}
+	}
+
+	if len(c.TextOverlays) > 0 {
+		if c.Signing == nil {
+			return errors.New(`TextOverlays requires Signing`)
+		}
+		s.textOverlays = make(map[string]*textOverlay, len(c.TextOverlays))
+		for preset, oc := range c.TextOverlays {
+			if _, ok := c.Presets[preset]; !ok {
+				return errors.Errorf(`TextOverlays refers to unknown preset '%s'`, preset)
+			}
+			o, err := compileTextOverlay(preset, oc)
+			if err != nil {
+				return err
+			}
+			s.textOverlays[preset] = o
+		}
+	}
+
+	for name, presets := range c.Profiles {
+		if len(presets) == 0 {
+			return errors.Errorf(`profile '%s' has no presets`, name)
+		}
+		for _, preset := range presets {
+			if _, ok := s.lookupPreset(preset); !ok {
+				return errors.Errorf(`profile '%s' refers to unknown preset '%s'`, name, preset)
+			}
+		}
+	}
+	return nil
+}
+
 func (s *Server) Initialize() error {
 	var err error
-	s.cache, err = urlcache.New(s.config.URLCache)
+	if p := s.custom.presets; p != nil {
+		s.config.Presets = p
+		s.config.applyDefaults()
+	}
+	// the whitelist may have been changed by a reload
+	s.whitelist, err = compileWhitelist(s.config.Whitelist)
+	if err != nil {
+		return errors.Wrap(err, `invalid Whitelist`)
+	}
+	if c := s.custom.cache; c != nil {
+		s.cache = c
+	} else {
+		s.cache, err = urlcache.New(s.config.URLCache)
+		if err != nil {
+			return errors.Wrap(err, `failed to create urlcache`)
+		}
+	}
+	// middleware may have been changed by a reload
+	if err := s.newHandlers(); err != nil {
+		return err
+	}
+	s.initBudget()
+	s.readOnly.configure(s.config.ReadOnly)
+	s.transformer, err = s.newTransformer()
 	if err != nil {
-		return errors.Wrap(err, `failed to create urlcache`)
+		return errors.Wrap(err, `failed to create transformer`)
+	}
+	s.auditLog, err = openAuditLog(s.config.AuditLog)
+	if err != nil {
+		return errors.Wrap(err, `failed to open audit log`)
+	}
+	if err := s.loadNotFoundImage(); err != nil {
+		return errors.Wrap(err, `failed to load NotFound.Placeholder`)
+	}
+	if s.config.Fallback.Policy == FallbackStale {
+		s.stale = newStaleCache(s.config.Fallback.StaleSize, s.config.Fallback.StaleBytes)
+	}
+	s.throttle = nil
+	if tc := s.config.Throttle; tc != nil {
+		s.throttle = throttle.New(tc.BatchCPUBudget)
+	}
+	s.hostLimiter = nil
+	if jc := s.config.Jobs; jc.HostRate > 0 || len(jc.HostRates) > 0 {
+		s.hostLimiter = throttle.NewHostLimiter(jc.HostRate, jc.HostBurst, jc.HostRates)
+	}
+	if mc := s.config.Mirror; mc != nil {
+		s.mirror, err = newMirror(mc)
+		if err != nil {
+			return errors.Wrap(err, `failed to setup mirroring`)
+		}
+	}
+
+	if err := s.initMetrics(); err != nil {
+		return errors.Wrap(err, `failed to setup metrics`)
+	}
+
+	if err := s.initErrorReporter(); err != nil {
+		return errors.Wrap(err, `failed to setup error reporting`)
+	}
+
+	if err := s.initEventPublisher(); err != nil {
+		return errors.Wrap(err, `failed to setup event publishing`)
 	}
-	s.transformer = transformer.New()
 
 	if err := s.newBackend(); err != nil {
 		return errors.Wrap(err, `failed to create storage backend`)
 	}
+	s.health = nil
+	if hc := s.config.Health; hc != nil {
+		s.health = newHealthMonitor(hc, s.backend)
+	}
+
+	ctx := context.Background()
+	for _, warning := range s.config.Lint() {
+		log.Debugf(ctx, "Config warning: %s", warning)
+	}
+
+	// Without /ready, refusing to start is the only way to keep
+	// traffic away from a broken engine
+	if err := s.selfTest(ctx); err != nil && s.health == nil {
+		return errors.Wrap(err, `transformer self-test failed`)
+	}
+	return nil
+}
+
+func (s *Server) newTransformer() (*transformer.Transformer, error) {
+	if t := s.custom.transformer; t != nil {
+		return t, nil
+	}
+	return newTransformer(s.config, s.custom.transport, transformer.WithFetchCounter(func(n int64) {
+		s.budget.add(budgetOrigin, n)
+	}))
+}
+
+func (s *Server) initMetrics() error {
+	mc := s.config.Metrics
+	if mc != nil && len(mc.Presets) > 0 {
+		metrics.SetPresets(mc.Presets)
+	} else {
+		names := make([]string, 0, len(s.config.Presets))
+		for name := range s.config.Presets {
+			names = append(names, name)
+		}
+		metrics.SetPresets(names)
+	}
+
+	if mc == nil || mc.Type == "" {
+		metrics.SetSink(nil)
+		return nil
+	}
+
+	switch mc.Type {
+	case "statsd":
+		sink, err := metrics.NewStatsd(&mc.Statsd)
+		if err != nil {
+			return errors.Wrap(err, `failed to create statsd sink`)
+		}
+		metrics.SetSink(sink)
+	default:
+		return errors.Errorf(`invalid metrics type %s`, mc.Type)
+	}
+	return nil
+}
+
+func (s *Server) initErrorReporter() error {
+	s.configReporter = nil
+
+	ec := s.config.ErrorReport
+	if ec == nil || ec.Type == "" {
+		return nil
+	}
+
+	switch ec.Type {
+	case "sentry":
+		r, err := errreport.NewSentry(&ec.Sentry)
+		if err != nil {
+			return errors.Wrap(err, `failed to create sentry reporter`)
+		}
+		s.configReporter = r
+	default:
+		return errors.Errorf(`invalid error report type %s`, ec.Type)
+	}
 	return nil
 }
 
+// SetErrorReporter sets a custom hook that is invoked for errors that
+// occur during transformation and storage operations. It is called in
+// addition to the reporter specified in the configuration, if any
+func (s *Server) SetErrorReporter(r errreport.Reporter) {
+	s.errorReporter = r
+}
+
+func (s *Server) reportError(ctx context.Context, ev *errreport.Event) {
+	if id := requestid.Get(ctx); id != "" {
+		if ev.Extra == nil {
+			ev.Extra = make(map[string]string)
+		}
+		ev.Extra["request_id"] = id
+	}
+
+	if r := s.configReporter; r != nil {
+		r.Report(ctx, ev)
+	}
+	if r := s.errorReporter; r != nil {
+		r.Report(ctx, ev)
+	}
+}
+
+// Backend returns the storage backend used by this server. It is only
+// available after Initialize() has been called
+func (s *Server) Backend() Backend {
+	return s.backend
+}
+
+// Transformer returns the transformer used by this server. It is only
+// available after Initialize() has been called
+func (s *Server) Transformer() *transformer.Transformer {
+	return s.transformer
+}
+
+// Presets returns the preset definitions that this server was configured with
+func (s *Server) Presets() map[string]string {
+	return s.config.Presets
+}
+
+// ProfilePresets returns the presets of the named profile, along with
+// their rules
+func (s *Server) ProfilePresets(name string) (map[string]string, bool) {
+	names, ok := s.config.Profiles[name]
+	if !ok {
+		return nil, false
+	}
+	presets := make(map[string]string, len(names))
+	for _, preset := range names {
+		presets[preset], _ = s.lookupPreset(preset)
+	}
+	return presets, true
+}
+
 func (s *Server) dumpConfig() {
-	j, err := json.MarshalIndent(s.config, "", "  ")
+	m, err := s.config.redacted()
+	if err != nil {
+		return
+	}
+
+	j, err := json.MarshalIndent(m, "", "  ")
 	if err != nil {
 		return
 	}
@@ -81,67 +440,283 @@ func (s *Server) dumpConfig() {
 	scanner := bufio.NewScanner(bytes.NewBuffer(j))
 	for scanner.Scan() {
 		l := scanner.Text()
-		log.Debugf(ctx, l)
+		log.Debugf(ctx, "%s", l)
 	}
 }
 
 func (s *Server) newBackend() error {
-	switch s.config.Backend.Type {
+	if b := s.custom.backend; b != nil {
+		s.backend = b
+		return nil
+	}
+
+	b, err := buildBackend(s.config, s.cache, s.transformer)
+	if err != nil {
+		return err
+	}
+	s.backend = b
+	return nil
+}
+
+// NewBackend creates the storage backend described by c.Backend, which
+// stores variants of the presets in c.Presets. If a previous backend is
+// configured, the returned backend migrates variants from it. c is not
+// modified
+func NewBackend(c *Config, cache *URLCache, t *Transformer) (Backend, error) {
+	return buildBackend(c.withDefaults(), cache.c, t.t)
+}
+
+// buildBackend is NewBackend. Defaults must already be applied to c
+func buildBackend(c *Config, cache *urlcache.URLCache, t *transformer.Transformer) (Backend, error) {
+	if c.Backend.ContentKeys {
+		if err := validateContentKeys(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// Records that are kept for each URL, such as the checksum of its
+	// source, are listed and deleted like the variants of a preset
+	var records []string
+	if c.Backend.ContentKeys {
+		records = append(records, contentSourcePreset)
+	}
+	if len(c.PresetTemplates) > 0 {
+		records = append(records, templateInstancesPreset)
+	}
+	presets := c.Presets
+	if len(records) > 0 {
+		presets = make(map[string]string, len(c.Presets)+len(records))
+		for preset, rule := range c.Presets {
+			presets[preset] = rule
+		}
+		for _, preset := range records {
+			presets[preset] = ""
+		}
+	}
+
+	b, err := newBackendFromConfig(&c.Backend, cache, t, presets)
+	if err != nil {
+		return nil, err
+	}
+
+	if prev := c.Backend.Previous; prev != nil {
+		pb, err := newBackendFromConfig(prev, cache, t, presets)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to create previous backend`)
+		}
+		b = newDualBackend(b, pb, t)
+	}
+
+	if c.Backend.ContentKeys {
+		b, err = newContentBackend(b, cache, t)
+		if err != nil {
+			return nil, errors.Wrap(err, `invalid Backend.ContentKeys`)
+		}
+	}
+	return b, nil
+}
+
+func newBackendFromConfig(c *BackendConfig, cache *urlcache.URLCache, t *transformer.Transformer, presets map[string]string) (Backend, error) {
+	if err := validateBackendType(c.Type); err != nil {
+		return nil, errors.Wrap(err, `unsupported storage backend`)
+	}
+
+	switch c.Type {
 	case "aws":
-		b, err := aws.NewBackend(
-			&s.config.Backend.Amazon,
-			s.cache,
-			s.transformer,
-			s.config.Presets,
-		)
+		b, err := aws.NewBackend(&c.Amazon, cache, t, presets)
 		if err != nil {
-			return errors.Wrap(err, `failed to create aws backend`)
+			return nil, errors.Wrap(err, `failed to create aws backend`)
 		}
-		s.backend = b
+		return b, nil
 	case "gcp":
-		b, err := gcp.NewBackend(
-			&s.config.Backend.Google,
-			s.cache,
-			s.transformer,
-			s.config.Presets,
-		)
+		b, err := gcp.NewBackend(&c.Google, cache, t, presets)
 		if err != nil {
-			return errors.Wrap(err, `failed to create gcp backend`)
+			return nil, errors.Wrap(err, `failed to create gcp backend`)
 		}
-		s.backend = b
+		return b, nil
 	case "fs":
-		b, err := fs.NewBackend(
-			&s.config.Backend.FileSystem,
-			s.cache,
-			s.transformer,
-			s.config.Presets,
-		)
+		b, err := fs.NewBackend(&c.FileSystem, cache, t, presets)
 		if err != nil {
-			return errors.Wrap(err, `failed to create file system backend`)
+			return nil, errors.Wrap(err, `failed to create file system backend`)
 		}
-		s.backend = b
+		return b, nil
+	case "memory":
+		return memory.NewBackend(t, presets), nil
 	default:
-		return errors.Errorf(`invalid storage backend %s`, s.config.Backend.Type)
+		return nil, errors.Errorf(`invalid storage backend %s`, c.Type)
 	}
-	return nil
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Honor the request ID if somebody upstream already assigned one
+	id := r.Header.Get(requestid.HeaderName)
+	if !requestid.Valid(id) {
+		id = requestid.New()
+	}
+	w.Header().Set(requestid.HeaderName, id)
+	r = r.WithContext(requestid.With(r.Context(), id))
+
+	if s.compressRoute(r.URL.Path) && acceptsGzip(r) {
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		w = gw
+	}
+
+	defer s.recoverRequest(w, r)
+
 	if r.URL.Path == "/favicon.ico" {
-		http.Error(w, "Not Found", http.StatusNotFound)
+		httpError(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	// Every listener answers readiness probes
+	if r.URL.Path == "/ready" && s.health != nil {
+		s.handleReady(w, r)
+		return
+	}
+
+	// Pretend that routes for roles not served by this listener
+	// don't exist
+	if !hasRole(r, requestRole(r)) {
+		httpError(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if !s.limitRequest(w, r) {
+		return
+	}
+
+	w, r = s.startTrace(w, r)
+
+	if h, ok := s.handlers[requestRole(r)]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	s.route(w, r)
+}
+
+// route serves r according to its path and method
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/debug/") {
+		s.handleDebug(w, r)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		s.handleAdmin(w, r)
+		return
+	}
+
+	if r.URL.Path == "/sign" {
+		if r.Method != http.MethodGet {
+			httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleSign(w, r)
+		return
+	}
+
+	if r.URL.Path == "/variant" {
+		if r.Method != http.MethodGet {
+			httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleVariant(w, r)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/placeholder/") {
+		if r.Method != http.MethodGet {
+			httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handlePlaceholder(w, r)
+		return
+	}
+
+	if r.URL.Path == "/info" {
+		if r.Method != http.MethodGet {
+			httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleInfo(w, r)
+		return
+	}
+
+	if r.URL.Path == "/estimate" {
+		if r.Method != http.MethodGet {
+			httpError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleEstimate(w, r)
 		return
 	}
 
 	switch r.Method {
 	case "GET":
+		s.maybeMirror(r)
+		s.handleFetch(w, r)
+	case "HEAD":
+		// Answered like GET, so that CDNs and clients can learn the
+		// Content-Length of variants without fetching them
 		s.handleFetch(w, r)
 	case "POST":
 		s.handleStore(w, r)
 	case "DELETE":
 		s.handleDelete(w, r)
 	default:
-		http.Error(w, "What, what, what?", http.StatusBadRequest)
+		httpError(w, r, "What, what, what?", http.StatusBadRequest)
+	}
+}
+
+// recoverRequest must be deferred at the beginning of request handlers.
+// It prevents a panic (e.g. from a broken image decoder) from bringing
+// down the whole process, and makes sure that it gets reported
+func (s *Server) recoverRequest(w http.ResponseWriter, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	ctx := util.RequestCtx(r)
+	s.handlePanic(ctx, v, r, map[string]string{})
+	httpError(w, r, "Internal server error", http.StatusInternalServerError)
+}
+
+// recoverBackground is the equivalent of recoverRequest for work that is
+// done outside of request handlers
+func (s *Server) recoverBackground(ctx context.Context, u *url.URL) {
+	v := recover()
+	if v == nil {
+		return
 	}
+	s.handlePanic(ctx, v, nil, map[string]string{"url": u.String()})
+}
+
+func (s *Server) handlePanic(ctx context.Context, v interface{}, r *http.Request, extra map[string]string) {
+	stack := debug.Stack()
+	log.Debugf(ctx, "panic: %v\n%s", v, stack)
+	metrics.Count("panics", 1)
+
+	extra["stack"] = string(stack)
+	s.reportError(ctx, &errreport.Event{
+		Kind:    errreport.KindPanic,
+		Err:     errors.Errorf("panic: %v", v),
+		Request: r,
+		Extra:   extra,
+	})
+}
+
+func compileWhitelist(pats []string) ([]*regexp.Regexp, error) {
+	whitelist := make([]*regexp.Regexp, len(pats))
+	for i, pat := range pats {
+		re, err := regexp.Compile(pat)
+		if err != nil {
+			return nil, err
+		}
+		whitelist[i] = re
+	}
+	return whitelist, nil
 }
 
 func (s *Server) allowedTarget(u *url.URL) bool {
@@ -157,55 +732,391 @@ func (s *Server) allowedTarget(u *url.URL) bool {
 	return false
 }
 
+// allowedPreset returns true if the preset may be applied to the image
+// at u. Presets without restrictions may be applied to any image that
+// passes the whitelist. Instances of preset templates are restricted
+// by the patterns given for the template
+func (s *Server) allowedPreset(preset string, u *url.URL) bool {
+	pats, ok := s.presetSources[preset]
+	if !ok {
+		if _, static := s.config.Presets[preset]; !static {
+			if pt := s.matchTemplate(preset); pt != nil {
+				pats, ok = s.presetSources[pt.name]
+			} else if base, _, isText := s.splitTextVariant(preset); isText {
+				pats, ok = s.presetSources[base]
+			}
+		}
+	}
+	if !ok {
+		return true
+	}
+
+	for _, pat := range pats {
+		if pat.MatchString(u.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedInternal returns true unless the preset is restricted to
+// internal clients, and r is neither from an allowed network nor
+// signed. Signatures themselves are checked by verifySignature
+func (s *Server) allowedInternal(r *http.Request, preset string) bool {
+	if !s.internalPreset(preset) {
+		return true
+	}
+	if s.config.Signing != nil && r.FormValue("sig") != "" {
+		return true
+	}
+	return s.fromInternalNetwork(r)
+}
+
+// allowedOriginalFallback returns true if the stored original may be
+// served in place of a missing variant. Signatures only cover the
+// requested preset, so an internal original is only served to requests
+// from allowed networks
+func (s *Server) allowedOriginalFallback(r *http.Request) bool {
+	if !s.internalPreset(OriginalPreset) {
+		return true
+	}
+	return s.fromInternalNetwork(r)
+}
+
+func (s *Server) fromInternalNetwork(r *http.Request) bool {
+	return len(s.config.Internal.AllowFrom) > 0 && s.internalAccess.allowed(r)
+}
+
+// internalPreset returns true if the preset, or the preset template
+// that it is an instance of, is restricted to internal clients
+func (s *Server) internalPreset(preset string) bool {
+	if _, ok := s.internalPresets[preset]; ok {
+		return true
+	}
+	if _, static := s.config.Presets[preset]; static {
+		return false
+	}
+	if pt := s.matchTemplate(preset); pt != nil {
+		_, ok := s.internalPresets[pt.name]
+		return ok
+	}
+	if base, _, ok := s.splitTextVariant(preset); ok {
+		_, ok := s.internalPresets[base]
+		return ok
+	}
+	return false
+}
+
+// checkRequest returns an error if the preset may not be applied to
+// the image at u
+func (s *Server) checkRequest(u *url.URL, preset string) error {
+	if !s.allowedTarget(u) {
+		return errors.WithKind(ErrSourceNotAllowed, errors.Errorf(`url %s is not in the whitelist`, u))
+	}
+	if _, ok := s.lookupPreset(preset); !ok {
+		return errors.WithKind(ErrPresetUnknown, errors.Errorf(`preset '%s' is not defined`, preset))
+	}
+	if !s.allowedPreset(preset, u) {
+		return errors.WithKind(ErrSourceNotAllowed, errors.Errorf(`preset '%s' may not be applied to %s`, preset, u))
+	}
+	return nil
+}
+
+// presetsFor returns the presets that may be applied to the image at u
+func (s *Server) presetsFor(u *url.URL) map[string]string {
+	presets := make(map[string]string)
+	for preset, rule := range s.config.Presets {
+		if s.allowedPreset(preset, u) {
+			presets[preset] = s.withMaxBytes(preset, rule)
+		}
+	}
+	return presets
+}
+
+// presetsToGenerate returns the presets to generate when the variant
+// for preset is missing. Presets defined in the configuration are
+// generated all at once, as they are for unknown presets, while
+// instances of preset templates are generated one by one
+func (s *Server) presetsToGenerate(u *url.URL, preset string) map[string]string {
+	if _, ok := s.config.Presets[preset]; ok {
+		return s.presetsFor(u)
+	}
+	if rule, ok := s.lookupPreset(preset); ok {
+		return map[string]string{preset: rule}
+	}
+	return s.presetsFor(u)
+}
+
+// validPresetName returns false for names that can not be presets at
+// all. Backends use preset names in paths, so these are rejected even
+// where unknown presets are not
+func validPresetName(preset string) bool {
+	return preset != "." && preset != ".." && !strings.ContainsAny(preset, "/\\")
+}
+
 // handleFetch replies with the proper URL of the image
 func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
 	ctx := util.RequestCtx(r)
 
-	u, err := util.GetTargetURL(r)
+	u, err := s.getTargetURL(r)
 	if err != nil {
 		log.Debugf(ctx, "Bad url: %s", err)
-		http.Error(w, "Bad url", http.StatusBadRequest)
+		httpError(w, r, "Bad url", http.StatusBadRequest)
 		return
 	}
 
-	if !s.allowedTarget(u) {
-		http.Error(w, "Specified url not allowed", http.StatusForbidden)
+	preset, err := util.GetPresetFromRequest(r)
+	if err != nil {
+		log.Debugf(ctx, "Bad preset: %s", err)
+		httpError(w, r, "Bad preset", http.StatusBadRequest)
+		return
+	}
+	if s.isTextVariant(preset) {
+		log.Debugf(ctx, "Rejecting request: text variant '%s' requested by name", preset)
+		httpError(w, r, "Bad preset", http.StatusBadRequest)
 		return
 	}
 
-	preset, err := util.GetPresetFromRequest(r)
+	if err := s.checkRequest(u, preset); err != nil {
+		if !IsError(err, ErrPresetUnknown) {
+			log.Debugf(ctx, "Rejecting request: %s", err)
+			httpError(w, r, err.Error(), errorStatus(err))
+			return
+		}
+		// Unknown presets are not rejected, so that pages keep working
+		// after a preset is removed: stored variants are still served,
+		// and misses fall back to the origin
+		if !validPresetName(preset) {
+			log.Debugf(ctx, "Bad preset '%s'", preset)
+			httpError(w, r, "Bad preset", http.StatusBadRequest)
+			return
+		}
+		log.Debugf(ctx, "Unknown preset '%s'", preset)
+	}
+
+	if err := s.verifySignature(r, preset); err != nil {
+		log.Debugf(ctx, "Rejecting request: %s", err)
+		httpError(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !s.allowedInternal(r, preset) {
+		log.Debugf(ctx, "Rejecting request: preset '%s' is internal", preset)
+		metrics.Count("dispatcher.internal.rejected", 1)
+		httpError(w, r, "preset '"+preset+"' is not available", http.StatusForbidden)
+		return
+	}
+
+	// Variants with text are stored separately. The signature covers
+	// the text, and has been checked above
+	if text := r.FormValue("text"); text != "" {
+		preset, err = s.textVariant(preset, text)
+		if err != nil {
+			log.Debugf(ctx, "Rejecting request: %s", err)
+			httpError(w, r, err.Error(), errorStatus(err))
+			return
+		}
+		if r.FormValue("sig") == "" {
+			log.Debugf(ctx, "Rejecting request: text is not signed")
+			httpError(w, r, "text must be signed", http.StatusForbidden)
+			return
+		}
+	}
+
+	wait, err := s.waitDuration(r)
 	if err != nil {
-		log.Debugf(ctx, "Bad preset: %s", err)
-		http.Error(w, "Bad preset", http.StatusBadRequest)
+		httpError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	var version string
+	if s.config.Versioning != nil {
+		version = r.FormValue("v")
+	}
+
+	entry := accesslog.FromContext(ctx)
+	entry.SetPreset(preset)
+	entry.SetSourceHost(u.Host)
+	entry.SetBackend(s.config.Backend.Type)
+
+	trace := requestTrace(r)
+	trace.record("backend", s.config.Backend.Type)
+
+	tag := metrics.PresetTag(preset)
+	metrics.Count("dispatcher.requests", 1, tag)
+	if s.readOnly.on() {
+		// backends must not regenerate stale variants either
+		ctx = util.WithReadOnly(ctx)
+	}
 	content, err := s.backend.Get(ctx, u, preset)
+	if err == nil && version != "" && !s.currentVersion(ctx, u, preset, version) {
+		// The source or the preset changed since the variant was
+		// generated. Don't let it be cached under the new version
+		log.Debugf(ctx, "Variant %s (%s) does not match version %s", u, preset, version)
+		metrics.Count("dispatcher.outdated", 1, tag)
+		trace.record("version", "outdated")
+		err = errors.TransformationRequiredError{}
+	}
 	if err == nil {
-		content.ServeHTTP(w, r)
+		trace.record("get", "hit")
+		metrics.Count("dispatcher.hit", 1, tag)
+		if version != "" && !httputil.IsRedirect(content) {
+			w.Header().Set("Cache-Control", s.config.Versioning.CacheControl)
+		}
+		s.serveAndRemember(w, r, u, preset, content)
+		return
+	}
+
+	if errors.IsStorageUnavailable(err) {
+		log.Debugf(ctx, "backend unavailable: %s", err)
+		trace.record("get", "unavailable")
+		trace.record("fallback", s.config.Fallback.Policy)
+		s.serveFallback(w, r, u, preset)
 		return
 	}
 
 	if !errors.IsTransformationRequired(err) {
+		trace.record("get", "error")
+		err = errors.WithKind(ErrStorage, err)
+		metrics.Count("dispatcher.errors", 1, tag)
+		s.reportError(ctx, &errreport.Event{
+			Kind:    errreport.KindStorage,
+			Err:     err,
+			Request: r,
+			Extra:   map[string]string{"url": u.String(), "preset": preset},
+		})
 		log.Debugf(ctx, "failed to serve from backend: %s", err)
-		http.Error(w, "Internal server error", 500)
+		httpError(w, r, "Internal server error", 500)
 		return
 	}
 
-	if err := s.deferedTransformAndStore(ctx, u); err != nil {
-		log.Debugf(ctx, "failed to transform content: %s", err)
-		http.Error(w, "Internal server error", 500)
+	trace.record("get", "miss")
+	if s.serveNotFound(ctx, w, r, u) {
 		return
 	}
 
+	metrics.Count("dispatcher.miss", 1, tag)
+	if s.readOnly.on() {
+		log.Debugf(ctx, "Read-only mode, redirecting to original content at %s", u)
+		metrics.Count("dispatcher.readonly", 1, tag)
+		trace.record("transform", "readonly")
+		s.originRedirect().To(u.String()).ServeHTTP(w, r)
+		return
+	}
+	if over, _ := s.budget.exceeded(); over {
+		log.Debugf(ctx, "Byte budget exceeded, redirecting to original content at %s", u)
+		metrics.Count("dispatcher.budget", 1, tag)
+		trace.record("transform", "budget")
+		s.originRedirect().To(u.String()).ServeHTTP(w, r)
+		return
+	}
+
+	// HEAD requests only ask about the variant, so they are answered
+	// like misses without generating it
+	if r.Method == http.MethodHead {
+		trace.record("transform", "head")
+	} else {
+		presets := s.presetsToGenerate(u, preset)
+		done, err := s.deferedTransformAndStore(s.withFlags(ctx, r, u), u, presets)
+		if err != nil {
+			log.Debugf(ctx, "failed to transform content: %s", err)
+			trace.record("transform", "error")
+			httpError(w, r, "Internal server error", 500)
+			return
+		}
+		trace.record("transform", "triggered("+strconv.Itoa(len(presets))+")")
+
+		if wait > 0 {
+			if s.waitForVariant(ctx, w, r, u, preset, done, wait) {
+				return
+			}
+			trace.record("wait", "timeout")
+		}
+	}
+
+	// If we have a stored copy of the original, serve that instead of
+	// hitting the origin
+	if _, ok := s.config.Presets[OriginalPreset]; ok && preset != OriginalPreset && s.allowedOriginalFallback(r) {
+		if content, err := s.backend.Get(ctx, u, OriginalPreset); err == nil {
+			log.Debugf(ctx, "Fallback to serving stored original content for %s", u)
+			trace.record("serve", "original")
+			content.ServeHTTP(w, r)
+			return
+		}
+	}
+
 	// Serve the original file, just so that we don't return an error
 	log.Debugf(ctx, "Fallback to serving original content at %s", u)
-	w.Header().Add("Location", u.String())
-	w.WriteHeader(http.StatusFound)
+	trace.record("serve", "origin")
+	s.originRedirect().To(u.String()).ServeHTTP(w, r)
 
 	return
 }
 
+// waitPollInterval is how often the backend is checked while waiting
+// for a variant that is generated elsewhere
+const waitPollInterval = 250 * time.Millisecond
+
+// waitDuration returns how long the client is willing to wait for a
+// missing variant to be generated, capped to Limits.MaxWait
+func (s *Server) waitDuration(r *http.Request) (time.Duration, error) {
+	v := r.FormValue("wait")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, errors.Errorf(`invalid wait '%s'`, v)
+	}
+	if d > s.config.Limits.MaxWait {
+		d = s.config.Limits.MaxWait
+	}
+	return d, nil
+}
+
+// waitForVariant waits up to d for the variant to be generated, and
+// serves it if it is. done is closed when the transformation is done,
+// or is nil if the backend has to be polled instead
+func (s *Server) waitForVariant(ctx context.Context, w http.ResponseWriter, r *http.Request, u *url.URL, preset string, done <-chan struct{}, d time.Duration) bool {
+	start := time.Now()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	var poll <-chan time.Time
+	if done == nil {
+		ticker := time.NewTicker(waitPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	tag := metrics.PresetTag(preset)
+	for {
+		select {
+		case <-done:
+			done = nil
+		case <-poll:
+		case <-timer.C:
+			log.Debugf(ctx, "Gave up waiting for %s (%s) after %s", u, preset, d)
+			metrics.Count("dispatcher.wait.timeout", 1, tag)
+			return false
+		case <-ctx.Done():
+			return false
+		}
+
+		content, err := s.backend.Get(ctx, u, preset)
+		if err == nil {
+			metrics.Timing("dispatcher.wait", time.Since(start), tag)
+			requestTrace(r).record("wait", "served")
+			content.ServeHTTP(w, r)
+			return true
+		}
+		if poll == nil {
+			// the transformation is done, but the variant is not there
+			return false
+		}
+	}
+}
+
 func (s *Server) markProcessing(ctx context.Context, u *url.URL) error {
 	cacheKey := urlcache.MakeCacheKey("processing", u.String())
 	return errors.Wrap(
@@ -225,52 +1136,260 @@ func (s *Server) unmarkProcessing(ctx context.Context, u *url.URL) error {
 // handleStore accepts POST requests to create resized images and
 // store them in the backend. This only exists so that you may perform
 // repairs for existing images: normally the GET method automatically
-// fetches and creates the resized images
+// fetches and creates the resized images. With dry-run=1, the images
+// are only created and described in the reply
 func (s *Server) handleStore(w http.ResponseWriter, r *http.Request) {
-	if !s.authorized(r) {
-		http.Error(w, `not authorized`, http.StatusForbidden)
+	if !s.guardianAccess.allowed(r) || !s.authorized(r) {
+		httpError(w, r, `not authorized`, http.StatusForbidden)
 		return
 	}
 
-	u, err := util.GetTargetURL(r)
+	if s.rejectReadOnly(w, r) {
+		return
+	}
+
+	u, err := s.getTargetURL(r)
 	if err != nil {
-		http.Error(w, `url parameter missing`, http.StatusBadRequest)
+		httpError(w, r, `url parameter missing`, http.StatusBadRequest)
 		return
 	}
 
-	ctx := util.RequestCtx(r)
-	if err := s.transformAndStore(ctx, u); err != nil {
+	// Specific presets may be requested, which is the only way to
+	// generate instances of preset templates, or a profile, which
+	// names a set of presets
+	names := r.Form["preset"]
+	if profile := r.FormValue("profile"); profile != "" {
+		pp, ok := s.config.Profiles[profile]
+		if !ok {
+			httpError(w, r, `profile '`+profile+`' is not defined`, http.StatusBadRequest)
+			return
+		}
+		names = append(append([]string(nil), names...), pp...)
+	}
+
+	presets := s.presetsFor(u)
+	if len(names) > 0 {
+		presets = make(map[string]string)
+		for _, preset := range names {
+			if err := s.checkRequest(u, preset); err != nil {
+				httpError(w, r, err.Error(), errorStatus(err))
+				return
+			}
+			presets[preset], _ = s.lookupPreset(preset)
+		}
+	}
+
+	if len(presets) == 0 {
+		httpError(w, r, `no presets may be applied to url`, http.StatusForbidden)
+		return
+	}
+
+	notBefore, err := parseNotBefore(r.FormValue("not_before"))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	delay := notBefore.Sub(time.Now())
+	if delay > s.config.Jobs.MaxDelay {
+		httpError(w, r, `not_before is too far in the future`, http.StatusBadRequest)
+		return
+	}
+
+	ctx := s.withFlags(util.RequestCtx(r), r, u)
+	if v := r.FormValue("parallelism"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			httpError(w, r, `invalid parallelism`, http.StatusBadRequest)
+			return
+		}
+		ctx = throttle.WithParallelism(ctx, n)
+	}
+	entry := accesslog.FromContext(ctx)
+	entry.SetSourceHost(u.Host)
+	entry.SetBackend(s.config.Backend.Type)
+
+	if dryRun, _ := strconv.ParseBool(r.FormValue("dry-run")); dryRun {
+		requestTrace(r).record("transform", "dry-run("+strconv.Itoa(len(presets))+")")
+		s.handleDryRun(ctx, w, u, presets)
+		return
+	}
+
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key != "" && s.replayIdempotent(ctx, w, r, key, u, presets) {
+		return
+	}
+
+	var status int
+	outcome := "stored"
+	if delay > 0 {
+		status, err = s.schedule(ctx, u, presets, notBefore)
+		outcome = "scheduled"
+	} else {
+		status, err = s.store(ctx, u, presets)
+	}
+	if err != nil {
+		outcome = "failed"
+	}
+	requestTrace(r).record("transform", outcome+"("+strconv.Itoa(len(presets))+")")
+	if key != "" {
+		s.recordIdempotent(ctx, key, u, presets, status, err)
+	}
+	if err != nil {
 		log.Debugf(ctx, "Error detected while processing: %s", err)
-		http.Error(w, err.Error(), 500)
+		httpError(w, r, err.Error(), status)
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	w.WriteHeader(status)
+}
+
+// store transforms and stores the variants for a guardian request, and
+// returns the status to reply with
+func (s *Server) store(ctx context.Context, u *url.URL, presets map[string]string) (int, error) {
+	// Scheduled requests may come due while in read-only mode
+	if s.readOnly.on() {
+		return http.StatusServiceUnavailable, errors.New(`server is in read-only mode`)
+	}
+
+	if over, wait := s.budget.exceeded(); over {
+		return http.StatusServiceUnavailable, errors.Errorf(`byte budget exceeded, retry in %s`, wait-wait%time.Second)
+	}
+
+	if err := s.hostLimiter.Wait(ctx, u.Host); err != nil {
+		return http.StatusServiceUnavailable, errors.New(`request canceled while rate limited`)
+	}
+
+	release, err := s.throttle.Batch(ctx)
+	if err != nil {
+		return http.StatusServiceUnavailable, errors.New(`request canceled while throttled`)
+	}
+	defer release()
+
+	start := time.Now()
+	err = s.transformAndStore(ctx, u, presets)
+	accesslog.FromContext(ctx).SetTransformTime(time.Since(start))
+	if err != nil {
+		return errorStatus(err), err
+	}
+	return http.StatusNoContent, nil
+}
+
+// schedule arranges for the variants for a guardian request to be
+// generated at the given time, and returns the status to reply with
+func (s *Server) schedule(ctx context.Context, u *url.URL, presets map[string]string, at time.Time) (int, error) {
+	if err := s.scheduleStore(ctx, u, presets, at); err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, `failed to schedule transformation`)
+	}
+	log.Debugf(ctx, "Scheduled transformation of %s at %s", u, at.Format(time.RFC3339))
+	metrics.Count("guardian.scheduled", 1)
+	return http.StatusAccepted, nil
+}
+
+// parseNotBefore parses the not_before parameter of guardian requests,
+// which is either a unix timestamp or an RFC3339 time. An empty string
+// yields the zero time
+func parseNotBefore(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, errors.Errorf(`invalid not_before '%s'`, v)
+	}
+	return t, nil
 }
 
-func (s *Server) transformAndStore(ctx context.Context, u *url.URL) error {
+func (s *Server) transformAndStore(ctx context.Context, u *url.URL, presets map[string]string) error {
 	// Don't process the same url while somebody else is processing it
 	if err := s.markProcessing(ctx, u); err != nil {
 		return errors.Wrap(err, `failed to mark processing flag`)
 	}
 	defer s.unmarkProcessing(ctx, u)
 
-	if err := s.backend.StoreTransformedContent(ctx, u); err != nil {
+	// Instances are recorded before they are stored, so that none of
+	// them is missed by DELETE
+	if err := s.recordInstances(ctx, u, presets); err != nil {
+		return err
+	}
+
+	presets = s.applyFlags(ctx, presets)
+	j := s.jobs.start(u, presets)
+	defer s.jobs.finish(j)
+
+	start := time.Now()
+	ctx, results := s.observeVariants(ctx)
+	if err := s.storeTransformedContent(ctx, u, presets); err != nil {
+		if IsError(err, ErrSourceNotFound) {
+			// Not our problem, so don't report it as an error
+			s.recordNotFound(ctx, u)
+			return errors.Wrap(err, `failed to process content`)
+		}
+		metrics.Count("transform.errors", 1, flags.Tags(ctx)...)
+		s.reportError(ctx, &errreport.Event{
+			Kind:  errreport.KindTransform,
+			Err:   err,
+			Extra: map[string]string{"url": u.String()},
+		})
+		if !IsError(err, ErrTransformFailed) {
+			err = errors.WithKind(ErrStorage, err)
+		}
 		return errors.Wrap(err, `failed to process content`)
 	}
+	elapsed := time.Since(start)
+	metrics.Timing("transform.duration", elapsed, flags.Tags(ctx)...)
+
+	// The source may have been restored since we last failed
+	s.forgetNotFound(ctx, u)
+	s.indexVariants(ctx, u, presets)
+	s.indexDuplicate(ctx, u, results)
+	s.publishTransformed(ctx, u, presets, results, elapsed)
 	return nil
 }
 
+// storeTransformedContent stores the variants for presets. If only some
+// of them fail, the variants that were stored are kept, and the failed
+// presets are tried once more
+func (s *Server) storeTransformedContent(ctx context.Context, u *url.URL, presets map[string]string) error {
+	if throttle.Parallelism(ctx) == 0 {
+		ctx = throttle.WithParallelism(ctx, s.config.Jobs.Parallelism)
+	}
+
+	err := s.backend.StoreTransformedContent(ctx, u, presets)
+	for preset := range presets {
+		s.stale.delete(preset, u.String())
+		s.forgetVersion(ctx, u, preset)
+	}
+	failed, ok := FailedPresets(err)
+	if !ok || len(failed) >= len(presets) {
+		return err
+	}
+
+	retry := make(map[string]string, len(failed))
+	for preset := range failed {
+		retry[preset] = presets[preset]
+	}
+	log.Debugf(ctx, "Stored %d of %d presets for %s, retrying the rest: %s", len(presets)-len(failed), len(presets), u, err)
+	metrics.Count("transform.retries", int64(len(retry)), flags.Tags(ctx)...)
+	return s.backend.StoreTransformedContent(ctx, u, retry)
+}
+
 // handleDelete accepts DELETE requests to delete all known resized images
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
-	if !s.authorized(r) {
-		http.Error(w, `not authorized`, http.StatusForbidden)
+	if !s.guardianAccess.allowed(r) || !s.authorized(r) {
+		httpError(w, r, `not authorized`, http.StatusForbidden)
 		return
 	}
 
-	u, err := util.GetTargetURL(r)
+	if s.rejectReadOnly(w, r) {
+		return
+	}
+
+	u, err := s.getTargetURL(r)
 	if err != nil {
-		http.Error(w, `url parameter missing`, http.StatusBadRequest)
+		httpError(w, r, `url parameter missing`, http.StatusBadRequest)
 		return
 	}
 
@@ -278,20 +1397,129 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 
 	// Don't process the same url while somebody else is processing it
 	if err := s.markProcessing(ctx, u); err != nil {
-		http.Error(w, "url is being processed", 500)
+		httpError(w, r, "url is being processed", 500)
 		return
 	}
 	defer s.unmarkProcessing(ctx, u)
 
-	if err := s.backend.Delete(ctx, u); err != nil {
+	presets, err := s.presetsToDelete(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	variants, err := s.deleteVariants(ctx, u, presets)
+	elapsed := time.Since(start)
+	entry := auditEntry{Action: "delete", URL: u.String(), Presets: presets}
+	if presets == nil {
+		entry.Presets = []string{"*"}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	s.audit(ctx, r, &entry)
+
+	for _, variant := range variants {
+		s.stale.delete(variant, u.String())
+		s.forgetVersion(ctx, u, variant)
+	}
+
+	if err != nil {
+		err = errors.WithKind(ErrStorage, err)
+		s.reportError(ctx, &errreport.Event{
+			Kind:    errreport.KindStorage,
+			Err:     err,
+			Request: r,
+			Extra:   map[string]string{"url": u.String()},
+		})
 		log.Debugf(ctx, "Error detected while processing: %s", err)
-		http.Error(w, err.Error(), 500)
+		httpError(w, r, err.Error(), 500)
 		return
 	}
+	s.publishDeleted(ctx, u, variants, elapsed)
 
 	// w.Header().Add("X-Sharaq-Elapsed-Time", fmt.Sprintf("%0.2f", time.Since(start).Seconds()))
 }
 
+// presetsToDelete returns the presets whose variants are removed by
+// handleDelete. The copy stored by the "original" preset is kept, unless
+// the original=true parameter is given. A nil list means all presets
+func (s *Server) presetsToDelete(r *http.Request) ([]string, error) {
+	var original bool
+	if v := r.FormValue("original"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.Errorf(`invalid value for original: %s`, v)
+		}
+		original = b
+	}
+
+	if _, ok := s.config.Presets[OriginalPreset]; !ok || original {
+		return nil, nil
+	}
+
+	presets := make([]string, 0, len(s.config.Presets))
+	for preset := range s.config.Presets {
+		if preset != OriginalPreset {
+			presets = append(presets, preset)
+		}
+	}
+	sort.Strings(presets)
+	return presets, nil
+}
+
+// deleteVariants deletes the variants of u for presets, and the
+// instances of preset templates that were generated for u. A nil list
+// means all presets. It returns the names of the variants that were
+// deleted
+func (s *Server) deleteVariants(ctx context.Context, u *url.URL, presets []string) ([]string, error) {
+	variants := s.variantsToDelete(presets)
+	instances, err := s.templateInstances(ctx, u)
+	if err != nil {
+		return variants, err
+	}
+	variants = append(variants, instances...)
+	if err := s.backend.Delete(ctx, u, variants); err != nil {
+		return variants, err
+	}
+
+	// Only forget about the instances once they are gone
+	if len(instances) > 0 {
+		if err := s.backend.Delete(ctx, u, []string{templateInstancesPreset}); err != nil {
+			return variants, err
+		}
+	}
+	return variants, nil
+}
+
+// Delete deletes all variants of u, including the instances of preset
+// templates
+func (s *Server) Delete(ctx context.Context, u *url.URL) error {
+	_, err := s.deleteVariants(ctx, u, nil)
+	return err
+}
+
+// variantsToDelete returns the names of the variants that are removed
+// for presets: the presets themselves, and their variants with text
+// overlays. A nil list means all presets
+func (s *Server) variantsToDelete(presets []string) []string {
+	if presets == nil {
+		presets = make([]string, 0, len(s.config.Presets))
+		for preset := range s.config.Presets {
+			presets = append(presets, preset)
+		}
+		sort.Strings(presets)
+	}
+
+	variants := make([]string, 0, len(presets))
+	for _, preset := range presets {
+		variants = append(variants, preset)
+		variants = append(variants, s.textVariants(preset)...)
+	}
+	return variants
+}
+
 func (s *Server) authorized(r *http.Request) bool {
 	if r.Header.Get("X-Appengine-Taskname") != "" {
 		// Trust inbound taskqueue requests
@@ -3,9 +3,17 @@
 package sharaq
 
 import (
+	"io"
+	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/lestrrat-go/sharaq/internal/flags"
+	"github.com/lestrrat-go/sharaq/internal/requestid"
+	"github.com/lestrrat-go/sharaq/internal/throttle"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/taskqueue"
@@ -13,13 +21,82 @@ import (
 
 var queueName = os.Getenv("SHARAQ_QUEUE_NAME")
 
+// handleDebug is not available on appengine, where profiling data is
+// collected by the platform
+func (s *Server) handleDebug(w http.ResponseWriter, r *http.Request) {
+	httpError(w, r, "Not Found", http.StatusNotFound)
+}
+
+// The aws backend relies on net/http's default client (via goamz), which
+// can not make outbound requests under appengine
+func validateBackendType(t string) error {
+	if t == "aws" {
+		return errors.New(`backend type "aws" is not available on appengine: use "gcp" instead`)
+	}
+	return nil
+}
+
+// Audit entries go to the appengine log
+func openAuditLog(_ *AuditConfig) (io.Writer, error) {
+	return nil, nil
+}
+
 // Under appengine, we MUST use a task queue to offload this
-func (s *Server) deferedTransformAndStore(ctx context.Context, u *url.URL) error {
-	task := taskqueue.NewPOSTTask("/", url.Values{
+//
+// As the task is processed elsewhere, there is no way to tell when it
+// is done, so the returned channel is nil
+func (s *Server) deferedTransformAndStore(ctx context.Context, u *url.URL, presets map[string]string) (<-chan struct{}, error) {
+	return nil, s.addStoreTask(ctx, u, presets, time.Time{})
+}
+
+// scheduleStore adds a task that is not run before the given time
+func (s *Server) scheduleStore(ctx context.Context, u *url.URL, presets map[string]string, at time.Time) error {
+	return s.addStoreTask(ctx, u, presets, at)
+}
+
+// addStoreTask adds a task that generates the variants. If eta is
+// non-zero, the task is not run before then
+func (s *Server) addStoreTask(ctx context.Context, u *url.URL, presets map[string]string, eta time.Time) error {
+	v := url.Values{
 		"url": []string{u.String()},
-	})
+	}
+	for preset := range presets {
+		v.Add("preset", preset)
+	}
+	if n := throttle.Parallelism(ctx); n > 0 {
+		v.Set("parallelism", strconv.Itoa(n))
+	}
+	task := taskqueue.NewPOSTTask("/", v)
+	task.ETA = eta
+	if id := requestid.Get(ctx); id != "" {
+		// Carry the request ID over, so the task can be correlated
+		// with the request that triggered it
+		task.Header.Set(requestid.HeaderName, id)
+	}
+	if len(s.config.Flags) > 0 {
+		// The task recomputes the flags, so pass the decisions made
+		// here, which may have been forced by the request
+		task.Header.Set(flagsHeader, taskFlags(ctx, s.config.Flags))
+	}
 	if _, err := taskqueue.Add(ctx, task, queueName); err != nil {
 		return errors.Wrap(err, `failed to add task to queue`)
 	}
 	return nil
 }
+
+// taskFlags lists all flags, with those not enabled in ctx disabled
+func taskFlags(ctx context.Context, all map[string]FlagConfig) string {
+	enabled := make(map[string]bool)
+	for _, name := range flags.Get(ctx) {
+		enabled[name] = true
+	}
+
+	list := make([]string, 0, len(all))
+	for name := range all {
+		if !enabled[name] {
+			name = "-" + name
+		}
+		list = append(list, name)
+	}
+	return strings.Join(list, ",")
+}
@@ -3,20 +3,27 @@
 package sharaq
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"net/url"
 	"os"
 	"os/signal"
-	"syscall"
 	"time"
 
 	apachelog "github.com/lestrrat-go/apache-logformat"
 	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
 	"github.com/lestrrat-go/server-starter/listener"
+	"github.com/lestrrat-go/sharaq/internal/accesslog"
+	"github.com/lestrrat-go/sharaq/internal/flags"
 	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/requestid"
+	"github.com/lestrrat-go/sharaq/internal/throttle"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
@@ -27,7 +34,7 @@ func (s *Server) Run(ctx context.Context) error {
 
 	log.Debugf(ctx, "Starting server %d", os.Getpid())
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	signal.Notify(sigCh, notifySignals...)
 	defer signal.Stop(sigCh)
 
 	termLoopCh := make(chan struct{}, 1) // we keep restarting as long as there are no messages on this channel
@@ -54,10 +61,29 @@ func (s *Server) loopOnce(ctx context.Context, termLoopCh chan struct{}, sigCh c
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	if d := s.dynamic; d != nil {
+		if d.currentIndex() == 0 {
+			s.loadDynamic(ctx)
+		}
+		if err := d.apply(s.config); err != nil {
+			log.Debugf(ctx, "Ignoring dynamic settings: %s", err)
+		}
+	}
+
 	if err := s.Initialize(); err != nil {
 		return errors.Wrap(err, `initilization failed`)
 	}
 
+	if s.health != nil {
+		go s.health.run(ctx)
+	}
+	if wc := s.config.Watch; wc != nil && s.config.filename != "" {
+		go s.watchConfig(ctx, s.config, wc.Interval)
+	}
+	if s.dynamic != nil {
+		go s.watchDynamic(ctx, s.config.Dynamic.Interval)
+	}
+
 	done := make(chan error)
 	go s.serve(ctx, done)
 
@@ -66,19 +92,14 @@ func (s *Server) loopOnce(ctx context.Context, termLoopCh chan struct{}, sigCh c
 		return err
 	case <-ctx.Done():
 		return errors.New(`context canceled`)
+	case <-s.reloadCh:
+		s.reloadConfig(ctx)
+		// cancel so we can bail out
+		cancel()
 	case sig := <-sigCh:
 		switch sig {
-		case syscall.SIGHUP:
-			log.Debugf(ctx, "Reload request received. Shutting down for reload...")
-			newConfig := &Config{}
-			if err := newConfig.ParseFile(s.config.filename); err != nil {
-				log.Debugf(ctx, "Failed to reload config file %s: %s", s.config.filename, err)
-			} else {
-				s.config = newConfig
-				if s.config.Debug {
-					s.dumpConfig()
-				}
-			}
+		case reloadSignal:
+			s.reloadConfig(ctx)
 			// cancel so we can bail out
 			cancel()
 		default:
@@ -91,6 +112,86 @@ func (s *Server) loopOnce(ctx context.Context, termLoopCh chan struct{}, sigCh c
 	return nil
 }
 
+// Reload makes a running server reload its config file, as if it had
+// received SIGHUP. This is how reloads are requested on platforms
+// without SIGHUP, such as Windows
+func (s *Server) Reload() {
+	select {
+	case s.reloadCh <- struct{}{}:
+	default:
+		// a reload is already pending
+	}
+}
+
+// watchConfig checks the config files of c every interval, and reloads
+// them once they have changed
+func (s *Server) watchConfig(ctx context.Context, c *Config, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if s.configChanged(ctx, c) {
+			log.Debugf(ctx, "Config file %s has changed", c.filename)
+			s.Reload()
+			return
+		}
+	}
+}
+
+// watchDynamic waits for the settings in the key/value store to change,
+// and reloads the config once they have
+func (s *Server) watchDynamic(ctx context.Context, interval time.Duration) {
+	d := s.dynamic
+	for {
+		index := d.currentIndex()
+		raw, newIndex, err := d.source.Get(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			changed, err := d.update(raw, newIndex, s.config)
+			if err != nil {
+				log.Debugf(ctx, "Ignoring dynamic settings: %s", err)
+			}
+			if changed {
+				log.Debugf(ctx, "Dynamic settings have changed")
+				s.Reload()
+				return
+			}
+			if newIndex != index {
+				continue
+			}
+		} else {
+			log.Debugf(ctx, "Failed to read dynamic settings: %s", err)
+		}
+
+		// the store failed, or does not block until the key changes
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (s *Server) reloadConfig(ctx context.Context) {
+	log.Debugf(ctx, "Reload request received. Shutting down for reload...")
+	newConfig := &Config{}
+	if err := newConfig.ParseFileEnv(s.config.filename, s.config.environment); err != nil {
+		log.Debugf(ctx, "Failed to reload config file %s: %s", s.config.filename, err)
+		return
+	}
+	s.config = newConfig
+	if s.config.Debug {
+		s.dumpConfig()
+	}
+}
+
 // start_server support utility
 func makeListener(listenAddr string) (net.Listener, error) {
 	var ln net.Listener
@@ -155,60 +256,208 @@ func (s *Server) serve(ctx context.Context, done chan error) {
 	defer close(done)
 
 	var output io.Writer = os.Stdout
-	if dl := s.logConfig; dl != nil {
-		var options []rotatelogs.Option
-		if loc := dl.Location; loc != "" {
-			// TODO: Properly report errors
-			l, err := time.LoadLocation(loc)
-			if err == nil {
-				options = append(options, rotatelogs.WithLocation(l))
-			}
+	var logFormat string
+	if dl := s.config.AccessLog; dl != nil {
+		logFormat = dl.Format
+		var err error
+		output, err = newRotateLogs(dl)
+		if err != nil {
+			log.Debugf(ctx, "Dispatcher log setup failed: %s", err)
+			done <- errors.Wrap(err, `log setup failed`)
+			return
 		}
-		if name := dl.LinkName; name != "" {
-			options = append(options, rotatelogs.WithLinkName(name))
+		log.Debugf(ctx, "Dispatcher logging to %s", dl.LogFile)
+	}
+
+	withLog := func(h http.Handler) http.Handler {
+		switch logFormat {
+		case accesslog.FormatCombinedExtras, accesslog.FormatJSON:
+			return accesslog.Wrap(h, output, logFormat)
+		default:
+			return apachelog.CombinedLog.Wrap(h, output)
 		}
+	}
 
-		if age := dl.MaxAge; age > 0 {
-			options = append(options, rotatelogs.WithMaxAge(age))
+	lcs := s.config.listeners()
+	lns := make([]net.Listener, 0, len(lcs))
+	defer func() {
+		for _, ln := range lns {
+			ln.Close()
 		}
+	}()
 
-		if rt := dl.RotationTime; rt > 0 {
-			options = append(options, rotatelogs.WithRotationTime(rt))
+	for i := range lcs {
+		lc := &lcs[i]
+		lh, err := newListenerHandler(lc, s)
+		if err != nil {
+			done <- err
+			return
 		}
 
-		var err error
-		output, err = rotatelogs.New(dl.LogFile, options...)
+		ln, err := makeListener(lc.Addr)
 		if err != nil {
-			log.Debugf(ctx, "Dispatcher log setup failed: %s", err)
-			done <- errors.Wrap(err, `log setup failed`)
+			log.Debugf(ctx, "Error binding to listen address: %s", err)
+			done <- errors.Wrap(err, `binding to listen address failed`)
 			return
 		}
-		log.Debugf(ctx, "Dispatcher logging to %s", dl.LogFile)
-	}
-	srv := &http.Server{
-		Addr:    s.config.Listen,
-		Handler: apachelog.CombinedLog.Wrap(s, output),
+		lns = append(lns, ln)
+
+		handler := withLog(lh)
+		var srvln net.Listener = tcpKeepAliveListener{ln.(*net.TCPListener)}
+		if tc := lc.TLS; tc != nil {
+			tlsConfig, err := newTLSConfig(tc)
+			if err != nil {
+				log.Debugf(ctx, "Error setting up TLS: %s", err)
+				done <- errors.Wrap(err, `TLS setup failed`)
+				return
+			}
+			srvln = tls.NewListener(srvln, tlsConfig)
+
+			if tc.HTTP3 {
+				handler, err = serveHTTP3(ctx, lc.Addr, tlsConfig, handler)
+				if err != nil {
+					log.Debugf(ctx, "Error setting up HTTP/3: %s", err)
+					done <- errors.Wrap(err, `HTTP/3 setup failed`)
+					return
+				}
+				log.Debugf(ctx, "Serving HTTP/3 on %s", lc.Addr)
+			}
+		}
+
+		srv := &http.Server{
+			Addr:    lc.Addr,
+			Handler: handler,
+		}
+		log.Debugf(ctx, "Listening on %s (roles: %v)", lc.Addr, lc.Roles)
+		go srv.Serve(srvln)
 	}
 
-	ln, err := makeListener(s.config.Listen)
+	<-ctx.Done()
+}
+
+// newTLSConfig creates the TLS configuration for the listener. If a
+// client CA is specified, client certificates are verified when
+// presented, but not required at the TLS level: whether a certificate
+// is required is decided per endpoint (see AccessConfig)
+func newTLSConfig(c *TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
 	if err != nil {
-		log.Debugf(ctx, "Error binding to listen address: %s", err)
-		done <- errors.Wrap(err, `binding to listen address failed`)
-		return
+		return nil, errors.Wrap(err, `failed to load certificate`)
 	}
 
-	defer ln.Close()
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
 
-	log.Debugf(ctx, "Dispatcher listening on %s", s.config.Listen)
-	go srv.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to read client CA file`)
+		}
 
-	select {
-	case <-ctx.Done():
-		ln.Close()
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf(`no certificates found in %s`, c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 	}
+	return tlsConfig, nil
 }
 
-func (s *Server) deferedTransformAndStore(ctx context.Context, u *url.URL) error {
-	go s.transformAndStore(ctx, u)
+// handleDebug serves the runtime profiling data. net/http/pprof is
+// only imported here, as importing it registers its handlers with
+// http.DefaultServeMux, which is what serves requests on appengine
+func (s *Server) handleDebug(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/debug/pprof/cmdline":
+		pprof.Cmdline(w, r)
+	case "/debug/pprof/profile":
+		pprof.Profile(w, r)
+	case "/debug/pprof/symbol":
+		pprof.Symbol(w, r)
+	case "/debug/pprof/trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+}
+
+func validateBackendType(_ string) error {
 	return nil
 }
+
+// deferedTransformAndStore transforms in the background. Misses for a
+// url that is already being transformed share the same transformation.
+// The returned channel is closed when it is done
+func (s *Server) deferedTransformAndStore(ctx context.Context, u *url.URL, presets map[string]string) (<-chan struct{}, error) {
+	// ctx is done as soon as the response is sent, so the work cannot
+	// be tied to it
+	bg := detachContext(ctx)
+	ch := s.inflight.DoChan(u.String(), func() (interface{}, error) {
+		defer s.recoverBackground(bg, u)
+		release, _ := s.throttle.Interactive(bg)
+		defer release()
+		return nil, s.transformAndStore(bg, u, presets)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		<-ch
+		close(done)
+	}()
+	return done, nil
+}
+
+// detachContext returns a context for work that outlives the request of
+// ctx. It keeps what identifies the request, but not its cancellation
+func detachContext(ctx context.Context) context.Context {
+	bg := flags.With(requestid.With(context.Background(), requestid.Get(ctx)), flags.Get(ctx))
+	return throttle.WithParallelism(bg, throttle.Parallelism(ctx))
+}
+
+// scheduleStore generates the variants at the given time. Scheduled
+// transformations are kept in memory, and are lost when the process exits
+func (s *Server) scheduleStore(ctx context.Context, u *url.URL, presets map[string]string, at time.Time) error {
+	bg := detachContext(ctx)
+	time.AfterFunc(at.Sub(time.Now()), func() {
+		defer s.recoverBackground(bg, u)
+		if _, err := s.store(bg, u, presets); err != nil {
+			log.Debugf(bg, "Scheduled transformation of %s failed: %s", u, err)
+		}
+	})
+	return nil
+}
+
+func newRotateLogs(dl *LogConfig) (*rotatelogs.RotateLogs, error) {
+	var options []rotatelogs.Option
+	if loc := dl.Location; loc != "" {
+		// TODO: Properly report errors
+		l, err := time.LoadLocation(loc)
+		if err == nil {
+			options = append(options, rotatelogs.WithLocation(l))
+		}
+	}
+	if name := dl.LinkName; name != "" {
+		options = append(options, rotatelogs.WithLinkName(name))
+	}
+
+	if age := dl.MaxAge; age > 0 {
+		options = append(options, rotatelogs.WithMaxAge(age))
+	}
+
+	if rt := dl.RotationTime; rt > 0 {
+		options = append(options, rotatelogs.WithRotationTime(rt))
+	}
+
+	return rotatelogs.New(dl.LogFile, options...)
+}
+
+func openAuditLog(ac *AuditConfig) (io.Writer, error) {
+	if ac == nil || ac.File == "" {
+		return nil, nil
+	}
+	// O_APPEND makes each entry a single append, even if the file is
+	// shared by several processes
+	return os.OpenFile(ac.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
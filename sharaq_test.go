@@ -3,14 +3,40 @@
 package sharaq
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"image"
+	"image/png"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/lestrrat-go/sharaq/errreport"
+	"github.com/lestrrat-go/sharaq/events"
+	"github.com/lestrrat-go/sharaq/fs"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/flags"
+	"github.com/lestrrat-go/sharaq/internal/httputil"
+	"github.com/lestrrat-go/sharaq/internal/kvconfig"
+	"github.com/lestrrat-go/sharaq/internal/phash"
+	"github.com/lestrrat-go/sharaq/internal/throttle"
+	"github.com/lestrrat-go/sharaq/internal/transformer"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/metadata"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 func newImageSource() *httptest.Server {
@@ -144,3 +170,3787 @@ func TestDelete(t *testing.T) {
 		return
 	}
 }
+
+type panicBackend struct{}
+
+func (panicBackend) Get(context.Context, *url.URL, string) (http.Handler, error) {
+	panic("boom")
+}
+func (panicBackend) StoreTransformedContent(context.Context, *url.URL, map[string]string) error {
+	return nil
+}
+func (panicBackend) Delete(context.Context, *url.URL, []string) error { return nil }
+
+func TestPanicRecovery(t *testing.T) {
+	s, st, err := newSharaq(nil)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	s.backend = panicBackend{}
+	var reported []*errreport.Event
+	s.SetErrorReporter(errreport.ReporterFunc(func(_ context.Context, ev *errreport.Event) {
+		reported = append(reported, ev)
+	}))
+
+	res, err := http.Get(st.URL + "/?url=http://example.com/foo.jpg&preset=small")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+
+	if !assert.Equal(t, http.StatusInternalServerError, res.StatusCode, "status code should be 500") {
+		return
+	}
+
+	if !assert.Len(t, reported, 1, "panic should be reported") {
+		return
+	}
+	assert.Equal(t, errreport.KindPanic, reported[0].Kind, "kind should be panic")
+}
+
+// flakyBackend fails to store the preset named "large" the given
+// number of times
+type flakyBackend struct {
+	mu          sync.Mutex
+	calls       []map[string]string
+	failures    int
+	parallelism int // of the last call
+}
+
+func (b *flakyBackend) Get(context.Context, *url.URL, string) (http.Handler, error) {
+	return nil, errors.TransformationRequiredError{}
+}
+func (b *flakyBackend) StoreTransformedContent(ctx context.Context, _ *url.URL, presets map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, presets)
+	b.parallelism = throttle.Parallelism(ctx)
+
+	var grp errors.PresetGroup
+	grp.SetLimit(b.parallelism)
+	for preset := range presets {
+		fail := preset == "large" && b.failures > 0
+		grp.Go(preset, func() error {
+			if fail {
+				return errors.New(`storage is flaky`)
+			}
+			return nil
+		})
+	}
+	if _, ok := presets["large"]; ok && b.failures > 0 {
+		b.failures--
+	}
+	return grp.Wait()
+}
+func (b *flakyBackend) Delete(context.Context, *url.URL, []string) error { return nil }
+
+func (b *flakyBackend) numCalls() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.calls)
+}
+
+func TestPartialStore(t *testing.T) {
+	presets := map[string]string{"small": "200x200", "medium": "400x400", "large": "800x800"}
+	u, _ := url.Parse("http://example.com/foo.jpg")
+	ctx := context.Background()
+
+	newServer := func(b Backend) (*Server, error) {
+		c := Config{
+			Presets:  presets,
+			URLCache: &urlcache.Config{Type: "Memory"},
+		}
+		s, err := NewServer(&c, WithBackend(b))
+		if err != nil {
+			return nil, err
+		}
+		return s, s.Initialize()
+	}
+
+	t.Run("retry succeeds", func(t *testing.T) {
+		b := &flakyBackend{failures: 1}
+		s, err := newServer(b)
+		if !assert.NoError(t, err, "creating sharaq server should succeed") {
+			return
+		}
+
+		if !assert.NoError(t, s.transformAndStore(ctx, u, presets), "transformAndStore should succeed") {
+			return
+		}
+		if !assert.Len(t, b.calls, 2, "backend should be called twice") {
+			return
+		}
+		assert.Equal(t, map[string]string{"large": "800x800"}, b.calls[1], "only the failed preset should be retried")
+	})
+	t.Run("retry fails", func(t *testing.T) {
+		s, err := newServer(&flakyBackend{failures: 2})
+		if !assert.NoError(t, err, "creating sharaq server should succeed") {
+			return
+		}
+
+		err = s.transformAndStore(ctx, u, presets)
+		if !assert.Error(t, err, "transformAndStore should fail") {
+			return
+		}
+		if !assert.True(t, IsError(err, ErrStorage), "error should be a storage error") {
+			return
+		}
+		failed, ok := FailedPresets(err)
+		if !assert.True(t, ok, "failed presets should be reported") {
+			return
+		}
+		if !assert.Len(t, failed, 1, "one preset should fail") {
+			return
+		}
+		assert.Contains(t, failed, "large", "large should fail")
+	})
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	c := Config{
+		Presets:  map[string]string{"large": "800x800"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	b := &flakyBackend{failures: 1}
+	s, err := NewServer(&c, WithBackend(b))
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	st := httptest.NewServer(s)
+	defer st.Close()
+
+	post := func(source string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodPost, st.URL+"/?"+url.Values{"url": {source}}.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		req.Header.Set(IdempotencyKeyHeader, "job-1")
+		return http.DefaultClient.Do(req)
+	}
+
+	// server errors are not replayed, so that retries get another chance
+	expected := []struct {
+		status   int
+		replayed string
+	}{
+		{http.StatusInternalServerError, ""},
+		{http.StatusNoContent, ""},
+		{http.StatusNoContent, "true"},
+	}
+	for i, e := range expected {
+		res, err := post("http://example.com/foo.jpg")
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return
+		}
+		if !assert.Equal(t, e.status, res.StatusCode, "status code should match (attempt %d)", i) {
+			return
+		}
+		if !assert.Equal(t, e.replayed, res.Header.Get(IdempotencyReplayedHeader), "replay header should match (attempt %d)", i) {
+			return
+		}
+	}
+	if !assert.Len(t, b.calls, 2, "replayed requests should not be processed") {
+		return
+	}
+
+	res, err := post("http://example.com/bar.jpg")
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode, "reusing a key for another url should be rejected")
+}
+
+func TestNotBefore(t *testing.T) {
+	c := Config{
+		Presets:  map[string]string{"small": "200x200"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	b := &flakyBackend{}
+	s, err := NewServer(&c, WithBackend(b))
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	st := httptest.NewServer(s)
+	defer st.Close()
+
+	post := func(notBefore string) (*http.Response, error) {
+		v := url.Values{"url": {"http://example.com/foo.jpg"}, "not_before": {notBefore}}
+		req, err := http.NewRequest(http.MethodPost, st.URL+"/?"+v.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		return http.DefaultClient.Do(req)
+	}
+
+	for _, notBefore := range []string{"tomorrow", time.Now().Add(48 * time.Hour).Format(time.RFC3339)} {
+		res, err := post(notBefore)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return
+		}
+		if !assert.Equal(t, http.StatusBadRequest, res.StatusCode, "not_before %s should be rejected", notBefore) {
+			return
+		}
+	}
+
+	res, err := post(strconv.FormatInt(time.Now().Add(2*time.Second).Unix(), 10))
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusAccepted, res.StatusCode, "request should be scheduled") {
+		return
+	}
+	if !assert.Equal(t, 0, b.numCalls(), "transformation should be delayed") {
+		return
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b.numCalls() == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, 1, b.numCalls(), "transformation should run once not_before has passed")
+}
+
+func TestParallelism(t *testing.T) {
+	c := Config{
+		Presets:  map[string]string{"small": "200x200", "large": "800x800"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+		Jobs:     JobsConfig{Parallelism: 2},
+	}
+	b := &flakyBackend{}
+	s, err := NewServer(&c, WithBackend(b))
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	st := httptest.NewServer(s)
+	defer st.Close()
+
+	post := func(parallelism string) (*http.Response, error) {
+		v := url.Values{"url": {"http://example.com/foo.jpg"}}
+		if parallelism != "" {
+			v.Set("parallelism", parallelism)
+		}
+		req, err := http.NewRequest(http.MethodPost, st.URL+"/?"+v.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		return http.DefaultClient.Do(req)
+	}
+
+	for _, parallelism := range []string{"0", "-1", "many"} {
+		res, err := post(parallelism)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return
+		}
+		if !assert.Equal(t, http.StatusBadRequest, res.StatusCode, "parallelism %s should be rejected", parallelism) {
+			return
+		}
+	}
+
+	for _, tc := range []struct {
+		parallelism string
+		expected    int
+	}{{"", 2}, {"1", 1}} {
+		res, err := post(tc.parallelism)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return
+		}
+		if !assert.Equal(t, http.StatusNoContent, res.StatusCode, "request should succeed") {
+			return
+		}
+		b.mu.Lock()
+		parallelism := b.parallelism
+		b.mu.Unlock()
+		if !assert.Equal(t, tc.expected, parallelism, "parallelism '%s' should apply", tc.parallelism) {
+			return
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	c := Config{
+		Presets:  map[string]string{"pc-thumb": "200x200", "sp-thumb": "100x100", "email-thumb": "80x80"},
+		Profiles: map[string][]string{"email": {"email-thumb"}, "broken": {"huge"}},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	_, err := NewServer(&c)
+	if !assert.Error(t, err, "profiles with unknown presets should be rejected") {
+		return
+	}
+
+	delete(c.Profiles, "broken")
+	b := &flakyBackend{}
+	s, err := NewServer(&c, WithBackend(b))
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	st := httptest.NewServer(s)
+	defer st.Close()
+
+	post := func(profile string) (*http.Response, error) {
+		v := url.Values{"url": {"http://example.com/foo.jpg"}, "profile": {profile}}
+		req, err := http.NewRequest(http.MethodPost, st.URL+"/?"+v.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		return http.DefaultClient.Do(req)
+	}
+
+	res, err := post("web")
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusBadRequest, res.StatusCode, "unknown profiles should be rejected") {
+		return
+	}
+
+	res, err = post("email")
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusNoContent, res.StatusCode, "request should succeed") {
+		return
+	}
+	if !assert.Equal(t, []map[string]string{{"email-thumb": "80x80"}}, b.calls, "only the presets of the profile should be generated") {
+		return
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	c := Config{
+		Presets:  map[string]string{"small": "200x200"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+		Middleware: map[string][]MiddlewareConfig{
+			RoleGuardian: {{Type: "unknown"}},
+		},
+	}
+	_, err := NewServer(&c)
+	if !assert.Error(t, err, "unknown middleware should be rejected") {
+		return
+	}
+
+	c.Middleware[RoleGuardian] = []MiddlewareConfig{{Type: MiddlewareBasicAuth, Users: map[string]string{"jobs": "s3cr3t"}}}
+	custom := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Custom", "1")
+			next.ServeHTTP(w, r)
+		})
+	}
+	s, err := NewServer(&c, WithBackend(&flakyBackend{}), WithMiddleware(RoleDispatch, custom))
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	v := url.Values{"url": {"http://example.com/foo.jpg"}, "preset": {"small"}}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?"+v.Encode(), nil))
+	if !assert.Equal(t, "1", w.Header().Get("X-Custom"), "dispatch middleware should run") {
+		return
+	}
+
+	for _, tc := range []struct {
+		user     string
+		password string
+		status   int
+	}{{"", "", http.StatusUnauthorized}, {"jobs", "wrong", http.StatusUnauthorized}, {"jobs", "s3cr3t", http.StatusNoContent}} {
+		req := httptest.NewRequest(http.MethodPost, "/?"+v.Encode(), nil)
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.password)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if !assert.Equal(t, tc.status, w.Code, "guardian request as '%s' should get %d", tc.user, tc.status) {
+			return
+		}
+		if !assert.Empty(t, w.Header().Get("X-Custom"), "dispatch middleware should not run for guardian requests") {
+			return
+		}
+	}
+
+	// reloads rebuild the chains from the new config
+	s.config.Middleware = map[string][]MiddlewareConfig{
+		RoleDispatch: {{Type: MiddlewareHeaders, Headers: map[string]string{"X-Reloaded": "1"}}},
+	}
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?"+v.Encode(), nil))
+	if !assert.Equal(t, "1", w.Header().Get("X-Reloaded"), "reloaded middleware should run") {
+		return
+	}
+	if !assert.Equal(t, "1", w.Header().Get("X-Custom"), "middleware given as options should be kept") {
+		return
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/?"+v.Encode(), nil)
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if !assert.Equal(t, http.StatusNoContent, w.Code, "removed middleware should not run") {
+		return
+	}
+}
+
+func TestRewrites(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	files := http.FileServer(http.Dir("etc"))
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.String())
+		mu.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	defer src.Close()
+
+	c := Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Presets:  map[string]string{"small": "10x10"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+		Origin: OriginConfig{
+			Rewrites: []RewriteRule{{Match: `[`}},
+		},
+	}
+	_, err := NewServer(&c)
+	if !assert.Error(t, err, "invalid rewrite rules should be rejected") {
+		return
+	}
+
+	c.Origin.Rewrites = []RewriteRule{{Match: `^http://cdn\.example\.com/`, Replace: src.URL + "/", StripParams: []string{"sig"}}}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	public := "http://cdn.example.com/sharaq.png?sig=abc"
+	v := url.Values{"url": {public}}
+	req, err := http.NewRequest(http.MethodPost, st.URL+"/?"+v.Encode(), nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusNoContent, res.StatusCode, "request should succeed") {
+		return
+	}
+
+	mu.Lock()
+	if !assert.Equal(t, []string{"/sharaq.png"}, fetched, "the rewritten URL should be fetched") {
+		mu.Unlock()
+		return
+	}
+	mu.Unlock()
+
+	u, _ := url.Parse(public)
+	m, err := s.Backend().(Storage).Metadata(context.Background(), u, "small")
+	if !assert.NoError(t, err, "variant should be stored under the public URL") {
+		return
+	}
+	assert.Equal(t, public, m.SourceURL, "metadata should refer to the public URL")
+}
+
+func TestDebugTrace(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	c := Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Presets:  map[string]string{"small": "10x10"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	cl := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(token, wait string) (*http.Response, error) {
+		v := url.Values{"url": {newURL(src, "sharaq.png")}, "preset": {"small"}, "wait": {wait}}
+		req, err := http.NewRequest(http.MethodGet, st.URL+"/?"+v.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(DebugHeader, "1")
+		req.Header.Set("Sharaq-Token", token)
+		return cl.Do(req)
+	}
+
+	res, err := get("wrong", "")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Empty(t, res.Header.Get(TraceHeader), "untrusted clients should not get a trace") {
+		return
+	}
+
+	res, err = get("AbCdEfG", "5s")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	trace := res.Header.Get(TraceHeader)
+	for _, step := range []string{"backend=memory@", "get=miss@", "transform=triggered(1)@"} {
+		if !assert.Contains(t, trace, step, "trace should contain %s", step) {
+			return
+		}
+	}
+
+	res, err = get("AbCdEfG", "")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	assert.Contains(t, res.Header.Get(TraceHeader), "get=hit@", "trace should show the hit")
+
+	// traced responses can still be streamed
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(DebugHeader, "1")
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	rec := httptest.NewRecorder()
+	w, req := s.startTrace(rec, req)
+	requestTrace(req).record("step", "flushed")
+	f, ok := w.(http.Flusher)
+	if !assert.True(t, ok, "traced writers should be flushers") {
+		return
+	}
+	f.Flush()
+	if !assert.True(t, rec.Flushed, "Flush should reach the underlying writer") {
+		return
+	}
+	assert.Contains(t, rec.Header().Get(TraceHeader), "step=flushed@", "trace should be set before flushing")
+}
+
+func TestWait(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	c := Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Presets:  map[string]string{"small": "10x10"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	cl := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(wait string) (*http.Response, error) {
+		v := url.Values{"url": {newURL(src, "sharaq.png")}, "preset": {"small"}, "wait": {wait}}
+		return cl.Get(st.URL + "/?" + v.Encode())
+	}
+
+	res, err := get("soon")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusBadRequest, res.StatusCode, "invalid wait should be rejected") {
+		return
+	}
+
+	res, err = get("5s")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "the variant should be served instead of a redirect") {
+		return
+	}
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"), "Content-Type should be image/png")
+}
+
+func TestVersioning(t *testing.T) {
+	files := http.FileServer(http.Dir("etc"))
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		files.ServeHTTP(w, r)
+	}))
+	defer src.Close()
+
+	c := Config{
+		Backend:    BackendConfig{Type: "memory"},
+		Presets:    map[string]string{"small": "10x10"},
+		URLCache:   &urlcache.Config{Type: "Memory"},
+		Versioning: &VersioningConfig{},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	source := newURL(src, "sharaq.png")
+	u, _ := url.Parse(source)
+	if !assert.NoError(t, s.Backend().StoreTransformedContent(context.Background(), u, c.Presets), "StoreTransformedContent should succeed") {
+		return
+	}
+
+	cl := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(version string) (*http.Response, error) {
+		v := url.Values{"url": {source}, "preset": {"small"}, "v": {version}}
+		return cl.Get(st.URL + "/?" + v.Encode())
+	}
+
+	counter := &metadataCounter{Backend: s.backend, Storage: s.backend.(Storage)}
+	s.backend = counter
+	for i := 0; i < 2; i++ {
+		res, err := get(VersionToken(`"v1"`, "10x10"))
+		if !assert.NoError(t, err, "http.Get should succeed") {
+			return
+		}
+		if !assert.Equal(t, http.StatusOK, res.StatusCode, "the variant should be served") {
+			return
+		}
+		if !assert.Equal(t, "public, max-age=31536000, immutable", res.Header.Get("Cache-Control"), "current versions should be immutable") {
+			return
+		}
+	}
+	if !assert.Equal(t, int32(1), atomic.LoadInt32(&counter.calls), "checked versions should be remembered") {
+		return
+	}
+
+	res, err := get(VersionToken(`"v2"`, "10x10"))
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusFound, res.StatusCode, "outdated variants should be regenerated") {
+		return
+	}
+	if !assert.Empty(t, res.Header.Get("Cache-Control"), "outdated versions should not be immutable") {
+		return
+	}
+
+	// backends that redirect to stored variants
+	s.backend = staticBackend{handler: httputil.RedirectContent("http://bucket.example.com/small/sharaq.png")}
+	res, err = get(VersionToken(`"v1"`, "10x10"))
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusFound, res.StatusCode, "the variant should be redirected to") {
+		return
+	}
+	if !assert.Empty(t, res.Header.Get("Cache-Control"), "redirects should not be immutable") {
+		return
+	}
+}
+
+// metadataCounter counts the calls to Metadata
+type metadataCounter struct {
+	Backend
+	Storage
+	calls int32
+}
+
+func (b *metadataCounter) Metadata(ctx context.Context, u *url.URL, preset string) (*metadata.Metadata, error) {
+	atomic.AddInt32(&b.calls, 1)
+	return b.Storage.Metadata(ctx, u, preset)
+}
+
+func TestRequestID(t *testing.T) {
+	_, st, err := newSharaq(nil)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	res, err := http.Get(st.URL)
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.NotEmpty(t, res.Header.Get("X-Request-ID"), "request ID should be generated") {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodGet, st.URL, nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("X-Request-ID", "upstream-assigned-id")
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	if !assert.Equal(t, "upstream-assigned-id", res.Header.Get("X-Request-ID"), "request ID should be honored") {
+		return
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	c := Config{
+		Tokens: []string{"AbCdEfG"},
+	}
+	c.Backend.Amazon.SecretKey = "very-secret"
+	_, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	req, err := http.NewRequest(http.MethodGet, st.URL+"/admin/config", nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusForbidden, res.StatusCode, "status code should be forbidden") {
+		return
+	}
+
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	defer res.Body.Close()
+
+	var v adminConfigResponse
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&v), "response should be JSON") {
+		return
+	}
+
+	backend := v.Config["Backend"].(map[string]interface{})
+	amazon := backend["Amazon"].(map[string]interface{})
+	assert.Equal(t, "(redacted)", amazon["SecretKey"], "secrets should be redacted")
+	assert.Equal(t, "(redacted)", v.Config["Tokens"], "tokens should be redacted")
+	assert.Contains(t, v.DefaultsApplied, "Listen", "default listen address should be reported")
+}
+
+func TestGuardianAccess(t *testing.T) {
+	c := Config{
+		Tokens: []string{"AbCdEfG"},
+		Guardian: &AccessConfig{
+			AllowFrom: []string{"192.0.2.0/24"},
+		},
+	}
+	_, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	req, err := http.NewRequest(http.MethodPost, st.URL, nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+
+	// Valid token, but 127.0.0.1 is not in the allowed network
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusForbidden, res.StatusCode, "status code should be forbidden") {
+		return
+	}
+
+	c.Guardian.AllowFrom = append(c.Guardian.AllowFrom, "127.0.0.1")
+	_, st2, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st2.Close()
+
+	req.URL, _ = url.Parse(st2.URL)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	// We didn't provide url so, we should bail there
+	if !assert.Equal(t, http.StatusBadRequest, res.StatusCode, "status code should be bad request") {
+		return
+	}
+}
+
+type unavailableBackend struct{}
+
+func (unavailableBackend) Get(context.Context, *url.URL, string) (http.Handler, error) {
+	return nil, errors.StorageUnavailableError{}
+}
+func (unavailableBackend) StoreTransformedContent(context.Context, *url.URL, map[string]string) error {
+	return nil
+}
+func (unavailableBackend) Delete(context.Context, *url.URL, []string) error { return nil }
+
+func TestFallback(t *testing.T) {
+	c := Config{
+		Fallback: FallbackConfig{Policy: FallbackUnavailable},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	s.backend = unavailableBackend{}
+	res, err := http.Get(st.URL + "/?url=http://example.com/foo.jpg&preset=small")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "status code should be 503") {
+		return
+	}
+	if !assert.Equal(t, "30", res.Header.Get("Retry-After"), "Retry-After should be the default") {
+		return
+	}
+}
+
+// redirectingBackend redirects to the variants in Storage, as the aws
+// and gcp backends do
+type redirectingBackend struct {
+	Backend
+	Storage
+}
+
+func (b redirectingBackend) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
+	if _, err := b.Storage.Metadata(ctx, u, preset); err != nil {
+		return nil, err
+	}
+	return httputil.RedirectContent("http://bucket.example.com/" + preset + u.Path), nil
+}
+
+func TestStaleFallback(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	c := Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Fallback: FallbackConfig{Policy: FallbackStale},
+		Presets:  map[string]string{"small": "10x10", "large": "20x20"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	source := newURL(src, "sharaq.png")
+	u, _ := url.Parse(source)
+	if !assert.NoError(t, s.Backend().StoreTransformedContent(ctx, u, c.Presets), "StoreTransformedContent should succeed") {
+		return
+	}
+	backend := s.backend
+
+	cl := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(preset string) (*http.Response, []byte, error) {
+		v := url.Values{"url": {source}, "preset": {preset}}
+		res, err := cl.Get(st.URL + "/?" + v.Encode())
+		if err != nil {
+			return nil, nil, err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return res, body, err
+	}
+
+	res, variant, err := get("small")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "the variant should be served") {
+		return
+	}
+
+	// variants that are redirected to are fetched in the background
+	s.backend = redirectingBackend{Backend: backend, Storage: backend.(Storage)}
+	res, _, err = get("large")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusFound, res.StatusCode, "the variant should be redirected to") {
+		return
+	}
+	key := urlcache.MakeCacheKey("large", u.String())
+	for i := 0; i < 100 && !s.stale.touch(key); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var large bytes.Buffer
+	if _, err := backend.(Storage).Fetch(ctx, u, "large", &large); !assert.NoError(t, err, "Fetch should succeed") {
+		return
+	}
+
+	s.backend = unavailableBackend{}
+	for preset, expected := range map[string][]byte{"small": variant, "large": large.Bytes()} {
+		res, body, err := get(preset)
+		if !assert.NoError(t, err, "http.Get should succeed") {
+			return
+		}
+		if !assert.Equal(t, http.StatusOK, res.StatusCode, "a copy of %s should be served", preset) {
+			return
+		}
+		if !assert.Equal(t, expected, body, "a copy of %s should be served", preset) {
+			return
+		}
+		if !assert.Equal(t, "true", res.Header.Get("X-Sharaq-Stale"), "copies should be marked as stale") {
+			return
+		}
+	}
+
+	// copies are dropped when the variants are stored again
+	if !assert.NoError(t, s.storeTransformedContent(ctx, u, map[string]string{"small": "10x10"}), "storeTransformedContent should succeed") {
+		return
+	}
+	res, _, err = get("small")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusFound, res.StatusCode, "variants without a copy should be redirected to the origin") {
+		return
+	}
+}
+
+func TestInfo(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	s, st, err := newSharaq(nil)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	s.transformer, err = s.newTransformer()
+	if !assert.NoError(t, err, "creating transformer should succeed") {
+		return
+	}
+	res, err := http.Get(st.URL + "/info?url=" + url.QueryEscape(newURL(src, "sharaq.png")))
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	defer res.Body.Close()
+
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "status code should be 200") {
+		return
+	}
+
+	var info map[string]interface{}
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&info), "decoding response should succeed") {
+		return
+	}
+	assert.Equal(t, "png", info["format"], "format should be png")
+	assert.Equal(t, "origin", info["source"], "source should be origin")
+	assert.NotEmpty(t, info["blurhash"], "blurhash should be computed")
+}
+
+func TestEstimate(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	c := Config{
+		Presets: map[string]string{"small": "100x100,png"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	s.transformer, err = s.newTransformer()
+	if !assert.NoError(t, err, "creating transformer should succeed") {
+		return
+	}
+	v := url.Values{"url": {newURL(src, "sharaq.png")}, "preset": {"small"}}
+	res, err := http.Get(st.URL + "/estimate?" + v.Encode())
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	defer res.Body.Close()
+
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "status code should be 200") {
+		return
+	}
+
+	var est estimateResponse
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&est), "decoding response should succeed") {
+		return
+	}
+	if !assert.Equal(t, []int{100, 100}, []int{est.Width, est.Height}, "dimensions should be estimated") {
+		return
+	}
+	if !assert.Equal(t, "png", est.Format, "format should be png") {
+		return
+	}
+	if !assert.Equal(t, transformer.BasisDefault, est.Basis, "nothing has been generated yet") {
+		return
+	}
+	if !assert.True(t, est.Size > 0, "size should be estimated") {
+		return
+	}
+	if !assert.Equal(t, []int{427, 647}, []int{est.Source.Width, est.Source.Height}, "source dimensions should be read") {
+		return
+	}
+
+	v.Set("preset", "unknown")
+	res2, err := http.Get(st.URL + "/estimate?" + v.Encode())
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res2.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res2.StatusCode, "unknown presets should be rejected")
+}
+
+func TestPresetSources(t *testing.T) {
+	c := Config{
+		Presets: map[string]string{
+			"small":   "100x100",
+			"partner": "50x50",
+		},
+		PresetSources: map[string][]string{
+			"partner": {`^http://partner\.example\.com/`},
+		},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	u, _ := url.Parse("http://example.com/foo.jpg")
+	if !assert.Equal(t, map[string]string{"small": "100x100"}, s.presetsFor(u), "only unrestricted presets should apply") {
+		return
+	}
+
+	res, err := http.Get(st.URL + "/?url=http://example.com/foo.jpg&preset=partner")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusForbidden, res.StatusCode, "status code should be forbidden") {
+		return
+	}
+
+	c.PresetSources["unknown"] = []string{"."}
+	_, _, err = newSharaq(&c)
+	if !assert.Error(t, err, "unknown presets should be rejected") {
+		return
+	}
+}
+
+func TestPresetMaxBytes(t *testing.T) {
+	c := Config{
+		Presets: map[string]string{
+			"small":       "100x100",
+			"email-thumb": "200x200,jpeg",
+		},
+		PresetMaxBytes: map[string]int64{
+			"email-thumb": 20000,
+			"w{w}":        50000,
+		},
+		PresetTemplates: map[string]PresetTemplate{
+			"w{w}": {MaxWidth: 1024},
+		},
+	}
+	s, err := NewServer(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+
+	for preset, expected := range map[string]string{
+		"small":       "100x100",
+		"email-thumb": "200x200,jpeg,maxbytes20000",
+		"w640":        "640x,maxbytes50000",
+	} {
+		rule, ok := s.lookupPreset(preset)
+		if !assert.True(t, ok, "%s should be a valid preset", preset) {
+			return
+		}
+		if !assert.Equal(t, expected, rule, "rule for %s should match", preset) {
+			return
+		}
+	}
+
+	u, _ := url.Parse("http://example.com/foo.jpg")
+	if !assert.Equal(t, "200x200,jpeg,maxbytes20000", s.presetsFor(u)["email-thumb"], "limit should apply to generated presets") {
+		return
+	}
+
+	c.PresetMaxBytes["unknown"] = 1000
+	_, err = NewServer(&c)
+	if !assert.Error(t, err, "unknown presets should be rejected") {
+		return
+	}
+
+	var pc Config
+	err = pc.Parse(strings.NewReader(`{"Presets":{"small":"100x100"},"PresetMaxBytes":{"small":0}}`))
+	if !assert.Error(t, err, "limits that are not positive should be rejected") {
+		return
+	}
+}
+
+func TestAdminViewCSRF(t *testing.T) {
+	c := Config{
+		Tokens:  []string{"AbCdEfG"},
+		Presets: map[string]string{"small": "100x100"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	src := "http://example.com/foo.jpg"
+	form := url.Values{
+		"url":        {src},
+		"preset":     {"small"},
+		"csrf_token": {"bogus"},
+	}
+	req, err := http.NewRequest(http.MethodPost, st.URL+"/admin/view", strings.NewReader(form.Encode()))
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusForbidden, res.StatusCode, "invalid CSRF token should be rejected") {
+		return
+	}
+
+	if !assert.Equal(t, s.csrfToken(src), s.csrfToken(src), "CSRF tokens should be stable") {
+		return
+	}
+	if !assert.NotEqual(t, s.csrfToken(src), s.csrfToken(src+"?x"), "CSRF tokens should depend on the url") {
+		return
+	}
+}
+
+func TestAdminViewFormats(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	c := Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Presets:  map[string]string{"small": "10x10"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	source := newURL(src, "sharaq.png")
+	u, err := url.Parse(source)
+	if !assert.NoError(t, err, "url.Parse should succeed") {
+		return
+	}
+	if !assert.NoError(t, s.Backend().StoreTransformedContent(context.Background(), u, c.Presets), "StoreTransformedContent should succeed") {
+		return
+	}
+
+	view := func(format, accept string) *http.Response {
+		v := url.Values{"url": {source}}
+		if format != "" {
+			v.Set("format", format)
+		}
+		req, err := http.NewRequest(http.MethodGet, st.URL+"/admin/view?"+v.Encode(), nil)
+		if !assert.NoError(t, err, "http.NewRequest should succeed") {
+			return nil
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return nil
+		}
+		return res
+	}
+
+	res := view("", "")
+	if res == nil {
+		return
+	}
+	defer res.Body.Close()
+	if !assert.Equal(t, "application/json", res.Header.Get("Content-Type"), "JSON should be the default") {
+		return
+	}
+	var v adminViewResponse
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&v), "response should be JSON") {
+		return
+	}
+	if !assert.Len(t, v.Variants, 1, "there should be one variant") {
+		return
+	}
+	if !assert.True(t, v.Variants[0].Stored, "variant should be stored") {
+		return
+	}
+	if !assert.Equal(t, 10, v.Variants[0].Width, "width should be reported") {
+		return
+	}
+
+	for _, tc := range []struct {
+		format, accept, contentType string
+	}{
+		{"", "text/html,application/xhtml+xml,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"json", "text/html", "application/json"},
+		{"html", "", "text/html; charset=utf-8"},
+	} {
+		res := view(tc.format, tc.accept)
+		if res == nil {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, tc.contentType, res.Header.Get("Content-Type"), "content type should match for format=%s, Accept: %s", tc.format, tc.accept) {
+			return
+		}
+	}
+}
+
+type staticBackend struct {
+	handler http.Handler
+}
+
+func (b staticBackend) Get(context.Context, *url.URL, string) (http.Handler, error) {
+	if b.handler == nil {
+		return nil, errors.TransformationRequiredError{}
+	}
+	return b.handler, nil
+}
+func (staticBackend) StoreTransformedContent(context.Context, *url.URL, map[string]string) error {
+	return nil
+}
+func (staticBackend) Delete(context.Context, *url.URL, []string) error { return nil }
+
+func TestDualBackend(t *testing.T) {
+	prev := http.NotFoundHandler()
+	d := newDualBackend(staticBackend{}, staticBackend{handler: prev}, nil)
+
+	u, _ := url.Parse("http://example.com/foo.jpg")
+	h, err := d.Get(context.Background(), u, "small")
+	if !assert.NoError(t, err, "Get should fall back to the previous backend") {
+		return
+	}
+	if !assert.NotNil(t, h, "handler should be returned") {
+		return
+	}
+
+	d.setMigrating(false)
+	_, err = d.Get(context.Background(), u, "small")
+	if !assert.True(t, errors.IsTransformationRequired(err), "Get should not fall back when migration mode is disabled") {
+		return
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	c := Config{
+		Presets:   map[string]string{"small": "200x200"},
+		Whitelist: []string{`^http://example\.com/`},
+	}
+	s, err := NewServer(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+
+	u, _ := url.Parse("http://example.org/foo.jpg")
+	err = s.checkRequest(u, "small")
+	if !assert.True(t, IsError(err, ErrSourceNotAllowed), "error should be ErrSourceNotAllowed") {
+		return
+	}
+
+	u, _ = url.Parse("http://example.com/foo.jpg")
+	err = errors.Wrap(s.checkRequest(u, "large"), `wrapped`)
+	if !assert.True(t, IsError(err, ErrPresetUnknown), "wrapped error should be ErrPresetUnknown") {
+		return
+	}
+	if !assert.False(t, IsError(err, ErrSourceNotAllowed), "error should not be ErrSourceNotAllowed") {
+		return
+	}
+
+	if !assert.True(t, IsError(errors.StorageUnavailableError{}, ErrStorage), "StorageUnavailableError should be ErrStorage") {
+		return
+	}
+}
+
+func TestUnknownPreset(t *testing.T) {
+	c := Config{
+		Presets: map[string]string{"small": "200x200"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	cl := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(preset string) (int, error) {
+		res, err := cl.Get(st.URL + "/?" + url.Values{"url": {"http://example.com/foo.jpg"}, "preset": {preset}}.Encode())
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	s.backend = staticBackend{}
+	for preset, status := range map[string]int{
+		"removed":    http.StatusFound,
+		"../removed": http.StatusBadRequest,
+		"..":         http.StatusBadRequest,
+	} {
+		got, err := get(preset)
+		if !assert.NoError(t, err, "http.Get should succeed") {
+			return
+		}
+		if !assert.Equal(t, status, got, "status code for %s should match", preset) {
+			return
+		}
+	}
+
+	s.backend = staticBackend{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}
+	got, err := get("removed")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, got, "stored variants of unknown presets should be served") {
+		return
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	c := Config{
+		Presets: map[string]string{"small": "200x200"},
+		Signing: &SigningConfig{Key: "s3cr3t", Required: true},
+		Tokens:  []string{"AbCdEfG"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	s.backend = staticBackend{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}
+
+	source := "http://example.com/foo.jpg"
+	res, err := http.Get(st.URL + "/?" + url.Values{"url": {source}, "preset": {"small"}}.Encode())
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusForbidden, res.StatusCode, "unsigned request should be rejected") {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodGet, st.URL+"/sign?"+url.Values{"url": {source}, "preset": {"small"}, "ttl": {"1m"}}.Encode(), nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	var signed signResponse
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&signed), "decoding response should succeed") {
+		return
+	}
+
+	res, err = http.Get(signed.URL)
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "signed request should be accepted") {
+		return
+	}
+
+	expired, err := SignURL(st.URL, []byte("s3cr3t"), source, "small", time.Now().Add(-time.Minute))
+	if !assert.NoError(t, err, "SignURL should succeed") {
+		return
+	}
+	res, err = http.Get(expired)
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusForbidden, res.StatusCode, "expired signature should be rejected") {
+		return
+	}
+}
+
+func TestPresetTemplates(t *testing.T) {
+	c := Config{
+		Presets: map[string]string{"small": "200x200"},
+		PresetTemplates: map[string]PresetTemplate{
+			"thumb-{w}x{h}": {
+				Rule:         "{w}x{h},fit",
+				MinWidth:     16,
+				MaxWidth:     512,
+				MinHeight:    16,
+				MaxHeight:    512,
+				AspectRatios: []string{"1:1", "16:9"},
+			},
+			"w{w}": {MaxWidth: 1024},
+		},
+	}
+	s, err := NewServer(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+
+	for preset, expected := range map[string]string{
+		"small":           "200x200",
+		"thumb-100x100":   "100x100,fit",
+		"thumb-160x90":    "160x90,fit",
+		"thumb-100x56":    "100x56,fit", // 16:9, rounded
+		"w640":            "640x",
+		"thumb-100x80":    "", // aspect ratio not allowed
+		"thumb-8x8":       "", // too small
+		"thumb-1024x1024": "", // too large
+		"thumb-0100x100":  "", // not canonical
+		"w2048":           "",
+		"large":           "",
+	} {
+		rule, ok := s.lookupPreset(preset)
+		if expected == "" {
+			if !assert.False(t, ok, "%s should not be a valid preset", preset) {
+				return
+			}
+			continue
+		}
+		if !assert.True(t, ok, "%s should be a valid preset", preset) {
+			return
+		}
+		if !assert.Equal(t, expected, rule, "rule for %s should match", preset) {
+			return
+		}
+	}
+
+	_, err = NewServer(&Config{
+		PresetTemplates: map[string]PresetTemplate{"w{w}": {}},
+	})
+	if !assert.Error(t, err, "templates without bounds should be rejected") {
+		return
+	}
+}
+
+func TestPresetTemplates_Delete(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	c := Config{
+		Backend: BackendConfig{Type: "memory"},
+		Presets: map[string]string{"small": "10x10"},
+		PresetTemplates: map[string]PresetTemplate{
+			"thumb-{w}x{h}": {MaxWidth: 200, MaxHeight: 200},
+		},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	u, _ := url.Parse(newURL(src, "sharaq.png"))
+	variants := []string{"small", "thumb-120x90", "thumb-32x32"}
+	for _, preset := range variants {
+		rule, _ := s.lookupPreset(preset)
+		if !assert.NoError(t, s.transformAndStore(ctx, u, map[string]string{preset: rule}), "transformAndStore should succeed for %s", preset) {
+			return
+		}
+	}
+
+	storage := s.Backend().(Storage)
+	for _, preset := range variants {
+		if _, err := storage.Metadata(ctx, u, preset); !assert.NoError(t, err, "%s should be stored", preset) {
+			return
+		}
+	}
+	instances, err := s.templateInstances(ctx, u)
+	if !assert.NoError(t, err, "templateInstances should succeed") {
+		return
+	}
+	if !assert.Equal(t, []string{"thumb-120x90", "thumb-32x32"}, instances, "instances should be recorded") {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, st.URL+"/?"+url.Values{"url": {u.String()}}.Encode(), nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "DELETE should succeed") {
+		return
+	}
+
+	for _, preset := range append(variants, templateInstancesPreset) {
+		_, err := storage.Metadata(ctx, u, preset)
+		if !assert.True(t, errors.IsTransformationRequired(err), "%s should be deleted", preset) {
+			return
+		}
+	}
+
+	_, err = NewServer(&Config{
+		Presets:         map[string]string{templateInstancesPreset: "10x10"},
+		PresetTemplates: c.PresetTemplates,
+	})
+	if !assert.Error(t, err, "reserved preset name should be rejected") {
+		return
+	}
+}
+
+// presetRecorder is a staticBackend that records the presets requested
+type presetRecorder struct {
+	staticBackend
+	presets []string
+	deleted []string
+}
+
+func (b *presetRecorder) Get(ctx context.Context, u *url.URL, preset string) (http.Handler, error) {
+	b.presets = append(b.presets, preset)
+	return b.staticBackend.Get(ctx, u, preset)
+}
+
+func (b *presetRecorder) Delete(_ context.Context, _ *url.URL, presets []string) error {
+	b.deleted = append(b.deleted, presets...)
+	return nil
+}
+
+func TestTextOverlays(t *testing.T) {
+	c := Config{
+		Presets: map[string]string{"event": "200x200", "small": "100x100"},
+		Signing: &SigningConfig{Key: "s3cr3t"},
+		Tokens:  []string{"AbCdEfG"},
+		TextOverlays: map[string]TextOverlayConfig{
+			"event": {Texts: []string{"SOLD OUT", "Few left!"}, Position: "nw", Background: "cc0000"},
+		},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	for preset, expected := range map[string]string{
+		"event~sold-out": "200x200,textU09MRCBPVVQ,atnw,badgecc0000",
+		"event~few-left": "200x200,text" + transformer.EncodeText("Few left!") + ",atnw,badgecc0000",
+		"event~free":     "", // not listed
+		"small~sold-out": "", // no overlay
+	} {
+		rule, ok := s.lookupPreset(preset)
+		if expected == "" {
+			if !assert.False(t, ok, "%s should not be a valid preset", preset) {
+				return
+			}
+			continue
+		}
+		if !assert.True(t, ok, "%s should be a valid preset", preset) {
+			return
+		}
+		if !assert.Equal(t, expected, rule, "rule for %s should match", preset) {
+			return
+		}
+	}
+
+	b := &presetRecorder{staticBackend: staticBackend{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}}
+	s.backend = b
+
+	source := "http://example.com/foo.jpg"
+	sign := func(preset, text string) string {
+		signed, err := SignTextURL(st.URL, []byte("s3cr3t"), source, preset, text, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatalf("SignTextURL failed: %s", err)
+		}
+		return signed
+	}
+	signed := sign("event", "SOLD OUT")
+	byName, err := SignURL(st.URL, []byte("s3cr3t"), source, "event~sold-out", time.Now().Add(time.Minute))
+	if !assert.NoError(t, err, "SignURL should succeed") {
+		return
+	}
+	direct := url.Values{"url": {source}, "preset": {"event~sold-out"}}.Encode()
+
+	for _, tt := range []struct {
+		url    string
+		status int
+	}{
+		{signed, http.StatusOK},
+		{sign("event", ""), http.StatusOK},
+		{strings.Replace(signed, "SOLD+OUT", "Few+left%21", 1), http.StatusForbidden},
+		{st.URL + "/?" + url.Values{"url": {source}, "preset": {"event"}, "text": {"SOLD OUT"}}.Encode(), http.StatusForbidden},
+		{sign("event", "FREE"), http.StatusBadRequest},
+		{sign("small", "SOLD OUT"), http.StatusBadRequest},
+		// variants with text are only reachable with "text" and "sig"
+		{st.URL + "/?" + direct, http.StatusBadRequest},
+		{byName, http.StatusBadRequest},
+		{st.URL + "/estimate?" + direct, http.StatusBadRequest},
+	} {
+		res, err := http.Get(tt.url)
+		if !assert.NoError(t, err, "http.Get should succeed") {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, tt.status, res.StatusCode, "status for %s should match", tt.url) {
+			return
+		}
+	}
+	if !assert.Equal(t, []string{"event~sold-out", "event"}, b.presets, "variants should be requested by name") {
+		return
+	}
+
+	signReq, err := http.NewRequest(http.MethodGet, st.URL+"/sign?"+direct, nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	signReq.Header.Set("Sharaq-Token", "AbCdEfG")
+	res, err := http.DefaultClient.Do(signReq)
+	if !assert.NoError(t, err, "/sign should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusBadRequest, res.StatusCode, "/sign should not sign variants with text by name") {
+		return
+	}
+
+	deleted := make(chan string, 8)
+	s.SetEventPublisher(events.PublisherFunc(func(_ context.Context, ev *events.Event) error {
+		deleted <- ev.Preset
+		return nil
+	}))
+	if !assert.NoError(t, s.initEventPublisher(), "initEventPublisher should succeed") {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, st.URL+"/?"+url.Values{"url": {source}}.Encode(), nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "DELETE should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "DELETE should return 200") {
+		return
+	}
+	if !assert.Equal(t, []string{"event", "event~few-left", "event~sold-out", "small"}, b.deleted, "DELETE should remove variants with text") {
+		return
+	}
+
+	var published []string
+	for range b.deleted {
+		select {
+		case preset := <-deleted:
+			published = append(published, preset)
+		case <-time.After(5 * time.Second):
+		}
+	}
+	sort.Strings(published)
+	if !assert.Equal(t, b.deleted, published, "delete events should be published for variants with text") {
+		return
+	}
+
+	for _, oc := range []TextOverlayConfig{
+		{},
+		{Texts: []string{"SOLD OUT", "sold out"}},
+		{Texts: []string{"!!!"}},
+	} {
+		_, err := NewServer(&Config{
+			Presets:      map[string]string{"event": "200x200"},
+			Signing:      &SigningConfig{Key: "s3cr3t"},
+			TextOverlays: map[string]TextOverlayConfig{"event": oc},
+		})
+		if !assert.Error(t, err, "%v should be rejected", oc.Texts) {
+			return
+		}
+	}
+
+	_, err = NewServer(&Config{
+		Presets:      map[string]string{"event": "200x200"},
+		TextOverlays: map[string]TextOverlayConfig{"event": {Texts: []string{"SOLD OUT"}}},
+	})
+	if !assert.Error(t, err, "text overlays without signing should be rejected") {
+		return
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	defer origin.Close()
+
+	c := Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Presets:  map[string]string{"small": "200x200"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	source := origin.URL + "/missing.jpg"
+	req, err := http.NewRequest(http.MethodPost, st.URL+"/?"+url.Values{"url": {source}}.Encode(), nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusNotFound, res.StatusCode, "POST should report that the source does not exist") {
+		return
+	}
+
+	cl := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err = cl.Get(st.URL + "/?" + url.Values{"url": {source}, "preset": {"small"}}.Encode())
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusNotFound, res.StatusCode, "GET should reply with 404 instead of redirecting") {
+		return
+	}
+}
+
+func TestCompression(t *testing.T) {
+	c := Config{
+		Compression: &CompressionConfig{Routes: []string{"/", "/admin/"}},
+		Presets:     map[string]string{"small": "200x200"},
+		Tokens:      []string{"AbCdEfG"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	s.backend = staticBackend{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("not really a png"))
+	})}
+
+	get := func(u string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		return http.DefaultClient.Do(req)
+	}
+
+	res, err := get(st.URL + "/admin/config")
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	defer res.Body.Close()
+	if !assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"), "JSON response should be compressed") {
+		return
+	}
+	gz, err := gzip.NewReader(res.Body)
+	if !assert.NoError(t, err, "gzip.NewReader should succeed") {
+		return
+	}
+	var v map[string]interface{}
+	if !assert.NoError(t, json.NewDecoder(gz).Decode(&v), "decoding response should succeed") {
+		return
+	}
+
+	res, err = get(st.URL + "/?" + url.Values{"url": {"http://example.com/foo.png"}, "preset": {"small"}}.Encode())
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	defer res.Body.Close()
+	if !assert.Empty(t, res.Header.Get("Content-Encoding"), "image response should not be compressed") {
+		return
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if !assert.Equal(t, "not really a png", string(body), "image should be served as is") {
+		return
+	}
+
+	// stored content of other types keeps its length
+	s.backend = staticBackend{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("not really a png"))
+	})}
+	req, err := http.NewRequest(http.MethodGet, st.URL+"/?"+url.Values{"url": {"http://example.com/foo.png"}, "preset": {"small"}}.Encode(), nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err = http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err, "RoundTrip should succeed") {
+		return
+	}
+	defer res.Body.Close()
+	if !assert.Empty(t, res.Header.Get("Content-Encoding"), "responses with a length should not be compressed") {
+		return
+	}
+	if !assert.Equal(t, "16", res.Header.Get("Content-Length"), "Content-Length should be kept") {
+		return
+	}
+}
+
+func TestDeleteOriginal(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	dir, err := ioutil.TempDir("", "sharaq-audit")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	c := Config{
+		AuditLog: &AuditConfig{File: filepath.Join(dir, "audit.log")},
+		Backend:  BackendConfig{Type: "memory"},
+		Original: &OriginalConfig{},
+		Presets:  map[string]string{"small": "200x200"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	source := newURL(src, "sharaq.png")
+	guardian := func(method string, v url.Values) int {
+		v.Set("url", source)
+		req, err := http.NewRequest(method, st.URL+"/?"+v.Encode(), nil)
+		if !assert.NoError(t, err, "http.NewRequest should succeed") {
+			return 0
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	exists := func(preset string) bool {
+		u, _ := url.Parse(source)
+		_, err := s.backend.(Storage).Metadata(context.Background(), u, preset)
+		return err == nil
+	}
+
+	if !assert.Equal(t, http.StatusNoContent, guardian(http.MethodPost, url.Values{}), "POST should succeed") {
+		return
+	}
+	if !assert.True(t, exists("small") && exists(OriginalPreset), "variants should be stored") {
+		return
+	}
+
+	if !assert.Equal(t, http.StatusOK, guardian(http.MethodDelete, url.Values{}), "DELETE should succeed") {
+		return
+	}
+	if !assert.False(t, exists("small"), "variant should be deleted") {
+		return
+	}
+	if !assert.True(t, exists(OriginalPreset), "original should be kept") {
+		return
+	}
+
+	if !assert.Equal(t, http.StatusOK, guardian(http.MethodDelete, url.Values{"original": {"true"}}), "DELETE should succeed") {
+		return
+	}
+	if !assert.False(t, exists(OriginalPreset), "original should be deleted") {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodGet, st.URL+"/admin/audit?"+url.Values{"url": {source}}.Encode(), nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	defer res.Body.Close()
+
+	var entries []auditEntry
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&entries), "response should be JSON") {
+		return
+	}
+	if !assert.Len(t, entries, 2, "each DELETE should be audited") {
+		return
+	}
+	if !assert.Equal(t, []string{"small"}, entries[0].Presets, "original should not be listed in the first DELETE") {
+		return
+	}
+	if !assert.Equal(t, []string{"*"}, entries[1].Presets, "second DELETE should remove all presets") {
+		return
+	}
+	if !assert.Equal(t, "ok", entries[1].Result, "result should be recorded") {
+		return
+	}
+	if !assert.True(t, strings.HasPrefix(entries[1].Who, "token:"), "token fingerprint should be recorded") {
+		return
+	}
+	if !assert.NotContains(t, entries[1].Who, "AbCdEfG", "token should not be recorded") {
+		return
+	}
+}
+
+func TestLimits(t *testing.T) {
+	c := Config{
+		Limits: LimitsConfig{MaxQuerySize: 256, MaxBodySize: 256, MaxFormValues: 4},
+		Tokens: []string{"AbCdEfG"},
+	}
+	_, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	res, err := http.Get(st.URL + "/?url=" + strings.Repeat("a", 512))
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode, "long query string should be rejected") {
+		return
+	}
+
+	res, err = http.Get(st.URL + "/?a=1&a=2&a=3&a=4&a=5")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode, "too many values should be rejected") {
+		return
+	}
+
+	// no Content-Length, so that the limit is hit while reading
+	body := ioutil.NopCloser(strings.NewReader("url=" + strings.Repeat("a", 512)))
+	req, err := http.NewRequest(http.MethodPost, st.URL, body)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode, "large body should be rejected") {
+		return
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	_, st, err := newSharaq(&Config{})
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	req, err := http.NewRequest(http.MethodGet, st.URL+"/?url=ftp://example.com/foo.jpg&preset=small", nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"), "errors should be plain text by default") {
+		return
+	}
+
+	req.Header.Set("Accept", "application/json")
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	defer res.Body.Close()
+
+	if !assert.Equal(t, http.StatusBadRequest, res.StatusCode, "bad url should be rejected") {
+		return
+	}
+	if !assert.Equal(t, "application/json", res.Header.Get("Content-Type"), "errors should be JSON") {
+		return
+	}
+
+	var e errorResponse
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&e), "decoding error should succeed") {
+		return
+	}
+	if !assert.Equal(t, errorResponse{Code: "bad_request", Message: "Bad url", RequestID: res.Header.Get("X-Request-Id")}, e, "error should be structured") {
+		return
+	}
+}
+
+func TestMirror(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	received := make(chan *http.Request, 2)
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}))
+	defer canary.Close()
+
+	c := Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Mirror:   &MirrorConfig{URL: canary.URL + "/", Percent: 100},
+		Presets:  map[string]string{"small": "200x200"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	v := url.Values{"url": {newURL(src, "sharaq.png")}, "preset": {"small"}}
+	res, err := client.Get(st.URL + "/?" + v.Encode())
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res.Body.Close()
+
+	select {
+	case r := <-received:
+		if !assert.Equal(t, v.Encode(), r.URL.RawQuery, "query should be mirrored") {
+			return
+		}
+		if !assert.Equal(t, "1", r.Header.Get(mirrorHeader), "mirrored requests should be marked") {
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("request was not mirrored")
+		return
+	}
+
+	// requests from other mirrors are not mirrored again
+	req, err := http.NewRequest(http.MethodGet, st.URL+"/?"+v.Encode(), nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set(mirrorHeader, "1")
+	res, err = client.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	res.Body.Close()
+
+	select {
+	case <-received:
+		t.Errorf("mirrored request was mirrored again")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestFlags(t *testing.T) {
+	c := Config{
+		Flags: map[string]FlagConfig{
+			"fast": {Percent: 0, Rule: "linear,q80"},
+			"all":  {Percent: 100, Rule: "q70", Presets: []string{"small"}},
+		},
+		Presets: map[string]string{"small": "200x200", "large": "400x400"},
+		Tokens:  []string{"AbCdEfG"},
+	}
+	s, err := NewServer(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+
+	u, _ := url.Parse("http://example.com/foo.jpg")
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(flagsHeader, "fast,-all")
+	if !assert.Equal(t, []string{"all"}, s.enabledFlags(r, u), "header should be ignored for unauthorized requests") {
+		return
+	}
+
+	r.Header.Set("Sharaq-Token", "AbCdEfG")
+	if !assert.Equal(t, []string{"fast"}, s.enabledFlags(r, u), "header should force flags") {
+		return
+	}
+
+	ctx := flags.With(context.Background(), []string{"all", "fast"})
+	expected := map[string]string{"small": "200x200,q70,linear,q80", "large": "400x400,linear,q80"}
+	if !assert.Equal(t, expected, s.applyFlags(ctx, c.Presets), "rules of enabled flags should be appended") {
+		return
+	}
+}
+
+func TestConfigInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sharaq-config-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"presets.json":           `{"Presets": {"small": "200x200", "large": "800x800"}}`,
+		"sharaq.json":            `{"Include": ["presets.json"], "Listen": "127.0.0.1:9090", "Fallback": {"RetryAfter": 45000000000}, "Tokens": ["a"]}`,
+		"sharaq.production.json": `{"Presets": {"small": "100x100"}, "Tokens": ["b", "c"]}`,
+		"loop.json":              `{"Include": ["loop.json"]}`,
+	}
+	for name, content := range files {
+		if !assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), "ioutil.WriteFile should succeed") {
+			return
+		}
+	}
+
+	var c Config
+	if !assert.NoError(t, c.ParseFileEnv(filepath.Join(dir, "sharaq.json"), ""), "ParseFileEnv should succeed") {
+		return
+	}
+	if !assert.Equal(t, map[string]string{"small": "200x200", "large": "800x800"}, c.Presets, "presets should be included") {
+		return
+	}
+	if !assert.Equal(t, "127.0.0.1:9090", c.Listen, "listen address should be read") {
+		return
+	}
+	if !assert.Equal(t, 45*time.Second, c.Fallback.RetryAfter, "durations should survive merging") {
+		return
+	}
+
+	c = Config{}
+	if !assert.NoError(t, c.ParseFileEnv(filepath.Join(dir, "sharaq.json"), "production"), "ParseFileEnv should succeed") {
+		return
+	}
+	if !assert.Equal(t, map[string]string{"small": "100x100", "large": "800x800"}, c.Presets, "overlay should be merged") {
+		return
+	}
+	if !assert.Equal(t, []string{"b", "c"}, c.Tokens, "lists should be replaced") {
+		return
+	}
+
+	// environments without an overlay use the base config
+	c = Config{}
+	if !assert.NoError(t, c.ParseFileEnv(filepath.Join(dir, "sharaq.json"), "staging"), "ParseFileEnv should succeed") {
+		return
+	}
+	if !assert.Equal(t, "200x200", c.Presets["small"], "base config should be used") {
+		return
+	}
+
+	c = Config{}
+	if !assert.Error(t, c.ParseFileEnv(filepath.Join(dir, "loop.json"), ""), "include loops should be rejected") {
+		return
+	}
+}
+
+type fileTransport string
+
+func (dir fileTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	http.FileServer(http.Dir(string(dir))).ServeHTTP(rec, r)
+	return rec.Result(), nil
+}
+
+func TestServerOptions(t *testing.T) {
+	presets := map[string]string{"small": "10x10"}
+
+	// images are fetched without going over the network
+	c := Config{
+		Backend: BackendConfig{Type: "memory"},
+		Presets: presets,
+	}
+	tr, err := NewTransformer(&c, fileTransport("etc"))
+	if !assert.NoError(t, err, "NewTransformer should succeed") {
+		return
+	}
+
+	_, err = NewTransformer(&Config{Origin: OriginConfig{Rewrites: []RewriteRule{{Match: "("}}}}, nil)
+	if !assert.Error(t, err, "NewTransformer should reject invalid rewrite rules") {
+		return
+	}
+
+	cache, err := NewURLCache(&c)
+	if !assert.NoError(t, err, "NewURLCache should succeed") {
+		return
+	}
+	b, err := NewBackend(&c, cache, tr)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+	if !assert.Equal(t, Config{Backend: BackendConfig{Type: "memory"}, Presets: presets}, c, "config should not be modified") {
+		return
+	}
+
+	s, err := NewServer(nil, WithBackend(b), WithCache(cache), WithTransformer(tr), WithPresets(presets))
+	if !assert.NoError(t, err, "NewServer should succeed") {
+		return
+	}
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	if !assert.Equal(t, b, s.Backend(), "backend should be used as is") {
+		return
+	}
+	if !assert.Equal(t, presets, s.Presets(), "presets should be used") {
+		return
+	}
+
+	u, err := url.Parse("http://images.invalid/sharaq.png")
+	if !assert.NoError(t, err, "url.Parse should succeed") {
+		return
+	}
+	ctx := context.Background()
+	if !assert.NoError(t, s.Backend().StoreTransformedContent(ctx, u, presets), "StoreTransformedContent should succeed") {
+		return
+	}
+	if _, err := s.Backend().Get(ctx, u, "small"); !assert.NoError(t, err, "variant should be stored") {
+		return
+	}
+}
+
+func TestContentKeys(t *testing.T) {
+	srcbytes, err := ioutil.ReadFile(filepath.Join("etc", "sharaq.png"))
+	if !assert.NoError(t, err, `ioutil.ReadFile("etc/sharaq.png") should succeed`) {
+		return
+	}
+	var changed bytes.Buffer
+	if !assert.NoError(t, png.Encode(&changed, image.NewRGBA(image.Rect(0, 0, 4, 4))), "png.Encode should succeed") {
+		return
+	}
+
+	// the same image is published as a.png and b.png, until a.png changes
+	var mu sync.Mutex
+	content := map[string][]byte{"/a.png": srcbytes, "/b.png": srcbytes}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		b, ok := content[r.URL.Path]
+		mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(b)
+	}))
+	defer origin.Close()
+
+	presets := map[string]string{"small": "10x10", "large": "20x20"}
+	c := Config{
+		Backend: BackendConfig{Type: "memory", ContentKeys: true},
+		Presets: presets,
+	}
+	tr, err := NewTransformer(&c, nil)
+	if !assert.NoError(t, err, "NewTransformer should succeed") {
+		return
+	}
+	cache, err := NewURLCache(&c)
+	if !assert.NoError(t, err, "NewURLCache should succeed") {
+		return
+	}
+	b, err := NewBackend(&c, cache, tr)
+	if !assert.NoError(t, err, "NewBackend should succeed") {
+		return
+	}
+
+	// stored counts the variants in the wrapped backend
+	stored := func() int {
+		var n int
+		b.(*contentBackend).backend.(Lister).List(context.Background(), func(m *metadata.Metadata) error {
+			if m.Preset != contentSourcePreset {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+
+	ctx := context.Background()
+	a, _ := url.Parse(origin.URL + "/a.png")
+	bu, _ := url.Parse(origin.URL + "/b.png")
+	for _, u := range []*url.URL{a, bu} {
+		if !assert.NoError(t, b.StoreTransformedContent(ctx, u, presets), "StoreTransformedContent should succeed for %s", u) {
+			return
+		}
+		if _, err := b.Get(ctx, u, "small"); !assert.NoError(t, err, "variant of %s should be stored", u) {
+			return
+		}
+	}
+	if !assert.Equal(t, len(presets), stored(), "variants of the same image should be stored once") {
+		return
+	}
+
+	st := b.(Storage)
+	m, err := st.Metadata(ctx, bu, "small")
+	if !assert.NoError(t, err, "Metadata should succeed") {
+		return
+	}
+	if !assert.Equal(t, bu.String(), m.SourceURL, "metadata should refer to the requested URL") {
+		return
+	}
+	oldSum := m.SourceSHA256
+
+	mu.Lock()
+	content["/a.png"] = changed.Bytes()
+	mu.Unlock()
+	if !assert.NoError(t, b.StoreTransformedContent(ctx, a, presets), "StoreTransformedContent should succeed") {
+		return
+	}
+	if !assert.Equal(t, 2*len(presets), stored(), "a changed image should be stored as new variants") {
+		return
+	}
+	m, err = st.Metadata(ctx, a, "small")
+	if !assert.NoError(t, err, "Metadata should succeed") {
+		return
+	}
+	if !assert.NotEqual(t, oldSum, m.SourceSHA256, "changed image should be served") {
+		return
+	}
+
+	if !assert.NoError(t, b.Delete(ctx, bu, nil), "Delete should succeed") {
+		return
+	}
+	if _, err := b.Get(ctx, bu, "small"); !assert.True(t, errors.IsTransformationRequired(err), "deleted variant should be gone") {
+		return
+	}
+	if _, err := b.Get(ctx, a, "small"); !assert.NoError(t, err, "variant of the changed image should be kept") {
+		return
+	}
+
+	var listed []string
+	b.(Lister).List(ctx, func(m *metadata.Metadata) error {
+		listed = append(listed, m.SourceURL)
+		return nil
+	})
+	if !assert.Equal(t, []string{a.String()}, listed, "List should return the URLs that are stored") {
+		return
+	}
+
+	for _, bc := range []BackendConfig{
+		{Type: "memory", ContentKeys: true, Previous: &BackendConfig{Type: "memory"}},
+		{Type: "fs", ContentKeys: true, FileSystem: fs.Config{Root: "/tmp", MaxStale: time.Hour}},
+	} {
+		if _, err := NewServer(&Config{Backend: bc}); !assert.Error(t, err, "%#v should be rejected", bc) {
+			return
+		}
+	}
+	_, err = NewServer(&Config{Backend: BackendConfig{Type: "memory", ContentKeys: true}, Presets: map[string]string{contentSourcePreset: "10x10"}})
+	if !assert.Error(t, err, "reserved preset name should be rejected") {
+		return
+	}
+}
+
+func TestListenerRoles(t *testing.T) {
+	c := Config{
+		Tokens: []string{"AbCdEfG"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	newListener := func(lc ListenerConfig) *httptest.Server {
+		lh, err := newListenerHandler(&lc, s)
+		if !assert.NoError(t, err, "newListenerHandler should succeed") {
+			return nil
+		}
+		return httptest.NewServer(lh)
+	}
+
+	public := newListener(ListenerConfig{Addr: "public", Roles: []string{RoleDispatch}})
+	if public == nil {
+		return
+	}
+	defer public.Close()
+	internal := newListener(ListenerConfig{Addr: "internal", Roles: []string{RoleGuardian, RoleAdmin, RoleDebug}})
+	if internal == nil {
+		return
+	}
+	defer internal.Close()
+	restricted := newListener(ListenerConfig{Addr: "restricted", Roles: []string{RoleAdmin}, Access: &AccessConfig{AllowFrom: []string{"192.0.2.0/24"}}})
+	if restricted == nil {
+		return
+	}
+	defer restricted.Close()
+
+	for _, tc := range []struct {
+		base   string
+		method string
+		path   string
+		status int
+	}{
+		{public.URL, http.MethodGet, "/", http.StatusBadRequest}, // no url given
+		{public.URL, http.MethodPost, "/", http.StatusNotFound},
+		{public.URL, http.MethodGet, "/admin/config", http.StatusNotFound},
+		{public.URL, http.MethodGet, "/debug/pprof/", http.StatusNotFound},
+		{internal.URL, http.MethodGet, "/", http.StatusNotFound},
+		{internal.URL, http.MethodPost, "/", http.StatusBadRequest},
+		{internal.URL, http.MethodGet, "/admin/config", http.StatusOK},
+		{internal.URL, http.MethodGet, "/debug/pprof/", http.StatusOK},
+		{restricted.URL, http.MethodGet, "/admin/config", http.StatusForbidden},
+		// without a listener, debug endpoints are never served
+		{st.URL, http.MethodGet, "/debug/pprof/", http.StatusNotFound},
+		{st.URL, http.MethodGet, "/admin/config", http.StatusOK},
+	} {
+		req, err := http.NewRequest(tc.method, tc.base+tc.path, nil)
+		if !assert.NoError(t, err, "http.NewRequest should succeed") {
+			return
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, tc.status, res.StatusCode, "status code for %s %s should match", tc.method, tc.path) {
+			return
+		}
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	c := Config{
+		Presets:  map[string]string{"small": "120x90", "square": "64"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, err := NewServer(&c, WithBackend(&flakyBackend{}))
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	st := httptest.NewServer(s)
+	defer st.Close()
+
+	res, err := http.Get(st.URL + "/placeholder/small")
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusNotFound, res.StatusCode, "placeholders should be disabled by default") {
+		return
+	}
+
+	s.config.Placeholders = &PlaceholderConfig{}
+	s.config.applyDefaults()
+
+	for preset, size := range map[string][2]int{"small": {120, 90}, "square": {64, 64}} {
+		res, err := http.Get(st.URL + "/placeholder/" + preset + "?text=hello&bg=%23336699")
+		if !assert.NoError(t, err, "http.Get should succeed") {
+			return
+		}
+		m, err := png.Decode(res.Body)
+		res.Body.Close()
+		if !assert.NoError(t, err, "response should be a PNG image") {
+			return
+		}
+		if !assert.Equal(t, size, [2]int{m.Bounds().Dx(), m.Bounds().Dy()}, "dimensions of %s should match", preset) {
+			return
+		}
+		if !assert.Equal(t, "public, max-age=86400", res.Header.Get("Cache-Control"), "Cache-Control should be set") {
+			return
+		}
+	}
+
+	for path, status := range map[string]int{
+		"/placeholder/small?bg=red": http.StatusBadRequest,
+		"/placeholder/huge":         http.StatusNotFound,
+	} {
+		res, err := http.Get(st.URL + path)
+		if !assert.NoError(t, err, "http.Get should succeed") {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, status, res.StatusCode, "status code for %s should match", path) {
+			return
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	src := httptest.NewServer(http.FileServer(http.Dir("etc")))
+	defer src.Close()
+
+	c := Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Presets:  map[string]string{"small": "10x10", "wide": "40x20"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	u := src.URL + "/sharaq.png"
+	v := url.Values{"url": {u}, "dry-run": {"1"}}
+	req, err := http.NewRequest(http.MethodPost, st.URL+"/?"+v.Encode(), nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	defer res.Body.Close()
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "dry runs should reply with a report") {
+		return
+	}
+
+	var report dryRunResponse
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&report), "report should be JSON") {
+		return
+	}
+	if !assert.Len(t, report.Presets, 2, "every preset should be reported") {
+		return
+	}
+	for preset, result := range report.Presets {
+		if !assert.Empty(t, result.Error, "%s should be transformed", preset) {
+			return
+		}
+		if !assert.True(t, result.Size > 0, "size of %s should be reported", preset) {
+			return
+		}
+	}
+	if !assert.Equal(t, 10, report.Presets["small"].Width, "width should be reported") {
+		return
+	}
+
+	pu, _ := url.Parse(u)
+	for preset := range c.Presets {
+		_, err := s.backend.Get(context.Background(), pu, preset)
+		if !assert.True(t, errors.IsTransformationRequired(err), "%s should not be stored", preset) {
+			return
+		}
+	}
+}
+
+func TestReverseIndex(t *testing.T) {
+	src := httptest.NewServer(http.FileServer(http.Dir("etc")))
+	defer src.Close()
+
+	dir, err := ioutil.TempDir("", "sharaq-reverse-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	c := Config{
+		Backend: BackendConfig{
+			Type:       "fs",
+			FileSystem: fs.Config{Root: dir, Paths: fs.PathConfig{Filename: true}},
+		},
+		Presets:      map[string]string{"small": "10x10"},
+		Tokens:       []string{"AbCdEfG"},
+		URLCache:     &urlcache.Config{Type: "Memory"},
+		ReverseIndex: &ReverseIndexConfig{},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	do := func(method, path string, v url.Values) (*http.Response, error) {
+		req, err := http.NewRequest(method, st.URL+path+"?"+v.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		return http.DefaultClient.Do(req)
+	}
+
+	u := src.URL + "/sharaq.png"
+	res, err := do(http.MethodPost, "/", url.Values{"url": {u}})
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusNoContent, res.StatusCode, "request should succeed") {
+		return
+	}
+
+	pu, _ := url.Parse(u)
+	p := s.backend.(Locator).VariantPath(pu, "small")
+	if !assert.Contains(t, p, "sharaq.png_", "path should contain the file name") {
+		return
+	}
+
+	res, err = do(http.MethodGet, "/admin/lookup", url.Values{"path": {"/" + p}})
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	defer res.Body.Close()
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "stored variants should be found") {
+		return
+	}
+	var entry reverseEntry
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&entry), "response should be JSON") {
+		return
+	}
+	if !assert.Equal(t, reverseEntry{Path: p, URL: u, Preset: "small"}, entry, "source should be found") {
+		return
+	}
+
+	res, err = do(http.MethodGet, "/admin/lookup", url.Values{"path": {"small/unknown.png"}})
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusNotFound, res.StatusCode, "unknown paths should not be found") {
+		return
+	}
+}
+
+type checkedBackend struct {
+	flakyBackend
+	err error
+}
+
+func TestDuplicateIndex(t *testing.T) {
+	src := httptest.NewServer(http.FileServer(http.Dir("etc")))
+	defer src.Close()
+
+	c := Config{
+		Backend:        BackendConfig{Type: "memory"},
+		Presets:        map[string]string{"small": "10x10"},
+		Tokens:         []string{"AbCdEfG"},
+		URLCache:       &urlcache.Config{Type: "Memory"},
+		DuplicateIndex: &DuplicateIndexConfig{},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	do := func(method, path string, v url.Values) (*http.Response, error) {
+		req, err := http.NewRequest(method, st.URL+path+"?"+v.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		return http.DefaultClient.Do(req)
+	}
+
+	// the same image, published under two URLs
+	u1 := src.URL + "/sharaq.png"
+	u2 := src.URL + "/sharaq.png?reupload=1"
+	for _, u := range []string{u1, u2} {
+		res, err := do(http.MethodPost, "/", url.Values{"url": {u}})
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, http.StatusNoContent, res.StatusCode, "request should succeed") {
+			return
+		}
+	}
+
+	res, err := do(http.MethodGet, "/admin/duplicates", url.Values{"url": {u1}})
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	defer res.Body.Close()
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "lookup should succeed") {
+		return
+	}
+	var found duplicatesResponse
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&found), "response should be JSON") {
+		return
+	}
+	if !assert.Len(t, found.Matches, 2, "both sources should be found") {
+		return
+	}
+	for _, m := range found.Matches {
+		if !assert.Equal(t, 0, m.Distance, "hashes should match exactly") {
+			return
+		}
+	}
+
+	// a hash that differs in 5 bits, 2 of them in the same band
+	h, err := phash.Parse(found.PerceptualHash)
+	if !assert.NoError(t, err, "hash should be valid") {
+		return
+	}
+	near := phash.Format(h ^ 0x0003000100010001)
+	for _, tt := range []struct {
+		distance string
+		matches  int
+	}{
+		{"4", 0},
+		{"5", 2},
+	} {
+		res, err := do(http.MethodGet, "/admin/duplicates", url.Values{"phash": {near}, "distance": {tt.distance}})
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return
+		}
+		var found duplicatesResponse
+		err = json.NewDecoder(res.Body).Decode(&found)
+		res.Body.Close()
+		if !assert.NoError(t, err, "response should be JSON") {
+			return
+		}
+		if !assert.Len(t, found.Matches, tt.matches, "sources within distance %s should be found", tt.distance) {
+			return
+		}
+	}
+
+	for _, v := range []url.Values{{"phash": {"xyz"}}, {"phash": {near}, "distance": {"8"}}, {}} {
+		res, err := do(http.MethodGet, "/admin/duplicates", v)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, http.StatusBadRequest, res.StatusCode, "bad request should be rejected: %v", v) {
+			return
+		}
+	}
+}
+
+func (b *checkedBackend) CheckHealth(context.Context) error {
+	return b.err
+}
+
+func TestUpstream(t *testing.T) {
+	var fetches int32
+	files := http.FileServer(http.Dir("etc"))
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		files.ServeHTTP(w, r)
+	}))
+	defer src.Close()
+
+	presets := map[string]string{"small": "10x10", "large": "20x20"}
+	central, cst, err := newSharaq(&Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Presets:  presets,
+		Tokens:   []string{"CeNtRaL"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	})
+	if !assert.NoError(t, err, "creating central server should succeed") {
+		return
+	}
+	defer cst.Close()
+	if !assert.NoError(t, central.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	edge, est, err := newSharaq(&Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Presets:  presets,
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+		Upstream: &UpstreamConfig{URL: cst.URL + "/", Token: "CeNtRaL"},
+	})
+	if !assert.NoError(t, err, "creating edge server should succeed") {
+		return
+	}
+	defer est.Close()
+	if !assert.NoError(t, edge.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	u := src.URL + "/sharaq.png"
+	req, err := http.NewRequest(http.MethodPost, est.URL+"/?"+url.Values{"url": {u}}.Encode(), nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusNoContent, res.StatusCode, "request should succeed") {
+		return
+	}
+	if !assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "only the upstream should fetch the source") {
+		return
+	}
+
+	pu, _ := url.Parse(u)
+	for preset := range presets {
+		var want, got bytes.Buffer
+		cm, err := central.Backend().(Storage).Fetch(context.Background(), pu, preset, &want)
+		if !assert.NoError(t, err, "central should have stored %s", preset) {
+			return
+		}
+		em, err := edge.Backend().(Storage).Fetch(context.Background(), pu, preset, &got)
+		if !assert.NoError(t, err, "edge should have stored %s", preset) {
+			return
+		}
+		if !assert.Equal(t, want.Bytes(), got.Bytes(), "edge should store the variant of the upstream") {
+			return
+		}
+		if !assert.Equal(t, cm.DominantColor, em.DominantColor, "edge should store the metadata of the upstream") {
+			return
+		}
+	}
+
+	// the endpoint is only for other sharaq instances
+	res, err = http.Get(cst.URL + "/variant?" + url.Values{"url": {u}, "preset": {"small"}}.Encode())
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusForbidden, res.StatusCode, "requests without a token should be rejected") {
+		return
+	}
+}
+
+func TestHealth(t *testing.T) {
+	cur := &checkedBackend{}
+	prev := &checkedBackend{}
+	c := Config{
+		Presets:  map[string]string{"small": "10x10"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+		Health:   &HealthConfig{},
+	}
+	s, err := NewServer(&c, WithBackend(newDualBackend(cur, prev, nil)))
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	st := httptest.NewServer(s)
+	defer st.Close()
+
+	ready := func() (int, readyResponse, error) {
+		var resp readyResponse
+		res, err := http.Get(st.URL + "/ready")
+		if err != nil {
+			return 0, resp, err
+		}
+		defer res.Body.Close()
+		return res.StatusCode, resp, json.NewDecoder(res.Body).Decode(&resp)
+	}
+
+	ctx := context.Background()
+	s.health.check(ctx)
+	status, resp, err := ready()
+	if !assert.NoError(t, err, "/ready should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, status, "healthy backends should be ready") {
+		return
+	}
+	if !assert.True(t, resp.Engine.Healthy, "the transformer should pass its self-test") {
+		return
+	}
+
+	cur.err = errors.New(`bucket is gone`)
+	s.health.check(ctx)
+	if !assert.False(t, s.backend.(*dualBackend).failingOver(), "a single failure should be tolerated") {
+		return
+	}
+	s.health.check(ctx)
+	status, resp, err = ready()
+	if !assert.NoError(t, err, "/ready should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, status, "the previous backend should serve requests") {
+		return
+	}
+	if !assert.True(t, resp.FailedOver, "should fail over to the previous backend") {
+		return
+	}
+	if !assert.Equal(t, "bucket is gone", resp.Backends["backend"].Error, "error should be reported") {
+		return
+	}
+
+	v := url.Values{"url": {"http://example.com/foo.jpg"}}
+	req, err := http.NewRequest(http.MethodPost, st.URL+"/?"+v.Encode(), nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Len(t, prev.calls, 1, "variants should be stored in the previous backend") {
+		return
+	}
+	if !assert.Len(t, cur.calls, 0, "variants should not be stored in the unhealthy backend") {
+		return
+	}
+
+	prev.err = errors.New(`disk full`)
+	s.health.check(ctx)
+	s.health.check(ctx)
+	status, _, err = ready()
+	if !assert.NoError(t, err, "/ready should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusServiceUnavailable, status, "should not be ready without a healthy backend") {
+		return
+	}
+
+	cur.err = nil
+	s.health.check(ctx)
+	if !assert.False(t, s.backend.(*dualBackend).failingOver(), "should fail back once the backend is healthy") {
+		return
+	}
+	// a broken engine keeps the server from becoming ready
+	s.engine = healthStatus{Error: "broken encoder"}
+	status, _, err = ready()
+	if !assert.NoError(t, err, "/ready should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusServiceUnavailable, status, "should not be ready with a broken engine") {
+		return
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	src := httptest.NewServer(http.FileServer(http.Dir("etc")))
+	defer src.Close()
+
+	c := Config{
+		Backend:     BackendConfig{Type: "memory"},
+		Compression: &CompressionConfig{Routes: []string{"/"}},
+		Presets:     map[string]string{"small": "10x10"},
+		Tokens:      []string{"AbCdEfG"},
+		URLCache:    &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	v := url.Values{"url": {src.URL + "/sharaq.png"}, "preset": {"small"}}
+	do := func(method string, header http.Header) (*http.Response, []byte, error) {
+		req, err := http.NewRequest(method, st.URL+"/?"+v.Encode(), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header = header
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		// don't let the transport decompress (and drop Content-Length)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		return res, b, err
+	}
+
+	res, _, err := do(http.MethodHead, http.Header{DebugHeader: {"1"}})
+	if !assert.NoError(t, err, "HEAD should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusFound, res.StatusCode, "HEAD misses should be redirected") {
+		return
+	}
+	if !assert.Contains(t, res.Header.Get(TraceHeader), "transform=head@", "HEAD misses should not be transformed") {
+		return
+	}
+
+	res, _, err = do(http.MethodPost, http.Header{})
+	if !assert.NoError(t, err, "POST should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusNoContent, res.StatusCode, "variant should be stored") {
+		return
+	}
+
+	res, body, err := do(http.MethodGet, http.Header{})
+	if !assert.NoError(t, err, "GET should succeed") {
+		return
+	}
+	if !assert.Equal(t, strconv.Itoa(len(body)), res.Header.Get("Content-Length"), "Content-Length should match the variant") {
+		return
+	}
+	if !assert.Empty(t, res.TransferEncoding, "variant should not be chunked") {
+		return
+	}
+
+	res, _, err = do(http.MethodHead, http.Header{})
+	if !assert.NoError(t, err, "HEAD should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "HEAD should be answered like GET") {
+		return
+	}
+	if !assert.Equal(t, strconv.Itoa(len(body)), res.Header.Get("Content-Length"), "HEAD should report the length of the variant") {
+		return
+	}
+
+	res, partial, err := do(http.MethodGet, http.Header{"Range": {"bytes=0-9"}})
+	if !assert.NoError(t, err, "GET should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusPartialContent, res.StatusCode, "ranges should be served") {
+		return
+	}
+	if !assert.Equal(t, "10", res.Header.Get("Content-Length"), "Content-Length should match the range") {
+		return
+	}
+	if !assert.Equal(t, body[:10], partial, "range should be served") {
+		return
+	}
+}
+
+func TestInternalPresets(t *testing.T) {
+	c := Config{
+		Presets:         map[string]string{"small": "200x200", "large": "4000x4000"},
+		PresetTemplates: map[string]PresetTemplate{"w{w}": {MaxWidth: 1024}},
+		Signing:         &SigningConfig{Key: "s3cr3t"},
+		Internal:        &InternalPresetsConfig{Presets: []string{"huge"}},
+	}
+	_, err := NewServer(&c)
+	if !assert.Error(t, err, "unknown internal presets should be rejected") {
+		return
+	}
+
+	c.Internal.Presets = []string{"large", "w{w}"}
+	c.Internal.AllowFrom = []string{"10.0.0.0/8"}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	s.backend = staticBackend{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}
+
+	source := "http://example.com/foo.jpg"
+	get := func(u string) (int, error) {
+		res, err := http.Get(u)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	for preset, status := range map[string]int{
+		"small": http.StatusOK,
+		"large": http.StatusForbidden,
+		"w640":  http.StatusForbidden,
+	} {
+		got, err := get(st.URL + "/?" + url.Values{"url": {source}, "preset": {preset}}.Encode())
+		if !assert.NoError(t, err, "http.Get should succeed") {
+			return
+		}
+		if !assert.Equal(t, status, got, "status code for %s should match", preset) {
+			return
+		}
+	}
+
+	signed, err := SignURL(st.URL, []byte("s3cr3t"), source, "large", time.Now().Add(time.Minute))
+	if !assert.NoError(t, err, "SignURL should succeed") {
+		return
+	}
+	got, err := get(signed)
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, got, "signed requests for internal presets should be accepted") {
+		return
+	}
+
+	c.Internal.AllowFrom = []string{"127.0.0.1", "::1"}
+	s2, st2, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st2.Close()
+	s2.backend = s.backend
+
+	got, err = get(st2.URL + "/?" + url.Values{"url": {source}, "preset": {"large"}}.Encode())
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, got, "allowed networks should be served internal presets") {
+		return
+	}
+}
+
+// originalBackend only has stored originals, and drops everything else
+type originalBackend struct {
+	handler http.Handler
+}
+
+func (b originalBackend) Get(_ context.Context, _ *url.URL, preset string) (http.Handler, error) {
+	if preset != OriginalPreset {
+		return nil, errors.TransformationRequiredError{}
+	}
+	return b.handler, nil
+}
+func (originalBackend) StoreTransformedContent(context.Context, *url.URL, map[string]string) error {
+	return nil
+}
+func (originalBackend) Delete(context.Context, *url.URL, []string) error { return nil }
+
+func TestInternalOriginalFallback(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	c := Config{
+		Presets:  map[string]string{"small": "200x200", OriginalPreset: ""},
+		Signing:  &SigningConfig{Key: "s3cr3t"},
+		Internal: &InternalPresetsConfig{Presets: []string{OriginalPreset}, AllowFrom: []string{"10.0.0.0/8"}},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	backend := originalBackend{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("original"))
+	})}
+	s.backend = backend
+
+	cl := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	source := newURL(src, "sharaq.png")
+	get := func(st *httptest.Server) (int, error) {
+		signed, err := SignURL(st.URL, []byte("s3cr3t"), source, "small", time.Now().Add(time.Minute))
+		if err != nil {
+			return 0, err
+		}
+		res, err := cl.Get(signed)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	got, err := get(st)
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusFound, got, "signatures for public presets should not reach the internal original") {
+		return
+	}
+
+	c.Internal.AllowFrom = []string{"127.0.0.1", "::1"}
+	s2, st2, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st2.Close()
+	s2.backend = backend
+
+	got, err = get(st2)
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, got, "allowed networks should fall back to the internal original") {
+		return
+	}
+}
+
+func TestEvents(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	c := Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Presets:  map[string]string{"small": "200x200"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	received := make(chan *events.Event, 2)
+	s.SetEventPublisher(events.PublisherFunc(func(_ context.Context, ev *events.Event) error {
+		received <- ev
+		return nil
+	}))
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	source := newURL(src, "sharaq.png")
+	guardian := func(method string) int {
+		v := url.Values{"url": {source}}
+		req, err := http.NewRequest(method, st.URL+"/?"+v.Encode(), nil)
+		if !assert.NoError(t, err, "http.NewRequest should succeed") {
+			return 0
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	next := func() *events.Event {
+		select {
+		case ev := <-received:
+			return ev
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}
+
+	if !assert.Equal(t, http.StatusNoContent, guardian(http.MethodPost), "POST should succeed") {
+		return
+	}
+	ev := next()
+	if !assert.NotNil(t, ev, "transform event should be published") {
+		return
+	}
+	if !assert.Equal(t, events.TypeTransform, ev.Type, "event should be a transform event") {
+		return
+	}
+	if !assert.Equal(t, source, ev.URL, "event should carry the source URL") {
+		return
+	}
+	if !assert.Equal(t, "small", ev.Preset, "event should carry the preset") {
+		return
+	}
+	if !assert.True(t, ev.Bytes > 0, "event should carry the size of the variant") {
+		return
+	}
+
+	if !assert.Equal(t, http.StatusOK, guardian(http.MethodDelete), "DELETE should succeed") {
+		return
+	}
+	ev = next()
+	if !assert.NotNil(t, ev, "delete event should be published") {
+		return
+	}
+	if !assert.Equal(t, events.TypeDelete, ev.Type, "event should be a delete event") {
+		return
+	}
+	if !assert.Equal(t, "small", ev.Preset, "event should carry the preset") {
+		return
+	}
+}
+
+func TestConfigWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sharaq-watch")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// lay out the files like a mounted ConfigMap, which is updated by
+	// replacing the ..data symlink
+	update := func(version, content string) error {
+		data := filepath.Join(dir, version)
+		if err := os.Mkdir(data, 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(data, "sharaq.json"), []byte(content), 0644); err != nil {
+			return err
+		}
+		tmp := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(version, tmp); err != nil {
+			return err
+		}
+		return os.Rename(tmp, filepath.Join(dir, "..data"))
+	}
+	if !assert.NoError(t, update("v1", `{"Presets": {"small": "200x200"}}`), "writing config should succeed") {
+		return
+	}
+	if !assert.NoError(t, os.Symlink(filepath.Join("..data", "sharaq.json"), filepath.Join(dir, "sharaq.json")), "os.Symlink should succeed") {
+		return
+	}
+
+	var c Config
+	if !assert.NoError(t, c.ParseFileEnv(filepath.Join(dir, "sharaq.json"), "production"), "ParseFileEnv should succeed") {
+		return
+	}
+	s, err := NewServer(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	if !assert.False(t, s.configChanged(ctx, &c), "config should not have changed") {
+		return
+	}
+
+	if !assert.NoError(t, update("v2", `{"Presets": {"small": "200x200"`), "writing config should succeed") {
+		return
+	}
+	if !assert.False(t, s.configChanged(ctx, &c), "broken config should be ignored") {
+		return
+	}
+
+	if !assert.NoError(t, update("v3", `{"Presets": {"small": "100x100"}}`), "writing config should succeed") {
+		return
+	}
+	if !assert.True(t, s.configChanged(ctx, &c), "config should have changed") {
+		return
+	}
+
+	// overlays that did not exist are watched too
+	var c2 Config
+	if !assert.NoError(t, c2.ParseFileEnv(filepath.Join(dir, "sharaq.json"), "production"), "ParseFileEnv should succeed") {
+		return
+	}
+	if !assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sharaq.production.json"), []byte(`{"Presets": {"small": "50x50"}}`), 0644), "ioutil.WriteFile should succeed") {
+		return
+	}
+	if !assert.True(t, s.configChanged(ctx, &c2), "created overlay should be a change") {
+		return
+	}
+}
+
+func TestDynamic(t *testing.T) {
+	value := `{"Presets": {"small": "100x100"}, "Whitelist": ["^http://allowed\\.example\\.com/"]}`
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "10")
+		w.Write([]byte(value))
+	}))
+	defer consul.Close()
+
+	c := Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Dynamic:  &kvconfig.Config{Type: "consul", Addr: consul.URL, Key: "sharaq"},
+		Presets:  map[string]string{"small": "200x200"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, err := NewServer(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+
+	ctx := context.Background()
+	s.loadDynamic(ctx)
+	s.dynamic.apply(s.config)
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	if !assert.Equal(t, map[string]string{"small": "100x100"}, s.config.Presets, "presets should be replaced") {
+		return
+	}
+	allowed, _ := url.Parse("http://allowed.example.com/a.jpg")
+	denied, _ := url.Parse("http://denied.example.com/a.jpg")
+	if !assert.True(t, s.allowedTarget(allowed), "whitelist should be applied") {
+		return
+	}
+	if !assert.False(t, s.allowedTarget(denied), "whitelist should be applied") {
+		return
+	}
+
+	// the same settings at the same index are not a change
+	changed, err := s.dynamic.update([]byte(value), 10, s.config)
+	if !assert.NoError(t, err, "update should succeed") {
+		return
+	}
+	if !assert.False(t, changed, "settings should not have changed") {
+		return
+	}
+
+	// broken settings are rejected
+	changed, err = s.dynamic.update([]byte(`{"Whitelist": ["("]}`), 11, s.config)
+	if !assert.Error(t, err, "invalid settings should be rejected") {
+		return
+	}
+	if !assert.False(t, changed, "invalid settings should not be a change") {
+		return
+	}
+
+	changed, err = s.dynamic.update([]byte(`{"Flags": {"fast": {"Percent": 10, "Rule": "linear"}}}`), 12, s.config)
+	if !assert.NoError(t, err, "update should succeed") {
+		return
+	}
+	if !assert.True(t, changed, "settings should have changed") {
+		return
+	}
+	reloaded := Config{Presets: map[string]string{"small": "200x200"}}
+	if !assert.NoError(t, s.dynamic.apply(&reloaded), "apply should succeed") {
+		return
+	}
+	if !assert.Equal(t, "200x200", reloaded.Presets["small"], "presets that are not set should be kept") {
+		return
+	}
+	if !assert.Equal(t, 10.0, reloaded.Flags["fast"].Percent, "flags should be replaced") {
+		return
+	}
+
+	// presets that other settings refer to must not be removed
+	s.config.Profiles = map[string][]string{"web": {"small"}}
+	changed, err = s.dynamic.update([]byte(`{"Presets": {"large": "800x800"}}`), 13, s.config)
+	if !assert.Error(t, err, "settings that remove referenced presets should be rejected") {
+		return
+	}
+	if !assert.False(t, changed, "rejected settings should not be a change") {
+		return
+	}
+	if !assert.Equal(t, 10.0, s.dynamic.settings.Flags["fast"].Percent, "rejected settings should not replace the current ones") {
+		return
+	}
+
+	// nor by a config file that was reloaded since the settings were read
+	changed, err = s.dynamic.update([]byte(`{"Presets": {"large": "800x800"}}`), 14, &Config{Presets: map[string]string{"small": "200x200"}})
+	if !assert.NoError(t, err, "update should succeed") {
+		return
+	}
+	if !assert.True(t, changed, "settings should have changed") {
+		return
+	}
+	reloaded = Config{
+		Presets:  map[string]string{"small": "200x200"},
+		Profiles: map[string][]string{"web": {"small"}},
+	}
+	if !assert.Error(t, s.dynamic.apply(&reloaded), "settings that remove referenced presets should not be applied") {
+		return
+	}
+	if !assert.Equal(t, map[string]string{"small": "200x200"}, reloaded.Presets, "config should be left as is") {
+		return
+	}
+}
+
+func TestBudget(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	c := Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Budget:   &BudgetConfig{OriginBytesPerHour: 1},
+		Presets:  map[string]string{"small": "200x200"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+
+	reported := make(chan *errreport.Event, 1)
+	s.SetErrorReporter(errreport.ReporterFunc(func(_ context.Context, ev *errreport.Event) {
+		reported <- ev
+	}))
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	guardian := func(source string) int {
+		v := url.Values{"url": {source}}
+		req, err := http.NewRequest(http.MethodPost, st.URL+"/?"+v.Encode(), nil)
+		if !assert.NoError(t, err, "http.NewRequest should succeed") {
+			return 0
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if !assert.Equal(t, http.StatusNoContent, guardian(newURL(src, "sharaq.png")), "POST within the budget should succeed") {
+		return
+	}
+	select {
+	case ev := <-reported:
+		if !assert.Equal(t, errreport.KindBudget, ev.Kind, "exceeding the budget should be reported") {
+			return
+		}
+		if !assert.Equal(t, "origin.hour", ev.Extra["budget"], "the exceeded budget should be reported") {
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("exceeding the budget was not reported")
+		return
+	}
+
+	if !assert.Equal(t, http.StatusServiceUnavailable, guardian(newURL(src, "sharaq.png")), "POST over the budget should be rejected") {
+		return
+	}
+
+	// misses are redirected without being transformed
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	source := newURL(src, "sharaq.png") + "?v=2"
+	v := url.Values{"url": {source}, "preset": {"small"}}
+	res, err := client.Get(st.URL + "/?" + v.Encode())
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusFound, res.StatusCode, "misses should be redirected") {
+		return
+	}
+	if !assert.Equal(t, source, res.Header.Get("Location"), "misses should be redirected to the origin") {
+		return
+	}
+	if !assert.Len(t, s.jobs.list(), 0, "misses should not be transformed") {
+		return
+	}
+
+	// budgets start over with the next period
+	s.budget.setClock(func() time.Time { return time.Now().Add(time.Hour) })
+	if over, _ := s.budget.exceeded(); !assert.False(t, over, "budget should be reset") {
+		return
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	src := newImageSource()
+	defer src.Close()
+
+	c := Config{
+		Backend:  BackendConfig{Type: "memory"},
+		Presets:  map[string]string{"small": "10x10"},
+		Tokens:   []string{"AbCdEfG"},
+		URLCache: &urlcache.Config{Type: "Memory"},
+	}
+	s, st, err := newSharaq(&c)
+	if !assert.NoError(t, err, "creating sharaq server should succeed") {
+		return
+	}
+	defer st.Close()
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	do := func(method, path string, v url.Values) int {
+		req, err := http.NewRequest(method, st.URL+path+"?"+v.Encode(), nil)
+		if !assert.NoError(t, err, "http.NewRequest should succeed") {
+			return 0
+		}
+		req.Header.Set("Sharaq-Token", "AbCdEfG")
+		res, err := client.Do(req)
+		if !assert.NoError(t, err, "http.Do should succeed") {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	stored := url.Values{"url": {newURL(src, "sharaq.png")}}
+	if !assert.Equal(t, http.StatusNoContent, do(http.MethodPost, "/", stored), "POST should succeed") {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, do(http.MethodPost, "/admin/readonly", url.Values{"enabled": {"true"}}), "enabling read-only mode should succeed") {
+		return
+	}
+
+	// admin clients get errors in the same format as everyone else
+	req, err := http.NewRequest(http.MethodPost, st.URL+"/admin/readonly?enabled=maybe", nil)
+	if !assert.NoError(t, err, "http.NewRequest should succeed") {
+		return
+	}
+	req.Header.Set("Sharaq-Token", "AbCdEfG")
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if !assert.NoError(t, err, "http.Do should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusBadRequest, res.StatusCode, "bad value should be rejected") {
+		return
+	}
+	if !assert.Equal(t, "application/json", res.Header.Get("Content-Type"), "admin errors should be JSON") {
+		return
+	}
+
+	if !assert.Equal(t, http.StatusServiceUnavailable, do(http.MethodPost, "/", stored), "POST should be rejected") {
+		return
+	}
+	if !assert.Equal(t, http.StatusServiceUnavailable, do(http.MethodDelete, "/", stored), "DELETE should be rejected") {
+		return
+	}
+
+	stored.Set("preset", "small")
+	if !assert.Equal(t, http.StatusOK, do(http.MethodGet, "/", stored), "stored variants should be served") {
+		return
+	}
+	missing := url.Values{"url": {newURL(src, "sharaq.png") + "?v=2"}, "preset": {"small"}}
+	if !assert.Equal(t, http.StatusFound, do(http.MethodGet, "/", missing), "misses should be redirected") {
+		return
+	}
+	if !assert.Len(t, s.jobs.list(), 0, "misses should not be transformed") {
+		return
+	}
+
+	// toggles survive reloads that do not change ReadOnly
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	if !assert.True(t, s.readOnly.on(), "read-only mode should survive reloads") {
+		return
+	}
+	s.config.ReadOnly = true
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	s.config.ReadOnly = false
+	if !assert.NoError(t, s.Initialize(), "Initialize should succeed") {
+		return
+	}
+	if !assert.False(t, s.readOnly.on(), "changes to ReadOnly should be applied on reload") {
+		return
+	}
+
+	stored.Del("preset")
+	if !assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/", stored), "DELETE should succeed again") {
+		return
+	}
+}
+
+func TestLint(t *testing.T) {
+	c := Config{
+		Presets: map[string]string{
+			"email-thumb": "200x200,jpeg",
+			"wando-thumb": "200x200,jpg",
+			"huge":        "40000x300",
+			"original":    "",
+		},
+		PresetTemplates: map[string]PresetTemplate{
+			"thumb-{w}": {MaxWidth: 100000},
+		},
+		Profiles: map[string][]string{
+			"email": {"email-thumb", "huge"},
+		},
+	}
+
+	expected := []string{
+		`preset 'huge' has a dimension larger than 8192: '40000x300'`,
+		`preset 'wando-thumb' is not in any profile`,
+		`preset template 'thumb-{w}' allows dimensions larger than 8192`,
+		`presets 'email-thumb', 'wando-thumb' have the same rule '200x200,jpeg'`,
+	}
+	if !assert.Equal(t, expected, c.Lint(), "Lint should warn about presets") {
+		return
+	}
+
+	c = Config{Presets: map[string]string{"small": "100x100", "large": "800x800"}}
+	if !assert.Empty(t, c.Lint(), "Lint should not warn about distinct presets") {
+		return
+	}
+}
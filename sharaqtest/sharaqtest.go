@@ -0,0 +1,204 @@
+// Package sharaqtest provides utilities to test sharaq configurations,
+// such as preset definitions, without touching real storage.
+//
+// The server created by NewServer stores variants in memory, and comes
+// with an origin server that generates fixture images of any size
+package sharaqtest
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/lestrrat-go/sharaq"
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"github.com/lestrrat-go/sharaq/memory"
+	"golang.org/x/net/context"
+)
+
+// Token is the token that the harness uses to access the guardian
+const Token = "sharaqtest"
+
+// maxFixtureSize limits the dimensions of fixture images
+const maxFixtureSize = 4096
+
+// Server is a sharaq server that serves both the dispatcher (GET) and
+// the guardian (POST, DELETE) at URL. Variants are stored in memory,
+// and are discarded when the server is closed
+type Server struct {
+	*httptest.Server
+
+	// Origin serves the fixture images. See FixtureURL
+	Origin *httptest.Server
+
+	sharaq *sharaq.Server
+}
+
+// NewServer creates a new Server using a copy of the given
+// configuration. The backend and URL cache configuration are replaced
+// with in-memory versions, and Token is added to the list of tokens.
+// Everything else, including presets and the whitelist, is used as-is
+func NewServer(c *sharaq.Config) (*Server, error) {
+	var cc sharaq.Config
+	if c != nil {
+		cc = *c
+	}
+	cc.Backend = sharaq.BackendConfig{Type: "memory"}
+	cc.URLCache = &urlcache.Config{Type: "Memory"}
+	// copy, so that appending never writes to the caller's array
+	cc.Tokens = append(append([]string(nil), cc.Tokens...), Token)
+
+	s, err := sharaq.NewServer(&cc)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create sharaq server`)
+	}
+	if err := s.Initialize(); err != nil {
+		return nil, errors.Wrap(err, `failed to initialize sharaq server`)
+	}
+
+	return &Server{
+		Server: httptest.NewServer(s),
+		Origin: httptest.NewServer(FixtureHandler()),
+		sharaq: s,
+	}, nil
+}
+
+// Close shuts down both the sharaq server and the origin
+func (s *Server) Close() {
+	s.Server.Close()
+	s.Origin.Close()
+}
+
+// Sharaq returns the underlying sharaq server
+func (s *Server) Sharaq() *sharaq.Server {
+	return s.sharaq
+}
+
+// Backend returns the in-memory backend where variants are stored
+func (s *Server) Backend() *memory.Backend {
+	return s.sharaq.Backend().(*memory.Backend)
+}
+
+// FixtureURL returns the URL of a fixture image with the given
+// dimensions, served by Origin. format may be "png", "jpeg", or "gif"
+func (s *Server) FixtureURL(width, height int, format string) string {
+	return fmt.Sprintf("%s/%dx%d.%s", s.Origin.URL, width, height, format)
+}
+
+// FetchURL returns the dispatcher URL for the given source URL and preset
+func (s *Server) FetchURL(source, preset string) string {
+	return s.URL + "/?" + url.Values{"url": {source}, "preset": {preset}}.Encode()
+}
+
+// Store asks the guardian to generate the variants of the source URL.
+// Unlike fetching from the dispatcher, variants are available as soon
+// as Store returns
+func (s *Server) Store(source string) error {
+	return s.guardian(http.MethodPost, source, http.StatusNoContent)
+}
+
+// Delete asks the guardian to delete the variants of the source URL
+func (s *Server) Delete(source string) error {
+	return s.guardian(http.MethodDelete, source, http.StatusOK)
+}
+
+func (s *Server) guardian(method, source string, expected int) error {
+	req, err := http.NewRequest(method, s.URL+"/?"+url.Values{"url": {source}}.Encode(), nil)
+	if err != nil {
+		return errors.Wrap(err, `failed to create request`)
+	}
+	req.Header.Set("Sharaq-Token", Token)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, `%s request failed`, method)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != expected {
+		body, _ := ioutil.ReadAll(res.Body)
+		return errors.Errorf(`%s request returned %d: %s`, method, res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Variant decodes the stored variant of the source URL for the given
+// preset. It returns an error if the variant has not been generated
+func (s *Server) Variant(source, preset string) (image.Image, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to parse url`)
+	}
+
+	var buf bytes.Buffer
+	if _, err := s.Backend().Fetch(context.Background(), u, preset, &buf); err != nil {
+		return nil, errors.Wrapf(err, `failed to fetch variant %s (%s)`, source, preset)
+	}
+
+	img, _, err := image.Decode(&buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to decode variant %s (%s)`, source, preset)
+	}
+	return img, nil
+}
+
+// FixtureHandler returns the handler used by Origin. It generates
+// images for paths in the form of /{width}x{height}.{format}. Query
+// parameters are ignored, so they can be used to create distinct
+// source URLs for the same image
+func FixtureHandler() http.Handler {
+	return http.HandlerFunc(serveFixture)
+}
+
+func serveFixture(w http.ResponseWriter, r *http.Request) {
+	var width, height int
+	var format string
+	if _, err := fmt.Sscanf(strings.Replace(r.URL.Path, ".", " ", 1), "/%dx%d %s", &width, &height, &format); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if width <= 0 || height <= 0 || width > maxFixtureSize || height > maxFixtureSize {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A gradient, so that transformations actually make a difference
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), 128, 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg", "jpg":
+		format = "jpeg"
+		err = jpeg.Encode(&buf, img, nil)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/"+format)
+	w.Write(buf.Bytes())
+}
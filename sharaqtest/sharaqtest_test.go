@@ -0,0 +1,90 @@
+package sharaqtest_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/lestrrat-go/sharaq"
+	"github.com/lestrrat-go/sharaq/sharaqtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	s, err := sharaqtest.NewServer(&sharaq.Config{
+		Presets: map[string]string{
+			"small":  "16x16",
+			"medium": "32x",
+		},
+	})
+	if !assert.NoError(t, err, "sharaqtest.NewServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	src := s.FixtureURL(64, 48, "png")
+	if !assert.NoError(t, s.Store(src), "Store should succeed") {
+		return
+	}
+
+	img, err := s.Variant(src, "small")
+	if !assert.NoError(t, err, "Variant should succeed") {
+		return
+	}
+	if !assert.Equal(t, 16, img.Bounds().Dx(), "width should match") {
+		return
+	}
+	if !assert.Equal(t, 16, img.Bounds().Dy(), "height should match") {
+		return
+	}
+
+	img, err = s.Variant(src, "medium")
+	if !assert.NoError(t, err, "Variant should succeed") {
+		return
+	}
+	if !assert.Equal(t, 24, img.Bounds().Dy(), "aspect ratio should be preserved") {
+		return
+	}
+
+	res, err := http.Get(s.FetchURL(src, "small"))
+	if !assert.NoError(t, err, "http.Get should succeed") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "variant should be served") {
+		return
+	}
+	if !assert.Equal(t, "image/png", res.Header.Get("Content-Type"), "content type should match") {
+		return
+	}
+
+	if !assert.NoError(t, s.Delete(src), "Delete should succeed") {
+		return
+	}
+	if _, err := s.Variant(src, "small"); !assert.Error(t, err, "Variant should fail after Delete") {
+		return
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	tokens := make([]string, 1, 2)
+	tokens[0] = "mine"
+	c := sharaq.Config{
+		Presets: map[string]string{"small": "16x16"},
+		Tokens:  tokens,
+	}
+	s, err := sharaqtest.NewServer(&c)
+	if !assert.NoError(t, err, "sharaqtest.NewServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	if !assert.Equal(t, []string{"mine"}, c.Tokens, "tokens of the caller should not change") {
+		return
+	}
+	if !assert.Empty(t, tokens[:2][1], "array of the caller should not change") {
+		return
+	}
+	if !assert.Nil(t, c.URLCache, "URL cache of the caller should not change") {
+		return
+	}
+}
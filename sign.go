@@ -0,0 +1,196 @@
+package sharaq
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/errors"
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/util"
+)
+
+// SignURL returns the URL of the variant of source for the given preset,
+// signed with key. The signature is valid until expires. base is the URL
+// where the dispatcher is served, such as "https://images.example.com/".
+//
+// Application servers that have access to the key can use this to
+// create URLs without calling /sign
+func SignURL(base string, key []byte, source, preset string, expires time.Time) (string, error) {
+	return SignTextURL(base, key, source, preset, "", expires)
+}
+
+// SignTextURL is like SignURL, but the variant has text drawn onto it.
+// See TextOverlayConfig
+func SignTextURL(base string, key []byte, source, preset, text string, expires time.Time) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", errors.Wrap(err, `failed to parse base url`)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{
+		"url":     {source},
+		"preset":  {preset},
+		"expires": {exp},
+		"sig":     {signature(key, source, preset, text, exp)},
+	}
+	if text != "" {
+		q.Set("text", text)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// signature returns the signature of a dispatcher URL. The text is only
+// signed if present, so that signatures of URLs without text do not change
+func signature(key []byte, source, preset, text, expires string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(source + "\n" + preset + "\n" + expires))
+	if text != "" {
+		h.Write([]byte("\n" + text))
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// verifySignature checks the signature of a dispatcher request. Unsigned
+// requests are only accepted if signatures are not required
+func (s *Server) verifySignature(r *http.Request, preset string) error {
+	sc := s.config.Signing
+	if sc == nil {
+		return nil
+	}
+
+	sig := r.FormValue("sig")
+	if sig == "" {
+		if sc.Required {
+			return errors.New(`signature required`)
+		}
+		return nil
+	}
+
+	exp := r.FormValue("expires")
+	v, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return errors.Wrap(err, `invalid expires parameter`)
+	}
+	if time.Now().Unix() > v {
+		return errors.New(`signature expired`)
+	}
+
+	expected := signature([]byte(sc.Key), r.FormValue("url"), preset, r.FormValue("text"), exp)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return errors.New(`invalid signature`)
+	}
+	return nil
+}
+
+type signResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+	Version string    `json:"version,omitempty"`
+}
+
+// handleSign replies with a signed dispatcher URL for the given url
+// and preset. As with the guardian, a token is required
+func (s *Server) handleSign(w http.ResponseWriter, r *http.Request) {
+	sc := s.config.Signing
+	if sc == nil {
+		httpError(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if !s.guardianAccess.allowed(r) || !s.authorized(r) {
+		httpError(w, r, `not authorized`, http.StatusForbidden)
+		return
+	}
+
+	ctx := util.RequestCtx(r)
+	u, err := s.getTargetURL(r)
+	if err != nil {
+		log.Debugf(ctx, "Bad url: %s", err)
+		httpError(w, r, "Bad url", http.StatusBadRequest)
+		return
+	}
+
+	preset, err := util.GetPresetFromRequest(r)
+	if err != nil || s.isTextVariant(preset) {
+		httpError(w, r, "Bad preset", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.checkRequest(u, preset); err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+
+	text := r.FormValue("text")
+	variant := preset
+	if text != "" {
+		variant, err = s.textVariant(preset, text)
+		if err != nil {
+			httpError(w, r, err.Error(), errorStatus(err))
+			return
+		}
+	}
+
+	ttl := sc.DefaultTTL
+	if v := r.FormValue("ttl"); v != "" {
+		ttl, err = time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			httpError(w, r, "Bad ttl", http.StatusBadRequest)
+			return
+		}
+		if ttl > sc.MaxTTL {
+			httpError(w, r, "ttl exceeds the maximum of "+sc.MaxTTL.String(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	base := sc.BaseURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host + "/"
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	signed, err := SignTextURL(base, []byte(sc.Key), r.FormValue("url"), preset, text, expires)
+	if err != nil {
+		log.Debugf(ctx, "failed to sign url: %s", err)
+		httpError(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var version string
+	if s.config.Versioning != nil {
+		etag, err := s.transformer.SourceETag(ctx, u.String())
+		if err != nil {
+			log.Debugf(ctx, "failed to fetch ETag of %s: %s", u, err)
+			httpError(w, r, "Failed to fetch image", http.StatusBadGateway)
+			return
+		}
+		rule, _ := s.lookupPreset(variant)
+		version = VersionToken(etag, rule)
+
+		// "v" is not signed, as it does not change what is served
+		su, _ := url.Parse(signed)
+		q := su.Query()
+		q.Set("v", version)
+		su.RawQuery = q.Encode()
+		signed = su.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(signResponse{URL: signed, Expires: expires, Version: version})
+}
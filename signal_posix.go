@@ -0,0 +1,14 @@
+// +build !appengine,!windows
+
+package sharaq
+
+import (
+	"os"
+	"syscall"
+)
+
+// notifySignals are the signals that Run handles. reloadSignal makes
+// the server reload its config file, and all others make it exit
+var notifySignals = []os.Signal{syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT}
+
+const reloadSignal = syscall.SIGHUP
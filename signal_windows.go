@@ -0,0 +1,15 @@
+// +build !appengine
+
+package sharaq
+
+import (
+	"os"
+	"syscall"
+)
+
+// Windows can only deliver the equivalents of SIGINT and SIGTERM. Use
+// Reload (e.g. via the service control manager) to reload the config
+var notifySignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// reloadSignal is never delivered on Windows
+const reloadSignal = syscall.SIGHUP
@@ -0,0 +1,119 @@
+package sharaq
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/accesslog"
+	"golang.org/x/net/context"
+)
+
+// Clients with a valid Sharaq-Token that send DebugHeader with a value
+// of "1" receive the decisions that were made while serving the request
+// in TraceHeader, such as "backend=fs, get=miss@0.4ms,
+// transform=triggered(2)@0.5ms, serve=origin@0.6ms, cache=miss"
+const (
+	DebugHeader = "X-Sharaq-Debug"
+	TraceHeader = "X-Sharaq-Trace"
+)
+
+// decisionTrace records the decisions made while serving a request,
+// along with the time they were made at
+type decisionTrace struct {
+	mu    sync.Mutex
+	start time.Time
+	steps []string
+}
+
+type traceKey struct{}
+
+// startTrace enables tracing for r if it was requested by a trusted
+// client
+func (s *Server) startTrace(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	if r.Header.Get(DebugHeader) != "1" || !s.authorized(r) {
+		return w, r
+	}
+
+	t := &decisionTrace{start: time.Now()}
+	ctx := context.WithValue(r.Context(), traceKey{}, t)
+	if accesslog.FromContext(ctx) == nil {
+		// backends report URL cache hits through the access log entry
+		ctx = accesslog.WithEntry(ctx, &accesslog.Entry{})
+	}
+	r = r.WithContext(ctx)
+	return &traceWriter{ResponseWriter: w, trace: t, entry: accesslog.FromContext(ctx)}, r
+}
+
+// requestTrace returns the trace of r, or nil if it is not traced. The
+// trace is taken from the request rather than from util.RequestCtx,
+// which does not carry it on appengine
+func requestTrace(r *http.Request) *decisionTrace {
+	t, _ := r.Context().Value(traceKey{}).(*decisionTrace)
+	return t
+}
+
+// record adds a decision to the trace. It is a no-op on a nil trace
+func (t *decisionTrace) record(name, value string) {
+	if t == nil {
+		return
+	}
+	elapsed := float64(time.Since(t.start)) / float64(time.Millisecond)
+	t.mu.Lock()
+	t.steps = append(t.steps, fmt.Sprintf("%s=%s@%.1fms", name, value, elapsed))
+	t.mu.Unlock()
+}
+
+func (t *decisionTrace) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.steps, ", ")
+}
+
+// traceWriter sets TraceHeader right before the response header is
+// written, when all decisions about the response have been made
+type traceWriter struct {
+	http.ResponseWriter
+	entry *accesslog.Entry
+	trace *decisionTrace
+	done  bool
+}
+
+func (w *traceWriter) setTrace() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	v := w.trace.String()
+	if cache := w.entry.Cache(); cache != "" {
+		if v != "" {
+			v += ", "
+		}
+		v += "cache=" + cache
+	}
+	if v != "" {
+		w.Header().Set(TraceHeader, v)
+	}
+}
+
+func (w *traceWriter) WriteHeader(status int) {
+	w.setTrace()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *traceWriter) Write(b []byte) (int, error) {
+	w.setTrace()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher, if the underlying writer does, so that
+// handlers that stream their responses keep working when traced
+func (w *traceWriter) Flush() {
+	w.setTrace()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,4 @@
+package sharaq
+
+// Version is the version of sharaq
+const Version = "0.0.8"
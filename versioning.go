@@ -0,0 +1,75 @@
+package sharaq
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"time"
+
+	"github.com/lestrrat-go/sharaq/internal/log"
+	"github.com/lestrrat-go/sharaq/internal/urlcache"
+	"golang.org/x/net/context"
+)
+
+// VersionToken returns the token that identifies the content of a
+// variant, given the ETag of the source image and the rule of the
+// preset. The token changes whenever either of them changes, so
+// dispatcher URLs that carry it (as the "v" parameter) can be cached
+// forever.
+//
+// Application servers that know the ETag of the source can use this
+// to create versioned URLs without calling /sign
+func VersionToken(etag, rule string) string {
+	sum := sha256.Sum256([]byte(etag + "\n" + rule))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// versionCacheTTL is how long the version of a stored variant is kept
+// in the URL cache. Variants that are regenerated by other means than
+// the dispatcher (e.g. revalidation by the fs backend) may be served
+// under their previous version for this long
+const versionCacheTTL = 10 * time.Minute
+
+func versionCacheKey(u *url.URL, preset string) string {
+	return urlcache.MakeCacheKey("version", preset, u.String())
+}
+
+// currentVersion returns true if the stored variant matches version.
+// If the backend does not allow access to the metadata of variants,
+// the version can not be checked, and is trusted. Versions that were
+// checked are remembered in the URL cache, so that hits do not cost
+// a metadata fetch each
+func (s *Server) currentVersion(ctx context.Context, u *url.URL, preset, version string) bool {
+	storage, ok := s.backend.(Storage)
+	if !ok {
+		return true
+	}
+
+	key := versionCacheKey(u, preset)
+	if s.cache.Lookup(ctx, key) == version {
+		return true
+	}
+
+	rule, ok := s.lookupPreset(preset)
+	if !ok {
+		return false
+	}
+
+	m, err := storage.Metadata(ctx, u, preset)
+	if err != nil {
+		log.Debugf(ctx, "Failed to fetch metadata of %s (%s): %s", u, preset, err)
+		return false
+	}
+	current := VersionToken(m.SourceETag, rule)
+	s.cache.Set(ctx, key, current, urlcache.WithExpires(versionCacheTTL))
+	return current == version
+}
+
+// forgetVersion removes the version of the variant from the URL cache,
+// after it was stored or deleted
+func (s *Server) forgetVersion(ctx context.Context, u *url.URL, preset string) {
+	if s.config.Versioning == nil {
+		return
+	}
+	s.cache.Delete(ctx, versionCacheKey(u, preset))
+}